@@ -1,10 +1,12 @@
 package auth
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 
 	"golang.org/x/oauth2"
 	"k8s.io/client-go/transport"
@@ -59,3 +61,23 @@ func (i *tokenInjector) RoundTrip(request *http.Request) (*http.Response, error)
 	request.Header.Set("Authorization", "Bearer "+token.AccessToken)
 	return i.next.RoundTrip(request)
 }
+
+// RequireToken only passes requests authenticated with the bearer token of
+// the token source to next. The token is read for every request, so it can
+// be rotated. Requests are rejected if the token can't be read.
+func RequireToken(tokenSource oauth2.TokenSource, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := tokenSource.Token()
+		if err != nil || token.AccessToken == "" {
+			http.Error(w, "token not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token.AccessToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -49,3 +49,50 @@ func TestTokenInjector(t *testing.T) {
 
 	assert.Equal(t, "Bearer the-token", string(out))
 }
+
+func TestRequireToken(tt *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+
+	for _, tc := range []struct {
+		msg           string
+		token         string
+		authorization string
+		expected      int
+	}{
+		{
+			msg:           "requests with the token should be passed",
+			token:         "the-token",
+			authorization: "Bearer the-token",
+			expected:      http.StatusOK,
+		},
+		{
+			msg:           "requests with another token should be rejected",
+			token:         "the-token",
+			authorization: "Bearer other-token",
+			expected:      http.StatusUnauthorized,
+		},
+		{
+			msg:      "requests without token should be rejected",
+			token:    "the-token",
+			expected: http.StatusUnauthorized,
+		},
+		{
+			msg:           "requests should be rejected without a configured token",
+			authorization: "Bearer ",
+			expected:      http.StatusServiceUnavailable,
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			handler := RequireToken(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tc.token}), next)
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			require.Equal(t, tc.expected, rec.Code)
+		})
+	}
+}
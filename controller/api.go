@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+// RegisterHandlers registers the HTTP API of the controller:
+//
+//	GET /routes  routes of the last applied configuration and their sources
+//	GET /status  status reported by the provider
+//	GET /plan    changes planned by the provider before the last sync
+//
+// Providers implementing provider.HandlerRegistrar register their own
+// endpoints below /provider/<name>.
+func (c *EgressController) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /routes", c.handleRoutes)
+	mux.HandleFunc("GET /status", c.handleStatus)
+	mux.HandleFunc("GET /plan", c.handlePlan)
+
+	if registrar, ok := c.provider.(provider.HandlerRegistrar); ok {
+		registrar.RegisterHandlers(mux)
+	}
+}
+
+func (c *EgressController) handleRoutes(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, c.AppliedRoutes())
+}
+
+func (c *EgressController) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	if _, ok := c.provider.(provider.StatusReporter); !ok {
+		http.Error(w, fmt.Sprintf("provider %s doesn't report its status", c.provider), http.StatusNotImplemented)
+		return
+	}
+
+	status := c.ProviderStatus()
+	if status == nil {
+		http.Error(w, "status not available yet", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{Status: status, Sync: c.SyncState()})
+}
+
+// statusResponse is the status of the provider together with the state of
+// the last sync, which is pending while the provider is still applying it.
+type statusResponse struct {
+	*provider.Status
+	Sync string `json:"sync"`
+}
+
+func (c *EgressController) handlePlan(w http.ResponseWriter, _ *http.Request) {
+	if _, ok := c.provider.(provider.Planner); !ok {
+		http.Error(w, fmt.Sprintf("provider %s doesn't support planning", c.provider), http.StatusNotImplemented)
+		return
+	}
+
+	plan := c.Plan()
+	if plan == nil {
+		http.Error(w, "plan not available yet", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Errorf("Failed to write response: %v", err)
+	}
+}
@@ -2,7 +2,11 @@ package controller
 
 import (
 	"context"
-	"net"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,8 +23,69 @@ var lastSyncTimestamp = prometheus.NewGauge(
 	},
 )
 
+var excludedCIDRs = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "kube_static_egress",
+		Subsystem: "controller",
+		Name:      "excluded_cidrs",
+		Help:      "Number of configured CIDRs overlapping with denied networks",
+	},
+)
+
+var widenedRoutes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "kube_static_egress",
+		Subsystem: "controller",
+		Name:      "widened_routes",
+		Help:      "Number of routes widened to fit into the route budget",
+	},
+)
+
+var egressIPs = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "kube_static_egress",
+		Subsystem: "controller",
+		Name:      "egress_ip_info",
+		Help:      "Egress IPs reported by the provider by zone and connectivity",
+	},
+	[]string{"zone", "ip", "connectivity"},
+)
+
+var appliedRoutes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "kube_static_egress",
+		Subsystem: "controller",
+		Name:      "applied_routes",
+		Help:      "Number of routes applied by the provider",
+	},
+)
+
+var providerHealthy = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "kube_static_egress",
+		Subsystem: "controller",
+		Name:      "provider_healthy",
+		Help:      "1 if all resources managed by the provider are healthy, 0 otherwise",
+	},
+)
+
+var unresolvedPrefixLists = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "kube_static_egress",
+		Subsystem: "controller",
+		Name:      "unresolved_prefix_lists",
+		Help:      "Number of referenced prefix lists which failed to resolve in the last sync",
+	},
+)
+
 func init() {
 	prometheus.MustRegister(lastSyncTimestamp)
+	prometheus.MustRegister(excludedCIDRs)
+	prometheus.MustRegister(widenedRoutes)
+	prometheus.MustRegister(egressIPs)
+	prometheus.MustRegister(appliedRoutes)
+	prometheus.MustRegister(providerHealthy)
+	prometheus.MustRegister(unresolvedPrefixLists)
 }
 
 type EgressConfigSource interface {
@@ -28,22 +93,63 @@ type EgressConfigSource interface {
 	Config() <-chan provider.EgressConfig
 }
 
+// StatusWriter writes the egress status back to the resources configuring
+// egress routes, e.g. as annotations of ConfigMaps.
+type StatusWriter interface {
+	WriteStatus(ctx context.Context, resource provider.Resource, status provider.ResourceStatus) error
+}
+
 // EgressController is the controller for creating Egress configuration via a
 // provider.
 type EgressController struct {
-	interval     time.Duration
-	configSource EgressConfigSource
-	configsCache map[provider.Resource]map[string]*net.IPNet
-	provider     provider.Provider
+	interval          time.Duration
+	configSource      EgressConfigSource
+	configsCache      map[provider.Resource][]provider.Source
+	prefixListsCache  map[provider.Resource]map[string][]string
+	prefixListEntries map[string][]netip.Prefix
+	prioritiesCache   map[provider.Resource]int
+	connectivityCache map[provider.Resource]provider.Connectivity
+	deniedCIDRs       []netip.Prefix
+	exclusions        []provider.Exclusion
+	routeBudget       provider.RouteBudget
+	widened           []provider.WidenedRoute
+	provider          provider.Provider
+	statusWriter      StatusWriter
+	writtenStatus     map[provider.Resource]provider.ResourceStatus
+	retryPolicies     map[provider.ErrorClass]RetryPolicy
+	failures          int
+	failureClass      provider.ErrorClass
+	nextSync          time.Time
+	deferEvents       bool
+
+	mu             sync.RWMutex
+	syncState      string
+	appliedRoutes  []provider.RouteSources
+	providerStatus *provider.Status
+	plan           *provider.Plan
 }
 
 // NewEgressController initializes a new EgressController.
-func NewEgressController(prov provider.Provider, configSource EgressConfigSource, interval time.Duration) *EgressController {
+// Networks overlapping with deniedCIDRs are never passed to the provider and
+// routes are compressed to fit into the route budget, if its MaxRoutes isn't
+// 0. If statusWriter is not nil, the status reported by the provider is
+// written back to the resources configuring egress routes.
+func NewEgressController(prov provider.Provider, configSource EgressConfigSource, interval time.Duration, deniedCIDRs []netip.Prefix, routeBudget provider.RouteBudget, statusWriter StatusWriter) *EgressController {
+	routeBudget.Denied = deniedCIDRs
 	return &EgressController{
-		interval:     interval,
-		provider:     prov,
-		configSource: configSource,
-		configsCache: make(map[provider.Resource]map[string]*net.IPNet),
+		interval:          interval,
+		provider:          prov,
+		configSource:      configSource,
+		statusWriter:      statusWriter,
+		writtenStatus:     make(map[provider.Resource]provider.ResourceStatus),
+		retryPolicies:     DefaultRetryPolicies,
+		deniedCIDRs:       deniedCIDRs,
+		routeBudget:       routeBudget,
+		configsCache:      make(map[provider.Resource][]provider.Source),
+		prefixListsCache:  make(map[provider.Resource]map[string][]string),
+		prefixListEntries: make(map[string][]netip.Prefix),
+		prioritiesCache:   make(map[provider.Resource]int),
+		connectivityCache: make(map[provider.Resource]provider.Connectivity),
 	}
 }
 
@@ -60,26 +166,30 @@ func (c *EgressController) Run(ctx context.Context) {
 		}
 
 		for _, config := range configs {
-			if len(config.IPAddresses) > 0 {
-				c.configsCache[config.Resource] = config.IPAddresses
-			}
+			c.updateCache(config)
 		}
-		ensureEgressRules(ctx, c.provider, c.configsCache)
+		c.ensureEgressRules(ctx)
 		break // successfully initialized cache, move on
 	}
 
 	for {
 		select {
-		case <-time.After(c.interval):
-			ensureEgressRules(ctx, c.provider, c.configsCache)
+		case <-time.After(time.Until(c.nextSync)):
+			c.ensureEgressRules(ctx)
 		case config := <-c.configSource.Config():
-			if len(config.IPAddresses) == 0 {
-				delete(c.configsCache, config.Resource)
-			} else {
-				log.Infof("Observed IP Addresses %v for %v", config.IPAddresses, config.Resource)
-				c.configsCache[config.Resource] = config.IPAddresses
+			if len(config.IPAddresses) > 0 || len(config.PrefixLists) > 0 {
+				log.Infof("Observed IP Addresses %v and prefix lists %v for %v", config.IPAddresses, config.PrefixLists, config.Resource)
 			}
-			ensureEgressRules(ctx, c.provider, c.configsCache)
+			c.updateCache(config)
+			if c.eventsDeferred() {
+				if c.SyncState() == syncStatePending {
+					log.Infof("Deferring sync of %v until %s while changes are pending", config.Resource, c.nextSync.Format(time.RFC3339))
+					continue
+				}
+				log.Infof("Deferring sync of %v until %s after %s error", config.Resource, c.nextSync.Format(time.RFC3339), c.failureClass)
+				continue
+			}
+			c.ensureEgressRules(ctx)
 		case <-ctx.Done():
 			log.Info("Terminating controller loop.")
 			return
@@ -87,12 +197,351 @@ func (c *EgressController) Run(ctx context.Context) {
 	}
 }
 
-func ensureEgressRules(ctx context.Context, prov provider.Provider, configsCache map[provider.Resource]map[string]*net.IPNet) {
-	err := prov.Ensure(ctx, configsCache)
+// updateCache stores the config in the cache or removes it from the cache if
+// it's empty.
+func (c *EgressController) updateCache(config provider.EgressConfig) {
+	if len(config.IPAddresses) == 0 {
+		delete(c.configsCache, config.Resource)
+	} else {
+		sources := make([]provider.Source, 0, len(config.IPAddresses))
+		for entry, ipnet := range config.IPAddresses {
+			source := provider.Source{
+				Resource: config.Resource,
+				Prefix:   provider.PrefixFromIPNet(ipnet),
+			}
+			for _, key := range keysOrEmpty(config.Keys[entry]) {
+				source.Key = key
+				sources = append(sources, source)
+			}
+		}
+		c.configsCache[config.Resource] = sources
+	}
+
+	if len(config.PrefixLists) == 0 {
+		delete(c.prefixListsCache, config.Resource)
+	} else {
+		prefixLists := make(map[string][]string, len(config.PrefixLists))
+		for _, id := range config.PrefixLists {
+			prefixLists[id] = keysOrEmpty(config.Keys[id])
+		}
+		c.prefixListsCache[config.Resource] = prefixLists
+	}
+
+	if config.Priority == 0 {
+		delete(c.prioritiesCache, config.Resource)
+	} else {
+		c.prioritiesCache[config.Resource] = config.Priority
+	}
+
+	if config.Connectivity == "" || config.Connectivity == provider.ConnectivityPublic {
+		delete(c.connectivityCache, config.Resource)
+	} else {
+		c.connectivityCache[config.Resource] = config.Connectivity
+	}
+}
+
+// desiredState returns the desired state of the cached configs with all
+// referenced prefix lists resolved into CIDRs, the denied networks excluded
+// and compressed to fit into the route budget. The cache itself is not
+// modified.
+func (c *EgressController) desiredState(ctx context.Context) (*provider.DesiredState, error) {
+	state, err := c.resolvedState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state, exclusions := state.Exclude(c.deniedCIDRs)
+	c.reportExclusions(exclusions)
+
+	state, report, err := state.EnforceRouteBudget(c.prioritiesCache, c.routeBudget)
 	if err != nil {
-		log.Errorf("Failed to ensure configuration: %v", err)
+		return nil, err
+	}
+	c.reportWidenedRoutes(report)
+	return state.WithConnectivity(c.connectivityCache), nil
+}
+
+// reportWidenedRoutes logs the routes widened to fit into the route budget
+// if they changed since the last call.
+func (c *EgressController) reportWidenedRoutes(report *provider.RouteBudgetReport) {
+	var widened []provider.WidenedRoute
+	if report != nil {
+		widened = report.Widened
+	}
+
+	widenedRoutes.Set(float64(len(widened)))
+	if fmt.Sprint(widened) == fmt.Sprint(c.widened) {
+		return
+	}
+
+	for _, w := range widened {
+		log.Warnf("Widened route to fit into route budget of %d: %s", report.MaxRoutes, w)
+	}
+	c.widened = widened
+}
+
+// reportExclusions logs the exclusions if they changed since the last call.
+func (c *EgressController) reportExclusions(exclusions []provider.Exclusion) {
+	excludedCIDRs.Set(float64(len(exclusions)))
+	if fmt.Sprint(exclusions) == fmt.Sprint(c.exclusions) {
+		return
+	}
+
+	for _, exclusion := range exclusions {
+		log.Warnf("Excluding denied networks: %s", exclusion)
+	}
+	c.exclusions = exclusions
+}
+
+// resolvedState returns the desired state of the cached configs with all
+// referenced prefix lists resolved into CIDRs. A prefix list failing to
+// resolve uses the entries of its last successful resolution. If it was
+// never resolved, e.g. after a restart, a retryable error is returned
+// instead of a state without its entries, which would remove its routes.
+func (c *EgressController) resolvedState(ctx context.Context) (*provider.DesiredState, error) {
+	var sources []provider.Source
+	for _, cached := range c.configsCache {
+		sources = append(sources, cached...)
+	}
+
+	if len(c.prefixListsCache) == 0 {
+		clear(c.prefixListEntries)
+		unresolvedPrefixLists.Set(0)
+		return provider.NewDesiredStateFromSources(sources), nil
+	}
+
+	resolver, ok := c.provider.(provider.PrefixListResolver)
+	if !ok {
+		log.Warnf("Provider %s can't resolve prefix lists, ignoring them", c.provider)
+		return provider.NewDesiredStateFromSources(sources), nil
+	}
+
+	// every prefix list is resolved once, even if referenced by several
+	// configs
+	resolved := make(map[string][]netip.Prefix)
+	failed := make(map[string]error)
+	for _, prefixLists := range c.prefixListsCache {
+		for id := range prefixLists {
+			if _, ok := resolved[id]; ok || failed[id] != nil {
+				continue
+			}
+			prefixes, err := resolver.ResolvePrefixList(ctx, id)
+			if err != nil {
+				failed[id] = err
+				continue
+			}
+			resolved[id] = prefixes
+		}
+	}
+	unresolvedPrefixLists.Set(float64(len(failed)))
+
+	var unresolved []string
+	for resource, prefixLists := range c.prefixListsCache {
+		for id, keys := range prefixLists {
+			prefixes, ok := resolved[id]
+			if err := failed[id]; err != nil {
+				prefixes, ok = c.prefixListEntries[id]
+				if !ok {
+					unresolved = append(unresolved, fmt.Sprintf("%s of %v: %v", id, resource, err))
+					continue
+				}
+				log.Warnf("Failed to resolve prefix list %s of %v (%s error), using its %d entries resolved before: %v", id, resource, provider.ClassOf(err), len(prefixes), err)
+			}
+
+			for _, p := range prefixes {
+				for _, key := range keys {
+					sources = append(sources, provider.Source{
+						Resource:   resource,
+						Key:        key,
+						PrefixList: id,
+						Prefix:     p,
+					})
+				}
+			}
+		}
+	}
+
+	// only the prefix lists still referenced are kept
+	for id := range c.prefixListEntries {
+		if _, ok := failed[id]; !ok {
+			delete(c.prefixListEntries, id)
+		}
+	}
+	for id, prefixes := range resolved {
+		c.prefixListEntries[id] = prefixes
+	}
+
+	if len(unresolved) > 0 {
+		sort.Strings(unresolved)
+		return nil, provider.NewError(provider.ErrorClassRetryable, fmt.Errorf("failed to resolve prefix lists never resolved before: %s", strings.Join(unresolved, "; ")))
+	}
+	return provider.NewDesiredStateFromSources(sources), nil
+}
+
+// keysOrEmpty returns the keys or a single empty key for entries of configs
+// without keys.
+func keysOrEmpty(keys []string) []string {
+	if len(keys) == 0 {
+		return []string{""}
+	}
+	return keys
+}
+
+func (c *EgressController) ensureEgressRules(ctx context.Context) {
+	state, err := c.desiredState(ctx)
+	if err != nil {
+		c.syncFailed("Failed to build desired configuration", err)
+		return
+	}
+
+	c.planChanges(ctx, state)
+
+	err = c.provider.Ensure(ctx, state)
+	if err != nil {
+		c.syncFailed("Failed to ensure configuration", err)
+		c.updateStatus(ctx, state)
 		return
 	}
 	// successfully synced
+	c.syncSucceeded()
 	lastSyncTimestamp.SetToCurrentTime()
+	c.reportAppliedRoutes(state.RoutesWithSources(provider.RouteOptions{}))
+	c.updateStatus(ctx, state)
+}
+
+// planChanges logs the changes the provider would make for the desired
+// state, if the provider supports planning.
+func (c *EgressController) planChanges(ctx context.Context, state *provider.DesiredState) {
+	planner, ok := c.provider.(provider.Planner)
+	if !ok {
+		return
+	}
+
+	plan, err := planner.Plan(ctx, state)
+	if err != nil {
+		log.Warnf("Failed to plan changes of provider %s: %v", c.provider, err)
+		return
+	}
+
+	c.mu.Lock()
+	c.plan = plan
+	c.mu.Unlock()
+
+	if !plan.Empty() {
+		log.Infof("Planned changes of provider %s: %s", c.provider, plan)
+	}
+}
+
+// Plan returns the last planned changes or nil if the provider doesn't
+// support planning.
+func (c *EgressController) Plan() *provider.Plan {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.plan
+}
+
+// updateStatus queries the status of the provider, if supported, and
+// reports it as metrics and to the status writer.
+func (c *EgressController) updateStatus(ctx context.Context, state *provider.DesiredState) {
+	reporter, ok := c.provider.(provider.StatusReporter)
+	if !ok {
+		return
+	}
+
+	status, err := reporter.Status(ctx)
+	if err != nil {
+		log.Errorf("Failed to get status of provider %s: %v", c.provider, err)
+		return
+	}
+
+	c.mu.Lock()
+	c.providerStatus = status
+	c.mu.Unlock()
+
+	egressIPs.Reset()
+	for zone, ips := range status.EgressIPs {
+		for _, ip := range ips {
+			egressIPs.WithLabelValues(zone, ip.String(), string(provider.ConnectivityPublic)).Set(1)
+		}
+	}
+	for zone, ips := range status.PrivateEgressIPs {
+		for _, ip := range ips {
+			egressIPs.WithLabelValues(zone, ip.String(), string(provider.ConnectivityPrivate)).Set(1)
+		}
+	}
+	appliedRoutes.Set(float64(len(status.Routes)))
+	if status.Healthy() {
+		providerHealthy.Set(1)
+	} else {
+		providerHealthy.Set(0)
+	}
+
+	if c.statusWriter != nil {
+		c.writeStatus(ctx, provider.ResourceStatuses(state, status))
+	}
+}
+
+// writeStatus writes the status of every resource which changed since it was
+// last written.
+func (c *EgressController) writeStatus(ctx context.Context, statuses map[provider.Resource]provider.ResourceStatus) {
+	for resource, status := range statuses {
+		if written, ok := c.writtenStatus[resource]; ok && fmt.Sprint(written) == fmt.Sprint(status) {
+			continue
+		}
+
+		err := c.statusWriter.WriteStatus(ctx, resource, status)
+		if err != nil {
+			log.Errorf("Failed to write status of %v: %v", resource, err)
+			continue
+		}
+		c.writtenStatus[resource] = status
+	}
+
+	for resource := range c.writtenStatus {
+		if _, ok := statuses[resource]; !ok {
+			delete(c.writtenStatus, resource)
+		}
+	}
+}
+
+// ProviderStatus returns the last status reported by the provider or nil if
+// the provider doesn't report its status.
+func (c *EgressController) ProviderStatus() *provider.Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.providerStatus
+}
+
+// reportAppliedRoutes logs the routes added or removed since the last call
+// together with the sources configuring them.
+func (c *EgressController) reportAppliedRoutes(routes []provider.RouteSources) {
+	c.mu.Lock()
+	previous := c.appliedRoutes
+	c.appliedRoutes = routes
+	c.mu.Unlock()
+
+	previousRoutes := make(map[netip.Prefix]struct{}, len(previous))
+	for _, r := range previous {
+		previousRoutes[r.Route] = struct{}{}
+	}
+	for _, r := range routes {
+		if _, ok := previousRoutes[r.Route]; ok {
+			delete(previousRoutes, r.Route)
+			continue
+		}
+		log.Infof("Route %s applied, configured by %v", r.Route, r.Sources)
+	}
+	for _, r := range previous {
+		if _, ok := previousRoutes[r.Route]; ok {
+			log.Infof("Route %s removed, previously configured by %v", r.Route, r.Sources)
+		}
+	}
+}
+
+// AppliedRoutes returns the routes of the last successfully ensured
+// configuration together with the sources configuring them. Providers may
+// merge the routes further.
+func (c *EgressController) AppliedRoutes() []provider.RouteSources {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.appliedRoutes
 }
@@ -2,9 +2,15 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"github.com/szuecs/kube-static-egress-controller/provider"
 	"github.com/szuecs/kube-static-egress-controller/provider/noop"
@@ -42,7 +48,7 @@ func TestControllerRun(t *testing.T) {
 		},
 		configsChan: configsChan,
 	}
-	controller := NewEgressController(prov, configSource, 0)
+	controller := NewEgressController(prov, configSource, 0, nil, provider.RouteBudget{}, nil)
 
 	// test adding the an egress config.
 	ctx, cancel := context.WithCancel(context.Background())
@@ -101,3 +107,347 @@ func TestControllerRun(t *testing.T) {
 
 	require.Len(t, controller.configsCache, 1)
 }
+
+type mockResolvingProvider struct {
+	prefixLists map[string][]netip.Prefix
+	configs     map[provider.Resource]map[string]*net.IPNet
+}
+
+func (p *mockResolvingProvider) Ensure(_ context.Context, state *provider.DesiredState) error {
+	p.configs = make(map[provider.Resource]map[string]*net.IPNet, state.Len())
+	for _, resource := range state.Resources() {
+		p.configs[resource] = make(map[string]*net.IPNet)
+		for _, prefix := range state.Prefixes(resource) {
+			p.configs[resource][prefix.String()] = &net.IPNet{
+				IP:   net.IP(prefix.Addr().AsSlice()),
+				Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+			}
+		}
+	}
+	return nil
+}
+
+func (p *mockResolvingProvider) String() string {
+	return "mock"
+}
+
+func (p *mockResolvingProvider) ResolvePrefixList(_ context.Context, id string) ([]netip.Prefix, error) {
+	nets, ok := p.prefixLists[id]
+	if !ok {
+		return nil, fmt.Errorf("prefix list %s not found", id)
+	}
+	return nets, nil
+}
+
+func TestControllerResolvePrefixLists(t *testing.T) {
+	_, netA, _ := net.ParseCIDR("1.0.0.1/32")
+	_, netB, _ := net.ParseCIDR("2.0.0.0/24")
+	resourceA := provider.Resource{Name: "a", Namespace: "y", Cluster: "m"}
+	resourceB := provider.Resource{Name: "b", Namespace: "y", Cluster: "m"}
+
+	prov := &mockResolvingProvider{
+		prefixLists: map[string][]netip.Prefix{
+			"pl-1111": {provider.PrefixFromIPNet(netB)},
+		},
+	}
+	configSource := mockEgressConfigSource{
+		configs: []provider.EgressConfig{
+			{
+				Resource: resourceA,
+				IPAddresses: map[string]*net.IPNet{
+					netA.String(): netA,
+				},
+				PrefixLists: []string{"pl-1111"},
+			},
+			{
+				Resource:    resourceB,
+				PrefixLists: []string{"pl-1111"},
+			},
+		},
+	}
+	controller := NewEgressController(prov, configSource, 0, nil, provider.RouteBudget{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	controller.Run(ctx)
+
+	require.Equal(t, map[provider.Resource]map[string]*net.IPNet{
+		resourceA: {
+			netA.String(): netA,
+			netB.String(): netB,
+		},
+		resourceB: {
+			netB.String(): netB,
+		},
+	}, prov.configs)
+
+	// resolving prefix lists must not modify the cache
+	require.Len(t, controller.configsCache, 1)
+	require.Len(t, controller.configsCache[resourceA], 1)
+
+	// prefix lists failing to resolve should use their entries resolved
+	// before
+	delete(prov.prefixLists, "pl-1111")
+	prov.configs = nil
+	controller.ensureEgressRules(context.Background())
+	require.Equal(t, map[provider.Resource]map[string]*net.IPNet{
+		resourceA: {
+			netA.String(): netA,
+			netB.String(): netB,
+		},
+		resourceB: {
+			netB.String(): netB,
+		},
+	}, prov.configs)
+	require.Equal(t, 1.0, testutil.ToFloat64(unresolvedPrefixLists))
+
+	// prefix lists never resolved should fail the sync instead of
+	// removing their routes
+	prov.configs = nil
+	controller.prefixListsCache[resourceB] = map[string][]string{"pl-2222": {""}}
+	state, err := controller.desiredState(context.Background())
+	require.Nil(t, state)
+	require.EqualError(t, err, "retryable: failed to resolve prefix lists never resolved before: pl-2222 of { b y m}: prefix list pl-2222 not found")
+	require.Equal(t, provider.ErrorClassRetryable, provider.ClassOf(err))
+	controller.ensureEgressRules(context.Background())
+	require.Nil(t, prov.configs)
+	require.Equal(t, 2.0, testutil.ToFloat64(unresolvedPrefixLists))
+	require.Equal(t, syncStateFailed, controller.SyncState())
+
+	prov.prefixLists["pl-2222"] = []netip.Prefix{provider.PrefixFromIPNet(netA)}
+	controller.ensureEgressRules(context.Background())
+	require.Equal(t, map[provider.Resource]map[string]*net.IPNet{
+		resourceA: {
+			netA.String(): netA,
+			netB.String(): netB,
+		},
+		resourceB: {
+			netA.String(): netA,
+		},
+	}, prov.configs)
+	require.Equal(t, 1.0, testutil.ToFloat64(unresolvedPrefixLists))
+	require.Equal(t, syncStateSucceeded, controller.SyncState())
+}
+
+func TestControllerDeniedCIDRs(t *testing.T) {
+	_, netA, _ := net.ParseCIDR("1.0.0.0/24")
+	_, netB, _ := net.ParseCIDR("2.0.0.1/32")
+	_, denied, _ := net.ParseCIDR("1.0.0.0/25")
+	_, remaining, _ := net.ParseCIDR("1.0.0.128/25")
+	resourceA := provider.Resource{Name: "a", Namespace: "y", Cluster: "m"}
+
+	prov := &mockResolvingProvider{}
+	configSource := mockEgressConfigSource{
+		configs: []provider.EgressConfig{
+			{
+				Resource: resourceA,
+				IPAddresses: map[string]*net.IPNet{
+					netA.String(): netA,
+					netB.String(): netB,
+				},
+			},
+		},
+	}
+	controller := NewEgressController(prov, configSource, 0, []netip.Prefix{provider.PrefixFromIPNet(denied)}, provider.RouteBudget{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	controller.Run(ctx)
+
+	require.Equal(t, map[provider.Resource]map[string]*net.IPNet{
+		resourceA: {
+			remaining.String(): remaining,
+			netB.String():      netB,
+		},
+	}, prov.configs)
+	require.Len(t, controller.exclusions, 1)
+	require.Contains(t, controller.configsCache[resourceA], provider.Source{Resource: resourceA, Prefix: provider.PrefixFromIPNet(netA)})
+}
+
+func TestControllerRouteBudget(t *testing.T) {
+	_, netA, _ := net.ParseCIDR("1.0.0.1/32")
+	_, netB, _ := net.ParseCIDR("1.0.0.2/32")
+	_, netC, _ := net.ParseCIDR("2.0.0.1/32")
+	_, widened, _ := net.ParseCIDR("1.0.0.0/30")
+	resourceA := provider.Resource{Name: "a", Namespace: "y", Cluster: "m"}
+	resourceB := provider.Resource{Name: "b", Namespace: "y", Cluster: "m"}
+
+	prov := &mockResolvingProvider{}
+	configSource := mockEgressConfigSource{
+		configs: []provider.EgressConfig{
+			{
+				Resource: resourceA,
+				IPAddresses: map[string]*net.IPNet{
+					netA.String(): netA,
+					netB.String(): netB,
+				},
+			},
+			{
+				Resource: resourceB,
+				IPAddresses: map[string]*net.IPNet{
+					netC.String(): netC,
+				},
+				Priority: 10,
+			},
+		},
+	}
+	controller := NewEgressController(prov, configSource, 0, nil, provider.RouteBudget{MaxRoutes: 2, MinPrefixLength: 16}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	controller.Run(ctx)
+
+	require.Equal(t, map[provider.Resource]map[string]*net.IPNet{
+		resourceA: {
+			widened.String(): widened,
+		},
+		resourceB: {
+			netC.String(): netC,
+		},
+	}, prov.configs)
+	require.Len(t, controller.widened, 1)
+
+	// exceeding the budget should not result in an Ensure call
+	prov.configs = nil
+	controller.routeBudget.MaxRoutes = 1
+	controller.ensureEgressRules(context.Background())
+	require.Nil(t, prov.configs)
+}
+
+func TestControllerAppliedRoutes(t *testing.T) {
+	_, netA, _ := net.ParseCIDR("10.0.0.0/24")
+	_, netB, _ := net.ParseCIDR("10.0.0.1/32")
+	resourceA := provider.Resource{Kind: "ConfigMap", Name: "a", Namespace: "y", Cluster: "m"}
+
+	prov := &mockResolvingProvider{
+		prefixLists: map[string][]netip.Prefix{
+			"pl-1111": {netip.MustParsePrefix("2.0.0.0/24")},
+		},
+	}
+	configSource := mockEgressConfigSource{
+		configs: []provider.EgressConfig{
+			{
+				Resource: resourceA,
+				IPAddresses: map[string]*net.IPNet{
+					netA.String(): netA,
+					netB.String(): netB,
+				},
+				Keys: map[string][]string{
+					netA.String(): {"a"},
+					netB.String(): {"b", "c"},
+					"pl-1111":     {"d"},
+				},
+				PrefixLists: []string{"pl-1111"},
+			},
+		},
+	}
+	controller := NewEgressController(prov, configSource, 0, nil, provider.RouteBudget{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	controller.Run(ctx)
+
+	expected := []provider.RouteSources{
+		{
+			Route: netip.MustParsePrefix("2.0.0.0/24"),
+			Sources: []provider.Source{
+				{Resource: resourceA, Key: "d", PrefixList: "pl-1111", Prefix: netip.MustParsePrefix("2.0.0.0/24")},
+			},
+		},
+		{
+			Route: netip.MustParsePrefix("10.0.0.0/24"),
+			Sources: []provider.Source{
+				{Resource: resourceA, Key: "a", Prefix: netip.MustParsePrefix("10.0.0.0/24")},
+				{Resource: resourceA, Key: "b", Prefix: netip.MustParsePrefix("10.0.0.1/32")},
+				{Resource: resourceA, Key: "c", Prefix: netip.MustParsePrefix("10.0.0.1/32")},
+			},
+		},
+	}
+	require.Equal(t, expected, controller.AppliedRoutes())
+
+	mux := http.NewServeMux()
+	controller.RegisterHandlers(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/routes", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var routes []provider.RouteSources
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &routes))
+	require.Equal(t, expected, routes)
+}
+
+type mockStatusWriter struct {
+	writes map[provider.Resource][]provider.ResourceStatus
+}
+
+func (w *mockStatusWriter) WriteStatus(_ context.Context, resource provider.Resource, status provider.ResourceStatus) error {
+	w.writes[resource] = append(w.writes[resource], status)
+	return nil
+}
+
+func TestControllerStatus(t *testing.T) {
+	_, netA, _ := net.ParseCIDR("10.0.0.0/24")
+	resourceA := provider.Resource{Kind: "ConfigMap", Name: "a", Namespace: "y", Cluster: "m"}
+
+	statusWriter := &mockStatusWriter{writes: make(map[provider.Resource][]provider.ResourceStatus)}
+	configSource := mockEgressConfigSource{
+		configs: []provider.EgressConfig{
+			{
+				Resource: resourceA,
+				IPAddresses: map[string]*net.IPNet{
+					netA.String(): netA,
+				},
+			},
+		},
+	}
+	controller := NewEgressController(noop.NewNoopProvider(), configSource, 0, nil, provider.RouteBudget{}, statusWriter)
+
+	mux := http.NewServeMux()
+	controller.RegisterHandlers(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// sync once directly, Run could already start the next sync with an
+	// interval of 0, which replaces the plan of the first sync
+	for _, config := range configSource.configs {
+		controller.updateCache(config)
+	}
+	controller.ensureEgressRules(context.Background())
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var status provider.Status
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, status.Routes)
+	require.True(t, status.Healthy())
+	require.Contains(t, rec.Body.String(), `"sync":"succeeded"`)
+
+	// the plan of the first sync should contain the new routes
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/plan", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, &provider.Plan{
+		Action: provider.PlanActionUpdate,
+		RouteTables: []provider.RouteTableChange{
+			{RouteTable: "noop", Added: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}},
+		},
+	}, controller.Plan())
+
+	// unchanged status should only be written once
+	controller.ensureEgressRules(context.Background())
+	require.True(t, controller.Plan().Empty())
+	require.Equal(t, map[provider.Resource][]provider.ResourceStatus{
+		resourceA: {{Applied: true, Healthy: true}},
+	}, statusWriter.writes)
+
+	// providers without status should be reported as such
+	controller = NewEgressController(&mockResolvingProvider{}, configSource, 0, nil, provider.RouteBudget{}, nil)
+	mux = http.NewServeMux()
+	controller.RegisterHandlers(mux)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusNotImplemented, rec.Code)
+}
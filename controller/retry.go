@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+var syncErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "kube_static_egress",
+		Subsystem: "controller",
+		Name:      "sync_errors_total",
+		Help:      "Number of failed syncs by error class",
+	},
+	[]string{"class"},
+)
+
+func init() {
+	prometheus.MustRegister(syncErrors)
+}
+
+// states of the last sync reported in the status
+const (
+	syncStateSucceeded = "succeeded"
+	syncStatePending   = "pending"
+	syncStateFailed    = "failed"
+)
+
+// RetryPolicy defines how failed syncs of an error class are handled.
+type RetryPolicy struct {
+	// Backoff is the delay before retrying after the first failure. It's
+	// doubled with every consecutive failure up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Alert logs failures as errors instead of warnings. Errors which
+	// won't be resolved by retrying should alert.
+	Alert bool
+	// DeferEvents defers syncs triggered by config changes until the
+	// backoff expired, e.g. to not add load to a throttled API.
+	DeferEvents bool
+	// Pending errors aren't failures but changes still being applied by
+	// the provider. They are checked again after Backoff, without
+	// counting as sync errors or increasing the backoff of failures.
+	Pending bool
+}
+
+// DefaultRetryPolicies are the retry policies by error class.
+var DefaultRetryPolicies = map[provider.ErrorClass]RetryPolicy{
+	provider.ErrorClassUnknown:         {Backoff: 30 * time.Second, MaxBackoff: 5 * time.Minute, Alert: true},
+	provider.ErrorClassRetryable:       {Backoff: 15 * time.Second, MaxBackoff: 5 * time.Minute},
+	provider.ErrorClassThrottled:       {Backoff: time.Minute, MaxBackoff: 15 * time.Minute, DeferEvents: true},
+	provider.ErrorClassConflict:        {Backoff: 30 * time.Second, MaxBackoff: 5 * time.Minute, DeferEvents: true},
+	provider.ErrorClassPermanent:       {Backoff: 5 * time.Minute, MaxBackoff: 30 * time.Minute, Alert: true},
+	provider.ErrorClassBlockedByPolicy: {Backoff: 5 * time.Minute, MaxBackoff: 30 * time.Minute, Alert: true},
+	provider.ErrorClassPartialApply:    {Backoff: 5 * time.Minute, MaxBackoff: 30 * time.Minute, Alert: true, DeferEvents: true},
+	provider.ErrorClassInProgress:      {Backoff: 15 * time.Second, DeferEvents: true, Pending: true},
+}
+
+// delay returns the backoff after the given number of consecutive failures.
+func (p RetryPolicy) delay(failures int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < failures && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+	return delay
+}
+
+// retryPolicy returns the retry policy of the error class. Classes without
+// a policy are handled like unknown errors.
+func (c *EgressController) retryPolicy(class provider.ErrorClass) RetryPolicy {
+	if policy, ok := c.retryPolicies[class]; ok {
+		return policy
+	}
+	return c.retryPolicies[provider.ErrorClassUnknown]
+}
+
+// syncFailed logs the error by its class and schedules the next sync
+// according to the retry policy of the class.
+func (c *EgressController) syncFailed(msg string, err error) {
+	class := provider.ClassOf(err)
+	policy := c.retryPolicy(class)
+	if policy.Pending {
+		c.syncPending(policy, err)
+		return
+	}
+	syncErrors.WithLabelValues(string(class)).Inc()
+	c.setSyncState(syncStateFailed)
+
+	c.failures++
+	if class != c.failureClass {
+		c.failures = 1
+		c.failureClass = class
+	}
+	delay := policy.delay(c.failures)
+	c.nextSync = time.Now().Add(delay)
+	c.deferEvents = policy.DeferEvents
+
+	logf := log.Warnf
+	if policy.Alert {
+		logf = log.Errorf
+	}
+	logf("%s (%s error, failure %d, retrying in %s): %v", msg, class, c.failures, delay, err)
+}
+
+// syncPending schedules the next check of the changes the provider is still
+// applying. The failures of previous syncs are kept, so their backoff
+// continues if the changes fail.
+func (c *EgressController) syncPending(policy RetryPolicy, err error) {
+	c.setSyncState(syncStatePending)
+	c.nextSync = time.Now().Add(policy.Backoff)
+	c.deferEvents = policy.DeferEvents
+	log.Infof("Sync pending, checking again in %s: %v", policy.Backoff, err)
+}
+
+// syncSucceeded resets the backoff and schedules the next resync.
+func (c *EgressController) syncSucceeded() {
+	c.setSyncState(syncStateSucceeded)
+	if c.failures > 0 {
+		log.Infof("Sync succeeded after %d failures", c.failures)
+	}
+	c.failures = 0
+	c.failureClass = ""
+	c.nextSync = time.Now().Add(c.interval)
+	c.deferEvents = false
+}
+
+func (c *EgressController) setSyncState(state string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.syncState = state
+}
+
+// SyncState returns the state of the last sync, succeeded, pending or
+// failed, or an empty string before the first sync.
+func (c *EgressController) SyncState() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.syncState
+}
+
+// eventsDeferred returns true if syncs triggered by config changes should
+// wait for the backoff of the last failure.
+func (c *EgressController) eventsDeferred() bool {
+	return c.deferEvents && time.Now().Before(c.nextSync)
+}
@@ -0,0 +1,111 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+type mockFailingProvider struct {
+	err   error
+	calls int
+}
+
+func (p *mockFailingProvider) Ensure(_ context.Context, _ *provider.DesiredState) error {
+	p.calls++
+	return p.err
+}
+
+func (p *mockFailingProvider) String() string {
+	return "failing"
+}
+
+func TestRetryPolicyDelay(tt *testing.T) {
+	policy := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for _, tc := range []struct {
+		msg      string
+		failures int
+		expected time.Duration
+	}{
+		{msg: "first failure should wait the backoff", failures: 1, expected: time.Second},
+		{msg: "consecutive failures should double the backoff", failures: 3, expected: 4 * time.Second},
+		{msg: "backoff should be limited", failures: 10, expected: 5 * time.Second},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			require.Equal(t, tc.expected, policy.delay(tc.failures))
+		})
+	}
+}
+
+func TestControllerRetry(t *testing.T) {
+	_, netA, _ := net.ParseCIDR("1.0.0.1/32")
+	prov := &mockFailingProvider{}
+	configsChan := make(chan provider.EgressConfig)
+	configSource := mockEgressConfigSource{
+		configs: []provider.EgressConfig{
+			{
+				Resource:    provider.Resource{Name: "a", Namespace: "y", Cluster: "m"},
+				IPAddresses: map[string]*net.IPNet{netA.String(): netA},
+			},
+		},
+		configsChan: configsChan,
+	}
+	controller := NewEgressController(prov, configSource, time.Hour, nil, provider.RouteBudget{}, nil)
+	controller.retryPolicies = map[provider.ErrorClass]RetryPolicy{
+		provider.ErrorClassUnknown:    {Backoff: time.Second, MaxBackoff: time.Minute},
+		provider.ErrorClassThrottled:  {Backoff: time.Minute, MaxBackoff: time.Hour, DeferEvents: true},
+		provider.ErrorClassInProgress: {Backoff: 2 * time.Second, DeferEvents: true, Pending: true},
+	}
+
+	ctx := context.Background()
+
+	// throttling should back off and defer config changes.
+	prov.err = provider.NewError(provider.ErrorClassThrottled, errors.New("rate exceeded"))
+	controller.ensureEgressRules(ctx)
+	controller.ensureEgressRules(ctx)
+	require.Equal(t, 2, controller.failures)
+	require.WithinDuration(t, time.Now().Add(2*time.Minute), controller.nextSync, time.Second)
+	require.True(t, controller.eventsDeferred())
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		configsChan <- provider.EgressConfig{Resource: provider.Resource{Name: "a", Namespace: "y", Cluster: "m"}}
+		cancel()
+	}()
+	controller.Run(ctx)
+	// only the initial sync of Run, not the config change.
+	require.Equal(t, 3, prov.calls)
+	require.Empty(t, controller.configsCache)
+
+	// a different class should restart the backoff with its own policy.
+	prov.err = errors.New("unknown")
+	controller.ensureEgressRules(ctx)
+	require.Equal(t, 1, controller.failures)
+	require.Equal(t, provider.ErrorClassUnknown, controller.failureClass)
+	require.WithinDuration(t, time.Now().Add(time.Second), controller.nextSync, time.Second)
+	require.False(t, controller.eventsDeferred())
+
+	// pending changes should be checked again without counting as failure.
+	syncErrorsBefore := testutil.ToFloat64(syncErrors.WithLabelValues(string(provider.ErrorClassInProgress)))
+	prov.err = provider.NewError(provider.ErrorClassInProgress, errors.New("waiting for update"))
+	controller.ensureEgressRules(ctx)
+	controller.ensureEgressRules(ctx)
+	require.Equal(t, 1, controller.failures)
+	require.Equal(t, syncStatePending, controller.SyncState())
+	require.Equal(t, syncErrorsBefore, testutil.ToFloat64(syncErrors.WithLabelValues(string(provider.ErrorClassInProgress))))
+	require.WithinDuration(t, time.Now().Add(2*time.Second), controller.nextSync, time.Second)
+	require.True(t, controller.eventsDeferred())
+
+	// success should reset the backoff.
+	prov.err = nil
+	controller.ensureEgressRules(ctx)
+	require.Equal(t, syncStateSucceeded, controller.SyncState())
+	require.Equal(t, 0, controller.failures)
+	require.WithinDuration(t, time.Now().Add(time.Hour), controller.nextSync, time.Second)
+}
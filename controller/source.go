@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+// multiConfigSource combines several EgressConfigSources into one.
+type multiConfigSource struct {
+	sources []EgressConfigSource
+	configs chan provider.EgressConfig
+}
+
+// NewMultiConfigSource returns an EgressConfigSource listing the configs of
+// all the given sources and forwarding the configs they observe.
+func NewMultiConfigSource(sources ...EgressConfigSource) EgressConfigSource {
+	m := &multiConfigSource{
+		sources: sources,
+		configs: make(chan provider.EgressConfig),
+	}
+
+	for _, source := range sources {
+		go func(source EgressConfigSource) {
+			for config := range source.Config() {
+				m.configs <- config
+			}
+		}(source)
+	}
+
+	return m
+}
+
+func (m *multiConfigSource) ListConfigs(ctx context.Context) ([]provider.EgressConfig, error) {
+	var configs []provider.EgressConfig
+	for _, source := range m.sources {
+		sourceConfigs, err := source.ListConfigs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, sourceConfigs...)
+	}
+	return configs, nil
+}
+
+func (m *multiConfigSource) Config() <-chan provider.EgressConfig {
+	return m.configs
+}
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestMultiConfigSource(t *testing.T) {
+	_, netA, _ := net.ParseCIDR("1.0.0.1/32")
+	configA := provider.EgressConfig{
+		Resource: provider.Resource{
+			Kind:      "ConfigMap",
+			Name:      "a",
+			Namespace: "y",
+			Cluster:   "m",
+		},
+		IPAddresses: map[string]*net.IPNet{
+			netA.String(): netA,
+		},
+	}
+	configB := provider.EgressConfig{
+		Resource: provider.Resource{
+			Kind:      "NetworkPolicy",
+			Name:      "a",
+			Namespace: "y",
+			Cluster:   "m",
+		},
+		IPAddresses: map[string]*net.IPNet{
+			netA.String(): netA,
+		},
+	}
+
+	chanA := make(chan provider.EgressConfig)
+	chanB := make(chan provider.EgressConfig)
+	source := NewMultiConfigSource(
+		mockEgressConfigSource{configs: []provider.EgressConfig{configA}, configsChan: chanA},
+		mockEgressConfigSource{configs: []provider.EgressConfig{configB}, configsChan: chanB},
+	)
+
+	configs, err := source.ListConfigs(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []provider.EgressConfig{configA, configB}, configs)
+
+	go func() {
+		chanB <- configB
+	}()
+	require.Equal(t, configB, <-source.Config())
+
+	go func() {
+		chanA <- configA
+	}()
+	require.Equal(t, configA, <-source.Config())
+}
@@ -0,0 +1,95 @@
+package kube
+
+import (
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	annotationPrefix       = "kube-static-egress-controller/"
+	priorityAnnotation     = annotationPrefix + "priority"
+	connectivityAnnotation = annotationPrefix + "connectivity"
+
+	// status annotations written by the controller
+	egressIPsAnnotation = annotationPrefix + "egress-ips"
+	statusAnnotation    = annotationPrefix + "status"
+	// acceptedDataAnnotation keeps the data of a ConfigMap last accepted
+	// in strict validation mode.
+	acceptedDataAnnotation = annotationPrefix + "accepted-data"
+
+	statusApplied   = "Applied"
+	statusPending   = "Pending"
+	statusUnhealthy = "Unhealthy"
+)
+
+// priorityFromAnnotations returns the priority of the egress configuration.
+// Routes of configurations with a lower priority are compressed first when
+// enforcing a route budget.
+func priorityFromAnnotations(meta metav1.ObjectMeta, kind string) int {
+	value, ok := meta.Annotations[priorityAnnotation]
+	if !ok {
+		return 0
+	}
+
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		log.Errorf("Invalid %s annotation '%s' on %s %s/%s", priorityAnnotation, value, kind, meta.Namespace, meta.Name)
+		return 0
+	}
+	return priority
+}
+
+// connectivityFromAnnotations returns the connectivity of the egress
+// configuration, which defaults to public egress IPs.
+func connectivityFromAnnotations(meta metav1.ObjectMeta, kind string) provider.Connectivity {
+	value, ok := meta.Annotations[connectivityAnnotation]
+	if !ok {
+		return provider.ConnectivityPublic
+	}
+
+	connectivity, err := provider.ParseConnectivity(value)
+	if err != nil {
+		log.Errorf("Invalid %s annotation '%s' on %s %s/%s: %v", connectivityAnnotation, value, kind, meta.Namespace, meta.Name, err)
+		return provider.ConnectivityPublic
+	}
+	return connectivity
+}
+
+// statusAnnotations returns the annotations describing the egress status of a
+// resource.
+func statusAnnotations(status provider.ResourceStatus) map[string]string {
+	ips := make([]string, 0, len(status.EgressIPs))
+	for _, ip := range status.EgressIPs {
+		ips = append(ips, ip.String())
+	}
+
+	state := statusPending
+	switch {
+	case !status.Healthy:
+		state = statusUnhealthy
+	case status.Applied:
+		state = statusApplied
+	}
+
+	return map[string]string{
+		egressIPsAnnotation: strings.Join(ips, ","),
+		statusAnnotation:    state,
+	}
+}
+
+// withoutStatusAnnotations returns the annotations without the ones written
+// by the controller.
+func withoutStatusAnnotations(annotations map[string]string) map[string]string {
+	result := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		if k == egressIPsAnnotation || k == statusAnnotation || k == acceptedDataAnnotation {
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
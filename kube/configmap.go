@@ -2,32 +2,46 @@ package kube
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net"
+	"sort"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/szuecs/kube-static-egress-controller/provider"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 )
 
+const (
+	configMapKind      = "ConfigMap"
+	prefixListIDPrefix = "pl-"
+)
+
 type ConfigMapWatcher struct {
 	clients   map[string]kubernetes.Interface
 	namespace string
 	selector  fields.Selector
+	validator *provider.CIDRValidator
 	configs   chan provider.EgressConfig
 }
 
 type EventHandler struct {
-	cluster string
-	configs chan provider.EgressConfig
+	cluster   string
+	client    kubernetes.Interface
+	validator *provider.CIDRValidator
+	configs   chan provider.EgressConfig
 }
 
-func NewConfigMapWatcher(clients map[string]kubernetes.Interface, namespace, selectorStr string, configs chan provider.EgressConfig) (*ConfigMapWatcher, error) {
+func NewConfigMapWatcher(clients map[string]kubernetes.Interface, namespace, selectorStr string, validator *provider.CIDRValidator, configs chan provider.EgressConfig) (*ConfigMapWatcher, error) {
 	selector, err := fields.ParseSelector(selectorStr)
 	if err != nil {
 		return nil, err
@@ -37,6 +51,7 @@ func NewConfigMapWatcher(clients map[string]kubernetes.Interface, namespace, sel
 		clients:   clients,
 		namespace: namespace,
 		selector:  selector,
+		validator: validator,
 		configs:   configs,
 	}, nil
 }
@@ -65,8 +80,10 @@ func (c *ConfigMapWatcher) runForClient(ctx context.Context, client kubernetes.I
 	)
 
 	informer.AddEventHandler(&EventHandler{
-		cluster: cluster,
-		configs: c.configs,
+		cluster:   cluster,
+		client:    client,
+		validator: c.validator,
+		configs:   c.configs,
 	})
 
 	go informer.Run(ctx.Done())
@@ -86,7 +103,12 @@ func (h *EventHandler) OnAdd(obj interface{}, _ bool) {
 		return
 	}
 
-	h.configs <- configMapToEgressConfig(cm, h.cluster)
+	config, ok := acceptedEgressConfig(context.TODO(), h.client, cm, h.cluster, h.validator)
+	if !ok {
+		return
+	}
+
+	h.configs <- config
 }
 
 func (h *EventHandler) OnUpdate(oldObj, newObj interface{}) {
@@ -96,7 +118,19 @@ func (h *EventHandler) OnUpdate(oldObj, newObj interface{}) {
 		return
 	}
 
-	h.configs <- configMapToEgressConfig(newCM, h.cluster)
+	// ignore updates of the status written by the controller
+	oldCM, ok := oldObj.(*v1.ConfigMap)
+	if ok && equality.Semantic.DeepEqual(oldCM.Data, newCM.Data) &&
+		equality.Semantic.DeepEqual(withoutStatusAnnotations(oldCM.Annotations), withoutStatusAnnotations(newCM.Annotations)) {
+		return
+	}
+
+	config, ok := acceptedEgressConfig(context.TODO(), h.client, newCM, h.cluster, h.validator)
+	if !ok {
+		return
+	}
+
+	h.configs <- config
 }
 
 func (h *EventHandler) OnDelete(obj interface{}) {
@@ -108,6 +142,7 @@ func (h *EventHandler) OnDelete(obj interface{}) {
 
 	h.configs <- provider.EgressConfig{
 		Resource: provider.Resource{
+			Kind:      configMapKind,
 			Name:      cm.Name,
 			Namespace: cm.Namespace,
 			Cluster:   h.cluster,
@@ -115,6 +150,31 @@ func (h *EventHandler) OnDelete(obj interface{}) {
 	}
 }
 
+// WriteStatus writes the egress status as annotations to the ConfigMap. Other
+// resources are ignored.
+func (c *ConfigMapWatcher) WriteStatus(ctx context.Context, resource provider.Resource, status provider.ResourceStatus) error {
+	if resource.Kind != configMapKind {
+		return nil
+	}
+
+	client, ok := c.clients[resource.Cluster]
+	if !ok {
+		return fmt.Errorf("unknown cluster %s", resource.Cluster)
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": statusAnnotations(status),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CoreV1().ConfigMaps(resource.Namespace).Patch(ctx, resource.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
 func (c *ConfigMapWatcher) ListConfigs(ctx context.Context) ([]provider.EgressConfig, error) {
 	egressConfigs := []provider.EgressConfig{}
 	for cluster, client := range c.clients {
@@ -139,7 +199,11 @@ func (c *ConfigMapWatcher) listConfigsForClient(ctx context.Context, client kube
 
 	configs := make([]provider.EgressConfig, 0, len(configMaps.Items))
 	for _, cm := range configMaps.Items {
-		configs = append(configs, configMapToEgressConfig(&cm, cluster))
+		config, ok := acceptedEgressConfig(ctx, client, &cm, cluster, c.validator)
+		if !ok {
+			continue
+		}
+		configs = append(configs, config)
 	}
 	return configs, nil
 }
@@ -148,23 +212,125 @@ func (c *ConfigMapWatcher) Config() <-chan provider.EgressConfig {
 	return c.configs
 }
 
-func configMapToEgressConfig(cm *v1.ConfigMap, cluster string) provider.EgressConfig {
+// acceptedEgressConfig returns the EgressConfig of the ConfigMap. In strict
+// validation mode the accepted data is kept in the accepted-data annotation
+// and a rejected ConfigMap falls back to it, so a rejected update keeps the
+// previous configuration also when the ConfigMap is listed again, e.g.
+// after a restart. False is returned for ConfigMaps never accepted.
+func acceptedEgressConfig(ctx context.Context, client kubernetes.Interface, cm *v1.ConfigMap, cluster string, validator *provider.CIDRValidator) (provider.EgressConfig, bool) {
+	config, err := configMapToEgressConfig(cm, cluster, validator)
+	if err == nil {
+		if validator.Strict {
+			err = writeAcceptedData(ctx, client, cm)
+			if err != nil {
+				log.Errorf("Failed to write accepted data of ConfigMap %s/%s: %v", cm.Namespace, cm.Name, err)
+			}
+		}
+		return config, true
+	}
+
+	accepted, ok := cm.Annotations[acceptedDataAnnotation]
+	if !ok {
+		log.Errorf("Rejected ConfigMap %s/%s: %v", cm.Namespace, cm.Name, err)
+		return provider.EgressConfig{}, false
+	}
+	log.Errorf("Rejected ConfigMap %s/%s, keeping the data accepted last: %v", cm.Namespace, cm.Name, err)
+
+	previous := cm.DeepCopy()
+	previous.Data = nil
+	err = json.Unmarshal([]byte(accepted), &previous.Data)
+	if err != nil {
+		log.Errorf("Invalid %s annotation on ConfigMap %s/%s: %v", acceptedDataAnnotation, cm.Namespace, cm.Name, err)
+		return provider.EgressConfig{}, false
+	}
+	config, err = configMapToEgressConfig(previous, cluster, validator)
+	if err != nil {
+		// e.g. after reserving more networks
+		log.Errorf("Rejected accepted data of ConfigMap %s/%s: %v", cm.Namespace, cm.Name, err)
+		return provider.EgressConfig{}, false
+	}
+	return config, true
+}
+
+// writeAcceptedData writes the data of the ConfigMap to its accepted-data
+// annotation, unless it's unchanged.
+func writeAcceptedData(ctx context.Context, client kubernetes.Interface, cm *v1.ConfigMap) error {
+	data, err := json.Marshal(cm.Data)
+	if err != nil {
+		return err
+	}
+	if cm.Annotations[acceptedDataAnnotation] == string(data) {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{acceptedDataAnnotation: string(data)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CoreV1().ConfigMaps(cm.Namespace).Patch(ctx, cm.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// configMapToEgressConfig converts the data of the ConfigMap into an
+// EgressConfig. In strict validation mode an error is returned if any of the
+// entries is invalid, otherwise invalid entries are skipped.
+func configMapToEgressConfig(cm *v1.ConfigMap, cluster string, validator *provider.CIDRValidator) (provider.EgressConfig, error) {
 	ipAddresses := make(map[string]*net.IPNet)
+	keys := make(map[string][]string)
+	var prefixLists []string
+	var problems []string
 	for key, cidr := range cm.Data {
-		_, ipnet, err := net.ParseCIDR(cidr)
-		if err != nil {
-			log.Errorf("Failed to parse CIDR '%s' from '%s' in ConfigMap %s/%s", cidr, key, cm.Namespace, cm.Name)
+		if strings.HasPrefix(cidr, prefixListIDPrefix) {
+			if _, ok := keys[cidr]; !ok {
+				prefixLists = append(prefixLists, cidr)
+			}
+			keys[cidr] = append(keys[cidr], key)
 			continue
 		}
+
+		ipnet, err := validator.ParseCIDR(cidr)
+		if err != nil {
+			if ipnet == nil || validator.Strict {
+				problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+				continue
+			}
+			log.Warnf("Invalid entry '%s' in ConfigMap %s/%s: %v", key, cm.Namespace, cm.Name, err)
+		}
 		ipAddresses[ipnet.String()] = ipnet
+		keys[ipnet.String()] = append(keys[ipnet.String()], key)
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		if validator.Strict {
+			return provider.EgressConfig{}, fmt.Errorf("invalid entries: %s", strings.Join(problems, "; "))
+		}
+		for _, problem := range problems {
+			log.Errorf("Skipping entry in ConfigMap %s/%s: %s", cm.Namespace, cm.Name, problem)
+		}
+	}
+	// stable order independent of the data keys
+	sort.Strings(prefixLists)
+	for _, k := range keys {
+		sort.Strings(k)
 	}
 
 	return provider.EgressConfig{
 		Resource: provider.Resource{
+			Kind:      configMapKind,
 			Name:      cm.Name,
 			Namespace: cm.Namespace,
 			Cluster:   cluster,
 		},
-		IPAddresses: ipAddresses,
-	}
+		IPAddresses:  ipAddresses,
+		Keys:         keys,
+		PrefixLists:  prefixLists,
+		Priority:     priorityFromAnnotations(cm.ObjectMeta, configMapKind),
+		Connectivity: connectivityFromAnnotations(cm.ObjectMeta, configMapKind),
+	}, nil
 }
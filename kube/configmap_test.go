@@ -0,0 +1,160 @@
+package kube
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func egressConfigMap(data map[string]string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "egress", Namespace: "x", Labels: map[string]string{"egress": "static"}},
+		Data:       data,
+	}
+}
+
+// configPrefixes returns the prefixes of the IP addresses of the config.
+func configPrefixes(config provider.EgressConfig) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, ipnet := range config.IPAddresses {
+		prefixes = append(prefixes, provider.PrefixFromIPNet(ipnet))
+	}
+	return prefixes
+}
+
+func TestAcceptedEgressConfig(t *testing.T) {
+	validator := &provider.CIDRValidator{Strict: true}
+	client := fake.NewClientset(egressConfigMap(map[string]string{"a": "1.0.0.0/24"}))
+	watcher, err := NewConfigMapWatcher(map[string]kubernetes.Interface{"m": client}, "x", "egress=static", validator, nil)
+	require.NoError(t, err)
+	get := func() *v1.ConfigMap {
+		cm, err := client.CoreV1().ConfigMaps("x").Get(t.Context(), "egress", metav1.GetOptions{})
+		require.NoError(t, err)
+		return cm
+	}
+	update := func(data map[string]string) {
+		cm := get()
+		cm.Data = data
+		_, err := client.CoreV1().ConfigMaps("x").Update(t.Context(), cm, metav1.UpdateOptions{})
+		require.NoError(t, err)
+	}
+
+	// accepted data is written to the ConfigMap
+	configs, err := watcher.ListConfigs(t.Context())
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("1.0.0.0/24")}, configPrefixes(configs[0]))
+	require.Equal(t, `{"a":"1.0.0.0/24"}`, get().Annotations[acceptedDataAnnotation])
+
+	// rejected updates keep the accepted data, when handled as update
+	// and when listed again after a restart
+	update(map[string]string{"a": "1.0.0.0/24", "b": "10.0.0.0/8"})
+	config, ok := acceptedEgressConfig(t.Context(), client, get(), "m", validator)
+	require.True(t, ok)
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("1.0.0.0/24")}, configPrefixes(config))
+	configs, err = watcher.ListConfigs(t.Context())
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("1.0.0.0/24")}, configPrefixes(configs[0]))
+	require.Equal(t, `{"a":"1.0.0.0/24"}`, get().Annotations[acceptedDataAnnotation])
+
+	// accepted updates replace the accepted data
+	update(map[string]string{"a": "2.0.0.0/24"})
+	config, ok = acceptedEgressConfig(t.Context(), client, get(), "m", validator)
+	require.True(t, ok)
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("2.0.0.0/24")}, configPrefixes(config))
+	require.Equal(t, `{"a":"2.0.0.0/24"}`, get().Annotations[acceptedDataAnnotation])
+
+	// ConfigMaps never accepted are skipped
+	_, ok = acceptedEgressConfig(t.Context(), client, egressConfigMap(map[string]string{"b": "10.0.0.0/8"}), "m", validator)
+	require.False(t, ok)
+
+	// the accepted data isn't written without strict validation
+	cm := egressConfigMap(map[string]string{"a": "3.0.0.0/24"})
+	_, ok = acceptedEgressConfig(t.Context(), fake.NewClientset(), cm, "m", &provider.CIDRValidator{})
+	require.True(t, ok)
+}
+
+func TestConfigMapToEgressConfig(tt *testing.T) {
+	_, vpcCIDR, _ := net.ParseCIDR("198.51.100.0/24")
+	data := map[string]string{
+		"a":   "1.0.0.0/24",
+		"b":   "2.0.0.1/24",
+		"c":   "foo",
+		"d":   "198.51.100.0/25",
+		"pl":  "pl-1111",
+		"pl2": "pl-1111",
+	}
+
+	for _, tc := range []struct {
+		msg         string
+		strict      bool
+		prefixes    []string
+		keys        map[string][]string
+		prefixLists []string
+		warnings    []string
+		errors      []string
+		err         string
+	}{
+		{
+			msg:         "invalid CIDRs should be routed with warnings and entries which are no CIDR should be skipped",
+			prefixes:    []string{"1.0.0.0/24", "198.51.100.0/25", "2.0.0.0/24"},
+			keys:        map[string][]string{"1.0.0.0/24": {"a"}, "2.0.0.0/24": {"b"}, "198.51.100.0/25": {"d"}, "pl-1111": {"pl", "pl2"}},
+			prefixLists: []string{"pl-1111"},
+			warnings: []string{
+				"Invalid entry 'b' in ConfigMap x/egress: invalid CIDR '2.0.0.1/24': host bits set, network is 2.0.0.0/24",
+				"Invalid entry 'd' in ConfigMap x/egress: invalid CIDR '198.51.100.0/25': overlaps reserved network 198.51.100.0/24",
+			},
+			errors: []string{"Skipping entry in ConfigMap x/egress: c: invalid CIDR 'foo': not a CIDR"},
+		},
+		{
+			msg:    "any invalid entry should reject the whole ConfigMap in strict mode",
+			strict: true,
+			err:    "invalid entries: b: invalid CIDR '2.0.0.1/24': host bits set, network is 2.0.0.0/24; c: invalid CIDR 'foo': not a CIDR; d: invalid CIDR '198.51.100.0/25': overlaps reserved network 198.51.100.0/24",
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			hook := logtest.NewGlobal()
+			defer hook.Reset()
+
+			validator := &provider.CIDRValidator{Strict: tc.strict, Reserved: []*net.IPNet{vpcCIDR}}
+			config, err := configMapToEgressConfig(egressConfigMap(data), "m", validator)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				require.Empty(t, hook.AllEntries())
+				return
+			}
+			require.NoError(t, err)
+
+			var prefixes []string
+			for _, prefix := range configPrefixes(config) {
+				prefixes = append(prefixes, prefix.String())
+			}
+			require.ElementsMatch(t, tc.prefixes, prefixes)
+			require.Equal(t, tc.keys, config.Keys)
+			require.Equal(t, tc.prefixLists, config.PrefixLists)
+			require.Equal(t, provider.Resource{Kind: configMapKind, Name: "egress", Namespace: "x", Cluster: "m"}, config.Resource)
+
+			var warnings, errors []string
+			for _, entry := range hook.AllEntries() {
+				switch entry.Level {
+				case log.WarnLevel:
+					warnings = append(warnings, entry.Message)
+				case log.ErrorLevel:
+					errors = append(errors, entry.Message)
+				}
+			}
+			require.ElementsMatch(t, tc.warnings, warnings)
+			require.Equal(t, tc.errors, errors)
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const networkPolicyKind = "NetworkPolicy"
+
+// NetworkPolicyWatcher watches NetworkPolicies and derives Egress
+// configurations from the ipBlock peers of their egress rules.
+type NetworkPolicyWatcher struct {
+	clients   map[string]kubernetes.Interface
+	namespace string
+	selector  fields.Selector
+	validator *provider.CIDRValidator
+	configs   chan provider.EgressConfig
+}
+
+type NetworkPolicyEventHandler struct {
+	cluster   string
+	validator *provider.CIDRValidator
+	configs   chan provider.EgressConfig
+}
+
+func NewNetworkPolicyWatcher(clients map[string]kubernetes.Interface, namespace, selectorStr string, validator *provider.CIDRValidator, configs chan provider.EgressConfig) (*NetworkPolicyWatcher, error) {
+	selector, err := fields.ParseSelector(selectorStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NetworkPolicyWatcher{
+		clients:   clients,
+		namespace: namespace,
+		selector:  selector,
+		validator: validator,
+		configs:   configs,
+	}, nil
+}
+
+func (c *NetworkPolicyWatcher) Run(ctx context.Context) {
+	for cluster, client := range c.clients {
+		c.runForClient(ctx, client, cluster)
+	}
+}
+
+func (c *NetworkPolicyWatcher) runForClient(ctx context.Context, client kubernetes.Interface, cluster string) {
+	informer := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.LabelSelector = c.selector.String()
+				return client.NetworkingV1().NetworkPolicies(c.namespace).List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.LabelSelector = c.selector.String()
+				return client.NetworkingV1().NetworkPolicies(c.namespace).Watch(ctx, options)
+			},
+		},
+		&networkingv1.NetworkPolicy{},
+		0, // skip resync
+		cache.Indexers{},
+	)
+
+	informer.AddEventHandler(&NetworkPolicyEventHandler{
+		cluster:   cluster,
+		validator: c.validator,
+		configs:   c.configs,
+	})
+
+	go informer.Run(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		log.Error("Timed out waiting for caches to sync")
+		return
+	}
+
+	log.Info("Synced NetworkPolicy watcher")
+}
+
+func (h *NetworkPolicyEventHandler) OnAdd(obj interface{}, _ bool) {
+	np, ok := obj.(*networkingv1.NetworkPolicy)
+	if !ok {
+		log.Errorf("Failed to get NetworkPolicy object")
+		return
+	}
+
+	config, err := networkPolicyToEgressConfig(np, h.cluster, h.validator)
+	if err != nil {
+		log.Errorf("Rejected NetworkPolicy %s/%s: %v", np.Namespace, np.Name, err)
+		return
+	}
+
+	h.configs <- config
+}
+
+func (h *NetworkPolicyEventHandler) OnUpdate(oldObj, newObj interface{}) {
+	newNP, ok := newObj.(*networkingv1.NetworkPolicy)
+	if !ok {
+		log.Errorf("Failed to get new NetworkPolicy object")
+		return
+	}
+
+	config, err := networkPolicyToEgressConfig(newNP, h.cluster, h.validator)
+	if err != nil {
+		// keep the previous configuration
+		log.Errorf("Rejected NetworkPolicy %s/%s: %v", newNP.Namespace, newNP.Name, err)
+		return
+	}
+
+	h.configs <- config
+}
+
+func (h *NetworkPolicyEventHandler) OnDelete(obj interface{}) {
+	np, ok := obj.(*networkingv1.NetworkPolicy)
+	if !ok {
+		log.Errorf("Failed to get NetworkPolicy object")
+		return
+	}
+
+	h.configs <- provider.EgressConfig{
+		Resource: provider.Resource{
+			Kind:      networkPolicyKind,
+			Name:      np.Name,
+			Namespace: np.Namespace,
+			Cluster:   h.cluster,
+		},
+	}
+}
+
+func (c *NetworkPolicyWatcher) ListConfigs(ctx context.Context) ([]provider.EgressConfig, error) {
+	egressConfigs := []provider.EgressConfig{}
+	for cluster, client := range c.clients {
+		configs, err := c.listConfigsForClient(ctx, client, cluster)
+		if err != nil {
+			return nil, err
+		}
+		egressConfigs = append(egressConfigs, configs...)
+	}
+	return egressConfigs, nil
+}
+
+func (c *NetworkPolicyWatcher) listConfigsForClient(ctx context.Context, client kubernetes.Interface, cluster string) ([]provider.EgressConfig, error) {
+	opts := metav1.ListOptions{
+		LabelSelector: c.selector.String(),
+	}
+
+	networkPolicies, err := client.NetworkingV1().NetworkPolicies(c.namespace).List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]provider.EgressConfig, 0, len(networkPolicies.Items))
+	for _, np := range networkPolicies.Items {
+		config, err := networkPolicyToEgressConfig(&np, cluster, c.validator)
+		if err != nil {
+			log.Errorf("Rejected NetworkPolicy %s/%s: %v", np.Namespace, np.Name, err)
+			continue
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func (c *NetworkPolicyWatcher) Config() <-chan provider.EgressConfig {
+	return c.configs
+}
+
+// egressPolicy returns true if the policy types of the NetworkPolicy include
+// Egress. Without policy types Kubernetes only includes Egress if the policy
+// has egress rules.
+func egressPolicy(np *networkingv1.NetworkPolicy) bool {
+	if len(np.Spec.PolicyTypes) == 0 {
+		return len(np.Spec.Egress) > 0
+	}
+	return slices.Contains(np.Spec.PolicyTypes, networkingv1.PolicyTypeEgress)
+}
+
+// networkPolicyToEgressConfig collects the CIDRs of all ipBlock peers in the
+// egress rules of the NetworkPolicy. The except ranges of an ipBlock are
+// subtracted from its CIDR. NetworkPolicies not applying to egress traffic
+// have no CIDRs. In strict validation mode an error is returned if any of the
+// ipBlocks is invalid.
+func networkPolicyToEgressConfig(np *networkingv1.NetworkPolicy, cluster string, validator *provider.CIDRValidator) (provider.EgressConfig, error) {
+	ipAddresses := make(map[string]*net.IPNet)
+	keys := make(map[string][]string)
+	rules := np.Spec.Egress
+	if !egressPolicy(np) {
+		log.Debugf("Skipping egress rules of NetworkPolicy %s/%s without policy type %s", np.Namespace, np.Name, networkingv1.PolicyTypeEgress)
+		rules = nil
+	}
+	for i, rule := range rules {
+	peers:
+		for j, peer := range rule.To {
+			if peer.IPBlock == nil {
+				continue
+			}
+			key := fmt.Sprintf("egress[%d].to[%d].ipBlock", i, j)
+
+			block, err := validator.ParseCIDR(peer.IPBlock.CIDR)
+			if err != nil {
+				if validator.Strict {
+					return provider.EgressConfig{}, err
+				}
+				if block == nil {
+					log.Errorf("Skipping ipBlock in NetworkPolicy %s/%s: %v", np.Namespace, np.Name, err)
+					continue
+				}
+				log.Warnf("Invalid ipBlock in NetworkPolicy %s/%s: %v", np.Namespace, np.Name, err)
+			}
+
+			excluded := make([]*net.IPNet, 0, len(peer.IPBlock.Except))
+			for _, except := range peer.IPBlock.Except {
+				_, ipnet, err := net.ParseCIDR(except)
+				if err != nil {
+					// skip the whole ipBlock rather than routing more
+					// than intended
+					log.Errorf("Failed to parse except CIDR '%s' from ipBlock in NetworkPolicy %s/%s", except, np.Namespace, np.Name)
+					continue peers
+				}
+				excluded = append(excluded, ipnet)
+			}
+
+			for _, ipnet := range provider.SubtractCIDRs(block, excluded...) {
+				ipAddresses[ipnet.String()] = ipnet
+				keys[ipnet.String()] = append(keys[ipnet.String()], key)
+			}
+		}
+	}
+
+	return provider.EgressConfig{
+		Resource: provider.Resource{
+			Kind:      networkPolicyKind,
+			Name:      np.Name,
+			Namespace: np.Namespace,
+			Cluster:   cluster,
+		},
+		IPAddresses:  ipAddresses,
+		Keys:         keys,
+		Priority:     priorityFromAnnotations(np.ObjectMeta, networkPolicyKind),
+		Connectivity: connectivityFromAnnotations(np.ObjectMeta, networkPolicyKind),
+	}, nil
+}
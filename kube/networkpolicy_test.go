@@ -0,0 +1,90 @@
+package kube
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func egressNetworkPolicy(name string, labels map[string]string, policyTypes []networkingv1.PolicyType, peers ...networkingv1.NetworkPolicyPeer) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "x", Labels: labels},
+		Spec: networkingv1.NetworkPolicySpec{
+			PolicyTypes: policyTypes,
+			Egress:      []networkingv1.NetworkPolicyEgressRule{{To: peers}},
+		},
+	}
+}
+
+func TestNetworkPolicyToEgressConfig(tt *testing.T) {
+	ipBlock := networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/24", Except: []string{"10.0.0.0/25", "10.0.0.192/26"}}}
+	podSelector := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "a"}}}
+
+	for _, tc := range []struct {
+		msg      string
+		np       *networkingv1.NetworkPolicy
+		prefixes []string
+		keys     map[string][]string
+	}{
+		{
+			msg:      "except ranges should be subtracted from the ipBlock",
+			np:       egressNetworkPolicy("a", nil, []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}, podSelector, ipBlock),
+			prefixes: []string{"10.0.0.128/26"},
+			keys:     map[string][]string{"10.0.0.128/26": {"egress[0].to[1].ipBlock"}},
+		},
+		{
+			msg: "peers without ipBlock should have no CIDRs",
+			np:  egressNetworkPolicy("a", nil, []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}, podSelector),
+		},
+		{
+			msg: "policies without policy type Egress should be skipped",
+			np:  egressNetworkPolicy("a", nil, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}, ipBlock),
+		},
+		{
+			msg:      "policies without policy types should include Egress if they have egress rules",
+			np:       egressNetworkPolicy("a", nil, nil, ipBlock),
+			prefixes: []string{"10.0.0.128/26"},
+			keys:     map[string][]string{"10.0.0.128/26": {"egress[0].to[0].ipBlock"}},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			config, err := networkPolicyToEgressConfig(tc.np, "m", &provider.CIDRValidator{})
+			require.NoError(t, err)
+			require.Equal(t, provider.Resource{Kind: networkPolicyKind, Name: "a", Namespace: "x", Cluster: "m"}, config.Resource)
+			var prefixes []string
+			for _, prefix := range configPrefixes(config) {
+				prefixes = append(prefixes, prefix.String())
+			}
+			require.ElementsMatch(t, tc.prefixes, prefixes)
+			if tc.keys == nil {
+				tc.keys = map[string][]string{}
+			}
+			require.Equal(t, tc.keys, config.Keys)
+		})
+	}
+}
+
+func TestNetworkPolicyWatcherListConfigs(t *testing.T) {
+	ipBlock := networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/24"}}
+	egressTypes := []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}
+	client := fake.NewClientset(
+		egressNetworkPolicy("marked", map[string]string{"egress": "static"}, egressTypes, ipBlock),
+		egressNetworkPolicy("unmarked", nil, egressTypes, ipBlock),
+		egressNetworkPolicy("other", map[string]string{"egress": "other"}, egressTypes, ipBlock),
+	)
+	watcher, err := NewNetworkPolicyWatcher(map[string]kubernetes.Interface{"m": client}, "x", "egress=static", &provider.CIDRValidator{}, nil)
+	require.NoError(t, err)
+
+	// only NetworkPolicies carrying the marker label are listed
+	configs, err := watcher.ListConfigs(t.Context())
+	require.NoError(t, err)
+	require.Len(t, configs, 1)
+	require.Equal(t, "marked", configs[0].Resource.Name)
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, configPrefixes(configs[0]))
+}
@@ -3,22 +3,23 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	kingpin "github.com/alecthomas/kingpin/v2"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/szuecs/kube-static-egress-controller/auth"
 	"github.com/szuecs/kube-static-egress-controller/controller"
 	"github.com/szuecs/kube-static-egress-controller/kube"
 	"github.com/szuecs/kube-static-egress-controller/provider"
-	"github.com/szuecs/kube-static-egress-controller/provider/aws"
-	"github.com/szuecs/kube-static-egress-controller/provider/noop"
+	_ "github.com/szuecs/kube-static-egress-controller/provider/all"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -26,6 +27,9 @@ import (
 
 const (
 	name = "kube-static-egress-controller"
+
+	runCommand              = "run"
+	releaseEgressIPsCommand = "release-egress-ips"
 )
 
 var (
@@ -36,65 +40,51 @@ var (
 )
 
 type Config struct {
-	Masters            []string
-	KubeConfig         string
-	DryRun             bool
-	LogFormat          string
-	LogLevel           string
-	Provider           string
-	VPCID              string
-	CFTemplateBucket   string
-	ClusterID          string
-	ClusterIDTagPrefix string
-	ControllerID       string
-	// required by AWS provider
-	NatCidrBlocks []string
-	// required by AWS provider
-	AvailabilityZones          []string
-	StackTerminationProtection bool
-	AdditionalStackTags        StringMap
-	Namespace                  string
-	ResyncInterval             time.Duration
-	Address                    string
+	Command                        string
+	Masters                        []string
+	KubeConfig                     string
+	DryRun                         bool
+	LogFormat                      string
+	LogLevel                       string
+	Provider                       string
+	ClusterID                      string
+	ControllerID                   string
+	MaxRouteOverApproximation      uint64
+	Namespace                      string
+	StrictValidation               bool
+	ReservedCIDRs                  []string
+	DeniedCIDRs                    []string
+	RouteBudget                    int
+	RouteBudgetMinPrefixLength     int
+	RouteBudgetMinPrefixLengthIPv6 int
+	NetworkPolicySource            bool
+	NetworkPolicySelector          string
+	ConfigMapStatus                bool
+	ResyncInterval                 time.Duration
+	Address                        string
+	ApprovalAddress                string
+	ApprovalTokenName              string
 	// required by Platform credentials
 	UsePlatformCredentials bool
 	CredentialsDir         string
 }
 
 var defaultConfig = &Config{
-	KubeConfig:                 "",
-	VPCID:                      "",
-	ClusterID:                  "",
-	ClusterIDTagPrefix:         "kubernetes.io/cluster/",
-	ControllerID:               "kube-static-egress-controller",
-	DryRun:                     false,
-	LogFormat:                  "text",
-	LogLevel:                   log.InfoLevel.String(),
-	Provider:                   "noop",
-	StackTerminationProtection: false,
-	Namespace:                  v1.NamespaceAll,
-	Address:                    ":8080",
+	KubeConfig:            "",
+	ClusterID:             "",
+	ControllerID:          "kube-static-egress-controller",
+	DryRun:                false,
+	LogFormat:             "text",
+	LogLevel:              log.InfoLevel.String(),
+	Provider:              "noop",
+	Namespace:             v1.NamespaceAll,
+	NetworkPolicySelector: "egress=static",
+	Address:               ":8080",
+	ApprovalTokenName:     "approval",
 }
 
 func NewConfig() *Config {
-	return &Config{
-		AdditionalStackTags: make(map[string]string),
-	}
-}
-
-func newProvider(clusterID, controllerID string, dry bool, name, vpcID string, cfTemplateBucket string, clusterIDTagPrefix string, natCidrBlocks, availabilityZones []string, stackTerminationProtection bool, additionalStackTags map[string]string) (provider.Provider, error) {
-	switch name {
-	case aws.ProviderName:
-		cfg, err := config.LoadDefaultConfig(context.TODO())
-		if err != nil {
-			return nil, err
-		}
-		return aws.NewAWSProvider(cfg, clusterID, controllerID, dry, vpcID, cfTemplateBucket, clusterIDTagPrefix, natCidrBlocks, availabilityZones, stackTerminationProtection, additionalStackTags)
-	case noop.ProviderName:
-		return noop.NewNoopProvider(), nil
-	default:
-		return nil, fmt.Errorf("Unkown provider: %s", name)
-	}
+	return &Config{}
 }
 
 func allLogLevelsAsStrings() []string {
@@ -116,7 +106,10 @@ small list of IPs.
 Example:
 
     %s --provider=aws --aws-nat-cidr-block="172.31.64.0/28" --aws-nat-cidr-block=172.31.64.16/28 --aws-nat-cidr-block=172.31.64.32/28 --aws-az=eu-central-1a --aws-az=eu-central-1b --aws-az=eu-central-1c --dry-run
-`, name, name))
+
+Providers:
+
+%s`, name, name, provider.Usage()))
 	app.Version(version + "\nbuild time: " + buildstamp + "\nGit ref: " + githash)
 	app.DefaultEnvars()
 
@@ -125,25 +118,38 @@ Example:
 	app.Flag("kubeconfig", "Retrieve target cluster configuration from a Kubernetes configuration file (default: auto-detect)").Default(defaultConfig.KubeConfig).StringVar(&cfg.KubeConfig)
 	app.Flag("use-platform-credentials", "Use Platform credentials (default: disabled)").BoolVar(&cfg.UsePlatformCredentials)
 	app.Flag("credentials-dir", "Directory where the Platform credentials are stored (default: /meta/credentials)").Default(auth.DefaultCredentialsDir).Envar(auth.CredentialsDirEnvar).StringVar(&cfg.CredentialsDir)
-	app.Flag("provider", "Provider implementing static egress <noop|aws> (default: auto-detect)").Default(defaultConfig.Provider).StringVar(&cfg.Provider)
+	app.Flag("provider", fmt.Sprintf("Provider implementing static egress <%s> (default: %s)", strings.Join(provider.Providers(), "|"), defaultConfig.Provider)).Default(defaultConfig.Provider).EnumVar(&cfg.Provider, provider.Providers()...)
 	app.Flag("cluster-id", "Cluster ID used define ownership of Egress stack.").StringVar(&cfg.ClusterID)
-	app.Flag("cluster-id-tag-prefix", "Prefix for the Cluster ID tag set on the Egress stack.").Default(defaultConfig.ClusterIDTagPrefix).StringVar(&cfg.ClusterIDTagPrefix)
 	app.Flag("controller-id", "Controller ID used to identify ownership of Egress stack.").Default(defaultConfig.ControllerID).StringVar(&cfg.ControllerID)
-	app.Flag("vpc-id", "VPC ID (default: auto-detect)").Default(defaultConfig.VPCID).StringVar(&cfg.VPCID)
-	app.Flag("cf-template-bucket", "S3 bucket to use for CF template storage").StringVar(&cfg.CFTemplateBucket)
-	app.Flag("aws-nat-cidr-block", "AWS Provider requires to specify NAT-CIDR-Blocks for each AZ to have a NAT gateway in. Each should be a small network having only the NAT GW").StringsVar(&cfg.NatCidrBlocks)
-	app.Flag("aws-az", "AWS Provider requires to specify all AZs to have a NAT gateway in.").StringsVar(&cfg.AvailabilityZones)
-	app.Flag("stack-termination-protection", "Enables AWS clouformation stack termination protection for the stacks managed by the controller.").BoolVar(&cfg.StackTerminationProtection)
-	app.Flag("additional-stack-tags", "Set additional custom tags on the Cloudformation Stacks managed by the controller.").SetValue(&cfg.AdditionalStackTags)
+	app.Flag("max-route-over-approximation", "Maximum number of unconfigured addresses a route may cover when merging neighbouring CIDRs into a common supernet. With 0 CIDRs are only merged if the covered addresses stay the same. (default: 0)").Default("0").Uint64Var(&cfg.MaxRouteOverApproximation)
 	app.Flag("resync-interval", "Resync interval to make sure current state is actual state.").Default("5m").DurationVar(&cfg.ResyncInterval)
 	app.Flag("dry-run", "When enabled, prints changes rather than actually performing them (default: disabled)").BoolVar(&cfg.DryRun)
 	app.Flag("log-level", "Set the level of logging. (default: info, options: panic, debug, info, warn, error, fatal").Default(defaultConfig.LogLevel).EnumVar(&cfg.LogLevel, allLogLevelsAsStrings()...)
 	app.Flag("namespace", "Limit controller to single namespace. (default: all namespaces").Default(defaultConfig.Namespace).StringVar(&cfg.Namespace)
+	app.Flag("strict-validation", "Reject egress configurations as a whole if any entry is invalid, has host bits set or overlaps a reserved network. Otherwise such entries only produce warnings. (default: disabled)").BoolVar(&cfg.StrictValidation)
+	app.Flag("reserved-cidr", "Additional network, e.g. of a peered VPC, which egress configurations must not overlap. Providers may reserve networks as well, e.g. the AWS provider reserves the CIDRs of its VPC.").StringsVar(&cfg.ReservedCIDRs)
+	app.Flag("deny-cidr", "Network which must never be routed via static egress IPs. It's excluded from all egress configurations, splitting partially overlapping networks.").StringsVar(&cfg.DeniedCIDRs)
+	app.Flag("route-budget", "Maximum number of routes per route table. If exceeded, neighbouring routes are merged into supernets, routes of lower priority first. (default: 0, disabled)").Default("0").IntVar(&cfg.RouteBudget)
+	app.Flag("route-budget-min-prefix-length", "Shortest prefix length IPv4 routes may be widened to when enforcing the route budget or over-approximating routes. (default: 16)").Default("16").IntVar(&cfg.RouteBudgetMinPrefixLength)
+	app.Flag("route-budget-min-prefix-length-ipv6", "Shortest prefix length IPv6 routes may be widened to when enforcing the route budget or over-approximating routes. (default: 48)").Default("48").IntVar(&cfg.RouteBudgetMinPrefixLengthIPv6)
+	app.Flag("network-policy-source", "Derive egress CIDRs from the egress ipBlock rules of NetworkPolicies matching --network-policy-selector (default: disabled)").BoolVar(&cfg.NetworkPolicySource)
+	app.Flag("network-policy-selector", "Label selector of NetworkPolicies used as egress source. (default: 'egress=static'").Default(defaultConfig.NetworkPolicySelector).StringVar(&cfg.NetworkPolicySelector)
+	app.Flag("configmap-status", "Write the egress IPs and the status of the routes as annotations to the egress ConfigMaps. Requires permission to patch ConfigMaps. (default: disabled)").BoolVar(&cfg.ConfigMapStatus)
 	app.Flag("address", "The address to listen on. (default: ':8080'").Default(defaultConfig.Address).StringVar(&cfg.Address)
-	_, err := app.Parse(args)
+	app.Flag("approval-address", "The address to serve the endpoints approving or injecting changes of the provider on, e.g. change sets replacing protected resources or failures of the memory provider. Requests must authenticate with the bearer token of the Platform credentials --approval-token-name. (default: disabled)").StringVar(&cfg.ApprovalAddress)
+	app.Flag("approval-token-name", "Name of the Platform credentials in --credentials-dir holding the token authenticating approvals. (default: approval)").Default(defaultConfig.ApprovalTokenName).StringVar(&cfg.ApprovalTokenName)
+
+	// Flags related to the providers
+	provider.RegisterFlags(app)
+
+	app.Command(runCommand, "Run the controller. (default)").Default()
+	app.Command(releaseEgressIPsCommand, "Release the egress IPs retained by the provider, e.g. the EIPs of deleted AWS stacks, and exit. Egress IPs still in use are kept. With --dry-run they are only listed.")
+
+	command, err := app.Parse(args)
 	if err != nil {
 		return err
 	}
+	cfg.Command = command
 
 	return nil
 }
@@ -168,13 +174,58 @@ func main() {
 	log.SetLevel(ll)
 	log.Debugf("config: %+v", cfg)
 
-	p, err := newProvider(cfg.ClusterID, cfg.ControllerID, cfg.DryRun, cfg.Provider, cfg.VPCID, cfg.CFTemplateBucket, cfg.ClusterIDTagPrefix, cfg.NatCidrBlocks, cfg.AvailabilityZones, cfg.StackTerminationProtection, cfg.AdditionalStackTags)
+	var deniedCIDRs []netip.Prefix
+	for _, denied := range cfg.DeniedCIDRs {
+		prefix, err := netip.ParsePrefix(denied)
+		if err != nil {
+			log.Fatalf("Failed to parse denied CIDR: %v", err)
+		}
+		deniedCIDRs = append(deniedCIDRs, prefix.Masked())
+	}
+
+	p, err := provider.New(cfg.Provider, provider.Options{
+		ClusterID:    cfg.ClusterID,
+		ControllerID: cfg.ControllerID,
+		DryRun:       cfg.DryRun,
+		RouteOptions: provider.RouteOptions{
+			MaxOverApproximation: cfg.MaxRouteOverApproximation,
+			MinPrefixLength:      cfg.RouteBudgetMinPrefixLength,
+			MinPrefixLengthIPv6:  cfg.RouteBudgetMinPrefixLengthIPv6,
+			Denied:               deniedCIDRs,
+		},
+	})
 	if err != nil {
 		log.Fatalf("Failed to create provider: %v", err)
 	}
 
+	if cfg.Command == releaseEgressIPsCommand {
+		err := releaseEgressIPs(context.Background(), p)
+		if err != nil {
+			log.Fatalf("Failed to release egress IPs: %v", err)
+		}
+		return
+	}
+
+	validator := &provider.CIDRValidator{Strict: cfg.StrictValidation}
+	for _, reserved := range cfg.ReservedCIDRs {
+		_, ipnet, err := net.ParseCIDR(reserved)
+		if err != nil {
+			log.Fatalf("Failed to parse reserved CIDR: %v", err)
+		}
+		validator.Reserved = append(validator.Reserved, ipnet)
+	}
+	if reserved, ok := p.(provider.ReservedNetworkProvider); ok {
+		networks, err := reserved.ReservedNetworks(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to get reserved networks of provider %s: %v", p, err)
+		}
+		log.Infof("Reserving networks %v of provider %s", networks, p)
+		validator.Reserved = append(validator.Reserved, networks...)
+	}
+
+	kubeClients := newKubeClients(cfg)
 	configsChan := make(chan provider.EgressConfig)
-	cmWatcher, err := kube.NewConfigMapWatcher(newKubeClients(cfg), cfg.Namespace, "egress=static", configsChan)
+	cmWatcher, err := kube.NewConfigMapWatcher(kubeClients, cfg.Namespace, "egress=static", validator, configsChan)
 	if err != nil {
 		log.Fatalf("Failed to setup ConfigMap watcher: %v", err)
 	}
@@ -184,14 +235,62 @@ func main() {
 
 	go cmWatcher.Run(ctx)
 
+	var configSource controller.EgressConfigSource = cmWatcher
+	if cfg.NetworkPolicySource {
+		npWatcher, err := kube.NewNetworkPolicyWatcher(kubeClients, cfg.Namespace, cfg.NetworkPolicySelector, validator, make(chan provider.EgressConfig))
+		if err != nil {
+			log.Fatalf("Failed to setup NetworkPolicy watcher: %v", err)
+		}
+		go npWatcher.Run(ctx)
+		configSource = controller.NewMultiConfigSource(cmWatcher, npWatcher)
+	}
+
+	var statusWriter controller.StatusWriter
+	if cfg.ConfigMapStatus {
+		statusWriter = cmWatcher
+	}
+
+	controller := controller.NewEgressController(p, configSource, cfg.ResyncInterval, deniedCIDRs, provider.RouteBudget{
+		MaxRoutes:           cfg.RouteBudget,
+		MinPrefixLength:     cfg.RouteBudgetMinPrefixLength,
+		MinPrefixLengthIPv6: cfg.RouteBudgetMinPrefixLengthIPv6,
+	}, statusWriter)
+
 	handler := http.NewServeMux()
 	handler.Handle("/metrics", promhttp.Handler())
+	controller.RegisterHandlers(handler)
 	go serve(ctx, cfg.Address, handler)
 
-	controller := controller.NewEgressController(p, cmWatcher, cfg.ResyncInterval)
+	// approving changes the infrastructure, so it's served separately from
+	// the unauthenticated metrics and only if enabled
+	if cfg.ApprovalAddress != "" {
+		registrar, ok := p.(provider.ApprovalHandlerRegistrar)
+		if !ok {
+			log.Fatalf("Provider %s doesn't support approvals", p)
+		}
+		approvals := http.NewServeMux()
+		registrar.RegisterApprovalHandlers(approvals)
+		go serve(ctx, cfg.ApprovalAddress, auth.RequireToken(auth.NewPlatformCredentialsTokenSource(cfg.ApprovalTokenName, cfg.CredentialsDir), approvals))
+	}
+
 	controller.Run(ctx)
 }
 
+// releaseEgressIPs releases the egress IPs retained by the provider.
+func releaseEgressIPs(ctx context.Context, p provider.Provider) error {
+	releaser, ok := p.(provider.EgressIPReleaser)
+	if !ok {
+		return fmt.Errorf("provider %s doesn't retain egress IPs", p)
+	}
+
+	ips, err := releaser.ReleaseEgressIPs(ctx)
+	if err != nil {
+		return err
+	}
+	log.Infof("Released %d egress IPs: %v", len(ips), ips)
+	return nil
+}
+
 // newKubeClients returns multiple Kubernetes clients with the given config.
 func newKubeClients(cfg *Config) map[string]kubernetes.Interface {
 	var kubeconfig string
@@ -12,9 +12,7 @@ func TestNewConfig(t *testing.T) {
 	}{
 		{
 			name: "test-new-config",
-			want: &Config{
-				AdditionalStackTags: make(map[string]string),
-			},
+			want: &Config{},
 		},
 	}
 	for _, tt := range tests {
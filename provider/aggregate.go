@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"math"
+	"net/netip"
+	"sort"
+)
+
+// RouteOptions configure how routes are generated from egress
+// configurations.
+type RouteOptions struct {
+	// MaxOverApproximation is the maximum number of addresses not
+	// covered by any configured CIDR, a route created by merging
+	// configured CIDRs may contain. With 0 routes are only merged if
+	// the covered addresses stay exactly the same.
+	MaxOverApproximation uint64
+	// MinPrefixLength is the shortest prefix length IPv4 routes may be
+	// merged into.
+	MinPrefixLength int
+	// MinPrefixLengthIPv6 is the shortest prefix length IPv6 routes may
+	// be merged into.
+	MinPrefixLengthIPv6 int
+	// Denied are networks a merged route must never overlap.
+	Denied []netip.Prefix
+}
+
+// aggregatePrefixes returns the minimal list of prefixes covering exactly
+// the same addresses as the given prefixes. The result is sorted.
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	trie := newPrefixTrie()
+	for _, p := range prefixes {
+		trie.insert(p.Masked())
+	}
+	trie.aggregate()
+	return trie.prefixes()
+}
+
+// overApproximatePrefixes merges neighbouring prefixes into their common
+// supernet as long as the supernet contains at most MaxOverApproximation
+// addresses not covered by the given prefixes, is no shorter than the
+// minimum prefix length of its address family and doesn't overlap any denied
+// network. The prefixes must
+// be aggregated. The common supernets are the branches of the prefix trie
+// and whether one can be merged doesn't depend on other merges, so all of
+// them are checked in a single pass.
+func overApproximatePrefixes(prefixes []netip.Prefix, opts RouteOptions) []netip.Prefix {
+	trie := newPrefixTrie()
+	for _, p := range prefixes {
+		trie.insert(p)
+	}
+	for _, c := range trie.mergeCandidates(func(netip.Prefix) int { return 0 }) {
+		if c.node.merged || c.extra > opts.MaxOverApproximation {
+			continue
+		}
+		if c.prefix.Bits() < minPrefixLength(c.prefix, opts.MinPrefixLength, opts.MinPrefixLengthIPv6) || overlapsAny(c.prefix, opts.Denied) {
+			continue
+		}
+		c.merge()
+	}
+	return trie.prefixes()
+}
+
+// minPrefixLength returns the minimum prefix length of the address family of
+// the prefix.
+func minPrefixLength(p netip.Prefix, ipv4, ipv6 int) int {
+	if p.Addr().Is4() {
+		return ipv4
+	}
+	return ipv6
+}
+
+// sortPrefixes sorts prefixes by address family and address, with
+// supernets before their subnets.
+func sortPrefixes(prefixes []netip.Prefix) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		if c := prefixes[i].Addr().Compare(prefixes[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+}
+
+// prefixContains returns true if sub is completely contained in super.
+func prefixContains(super, sub netip.Prefix) bool {
+	return super.Bits() <= sub.Bits() && super.Contains(sub.Addr())
+}
+
+// areSiblings returns true if a and b are the two halves of the same
+// supernet.
+func areSiblings(a, b netip.Prefix) bool {
+	if a.Bits() != b.Bits() || a.Bits() == 0 || a.Addr().BitLen() != b.Addr().BitLen() || a == b {
+		return false
+	}
+	parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+	return parent.Contains(b.Addr())
+}
+
+// uncoveredAddresses returns the number of addresses of supernet not covered
+// by any of the non-overlapping prefixes. The result saturates at
+// math.MaxUint64.
+func uncoveredAddresses(supernet netip.Prefix, prefixes []netip.Prefix) uint64 {
+	size := addressCount(supernet)
+	if size == math.MaxUint64 {
+		return size
+	}
+
+	for _, p := range prefixes {
+		if prefixContains(supernet, p) {
+			size -= addressCount(p)
+		}
+	}
+	return size
+}
+
+// addressCount returns the number of addresses in the prefix, saturating at
+// math.MaxUint64.
+func addressCount(p netip.Prefix) uint64 {
+	hostBits := p.Addr().BitLen() - p.Bits()
+	if hostBits >= 64 {
+		return math.MaxUint64
+	}
+	return 1 << hostBits
+}
@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"math"
+	"math/rand"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateRoutesWithOptions(tt *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		cidrs    []string
+		opts     RouteOptions
+		expected []string
+	}{
+		{
+			msg:      "adjacent siblings should be merged",
+			cidrs:    []string{"10.0.0.0/25", "10.0.0.128/25"},
+			expected: []string{"10.0.0.0/24"},
+		},
+		{
+			msg:      "contiguous run of addresses should be merged",
+			cidrs:    []string{"1.2.3.0/32", "1.2.3.1/32", "1.2.3.2/32", "1.2.3.3/32"},
+			expected: []string{"1.2.3.0/30"},
+		},
+		{
+			msg:      "adjacent non-siblings should not be merged",
+			cidrs:    []string{"1.2.3.1/32", "1.2.3.2/32"},
+			expected: []string{"1.2.3.1/32", "1.2.3.2/32"},
+		},
+		{
+			msg:      "adjacent non-siblings should be merged within the over-approximation bound",
+			cidrs:    []string{"1.2.3.1/32", "1.2.3.2/32"},
+			opts:     RouteOptions{MaxOverApproximation: 2},
+			expected: []string{"1.2.3.0/30"},
+		},
+		{
+			msg:      "routes should not be merged beyond the over-approximation bound",
+			cidrs:    []string{"1.2.3.0/32", "1.2.3.8/32"},
+			opts:     RouteOptions{MaxOverApproximation: 2},
+			expected: []string{"1.2.3.0/32", "1.2.3.8/32"},
+		},
+		{
+			msg:      "routes should not be merged over denied networks",
+			cidrs:    []string{"1.2.3.0/32", "1.2.3.2/32"},
+			opts:     RouteOptions{MaxOverApproximation: 2, Denied: []netip.Prefix{netip.MustParsePrefix("1.2.3.1/32")}},
+			expected: []string{"1.2.3.0/32", "1.2.3.2/32"},
+		},
+		{
+			msg:      "routes should not be merged beyond the min prefix length",
+			cidrs:    []string{"10.0.0.0/24", "10.0.2.0/24"},
+			opts:     RouteOptions{MaxOverApproximation: 1 << 9, MinPrefixLength: 24},
+			expected: []string{"10.0.0.0/24", "10.0.2.0/24"},
+		},
+		{
+			msg:      "different address families should not be merged",
+			cidrs:    []string{"255.255.255.255/32", "::/128"},
+			opts:     RouteOptions{MaxOverApproximation: 1 << 32},
+			expected: []string{"255.255.255.255/32", "::/128"},
+		},
+		{
+			msg:      "IPv6 routes should not be merged beyond the IPv6 min prefix length",
+			cidrs:    []string{"2001:db8::/48", "2001:db8:2::/48"},
+			opts:     RouteOptions{MaxOverApproximation: math.MaxUint64, MinPrefixLength: 16, MinPrefixLengthIPv6: 48},
+			expected: []string{"2001:db8::/48", "2001:db8:2::/48"},
+		},
+		{
+			msg:      "IPv4 routes should not be limited by the IPv6 min prefix length",
+			cidrs:    []string{"10.0.0.0/24", "10.0.2.0/24"},
+			opts:     RouteOptions{MaxOverApproximation: 1 << 9, MinPrefixLength: 16, MinPrefixLengthIPv6: 48},
+			expected: []string{"10.0.0.0/22"},
+		},
+		{
+			msg:      "IPv6 siblings should be merged",
+			cidrs:    []string{"2001:db8::/33", "2001:db8:8000::/33"},
+			expected: []string{"2001:db8::/32"},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			ipAddresses := make(map[string]*net.IPNet, len(tc.cidrs))
+			for _, c := range tc.cidrs {
+				_, ipnet, err := net.ParseCIDR(c)
+				require.NoError(t, err)
+				ipAddresses[ipnet.String()] = ipnet
+			}
+
+			expected := make(map[string]struct{}, len(tc.expected))
+			for _, c := range tc.expected {
+				expected[c] = struct{}{}
+			}
+
+			routes := GenerateRoutesWithOptions(map[Resource]map[string]*net.IPNet{
+				{Name: "a", Namespace: "x", Cluster: "m"}: ipAddresses,
+			}, tc.opts)
+			require.Equal(t, expected, routes)
+		})
+	}
+}
+
+// prefixSet is a random set of prefixes within 10.0.0.0/24 for property
+// based tests.
+type prefixSet []netip.Prefix
+
+func (prefixSet) Generate(rand *rand.Rand, size int) reflect.Value {
+	n := rand.Intn(size + 1)
+	prefixes := make(prefixSet, 0, n)
+	for i := 0; i < n; i++ {
+		addr := netip.AddrFrom4([4]byte{10, 0, 0, byte(rand.Intn(256))})
+		prefixes = append(prefixes, netip.PrefixFrom(addr, 24+rand.Intn(9)).Masked())
+	}
+	return reflect.ValueOf(prefixes)
+}
+
+// coveredAddresses returns the addresses of 10.0.0.0/24 covered by the
+// prefixes.
+func coveredAddresses(prefixes []netip.Prefix) [256]bool {
+	var covered [256]bool
+	for i := range covered {
+		addr := netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				covered[i] = true
+				break
+			}
+		}
+	}
+	return covered
+}
+
+func TestAggregatePrefixesProperties(t *testing.T) {
+	// aggregation never changes the covered addresses
+	sameCoverage := func(prefixes prefixSet) bool {
+		return coveredAddresses(prefixes) == coveredAddresses(aggregatePrefixes(prefixes))
+	}
+	require.NoError(t, quick.Check(sameCoverage, nil))
+
+	// aggregated prefixes are non-overlapping and can't be merged any
+	// further
+	minimal := func(prefixes prefixSet) bool {
+		aggregated := aggregatePrefixes(prefixes)
+		for i := range aggregated {
+			for j := range aggregated {
+				if i != j && (aggregated[i].Overlaps(aggregated[j]) || areSiblings(aggregated[i], aggregated[j])) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	require.NoError(t, quick.Check(minimal, nil))
+}
+
+func TestOverApproximatePrefixesProperties(t *testing.T) {
+	// over-approximation only ever widens coverage and adds at most
+	// maxExtra unconfigured addresses per route
+	bounded := func(prefixes prefixSet, maxExtra uint8) bool {
+		aggregated := aggregatePrefixes(prefixes)
+		approximated := overApproximatePrefixes(aggregated, RouteOptions{MaxOverApproximation: uint64(maxExtra)})
+
+		original := coveredAddresses(aggregated)
+		result := coveredAddresses(approximated)
+		for i := range original {
+			if original[i] && !result[i] {
+				return false
+			}
+		}
+
+		for _, route := range approximated {
+			if uncoveredAddresses(route, aggregated) > uint64(maxExtra) {
+				return false
+			}
+		}
+		return len(approximated) <= len(aggregated)
+	}
+	require.NoError(t, quick.Check(bounded, nil))
+}
+
+func BenchmarkOverApproximatePrefixes(b *testing.B) {
+	prefixes := aggregatePrefixes(benchmarkSpreadHosts(1500))
+
+	b.ReportAllocs()
+	for b.Loop() {
+		overApproximatePrefixes(prefixes, RouteOptions{MaxOverApproximation: 16})
+	}
+}
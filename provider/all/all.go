@@ -0,0 +1,11 @@
+// Package all registers all providers built into the controller. Providers
+// are added by importing their package here.
+package all
+
+import (
+	// register the providers
+	_ "github.com/szuecs/kube-static-egress-controller/provider/aws"
+	_ "github.com/szuecs/kube-static-egress-controller/provider/memory"
+	_ "github.com/szuecs/kube-static-egress-controller/provider/noop"
+	_ "github.com/szuecs/kube-static-egress-controller/provider/plugin"
+)
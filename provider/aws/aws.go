@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/netip"
 	"sort"
 	"strings"
 	"time"
@@ -35,17 +36,19 @@ const (
 	kubernetesApplicationTagKey         = "kubernetes:application"
 	resourceLifecycleOwned              = "owned"
 	maxStackWaitTimeout                 = 15 * time.Minute
-	stackStatusCheckInterval            = 15 * time.Second
+	prefixListRefreshInterval           = 5 * time.Minute
 )
 
 var (
-	errCreateFailed           = fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusCreateFailed)
-	errRollbackComplete       = fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusRollbackComplete)
-	errUpdateRollbackComplete = fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusUpdateRollbackComplete)
-	errRollbackFailed         = fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusRollbackFailed)
-	errUpdateRollbackFailed   = fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusUpdateRollbackFailed)
-	errDeleteFailed           = fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusDeleteFailed)
-	errTimeoutExceeded        = fmt.Errorf("wait for stack timeout exceeded")
+	// stack states are classified by whether the stack can be updated
+	// again and whether it's left with only part of the changes applied.
+	errCreateFailed           = provider.NewError(provider.ErrorClassPartialApply, fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusCreateFailed))
+	errRollbackComplete       = provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusRollbackComplete))
+	errUpdateRollbackComplete = provider.NewError(provider.ErrorClassRetryable, fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusUpdateRollbackComplete))
+	errRollbackFailed         = provider.NewError(provider.ErrorClassPartialApply, fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusRollbackFailed))
+	errUpdateRollbackFailed   = provider.NewError(provider.ErrorClassPartialApply, fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusUpdateRollbackFailed))
+	errDeleteFailed           = provider.NewError(provider.ErrorClassPartialApply, fmt.Errorf("wait for stack failed with %s", cftypes.StackStatusDeleteFailed))
+	errTimeoutExceeded        = provider.NewError(provider.ErrorClassRetryable, fmt.Errorf("wait for stack timeout exceeded"))
 )
 
 type AWSProvider struct {
@@ -62,6 +65,20 @@ type AWSProvider struct {
 	s3Uploader                 s3UploaderAPI
 	stackTerminationProtection bool
 	additionalStackTags        map[string]string
+	routeOptions               provider.RouteOptions
+	egressIPs                  EgressIPConfig
+	eipPublicIPs               []string
+	transitGateway             TransitGatewayConfig
+	privateNAT                 PrivateNATConfig
+	existingNAT                ExistingNATConfig
+	existingNATGateways        []existingNATGateway
+	prefixList                 PrefixListConfig
+	shards                     ShardConfig
+	changeSet                  ChangeSetConfig
+	recovery                   RecoveryConfig
+	prefixLists                *prefixListCache
+	changeSets                 *changeSetStore
+	operations                 *operationStore
 	logger                     *log.Entry
 }
 
@@ -69,6 +86,7 @@ type stackSpec struct {
 	name                       string
 	vpcID                      string
 	internetGatewayID          string
+	transitGatewayID           string
 	tableID                    map[string]string
 	timeoutInMinutes           uint
 	template                   string
@@ -76,66 +94,237 @@ type stackSpec struct {
 	tags                       []cftypes.Tag
 }
 
-func NewAWSProvider(cfg aws.Config, clusterID, controllerID string, dry bool, vpcID string, cfTemplateBucket string, clusterIDTagPrefix string, natCidrBlocks, availabilityZones []string, stackTerminationProtection bool, additionalStackTags map[string]string) (*AWSProvider, error) {
+// AWSProviderConfig configures the AWS provider.
+type AWSProviderConfig struct {
+	// ClusterID identifies the cluster owning the stacks.
+	ClusterID string
+	// ControllerID identifies the controller managing the stacks.
+	ControllerID string
+	// DryRun only logs the changes instead of applying them.
+	DryRun bool
+	// VPCID is the ID of the VPC, it's detected if empty.
+	VPCID string
+	// CFTemplateBucket is the S3 bucket the stack templates are uploaded
+	// to. If empty the templates are passed inline.
+	CFTemplateBucket string
+	// ClusterIDTagPrefix is the prefix of the cluster ID tag of the stacks.
+	ClusterIDTagPrefix string
+	// NATCIDRBlocks are the CIDRs of the NAT gateway subnets, one per
+	// availability zone.
+	NATCIDRBlocks []string
+	// AvailabilityZones are the availability zones of the NAT gateways.
+	AvailabilityZones []string
+	// StackTerminationProtection enables the termination protection of
+	// the stacks.
+	StackTerminationProtection bool
+	// AdditionalStackTags are set on the stacks in addition to the tags
+	// of the controller.
+	AdditionalStackTags map[string]string
+	// RouteOptions configure how the desired state is turned into
+	// routes.
+	RouteOptions   provider.RouteOptions
+	EgressIPs      EgressIPConfig
+	TransitGateway TransitGatewayConfig
+	PrivateNAT     PrivateNATConfig
+	ExistingNAT    ExistingNATConfig
+	PrefixList     PrefixListConfig
+	Shards         ShardConfig
+	ChangeSet      ChangeSetConfig
+	Recovery       RecoveryConfig
+}
+
+func NewAWSProvider(cfg aws.Config, config AWSProviderConfig) (*AWSProvider, error) {
 	// TODO: find vpcID at startup
-	return &AWSProvider{
-		clusterID:                  clusterID,
-		clusterIDTagPrefix:         clusterIDTagPrefix,
-		controllerID:               controllerID,
-		dry:                        dry,
-		vpcID:                      vpcID,
-		cfTemplateBucket:           cfTemplateBucket,
-		natCidrBlocks:              natCidrBlocks,
-		availabilityZones:          availabilityZones,
+	p := &AWSProvider{
+		clusterID:                  config.ClusterID,
+		clusterIDTagPrefix:         config.ClusterIDTagPrefix,
+		controllerID:               config.ControllerID,
+		dry:                        config.DryRun,
+		vpcID:                      config.VPCID,
+		cfTemplateBucket:           config.CFTemplateBucket,
+		natCidrBlocks:              config.NATCIDRBlocks,
+		availabilityZones:          config.AvailabilityZones,
 		cloudformation:             cloudformation.NewFromConfig(cfg),
 		ec2:                        ec2.NewFromConfig(cfg),
 		s3Uploader:                 manager.NewUploader(s3.NewFromConfig(cfg)),
-		stackTerminationProtection: stackTerminationProtection,
-		additionalStackTags:        additionalStackTags,
+		stackTerminationProtection: config.StackTerminationProtection,
+		additionalStackTags:        config.AdditionalStackTags,
+		routeOptions:               config.RouteOptions,
+		egressIPs:                  config.EgressIPs,
+		transitGateway:             config.TransitGateway,
+		privateNAT:                 config.PrivateNAT,
+		existingNAT:                config.ExistingNAT,
+		prefixList:                 config.PrefixList,
+		shards:                     config.Shards,
+		changeSet:                  config.ChangeSet,
+		recovery:                   config.Recovery,
+		prefixLists:                newPrefixListCache(prefixListRefreshInterval),
+		changeSets:                 newChangeSetStore(),
+		operations:                 newOperationStore(),
 		logger:                     log.WithFields(log.Fields{"provider": ProviderName}),
-	}, nil
+	}
+
+	err := p.validateEgressIPs(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.validateTransitGateway(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.validateExistingNAT(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.validatePrivateNAT(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.prefixList.validate()
+	if err != nil {
+		return nil, provider.NewError(provider.ErrorClassPermanent, err)
+	}
+
+	err = p.shards.validate(p.transitGateway, p.existingNAT, p.prefixList)
+	if err != nil {
+		return nil, provider.NewError(provider.ErrorClassPermanent, err)
+	}
+	return p, nil
 }
 
 func (p AWSProvider) String() string {
 	return ProviderName
 }
 
-func (p *AWSProvider) Ensure(ctx context.Context, configs map[provider.Resource]map[string]*net.IPNet) error {
-	stack, err := p.getEgressStack(ctx)
+// egressTarget describes where the egress traffic is routed to.
+func (p *AWSProvider) egressTarget() string {
+	switch {
+	case p.transitGateway.enabled():
+		return "transit gateway " + p.transitGateway.ID
+	case p.existingNAT.enabled():
+		return "existing NAT gateways " + p.existingNAT.String()
+	}
+	return "NAT gateways"
+}
+
+// egressMode returns how the egress stack routes egress traffic.
+func (p *AWSProvider) egressMode() egressMode {
+	switch {
+	case p.transitGateway.enabled():
+		return egressModeTransitGateway
+	case p.existingNAT.enabled():
+		return egressModeExistingNATGateways
+	}
+	return egressModeNATGateways
+}
+
+// modeChanged returns true if the stack was created for another egress
+// mode, with or without prefix list routing or shard stacks, or routes to
+// other existing NAT gateways than the configured ones.
+func (p *AWSProvider) modeChanged(current stackTemplate) bool {
+	mode := p.egressMode()
+	if current.egressMode() != mode || current.hasPrefixList() != p.prefixList.Enabled {
+		return true
+	}
+	if mode == egressModeNATGateways && current.exportsNATGateways() != p.shards.enabled() {
+		return true
+	}
+	return mode == egressModeExistingNATGateways && p.existingNATGatewaysChanged(current)
+}
+
+// Ensure creates, updates or deletes the egress stack to match the desired
+// state. Errors are classified by classifyError.
+func (p *AWSProvider) Ensure(ctx context.Context, state *provider.DesiredState) error {
+	return classifyError(p.ensure(ctx, state))
+}
+
+func (p *AWSProvider) ensure(ctx context.Context, state *provider.DesiredState) error {
+	stacks, err := p.getOwnedStacks(ctx)
 	if err != nil {
 		return err
 	}
 
-	// don't do anything if the stack doesn't exist and the config is empty
-	if len(configs) == 0 && stack.StackName == nil {
-		return nil
+	// the egress stack isn't changed while an operation started by a
+	// previous sync, or found running e.g. after a restart, is still in
+	// progress. Shard stacks are awaited one by one by ensureShards, so an
+	// operation of a shard doesn't block the egress stack or other shards.
+	// Operations of stacks deleted meanwhile are finished.
+	p.adoptOperations(stacks)
+	err = p.awaitStackOperations(ctx, p.deletedStacks(stacks)...)
+	if err != nil {
+		return err
+	}
+	stack := egressStack(stacks)
+	if stack.StackName != nil {
+		err = p.awaitStackOperations(ctx, aws.ToString(stack.StackName))
+		if err != nil {
+			return err
+		}
 	}
 
-	spec, err := p.generateStackSpec(ctx, configs)
-	if err != nil {
-		return errors.Wrap(err, "failed to generate stack spec")
+	// stacks stuck in a state which can't be updated are recovered first,
+	// once recovered they are reconciled again, e.g. created again if
+	// they were deleted
+	if stack.StackName != nil {
+		err = p.recoverStack(ctx, stack)
+		if err != nil {
+			return err
+		}
+		if p.operations.inProgress(aws.ToString(stack.StackName)) {
+			err = p.awaitStackOperations(ctx, aws.ToString(stack.StackName))
+			if err != nil {
+				return err
+			}
+			return p.ensure(ctx, state)
+		}
+	}
+
+	// don't do anything if the stack doesn't exist and the config is empty
+	if state.Len() == 0 && stack.StackName == nil {
+		return nil
 	}
 
 	// create new stack if it doesn't already exists
 	if stack.StackName == nil {
-		p.logger.Infof("Creating CF stack with config: %v", configs)
-		err := p.createCFStack(ctx, spec)
+		spec, err := p.generateStackSpec(ctx, state, nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to generate stack spec")
+		}
+
+		p.logger.Infof("Creating CF stack with config: %v", state)
+		err = p.createCFStack(ctx, spec)
 		if err != nil {
 			return errors.Wrap(err, "failed to create CF stack")
 		}
-		p.logger.Infof("Created CF stack with config: %v", configs)
-		return nil
+		err = p.awaitStackOperations(ctx, spec.name)
+		if err != nil {
+			return err
+		}
+		if !p.shards.enabled() {
+			return nil
+		}
+		return p.ensureShards(ctx, state, spec.name)
 	}
 
-	spec.name = aws.ToString(stack.StackName)
-	if len(configs) == 0 {
+	stackName := aws.ToString(stack.StackName)
+	if state.Len() == 0 {
+		// shard stacks import the NAT gateways of the egress stack and
+		// are deleted first
+		err := p.ensureShards(ctx, state, stackName)
+		if err != nil {
+			return err
+		}
+
 		p.logger.Info("Deleting CF stack. No egress configs")
-		err := p.deleteCFStack(ctx, spec.name)
+		err = p.deleteCFStack(ctx, stackName, operationDelete)
 		if err != nil {
 			return err
 		}
-		p.logger.Info("Deleted CF stack.")
-		return nil
+		return p.awaitStackOperations(ctx, stackName)
 	}
 
 	// get stack template body
@@ -144,22 +333,70 @@ func (p *AWSProvider) Ensure(ctx context.Context, configs map[provider.Resource]
 		return err
 	}
 
-	storedCIDRs := getCIDRsFromTemplate(templateBody)
+	routes := p.egressRoutes(state)
+	current := parseStackTemplate(templateBody)
+	modeChanged := p.modeChanged(current)
+	if !routes.changed(templateBody) && !modeChanged {
+		if !p.shards.enabled() {
+			return nil
+		}
+		return p.ensureShards(ctx, state, stackName)
+	}
 
-	newCIDRs := provider.GenerateRoutes(configs)
+	if modeChanged {
+		p.logger.Infof("Switching CF stack to %s", p.egressTarget())
+	}
 
-	if stringSetEqual(storedCIDRs, newCIDRs) {
-		return nil
+	spec, err := p.generateStackSpec(ctx, state, &current)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate stack spec")
+	}
+	spec.name = stackName
+
+	p.logRouteChanges("", getCIDRsFromTemplate(templateBody), routes.public, state.FilterConnectivity(provider.ConnectivityPublic))
+	p.logRouteChanges("private ", getPrivateCIDRsFromTemplate(templateBody), routes.private, state.FilterConnectivity(provider.ConnectivityPrivate))
+
+	// shard stacks are deleted before their routes are moved back to
+	// the egress stack, which can't remove the exports of the NAT
+	// gateways while they are imported
+	if !p.shards.enabled() {
+		err := p.ensureShards(ctx, state, stackName)
+		if err != nil {
+			return err
+		}
 	}
 
 	// update stack with new config
-	p.logger.Infof("Updating CF stack with config: %v", configs)
+	p.logger.Infof("Updating CF stack with config: %v", state)
 	err = p.updateCFStack(ctx, spec)
 	if err != nil {
 		return errors.Wrap(err, "failed to update CF stack")
 	}
-	p.logger.Infof("Updated CF stack with config: %v", configs)
-	return nil
+	err = p.awaitStackOperations(ctx, stackName)
+	if err != nil {
+		return err
+	}
+
+	if !p.shards.enabled() {
+		return nil
+	}
+	return p.ensureShards(ctx, state, stackName)
+}
+
+// logRouteChanges logs the routes added to and removed from the stored
+// routes of the kind.
+func (p *AWSProvider) logRouteChanges(kind string, stored map[string]struct{}, routes []netip.Prefix, state *provider.DesiredState) {
+	desired := provider.PrefixSet(routes)
+	for _, route := range routes {
+		if _, ok := stored[route.String()]; !ok {
+			p.logger.Infof("Adding %sroute %s configured by %v", kind, route, state.Provenance(route))
+		}
+	}
+	for cidr := range stored {
+		if _, ok := desired[cidr]; !ok {
+			p.logger.Infof("Removing %sroute %s", kind, cidr)
+		}
+	}
 }
 
 func stringSetEqual(a, b map[string]struct{}) bool {
@@ -175,8 +412,19 @@ func stringSetEqual(a, b map[string]struct{}) bool {
 	return true
 }
 
-// parses CIDRs from the Cloudformation template.
+// parses CIDRs from the Cloudformation template, either routed one by one
+// or as entries of the prefix list.
 func getCIDRsFromTemplate(template string) map[string]struct{} {
+	cidrs := getRouteCIDRsFromTemplate(template, "RouteToNAT")
+	for cidr := range getPrefixListCIDRsFromTemplate(template) {
+		cidrs[cidr] = struct{}{}
+	}
+	return cidrs
+}
+
+// getRouteCIDRsFromTemplate parses the CIDRs of the routes with the name
+// prefix from the CloudFormation template.
+func getRouteCIDRsFromTemplate(template, prefix string) map[string]struct{} {
 	var cfTemplate struct {
 		Resources map[string]struct {
 			Type       string
@@ -194,7 +442,7 @@ func getCIDRsFromTemplate(template string) map[string]struct{} {
 
 	cidrs := make(map[string]struct{})
 	for resourceName, r := range cfTemplate.Resources {
-		if strings.HasPrefix(resourceName, "RouteToNAT") {
+		if strings.HasPrefix(resourceName, prefix) {
 			// get CIDR from CF resource definition
 			if r.Type == "AWS::EC2::Route" {
 				cidrs[r.Properties.DestinationCidrBlock] = struct{}{}
@@ -215,7 +463,10 @@ func findTagByKey(tags []ec2types.Tag, key string) string {
 	return ""
 }
 
-func (p *AWSProvider) generateStackSpec(ctx context.Context, configs map[provider.Resource]map[string]*net.IPNet) (*stackSpec, error) {
+// generateStackSpec generates the spec of the egress stack for the desired
+// state. The current template of an existing stack is used to keep its EIPs,
+// it's nil for a new stack.
+func (p *AWSProvider) generateStackSpec(ctx context.Context, state *provider.DesiredState, current *stackTemplate) (*stackSpec, error) {
 	spec := &stackSpec{
 		name:                       normalizeStackName(p.clusterID),
 		timeoutInMinutes:           10,
@@ -234,26 +485,77 @@ func (p *AWSProvider) generateStackSpec(ctx context.Context, configs map[provide
 	}
 	spec.vpcID = vpcID
 
-	// get assigned internet gateway
-	igw, err := p.getInternetGatewayId(ctx, spec.vpcID)
-	p.logger.Debugf("%s: igw(%d)", p, len(igw))
+	switch p.egressMode() {
+	case egressModeTransitGateway:
+		spec.transitGatewayID = p.transitGateway.ID
+	case egressModeExistingNATGateways:
+		// the subnets of existing NAT gateways are routed to the
+		// internet gateway by their operators
+	default:
+		// get assigned internet gateway
+		igw, err := p.getInternetGatewayId(ctx, spec.vpcID)
+		p.logger.Debugf("%s: igw(%d)", p, len(igw))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(igw) == 0 {
+			return nil, fmt.Errorf("no Internet Gateways found")
+		}
+
+		// get first internet gateway ID
+		igwID := aws.ToString(igw[0].InternetGatewayId)
+		spec.internetGatewayID = igwID
+	}
+
+	tables, err := p.routeTables(ctx, spec.vpcID)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(igw) == 0 {
-		return nil, fmt.Errorf("no Internet Gateways found")
+	var eips []egressIP
+	if p.egressMode() == egressModeNATGateways {
+		eips, err = p.natGatewayEIPs(ctx, current)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// get first internet gateway ID
-	igwID := aws.ToString(igw[0].InternetGatewayId)
-	spec.internetGatewayID = igwID
+	routes := p.egressRoutes(state)
+	if p.prefixList.Enabled {
+		err := p.prefixList.checkRoutes(len(routes.public))
+		if err != nil {
+			return nil, provider.NewError(provider.ErrorClassPermanent, err)
+		}
+	}
+	if len(routes.unsupported) > 0 {
+		p.logger.Warnf("Skipping private routes %v, no private NAT gateways are configured", routes.unsupported)
+	}
+	if len(routes.conflicting) > 0 {
+		p.logger.Warnf("Routing %v via %s, they are configured with public and private connectivity", routes.conflicting, p.egressTarget())
+	}
+
+	spec.template = p.generateTemplate(state, tables.paramOrder, tables.zoneIndexes, eips)
+	spec.tableID = tables.ids
+	return spec, nil
+}
+
+// routeTables are the route tables egress CIDRs are routed in, referenced
+// by the stack parameters in paramOrder.
+type routeTables struct {
+	paramOrder  []string
+	zoneIndexes map[string]int
+	ids         map[string]string
+}
 
+// routeTables returns the route tables of the VPC tagged with their
+// availability zone.
+func (p *AWSProvider) routeTables(ctx context.Context, vpcID string) (routeTables, error) {
 	// get route tables
-	rt, err := p.getRouteTables(ctx, spec.vpcID)
+	rt, err := p.getRouteTables(ctx, vpcID)
 	p.logger.Debugf("%s: rt(%d)", p, len(rt))
 	if err != nil {
-		return nil, err
+		return routeTables{}, err
 	}
 
 	// [supporting multiple routing tables]
@@ -299,32 +601,32 @@ func (p *AWSProvider) generateStackSpec(ctx context.Context, configs map[provide
 		return zoneIndexi < zoneIndexj
 	})
 
-	var paramOrder []string
-	tableZoneIndexes := make(map[string]int)
-	tableID := make(map[string]string)
+	tables := routeTables{
+		zoneIndexes: make(map[string]int),
+		ids:         make(map[string]string),
+	}
 	for i, table := range rt {
 		zone, ok := routeTableZone(table)
 		if !ok {
 			continue
 		}
 
+		// all route tables route to the transit gateway regardless of
+		// their zone
 		zindex, ok := zoneIndex(p.availabilityZones, zone)
-		if !ok {
-			return nil, fmt.Errorf(
+		if !ok && !p.transitGateway.enabled() {
+			return routeTables{}, fmt.Errorf(
 				"unrecognized availability zone in routing table tags: %s",
 				zone,
 			)
 		}
 
 		paramName := fmt.Sprintf("AZ%dRouteTableIDParameter", i+1)
-		paramOrder = append(paramOrder, paramName)
-		tableZoneIndexes[paramName] = zindex
-		tableID[paramName] = aws.ToString(table.RouteTableId)
+		tables.paramOrder = append(tables.paramOrder, paramName)
+		tables.zoneIndexes[paramName] = zindex
+		tables.ids[paramName] = aws.ToString(table.RouteTableId)
 	}
-
-	spec.template = p.generateTemplate(configs, paramOrder, tableZoneIndexes)
-	spec.tableID = tableID
-	return spec, nil
+	return tables, nil
 }
 
 func routeTableZone(rt ec2types.RouteTable) (string, bool) {
@@ -347,6 +649,50 @@ func zoneIndex(zones []string, zone string) (int, bool) {
 	return 0, false
 }
 
+// ReservedNetworks returns the IPv4 and IPv6 CIDRs of the VPC, which are
+// routed within the VPC and must not be routed via the egress IPs.
+func (p *AWSProvider) ReservedNetworks(ctx context.Context) ([]*net.IPNet, error) {
+	vpcID, err := p.findVPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.ec2.DescribeVpcs(ctx, &ec2.DescribeVpcsInput{VpcIds: []string{vpcID}})
+	if err != nil {
+		return nil, err
+	}
+
+	var cidrs []string
+	for _, vpc := range resp.Vpcs {
+		for _, association := range vpc.CidrBlockAssociationSet {
+			if association.CidrBlockState != nil && vpcCIDRBlockAssociated(string(association.CidrBlockState.State)) {
+				cidrs = append(cidrs, aws.ToString(association.CidrBlock))
+			}
+		}
+		for _, association := range vpc.Ipv6CidrBlockAssociationSet {
+			if association.Ipv6CidrBlockState != nil && vpcCIDRBlockAssociated(string(association.Ipv6CidrBlockState.State)) {
+				cidrs = append(cidrs, aws.ToString(association.Ipv6CidrBlock))
+			}
+		}
+	}
+
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid CIDR of VPC %s", vpcID)
+		}
+		networks = append(networks, ipnet)
+	}
+	return networks, nil
+}
+
+// vpcCIDRBlockAssociated returns true if the CIDR block is or becomes
+// associated with the VPC.
+func vpcCIDRBlockAssociated(state string) bool {
+	return state == string(ec2types.VpcCidrBlockStateCodeAssociated) || state == string(ec2types.VpcCidrBlockStateCodeAssociating)
+}
+
 func (p *AWSProvider) findVPC(ctx context.Context) (string, error) {
 	// provided by the user
 	if p.vpcID != "" {
@@ -373,9 +719,10 @@ func (p *AWSProvider) findVPC(ctx context.Context) (string, error) {
 }
 
 func (p *AWSProvider) generateTemplate(
-	configs map[provider.Resource]map[string]*net.IPNet,
+	state *provider.DesiredState,
 	routeTableParamOrder []string,
 	routeTableZoneIndexes map[string]int,
+	eips []egressIP,
 ) string {
 	template := cft.NewTemplate()
 	template.Description = "Static Egress Stack"
@@ -384,26 +731,30 @@ func (p *AWSProvider) generateTemplate(
 		Description: "VPC ID",
 		Type:        "AWS::EC2::VPC::Id",
 	}
-	template.Parameters["InternetGatewayIDParameter"] = &cft.Parameter{
-		Description: "Internet Gateway ID",
-		Type:        "String",
+	switch p.egressMode() {
+	case egressModeTransitGateway:
+		template.Parameters[parameterTransitGatewayIDParameter] = &cft.Parameter{
+			Description: "Transit Gateway ID",
+			Type:        "String",
+		}
+	case egressModeNATGateways:
+		template.Parameters["InternetGatewayIDParameter"] = &cft.Parameter{
+			Description: "Internet Gateway ID",
+			Type:        "String",
+		}
+		if p.shards.enabled() {
+			p.addNATGatewayExports(template)
+		}
+	case egressModeExistingNATGateways:
+		p.addExistingNATGatewayOutputs(template)
 	}
 
-	for i := 1; i <= len(p.availabilityZones); i++ {
-		template.AddResource(fmt.Sprintf("NATGateway%d", i), &cft.EC2NatGateway{
-			SubnetID: cft.Ref(
-				fmt.Sprintf("NATSubnet%d", i)).String(),
-			AllocationID: cft.GetAtt(
-				fmt.Sprintf("EIP%d", i), "AllocationId"),
-		})
-
-		template.AddResource(fmt.Sprintf("EIP%d", i), &cft.EC2EIP{
-			Domain: cft.String("vpc"),
-		})
-		template.Outputs[fmt.Sprintf("EIP%d", i)] = &cft.Output{
-			Description: fmt.Sprintf("external IP of the NATGateway%d", i),
-			Value:       cft.Ref(fmt.Sprintf("EIP%d", i)),
+	for i := 1; i <= len(p.availabilityZones) && p.egressMode() == egressModeNATGateways; i++ {
+		var eip egressIP
+		if i <= len(eips) {
+			eip = eips[i-1]
 		}
+		p.addEgressIP(template, i, eip)
 
 		template.AddResource(fmt.Sprintf("NATSubnet%d", i), &cft.EC2Subnet{
 			CidrBlock:        cft.String(p.natCidrBlocks[i-1]),
@@ -441,16 +792,39 @@ func (p *AWSProvider) generateTemplate(
 		})
 	}
 
-	nets := provider.GenerateRoutes(configs)
-	for cidrEntry := range nets {
-		cleanCidrEntry := strings.Replace(cidrEntry, "/", "y", -1)
-		cleanCidrEntry = strings.Replace(cleanCidrEntry, ".", "x", -1)
+	routes := p.egressRoutes(state)
+	if len(routes.public) > 0 || len(routes.private) > 0 {
 		for i, routeTableParam := range routeTableParamOrder {
 			template.Parameters[routeTableParam] = &cft.Parameter{
 				Description: fmt.Sprintf("Route Table ID No %d", i+1),
 				Type:        "String",
 			}
+		}
+	}
+
+	// with prefix list routing the route tables of the VPC only route the
+	// prefix list, routes outside of the VPC are still added per CIDR
+	vpcRouteTables := routeTableParamOrder
+	if p.prefixList.Enabled {
+		p.addPrefixList(template, routes.public)
+		if len(routes.public) > 0 {
+			p.addPrefixListRoutes(template, routeTableParamOrder, routeTableZoneIndexes)
+		}
+		vpcRouteTables = nil
+	}
+
+	for _, route := range routes.public {
+		cidrEntry, cleanCidrEntry := routeNames(route)
+		switch p.egressMode() {
+		case egressModeTransitGateway:
+			p.addTransitGatewayRoutes(template, cidrEntry, cleanCidrEntry, vpcRouteTables)
+			continue
+		case egressModeExistingNATGateways:
+			p.addExistingNATGatewayRoutes(template, cidrEntry, cleanCidrEntry, vpcRouteTables, routeTableZoneIndexes)
+			continue
+		}
 
+		for i, routeTableParam := range vpcRouteTables {
 			template.AddResource(fmt.Sprintf("RouteToNAT%dz%s", i+1, cleanCidrEntry), &cft.EC2Route{
 				RouteTableID:         cft.Ref(routeTableParam).String(),
 				DestinationCidrBlock: cft.String(cidrEntry),
@@ -462,10 +836,69 @@ func (p *AWSProvider) generateTemplate(
 		}
 	}
 
+	// private NAT gateways are only created for private routes, they
+	// don't need to be kept like the EIPs of the public ones
+	if len(routes.private) > 0 {
+		p.addPrivateNATGateways(template)
+	}
+	for _, route := range routes.private {
+		cidrEntry, cleanCidrEntry := routeNames(route)
+		addPrivateNATRoutes(template, cidrEntry, cleanCidrEntry, routeTableParamOrder, routeTableZoneIndexes)
+	}
+
 	stack, _ := json.Marshal(template)
 	return string(stack)
 }
 
+// routeNames returns the destination of the route and its representation
+// used in the names of the resources of the route.
+func routeNames(route netip.Prefix) (string, string) {
+	cidrEntry := route.String()
+	cleanCidrEntry := strings.Replace(cidrEntry, "/", "y", -1)
+	cleanCidrEntry = strings.Replace(cleanCidrEntry, ".", "x", -1)
+	return cidrEntry, cleanCidrEntry
+}
+
+// addEgressIP adds the NAT gateway of the i-th availability zone with its
+// EIP. Existing EIPs are referenced by their allocation ID, otherwise an EIP
+// is created, optionally from a public IPv4 pool. Created EIPs are retained
+// when they are removed from the stack, so egress IPs are never released
+// by accident.
+func (p *AWSProvider) addEgressIP(template *cft.Template, i int, eip egressIP) {
+	natGateway := &cft.EC2NatGateway{
+		SubnetID: cft.Ref(
+			fmt.Sprintf("NATSubnet%d", i)).String(),
+	}
+	output := &cft.Output{
+		Description: fmt.Sprintf("external IP of the NATGateway%d", i),
+	}
+
+	if eip.allocationID != "" {
+		natGateway.AllocationID = cft.String(eip.allocationID)
+		if eip.publicIP != "" {
+			output.Value = eip.publicIP
+		}
+	} else {
+		natGateway.AllocationID = cft.GetAtt(
+			fmt.Sprintf("EIP%d", i), "AllocationId")
+
+		resource := &eipResource{
+			Domain: cft.String("vpc"),
+			Tags:   p.eipTags(p.availabilityZones[i-1]),
+		}
+		if pool := p.egressIPs.publicIPv4Pool(i - 1); pool != "" {
+			resource.PublicIpv4Pool = cft.String(pool)
+		}
+		template.AddResource(fmt.Sprintf("EIP%d", i), resource).DeletionPolicy = "Retain"
+		output.Value = cft.Ref(fmt.Sprintf("EIP%d", i))
+	}
+
+	template.AddResource(fmt.Sprintf("NATGateway%d", i), natGateway)
+	if output.Value != nil {
+		template.Outputs[fmt.Sprintf("EIP%d", i)] = output
+	}
+}
+
 func isDoesNotExistsErr(err error) bool {
 	if smithyErr, ok := err.(*smithy.OperationError); ok {
 		if respErr, ok := smithyErr.Err.(*http.ResponseError); ok {
@@ -479,7 +912,9 @@ func isDoesNotExistsErr(err error) bool {
 	return false
 }
 
-func (p *AWSProvider) deleteCFStack(ctx context.Context, stackName string) error {
+// deleteCFStack starts deleting the stack by the action, the delete or a
+// recovery action.
+func (p *AWSProvider) deleteCFStack(ctx context.Context, stackName, action string) error {
 	if p.dry {
 		p.logger.Debugf("%s: Stack to delete: %s", p, stackName)
 		return nil
@@ -506,20 +941,12 @@ func (p *AWSProvider) deleteCFStack(ctx context.Context, stackName string) error
 		}
 		return err
 	}
-
-	ctx, cancel := context.WithTimeout(ctx, maxStackWaitTimeout)
-	defer cancel()
-
-	err = p.waitForStack(ctx, stackStatusCheckInterval, stackName)
-	if err != nil {
-		if isDoesNotExistsErr(err) {
-			return nil
-		}
-		return err
-	}
+	p.startOperation(stackName, "", action)
 	return nil
 }
 
+// updateCFStack starts updating the stack. The update isn't waited for,
+// its result is picked up by awaitStackOperations.
 func (p *AWSProvider) updateCFStack(ctx context.Context, spec *stackSpec) error {
 	var templateURL string
 	if p.cfTemplateBucket != "" {
@@ -536,15 +963,10 @@ func (p *AWSProvider) updateCFStack(ctx context.Context, spec *stackSpec) error
 	}
 
 	params := &cloudformation.UpdateStackInput{
-		StackName: aws.String(spec.name),
-		Parameters: append(
-			[]cftypes.Parameter{
-				cfParam(parameterVPCIDParameter, spec.vpcID),
-				cfParam(parameterInternetGatewayIDParameter, spec.internetGatewayID),
-			},
-			routeTableParams(spec)...,
-		),
-		Tags: spec.tags,
+		StackName:       aws.String(spec.name),
+		Parameters:      stackParameters(spec),
+		StackPolicyBody: aws.String(eipStackPolicy),
+		Tags:            spec.tags,
 	}
 
 	if templateURL != "" {
@@ -567,17 +989,19 @@ func (p *AWSProvider) updateCFStack(ctx context.Context, spec *stackSpec) error
 			}
 		}
 
-		_, err := p.cloudformation.UpdateStack(ctx, params)
+		if p.changeSet.Enabled {
+			return p.updateCFStackWithChangeSet(ctx, spec, params)
+		}
+
+		resp, err := p.cloudformation.UpdateStack(ctx, params)
 		if err != nil {
 			if isDoesNotExistsErr(err) {
 				return provider.NewDoesNotExistError(fmt.Sprintf("Stack '%s' does not exist", spec.name))
 			}
 			return err
 		}
-
-		ctx, cancel := context.WithTimeout(ctx, maxStackWaitTimeout)
-		defer cancel()
-		return p.waitForStack(ctx, stackStatusCheckInterval, spec.name)
+		p.startOperation(spec.name, aws.ToString(resp.StackId), operationUpdate)
+		return nil
 	}
 
 	p.logger.Debugf("%s: DRY: Stack to update: %v", p, params)
@@ -585,6 +1009,8 @@ func (p *AWSProvider) updateCFStack(ctx context.Context, spec *stackSpec) error
 	return nil
 }
 
+// createCFStack starts creating the stack. The creation isn't waited for,
+// its result is picked up by awaitStackOperations.
 func (p *AWSProvider) createCFStack(ctx context.Context, spec *stackSpec) error {
 	var templateURL string
 	if p.cfTemplateBucket != "" {
@@ -601,17 +1027,12 @@ func (p *AWSProvider) createCFStack(ctx context.Context, spec *stackSpec) error
 	}
 
 	params := &cloudformation.CreateStackInput{
-		StackName: aws.String(spec.name),
-		OnFailure: cftypes.OnFailureDelete,
-		Parameters: append(
-			[]cftypes.Parameter{
-				cfParam(parameterVPCIDParameter, spec.vpcID),
-				cfParam(parameterInternetGatewayIDParameter, spec.internetGatewayID),
-			},
-			routeTableParams(spec)...,
-		),
+		StackName:                   aws.String(spec.name),
+		OnFailure:                   cftypes.OnFailureDelete,
+		Parameters:                  stackParameters(spec),
 		TimeoutInMinutes:            aws.Int32(int32(spec.timeoutInMinutes)),
 		EnableTerminationProtection: aws.Bool(spec.stackTerminationProtection),
+		StackPolicyBody:             aws.String(eipStackPolicy),
 		Tags:                        spec.tags,
 	}
 
@@ -622,7 +1043,7 @@ func (p *AWSProvider) createCFStack(ctx context.Context, spec *stackSpec) error
 	}
 
 	if !p.dry {
-		_, err := p.cloudformation.CreateStack(ctx, params)
+		resp, err := p.cloudformation.CreateStack(ctx, params)
 		if err != nil {
 			var aer *cftypes.AlreadyExistsException
 			if errors.As(err, &aer) {
@@ -630,9 +1051,8 @@ func (p *AWSProvider) createCFStack(ctx context.Context, spec *stackSpec) error
 			}
 			return err
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), maxStackWaitTimeout)
-		defer cancel()
-		return p.waitForStack(ctx, stackStatusCheckInterval, spec.name)
+		p.startOperation(spec.name, aws.ToString(resp.StackId), operationCreate)
+		return nil
 	}
 	p.logger.Debugf("%s: DRY: Stack to create: %v", p, params)
 	p.logger.Debugln(aws.ToString(params.TemplateBody))
@@ -640,6 +1060,23 @@ func (p *AWSProvider) createCFStack(ctx context.Context, spec *stackSpec) error
 
 }
 
+// stackParameters returns the parameters of the stack, which depend on
+// whether egress goes through NAT gateways or a transit gateway. Shard
+// stacks only have the route table parameters.
+func stackParameters(s *stackSpec) []cftypes.Parameter {
+	var params []cftypes.Parameter
+	if s.vpcID != "" {
+		params = append(params, cfParam(parameterVPCIDParameter, s.vpcID))
+	}
+	switch {
+	case s.transitGatewayID != "":
+		params = append(params, cfParam(parameterTransitGatewayIDParameter, s.transitGatewayID))
+	case s.internetGatewayID != "":
+		params = append(params, cfParam(parameterInternetGatewayIDParameter, s.internetGatewayID))
+	}
+	return append(params, routeTableParams(s)...)
+}
+
 func routeTableParams(s *stackSpec) []cftypes.Parameter {
 	var params []cftypes.Parameter
 	for paramName, routeTableID := range s.tableID {
@@ -665,8 +1102,29 @@ func (p *AWSProvider) getStackByName(ctx context.Context, stackName string) (cft
 }
 
 // getEgressStack gets the Egress stack by ClusterID tag or by static stack
-// name.
+// name. Shard stacks are skipped.
 func (p *AWSProvider) getEgressStack(ctx context.Context) (cftypes.Stack, error) {
+	stacks, err := p.getOwnedStacks(ctx)
+	if err != nil {
+		return cftypes.Stack{}, err
+	}
+	return egressStack(stacks), nil
+}
+
+// egressStack returns the egress stack of the owned stacks.
+func egressStack(stacks []cftypes.Stack) cftypes.Stack {
+	var egressStack cftypes.Stack
+	for _, stack := range stacks {
+		if stackTag(stack, shardTagKey) == "" {
+			egressStack = stack
+		}
+	}
+	return egressStack
+}
+
+// getOwnedStacks returns the egress stack and the shard stacks of the
+// controller.
+func (p *AWSProvider) getOwnedStacks(ctx context.Context) ([]cftypes.Stack, error) {
 	tags := map[string]string{
 		p.clusterIDTagPrefix + p.clusterID: resourceLifecycleOwned,
 		kubernetesApplicationTagKey:        p.controllerID,
@@ -675,22 +1133,20 @@ func (p *AWSProvider) getEgressStack(ctx context.Context) (cftypes.Stack, error)
 	params := &cloudformation.DescribeStacksInput{}
 	paginator := cloudformation.NewDescribeStacksPaginator(p.cloudformation, params)
 
-	var egressStack cftypes.Stack
+	var stacks []cftypes.Stack
 	for paginator.HasMorePages() {
 		resp, err := paginator.NextPage(ctx)
 		if err != nil {
-			return cftypes.Stack{}, err
+			return nil, err
 		}
 
 		for _, stack := range resp.Stacks {
 			if cloudformationHasTags(tags, stack.Tags) {
-				egressStack = stack
-				break
+				stacks = append(stacks, stack)
 			}
 		}
 	}
-
-	return egressStack, nil
+	return stacks, nil
 }
 
 func (p *AWSProvider) getStackTemplateBody(ctx context.Context, stack cftypes.Stack) (string, error) {
@@ -727,42 +1183,6 @@ func cloudformationHasTags(expected map[string]string, tags []cftypes.Tag) bool
 	return true
 }
 
-func (p *AWSProvider) waitForStack(ctx context.Context, waitTime time.Duration, stackName string) error {
-	for {
-		stack, err := p.getStackByName(ctx, stackName)
-		if err != nil {
-			return err
-		}
-		switch stack.StackStatus {
-		case cftypes.StackStatusUpdateComplete:
-			return nil
-		case cftypes.StackStatusCreateComplete:
-			return nil
-		case cftypes.StackStatusDeleteComplete:
-			return nil
-		case cftypes.StackStatusCreateFailed:
-			return errCreateFailed
-		case cftypes.StackStatusDeleteFailed:
-			return errDeleteFailed
-		case cftypes.StackStatusRollbackComplete:
-			return errRollbackComplete
-		case cftypes.StackStatusRollbackFailed:
-			return errRollbackFailed
-		case cftypes.StackStatusUpdateRollbackComplete:
-			return errUpdateRollbackComplete
-		case cftypes.StackStatusUpdateRollbackFailed:
-			return errUpdateRollbackFailed
-		}
-		p.logger.Debugf("Stack '%s' - [%s]", stackName, stack.StackStatus)
-
-		select {
-		case <-ctx.Done():
-			return errTimeoutExceeded
-		case <-time.After(waitTime):
-		}
-	}
-}
-
 func cfParam(key, value string) cftypes.Parameter {
 	return cftypes.Parameter{
 		ParameterKey:   aws.String(key),
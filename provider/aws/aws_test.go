@@ -29,6 +29,7 @@ type mockedReceiveMsgs struct {
 	RespVpcs             ec2.DescribeVpcsOutput
 	RespInternetGateways ec2.DescribeInternetGatewaysOutput
 	RespRouteTables      ec2.DescribeRouteTablesOutput
+	RespAddresses        ec2.DescribeAddressesOutput
 }
 
 func (m mockedReceiveMsgs) DescribeVpcs(_ context.Context, in *ec2.DescribeVpcsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVpcsOutput, error) {
@@ -43,6 +44,10 @@ func (m mockedReceiveMsgs) DescribeRouteTables(_ context.Context, in *ec2.Descri
 	return &m.RespRouteTables, nil
 }
 
+func (m mockedReceiveMsgs) DescribeAddresses(_ context.Context, in *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	return &m.RespAddresses, nil
+}
+
 func TestGenerateStackSpec(t *testing.T) {
 	expectedVpcId := "vpc-1111"
 	expectedInternetGatewayId := "igw-1111"
@@ -127,7 +132,7 @@ func TestGenerateStackSpec(t *testing.T) {
 		logger:                     log.WithFields(log.Fields{"provider": ProviderName}),
 	}
 
-	stackSpec, err := p.generateStackSpec(context.Background(), destinationCidrBlocks)
+	stackSpec, err := p.generateStackSpec(context.Background(), provider.DesiredStateFromLegacy(destinationCidrBlocks), nil)
 	if err != nil {
 		t.Error("Failed to generate CloudFormation stack")
 	}
@@ -151,6 +156,38 @@ func TestGenerateStackSpec(t *testing.T) {
 	require.EqualValues(t, expectedTags, stackSpec.tags)
 }
 
+func TestReservedNetworks(t *testing.T) {
+	m := &mockEC2{
+		describeVpcs: &ec2.DescribeVpcsOutput{
+			Vpcs: []ec2types.Vpc{{
+				VpcId: aws.String("vpc-1"),
+				CidrBlockAssociationSet: []ec2types.VpcCidrBlockAssociation{
+					{CidrBlock: aws.String("172.31.0.0/16"), CidrBlockState: &ec2types.VpcCidrBlockState{State: ec2types.VpcCidrBlockStateCodeAssociated}},
+					{CidrBlock: aws.String("198.51.100.0/24"), CidrBlockState: &ec2types.VpcCidrBlockState{State: ec2types.VpcCidrBlockStateCodeAssociating}},
+					{CidrBlock: aws.String("203.0.113.0/24"), CidrBlockState: &ec2types.VpcCidrBlockState{State: ec2types.VpcCidrBlockStateCodeDisassociated}},
+				},
+				Ipv6CidrBlockAssociationSet: []ec2types.VpcIpv6CidrBlockAssociation{
+					{Ipv6CidrBlock: aws.String("2001:db8::/56"), Ipv6CidrBlockState: &ec2types.VpcCidrBlockState{State: ec2types.VpcCidrBlockStateCodeAssociated}},
+				},
+			}},
+		},
+	}
+	p := newTestProvider(m)
+
+	networks, err := p.ReservedNetworks(t.Context())
+	require.NoError(t, err)
+	var cidrs []string
+	for _, network := range networks {
+		cidrs = append(cidrs, network.String())
+	}
+	require.Equal(t, []string{"172.31.0.0/16", "198.51.100.0/24", "2001:db8::/56"}, cidrs)
+
+	// CIDRs overlapping the VPC are invalid
+	validator := &provider.CIDRValidator{Reserved: networks}
+	_, err = validator.ParseCIDR("198.51.100.128/25")
+	require.EqualError(t, err, "invalid CIDR '198.51.100.128/25': overlaps reserved network 198.51.100.0/24")
+}
+
 func TestGenerateTemplate(t *testing.T) {
 	_, netA, _ := net.ParseCIDR("213.95.138.236/32")
 	natCidrBlocks := []string{"172.31.64.0/28"}
@@ -177,11 +214,12 @@ func TestGenerateTemplate(t *testing.T) {
 		logger:                     log.WithFields(log.Fields{"provider": ProviderName}),
 	}
 
-	expect := `{"AWSTemplateFormatVersion":"2010-09-09","Description":"Static Egress Stack","Parameters":{"AZ1RouteTableIDParameter":{"Type":"String","Description":"Route Table ID No 1"},"InternetGatewayIDParameter":{"Type":"String","Description":"Internet Gateway ID"},"VPCIDParameter":{"Type":"AWS::EC2::VPC::Id","Description":"VPC ID"}},"Resources":{"EIP1":{"Type":"AWS::EC2::EIP","Properties":{"Domain":"vpc"}},"NATGateway1":{"Type":"AWS::EC2::NatGateway","Properties":{"AllocationId":{"Fn::GetAtt":["EIP1","AllocationId"]},"SubnetId":{"Ref":"NATSubnet1"}}},"NATSubnet1":{"Type":"AWS::EC2::Subnet","Properties":{"AvailabilityZone":"eu-central-1a","CidrBlock":"172.31.64.0/28","Tags":[{"Key":"Name","Value":"nat-eu-central-1a"}],"VpcId":{"Ref":"VPCIDParameter"}}},"NATSubnetRoute1":{"Type":"AWS::EC2::Route","Properties":{"DestinationCidrBlock":"0.0.0.0/0","GatewayId":{"Ref":"InternetGatewayIDParameter"},"RouteTableId":{"Ref":"NATSubnetRouteTable1"}}},"NATSubnetRouteTable1":{"Type":"AWS::EC2::RouteTable","Properties":{"Tags":[{"Key":"Name","Value":"nat-eu-central-1a"}],"VpcId":{"Ref":"VPCIDParameter"}}},"NATSubnetRouteTableAssociation1":{"Type":"AWS::EC2::SubnetRouteTableAssociation","Properties":{"RouteTableId":{"Ref":"NATSubnetRouteTable1"},"SubnetId":{"Ref":"NATSubnet1"}}},"RouteToNAT1z213x95x138x236y32":{"Type":"AWS::EC2::Route","Properties":{"DestinationCidrBlock":"213.95.138.236/32","NatGatewayId":{"Ref":"NATGateway1"},"RouteTableId":{"Ref":"AZ1RouteTableIDParameter"}}}},"Outputs":{"EIP1":{"Description":"external IP of the NATGateway1","Value":{"Ref":"EIP1"}}}}`
+	expect := `{"AWSTemplateFormatVersion":"2010-09-09","Description":"Static Egress Stack","Parameters":{"AZ1RouteTableIDParameter":{"Type":"String","Description":"Route Table ID No 1"},"InternetGatewayIDParameter":{"Type":"String","Description":"Internet Gateway ID"},"VPCIDParameter":{"Type":"AWS::EC2::VPC::Id","Description":"VPC ID"}},"Resources":{"EIP1":{"Type":"AWS::EC2::EIP","DeletionPolicy":"Retain","Properties":{"Domain":"vpc","Tags":[{"Key":"kubernetes.io/cluster/cluster-x","Value":"owned"},{"Key":"kubernetes:application","Value":"controller-x"},{"Key":"AvailabilityZone","Value":"eu-central-1a"}]}},"NATGateway1":{"Type":"AWS::EC2::NatGateway","Properties":{"AllocationId":{"Fn::GetAtt":["EIP1","AllocationId"]},"SubnetId":{"Ref":"NATSubnet1"}}},"NATSubnet1":{"Type":"AWS::EC2::Subnet","Properties":{"AvailabilityZone":"eu-central-1a","CidrBlock":"172.31.64.0/28","Tags":[{"Key":"Name","Value":"nat-eu-central-1a"}],"VpcId":{"Ref":"VPCIDParameter"}}},"NATSubnetRoute1":{"Type":"AWS::EC2::Route","Properties":{"DestinationCidrBlock":"0.0.0.0/0","GatewayId":{"Ref":"InternetGatewayIDParameter"},"RouteTableId":{"Ref":"NATSubnetRouteTable1"}}},"NATSubnetRouteTable1":{"Type":"AWS::EC2::RouteTable","Properties":{"Tags":[{"Key":"Name","Value":"nat-eu-central-1a"}],"VpcId":{"Ref":"VPCIDParameter"}}},"NATSubnetRouteTableAssociation1":{"Type":"AWS::EC2::SubnetRouteTableAssociation","Properties":{"RouteTableId":{"Ref":"NATSubnetRouteTable1"},"SubnetId":{"Ref":"NATSubnet1"}}},"RouteToNAT1z213x95x138x236y32":{"Type":"AWS::EC2::Route","Properties":{"DestinationCidrBlock":"213.95.138.236/32","NatGatewayId":{"Ref":"NATGateway1"},"RouteTableId":{"Ref":"AZ1RouteTableIDParameter"}}}},"Outputs":{"EIP1":{"Description":"external IP of the NATGateway1","Value":{"Ref":"EIP1"}}}}`
 	template := p.generateTemplate(
-		destinationCidrBlocks,
+		provider.DesiredStateFromLegacy(destinationCidrBlocks),
 		[]string{"AZ1RouteTableIDParameter"},
 		map[string]int{"AZ1RouteTableIDParameter": 0},
+		nil,
 	)
 	if template != expect {
 		t.Errorf("Expect:\n %s,\n but got:\n %s", expect, template)
@@ -190,10 +228,16 @@ func TestGenerateTemplate(t *testing.T) {
 }
 
 type mockCloudformation struct {
-	err          error
-	stack        cftypes.Stack
-	templateBody string
-	templateURL  string
+	err             error
+	stack           cftypes.Stack
+	templateBody    string
+	templateURL     string
+	stackPolicyBody string
+	parameters      []cftypes.Parameter
+	events          []cftypes.StackEvent
+	// deletedStackID only returns the events by this stack ID, like for
+	// deleted stacks.
+	deletedStackID string
 }
 
 func (cf *mockCloudformation) DescribeStacks(_ context.Context, input *cloudformation.DescribeStacksInput, optFns ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
@@ -207,6 +251,15 @@ func (cf *mockCloudformation) DescribeStacks(_ context.Context, input *cloudform
 	}, cf.err
 }
 
+func (cf *mockCloudformation) DescribeStackEvents(_ context.Context, input *cloudformation.DescribeStackEventsInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error) {
+	if cf.deletedStackID != "" && aws.ToString(input.StackName) != cf.deletedStackID {
+		return nil, fmt.Errorf("Stack [%s] does not exist", aws.ToString(input.StackName))
+	}
+	return &cloudformation.DescribeStackEventsOutput{
+		StackEvents: cf.events,
+	}, nil
+}
+
 func (cf *mockCloudformation) GetTemplate(_ context.Context, input *cloudformation.GetTemplateInput, optFns ...func(*cloudformation.Options)) (*cloudformation.GetTemplateOutput, error) {
 	if cf.templateBody != "" {
 		return &cloudformation.GetTemplateOutput{
@@ -226,6 +279,8 @@ func (cf *mockCloudformation) CreateStack(_ context.Context, input *cloudformati
 	}
 	cf.templateBody = aws.ToString(input.TemplateBody)
 	cf.templateURL = aws.ToString(input.TemplateURL)
+	cf.stackPolicyBody = aws.ToString(input.StackPolicyBody)
+	cf.parameters = input.Parameters
 	return &cloudformation.CreateStackOutput{
 		StackId: aws.String(""),
 	}, cf.err
@@ -239,11 +294,33 @@ func (cf *mockCloudformation) UpdateStack(_ context.Context, input *cloudformati
 	}
 	cf.templateBody = aws.ToString(input.TemplateBody)
 	cf.templateURL = aws.ToString(input.TemplateURL)
+	cf.stackPolicyBody = aws.ToString(input.StackPolicyBody)
+	cf.parameters = input.Parameters
 	return &cloudformation.UpdateStackOutput{
 		StackId: aws.String(""),
 	}, cf.err
 }
 
+func (cf *mockCloudformation) CreateChangeSet(context.Context, *cloudformation.CreateChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.CreateChangeSetOutput, error) {
+	return nil, cf.err
+}
+
+func (cf *mockCloudformation) DescribeChangeSet(context.Context, *cloudformation.DescribeChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.DescribeChangeSetOutput, error) {
+	return nil, cf.err
+}
+
+func (cf *mockCloudformation) ExecuteChangeSet(context.Context, *cloudformation.ExecuteChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.ExecuteChangeSetOutput, error) {
+	return nil, cf.err
+}
+
+func (cf *mockCloudformation) DeleteChangeSet(context.Context, *cloudformation.DeleteChangeSetInput, ...func(*cloudformation.Options)) (*cloudformation.DeleteChangeSetOutput, error) {
+	return nil, cf.err
+}
+
+func (cf *mockCloudformation) ContinueUpdateRollback(context.Context, *cloudformation.ContinueUpdateRollbackInput, ...func(*cloudformation.Options)) (*cloudformation.ContinueUpdateRollbackOutput, error) {
+	return nil, cf.err
+}
+
 func (cf *mockCloudformation) UpdateTerminationProtection(context.Context, *cloudformation.UpdateTerminationProtectionInput, ...func(*cloudformation.Options)) (*cloudformation.UpdateTerminationProtectionOutput, error) {
 	return nil, cf.err
 }
@@ -261,6 +338,16 @@ type mockEC2 struct {
 	err                            error
 	describeInternetGatewaysOutput *ec2.DescribeInternetGatewaysOutput
 	describeRouteTables            *ec2.DescribeRouteTablesOutput
+	describeAddresses              *ec2.DescribeAddressesOutput
+	describeNatGateways            *ec2.DescribeNatGatewaysOutput
+	describePublicIpv4Pools        *ec2.DescribePublicIpv4PoolsOutput
+	describeTransitGateways        *ec2.DescribeTransitGatewaysOutput
+	describeTGWVpcAttachments      *ec2.DescribeTransitGatewayVpcAttachmentsOutput
+	describeTGWRouteTables         *ec2.DescribeTransitGatewayRouteTablesOutput
+	describeTGWAttachments         *ec2.DescribeTransitGatewayAttachmentsOutput
+	describeSubnets                *ec2.DescribeSubnetsOutput
+	describeVpcs                   *ec2.DescribeVpcsOutput
+	released                       []string
 }
 
 func (ec2 *mockEC2) DescribeInternetGateways(context.Context, *ec2.DescribeInternetGatewaysInput, ...func(*ec2.Options)) (*ec2.DescribeInternetGatewaysOutput, error) {
@@ -271,6 +358,53 @@ func (ec2 *mockEC2) DescribeRouteTables(context.Context, *ec2.DescribeRouteTable
 	return ec2.describeRouteTables, ec2.err
 }
 
+func (m *mockEC2) DescribeAddresses(context.Context, *ec2.DescribeAddressesInput, ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	if m.describeAddresses == nil {
+		return &ec2.DescribeAddressesOutput{}, m.err
+	}
+	return m.describeAddresses, m.err
+}
+
+func (m *mockEC2) ReleaseAddress(_ context.Context, input *ec2.ReleaseAddressInput, _ ...func(*ec2.Options)) (*ec2.ReleaseAddressOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	m.released = append(m.released, aws.ToString(input.AllocationId))
+	return &ec2.ReleaseAddressOutput{}, nil
+}
+
+func (ec2 *mockEC2) DescribeNatGateways(context.Context, *ec2.DescribeNatGatewaysInput, ...func(*ec2.Options)) (*ec2.DescribeNatGatewaysOutput, error) {
+	return ec2.describeNatGateways, ec2.err
+}
+
+func (ec2 *mockEC2) DescribePublicIpv4Pools(context.Context, *ec2.DescribePublicIpv4PoolsInput, ...func(*ec2.Options)) (*ec2.DescribePublicIpv4PoolsOutput, error) {
+	return ec2.describePublicIpv4Pools, ec2.err
+}
+
+func (ec2 *mockEC2) DescribeTransitGateways(context.Context, *ec2.DescribeTransitGatewaysInput, ...func(*ec2.Options)) (*ec2.DescribeTransitGatewaysOutput, error) {
+	return ec2.describeTransitGateways, ec2.err
+}
+
+func (ec2 *mockEC2) DescribeTransitGatewayVpcAttachments(context.Context, *ec2.DescribeTransitGatewayVpcAttachmentsInput, ...func(*ec2.Options)) (*ec2.DescribeTransitGatewayVpcAttachmentsOutput, error) {
+	return ec2.describeTGWVpcAttachments, ec2.err
+}
+
+func (ec2 *mockEC2) DescribeTransitGatewayRouteTables(context.Context, *ec2.DescribeTransitGatewayRouteTablesInput, ...func(*ec2.Options)) (*ec2.DescribeTransitGatewayRouteTablesOutput, error) {
+	return ec2.describeTGWRouteTables, ec2.err
+}
+
+func (ec2 *mockEC2) DescribeTransitGatewayAttachments(context.Context, *ec2.DescribeTransitGatewayAttachmentsInput, ...func(*ec2.Options)) (*ec2.DescribeTransitGatewayAttachmentsOutput, error) {
+	return ec2.describeTGWAttachments, ec2.err
+}
+
+func (ec2 *mockEC2) DescribeVpcs(context.Context, *ec2.DescribeVpcsInput, ...func(*ec2.Options)) (*ec2.DescribeVpcsOutput, error) {
+	return ec2.describeVpcs, ec2.err
+}
+
+func (ec2 *mockEC2) DescribeSubnets(context.Context, *ec2.DescribeSubnetsInput, ...func(*ec2.Options)) (*ec2.DescribeSubnetsOutput, error) {
+	return ec2.describeSubnets, ec2.err
+}
+
 type mockS3UploaderAPI struct {
 	err error
 }
@@ -531,6 +665,7 @@ func TestEnsure(tt *testing.T) {
 		},
 	} {
 		tt.Run(tc.msg, func(t *testing.T) {
+			state := provider.DesiredStateFromLegacy(tc.configs)
 			provider := &AWSProvider{
 				clusterIDTagPrefix: clusterIDTagPrefix,
 				clusterID:          "cluster-x",
@@ -547,12 +682,13 @@ func TestEnsure(tt *testing.T) {
 					"eu-central-1c",
 				},
 				cloudformation:             tc.cf,
+				operations:                 newOperationStore(),
 				ec2:                        tc.ec2,
 				stackTerminationProtection: true,
 				logger:                     log.WithFields(log.Fields{"provider": ProviderName}),
 			}
 
-			err := provider.Ensure(context.Background(), tc.configs)
+			err := provider.Ensure(context.Background(), state)
 			if tc.success {
 				require.NoError(t, err)
 				if tc.cf.stack.StackName != nil && len(tc.cf.stack.Tags) > 0 {
@@ -596,6 +732,7 @@ func TestCloudformationS3TemplateUpload(t *testing.T) {
 			provider := &AWSProvider{
 				vpcID:            "x",
 				cloudformation:   cloudformationAPI,
+				operations:       newOperationStore(),
 				s3Uploader:       &mockS3UploaderAPI{err: tc.s3UploaderErr},
 				cfTemplateBucket: tc.cfTemplateBucket,
 				logger:           log.WithFields(log.Fields{"provider": ProviderName}),
@@ -689,3 +826,84 @@ func TestCloudformationHasTags(tt *testing.T) {
 		})
 	}
 }
+
+// newTestProvider returns a provider of the cluster "cluster" in the VPC
+// vpc-1 with NAT gateways in the given zones.
+func newTestProvider(m *mockEC2, zones ...string) *AWSProvider {
+	return &AWSProvider{
+		clusterID:          "cluster",
+		controllerID:       "controller",
+		clusterIDTagPrefix: clusterIDTagPrefix,
+		vpcID:              "vpc-1",
+		natCidrBlocks:      []string{"172.31.64.0/28", "172.31.64.16/28"}[:len(zones)],
+		availabilityZones:  zones,
+		ec2:                m,
+		operations:         newOperationStore(),
+		logger:             log.WithFields(log.Fields{"provider": ProviderName}),
+	}
+}
+
+// newTestStack returns the CloudFormation stack of the provider routing the
+// state via its NAT gateways. The default route tables are rtb-1 in
+// eu-central-1a and rtb-2 in eu-central-1b.
+func newTestStack(p *AWSProvider, state *provider.DesiredState) *mockCloudformation {
+	m := p.ec2.(*mockEC2)
+	m.describeInternetGatewaysOutput = &ec2.DescribeInternetGatewaysOutput{
+		InternetGateways: []ec2types.InternetGateway{{InternetGatewayId: aws.String("igw-1")}},
+	}
+	m.describeRouteTables = &ec2.DescribeRouteTablesOutput{
+		RouteTables: []ec2types.RouteTable{
+			{
+				RouteTableId: aws.String("rtb-1"),
+				Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+			},
+			{
+				RouteTableId: aws.String("rtb-2"),
+				Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1b")}},
+			},
+		},
+	}
+
+	var params []string
+	var parameters []cftypes.Parameter
+	zones := make(map[string]int)
+	for i := range p.availabilityZones {
+		param := fmt.Sprintf("AZ%dRouteTableIDParameter", i+1)
+		params = append(params, param)
+		parameters = append(parameters, cfParam(param, fmt.Sprintf("rtb-%d", i+1)))
+		zones[param] = i
+	}
+
+	cf := &mockCloudformation{
+		stack: cftypes.Stack{
+			StackName:   aws.String("stack"),
+			StackStatus: cftypes.StackStatusCreateComplete,
+			Tags: []cftypes.Tag{
+				{Key: aws.String(clusterIDTagPrefix + "cluster"), Value: aws.String(resourceLifecycleOwned)},
+				{Key: aws.String(kubernetesApplicationTagKey), Value: aws.String("controller")},
+			},
+			Parameters: parameters,
+		},
+		templateBody: p.generateTemplate(state, params, zones, nil),
+	}
+	p.cloudformation = cf
+	return cf
+}
+
+// requireStackUnchanged requires a further sync of the state not to update
+// the stack. The template body is changed without changing the template to
+// make sure templates are compared by content.
+func requireStackUnchanged(t *testing.T, p *AWSProvider, cf *mockCloudformation, state *provider.DesiredState) {
+	t.Helper()
+	cf.templateBody, cf.parameters = cf.templateBody+" ", nil
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.Nil(t, cf.parameters)
+}
+
+func resourceNames(template stackTemplate) []string {
+	var names []string
+	for name := range template.Resources {
+		names = append(names, name)
+	}
+	return names
+}
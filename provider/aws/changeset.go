@@ -0,0 +1,368 @@
+package aws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+const (
+	// changeSetPrefix prefixes the names of the change sets created by the
+	// controller, followed by a hash of the update.
+	changeSetPrefix          = "egress-"
+	maxChangeSetWaitTimeout  = 5 * time.Minute
+	changeSetStatusPending   = "pending_approval"
+	changeSetStatusApproved  = "approved"
+	changeSetStatusExecuted  = "executed"
+	changeSetNoChangesReason = "didn't contain changes"
+	changeSetNoUpdatesReason = "No updates are to be performed"
+)
+
+var errChangeSetTimeoutExceeded = provider.NewError(provider.ErrorClassRetryable, fmt.Errorf("wait for change set timeout exceeded"))
+
+// DefaultProtectedResourceTypes are the resource types whose replacement or
+// deletion requires approval. Replacing them changes the egress IPs.
+var DefaultProtectedResourceTypes = []string{"AWS::EC2::NatGateway", "AWS::EC2::EIP"}
+
+// ChangeSetConfig configures updating the stacks via change sets. Change
+// sets replacing or deleting protected resources are only executed once
+// approved.
+type ChangeSetConfig struct {
+	Enabled bool
+	// ProtectedTypes are the resource types whose replacement or deletion
+	// requires approval.
+	ProtectedTypes []string
+}
+
+// ChangeSet summarizes a change set of a stack.
+type ChangeSet struct {
+	Stack   string            `json:"stack"`
+	Name    string            `json:"name"`
+	Status  string            `json:"status"`
+	Changes []ChangeSetChange `json:"changes"`
+	Created time.Time         `json:"created"`
+}
+
+// ChangeSetChange is a change of a resource by a change set.
+type ChangeSetChange struct {
+	Action      string `json:"action"`
+	LogicalID   string `json:"logicalId"`
+	Type        string `json:"type"`
+	Replacement string `json:"replacement,omitempty"`
+	// Protected is true if the change replaces or deletes a protected
+	// resource.
+	Protected bool `json:"protected,omitempty"`
+}
+
+func (c ChangeSetChange) String() string {
+	if c.Replacement != "" {
+		return fmt.Sprintf("%s %s (%s, replacement: %s)", c.Action, c.LogicalID, c.Type, c.Replacement)
+	}
+	return fmt.Sprintf("%s %s (%s)", c.Action, c.LogicalID, c.Type)
+}
+
+// protected returns the logical IDs of the protected resources replaced or
+// deleted by the change set.
+func (c *ChangeSet) protected() []string {
+	var ids []string
+	for _, change := range c.Changes {
+		if change.Protected {
+			ids = append(ids, change.LogicalID)
+		}
+	}
+	return ids
+}
+
+// changeSetStore keeps the last change set of every stack.
+type changeSetStore struct {
+	sync.Mutex
+	changeSets map[string]*ChangeSet
+}
+
+func newChangeSetStore() *changeSetStore {
+	return &changeSetStore{
+		changeSets: make(map[string]*ChangeSet),
+	}
+}
+
+// set records the change set as the last one of its stack.
+func (s *changeSetStore) set(changeSet *ChangeSet) {
+	s.Lock()
+	defer s.Unlock()
+	s.changeSets[changeSet.Stack] = changeSet
+}
+
+// approved returns true if the change set was approved.
+func (s *changeSetStore) approved(stack, name string) bool {
+	s.Lock()
+	defer s.Unlock()
+	changeSet, ok := s.changeSets[stack]
+	return ok && changeSet.Name == name && changeSet.Status == changeSetStatusApproved
+}
+
+// approve approves the change set waiting for approval with the name.
+func (s *changeSetStore) approve(name string) (ChangeSet, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, changeSet := range s.changeSets {
+		if changeSet.Name == name && changeSet.Status == changeSetStatusPending {
+			changeSet.Status = changeSetStatusApproved
+			return *changeSet, true
+		}
+	}
+	return ChangeSet{}, false
+}
+
+// list returns the last change sets sorted by stack.
+func (s *changeSetStore) list() []ChangeSet {
+	s.Lock()
+	defer s.Unlock()
+	changeSets := make([]ChangeSet, 0, len(s.changeSets))
+	for _, changeSet := range s.changeSets {
+		changeSets = append(changeSets, *changeSet)
+	}
+	sort.Slice(changeSets, func(i, j int) bool {
+		return changeSets[i].Stack < changeSets[j].Stack
+	})
+	return changeSets
+}
+
+// changeSetName returns the name of the change set of the update. It's
+// derived from the template, parameters and tags, so an unchanged update
+// reuses the change set and its approval, while a changed one requires a
+// new approval.
+func changeSetName(spec *stackSpec, params *cloudformation.UpdateStackInput) string {
+	// parameters and tags are hashed sorted, as they are generated from
+	// maps
+	var fields []string
+	for _, param := range params.Parameters {
+		fields = append(fields, fmt.Sprintf("%s=%s", aws.ToString(param.ParameterKey), aws.ToString(param.ParameterValue)))
+	}
+	for _, tag := range params.Tags {
+		fields = append(fields, fmt.Sprintf("%s:%s", aws.ToString(tag.Key), aws.ToString(tag.Value)))
+	}
+	sort.Strings(fields)
+
+	h := sha256.New()
+	h.Write([]byte(spec.template))
+	for _, field := range fields {
+		fmt.Fprintf(h, "\x00%s", field)
+	}
+	return changeSetPrefix + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// changeSetInProgress returns true if CloudFormation is still computing
+// the changes of the change set.
+func changeSetInProgress(status cftypes.ChangeSetStatus) bool {
+	return status == cftypes.ChangeSetStatusCreatePending || status == cftypes.ChangeSetStatusCreateInProgress
+}
+
+// updateCFStackWithChangeSet updates the stack by a change set. Change sets
+// aren't waited for, once created the operation is awaited like stack
+// operations and the change set is executed by a later sync. Change sets
+// replacing or deleting protected resources are kept until approved.
+func (p *AWSProvider) updateCFStackWithChangeSet(ctx context.Context, spec *stackSpec, params *cloudformation.UpdateStackInput) error {
+	name := changeSetName(spec, params)
+	output, err := p.describeChangeSet(ctx, spec.name, name)
+	if err != nil {
+		return err
+	}
+
+	if output == nil || (output.Status != cftypes.ChangeSetStatusFailed && output.ExecutionStatus != cftypes.ExecutionStatusAvailable && !changeSetInProgress(output.Status)) {
+		if output != nil {
+			err = p.deleteChangeSet(ctx, spec.name, name)
+			if err != nil {
+				return err
+			}
+		}
+		output, err = p.createChangeSet(ctx, name, params)
+		if err != nil {
+			return err
+		}
+	}
+
+	if output == nil || changeSetInProgress(output.Status) {
+		// the change set is executed by a later sync once created
+		p.startChangeSetOperation(spec.name, name)
+		return nil
+	}
+
+	if output.Status == cftypes.ChangeSetStatusFailed {
+		// failed change sets are deleted, so they are created again
+		// by the next update
+		err = p.deleteChangeSet(ctx, spec.name, name)
+		if err != nil {
+			return err
+		}
+		reason := aws.ToString(output.StatusReason)
+		if strings.Contains(reason, changeSetNoChangesReason) || strings.Contains(reason, changeSetNoUpdatesReason) {
+			p.logger.Debugf("Change set %s of stack %s contains no changes", name, spec.name)
+			return nil
+		}
+		return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("change set %s of stack %s failed: %s", name, spec.name, reason))
+	}
+
+	changeSet := p.summarizeChangeSet(spec.name, output)
+	for _, change := range changeSet.Changes {
+		p.logger.Infof("Change set %s of stack %s: %s", name, spec.name, change)
+	}
+
+	if protected := changeSet.protected(); len(protected) > 0 && !p.changeSets.approved(spec.name, name) {
+		changeSet.Status = changeSetStatusPending
+		p.changeSets.set(changeSet)
+		return provider.NewError(provider.ErrorClassRetryable, fmt.Errorf("change set %s of stack %s replaces or deletes protected resources %s, waiting for approval", name, spec.name, strings.Join(protected, ", ")))
+	}
+
+	_, err = p.cloudformation.ExecuteChangeSet(ctx, &cloudformation.ExecuteChangeSetInput{
+		StackName:     aws.String(spec.name),
+		ChangeSetName: aws.String(name),
+	})
+	if err != nil {
+		return err
+	}
+	changeSet.Status = changeSetStatusExecuted
+	p.changeSets.set(changeSet)
+	p.startOperation(spec.name, "", operationUpdate)
+	return nil
+}
+
+// createChangeSet creates the change set of the update and returns it as
+// created so far, computing the changes isn't waited for.
+func (p *AWSProvider) createChangeSet(ctx context.Context, name string, params *cloudformation.UpdateStackInput) (*cloudformation.DescribeChangeSetOutput, error) {
+	_, err := p.cloudformation.CreateChangeSet(ctx, &cloudformation.CreateChangeSetInput{
+		StackName:     params.StackName,
+		ChangeSetName: aws.String(name),
+		ChangeSetType: cftypes.ChangeSetTypeUpdate,
+		Parameters:    params.Parameters,
+		Tags:          params.Tags,
+		TemplateBody:  params.TemplateBody,
+		TemplateURL:   params.TemplateURL,
+	})
+	if err != nil {
+		if isDoesNotExistsErr(err) {
+			return nil, provider.NewDoesNotExistError(fmt.Sprintf("Stack '%s' does not exist", aws.ToString(params.StackName)))
+		}
+		return nil, err
+	}
+	return p.describeChangeSet(ctx, aws.ToString(params.StackName), name)
+}
+
+// describeChangeSet returns the change set with all its changes, or nil if
+// it doesn't exist.
+func (p *AWSProvider) describeChangeSet(ctx context.Context, stackName, name string) (*cloudformation.DescribeChangeSetOutput, error) {
+	params := &cloudformation.DescribeChangeSetInput{
+		StackName:     aws.String(stackName),
+		ChangeSetName: aws.String(name),
+	}
+
+	var changeSet *cloudformation.DescribeChangeSetOutput
+	for {
+		output, err := p.cloudformation.DescribeChangeSet(ctx, params)
+		if err != nil {
+			var notFound *cftypes.ChangeSetNotFoundException
+			if errors.As(err, &notFound) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		if changeSet == nil {
+			changeSet = output
+		} else {
+			changeSet.Changes = append(changeSet.Changes, output.Changes...)
+		}
+		if output.NextToken == nil {
+			return changeSet, nil
+		}
+		params.NextToken = output.NextToken
+	}
+}
+
+func (p *AWSProvider) deleteChangeSet(ctx context.Context, stackName, name string) error {
+	_, err := p.cloudformation.DeleteChangeSet(ctx, &cloudformation.DeleteChangeSetInput{
+		StackName:     aws.String(stackName),
+		ChangeSetName: aws.String(name),
+	})
+	return err
+}
+
+// summarizeChangeSet summarizes the resource changes of the change set and
+// marks replacements and deletions of protected resources.
+func (p *AWSProvider) summarizeChangeSet(stackName string, output *cloudformation.DescribeChangeSetOutput) *ChangeSet {
+	changeSet := &ChangeSet{
+		Stack:   stackName,
+		Name:    aws.ToString(output.ChangeSetName),
+		Changes: make([]ChangeSetChange, 0, len(output.Changes)),
+		Created: aws.ToTime(output.CreationTime),
+	}
+	for _, c := range output.Changes {
+		if c.ResourceChange == nil {
+			continue
+		}
+		change := ChangeSetChange{
+			Action:      string(c.ResourceChange.Action),
+			LogicalID:   aws.ToString(c.ResourceChange.LogicalResourceId),
+			Type:        aws.ToString(c.ResourceChange.ResourceType),
+			Replacement: string(c.ResourceChange.Replacement),
+		}
+		replaced := c.ResourceChange.Replacement == cftypes.ReplacementTrue || c.ResourceChange.Replacement == cftypes.ReplacementConditional
+		deleted := c.ResourceChange.Action == cftypes.ChangeActionRemove
+		change.Protected = (replaced || deleted) && slices.Contains(p.changeSet.ProtectedTypes, change.Type)
+		changeSet.Changes = append(changeSet.Changes, change)
+	}
+	return changeSet
+}
+
+// RegisterHandlers registers the read-only endpoints of the AWS provider:
+//
+//	GET  /provider/aws/changesets  last change set of every stack
+func (p *AWSProvider) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /provider/aws/changesets", p.handleChangeSets)
+}
+
+// RegisterApprovalHandlers registers the endpoints approving changes of the
+// AWS provider:
+//
+//	POST /provider/aws/changesets/{name}/approve  approve a change set waiting for approval
+func (p *AWSProvider) RegisterApprovalHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("POST /provider/aws/changesets/{name}/approve", p.handleApproveChangeSet)
+}
+
+func (p *AWSProvider) handleChangeSets(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, p.changeSets.list())
+}
+
+func (p *AWSProvider) handleApproveChangeSet(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	changeSet, ok := p.changeSets.approve(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no change set %s waiting for approval", name), http.StatusNotFound)
+		return
+	}
+	p.logger.Infof("Approved change set %s of stack %s", name, changeSet.Stack)
+	writeJSON(w, http.StatusOK, changeSet)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Errorf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+type mockChangeSet struct {
+	input  *cloudformation.CreateChangeSetInput
+	output *cloudformation.DescribeChangeSetOutput
+	// created is the change set once completeChangeSets computed its
+	// changes.
+	created *cloudformation.DescribeChangeSetOutput
+}
+
+// completeChangeSets completes the creation of the change sets created
+// with creatingChangeSets.
+func (cf *mockStacks) completeChangeSets() {
+	for _, changeSet := range cf.changeSets {
+		if changeSet.created != nil {
+			changeSet.output, changeSet.created = changeSet.created, nil
+		}
+	}
+}
+
+func (cf *mockStacks) CreateChangeSet(_ context.Context, input *cloudformation.CreateChangeSetInput, _ ...func(*cloudformation.Options)) (*cloudformation.CreateChangeSetOutput, error) {
+	stackName := aws.ToString(input.StackName)
+	output := &cloudformation.DescribeChangeSetOutput{
+		StackName:       input.StackName,
+		ChangeSetName:   input.ChangeSetName,
+		Status:          cftypes.ChangeSetStatusCreateComplete,
+		ExecutionStatus: cftypes.ExecutionStatusAvailable,
+		Changes:         cf.changes,
+	}
+	if cf.templates[stackName] == aws.ToString(input.TemplateBody) {
+		output.Status = cftypes.ChangeSetStatusFailed
+		output.ExecutionStatus = cftypes.ExecutionStatusUnavailable
+		output.StatusReason = aws.String("The submitted information didn't contain changes. Submit different information to create a change set.")
+		output.Changes = nil
+	}
+	changeSet := &mockChangeSet{input: input, output: output}
+	if cf.creatingChangeSets {
+		changeSet.created = output
+		changeSet.output = &cloudformation.DescribeChangeSetOutput{
+			StackName:       input.StackName,
+			ChangeSetName:   input.ChangeSetName,
+			Status:          cftypes.ChangeSetStatusCreateInProgress,
+			ExecutionStatus: cftypes.ExecutionStatusUnavailable,
+		}
+	}
+	cf.changeSets[stackName+"/"+aws.ToString(input.ChangeSetName)] = changeSet
+	return &cloudformation.CreateChangeSetOutput{}, nil
+}
+
+func (cf *mockStacks) DescribeChangeSet(_ context.Context, input *cloudformation.DescribeChangeSetInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeChangeSetOutput, error) {
+	changeSet, ok := cf.changeSets[aws.ToString(input.StackName)+"/"+aws.ToString(input.ChangeSetName)]
+	if !ok {
+		return nil, &cftypes.ChangeSetNotFoundException{}
+	}
+	return changeSet.output, nil
+}
+
+func (cf *mockStacks) ExecuteChangeSet(ctx context.Context, input *cloudformation.ExecuteChangeSetInput, _ ...func(*cloudformation.Options)) (*cloudformation.ExecuteChangeSetOutput, error) {
+	changeSet := cf.changeSets[aws.ToString(input.StackName)+"/"+aws.ToString(input.ChangeSetName)].input
+	_, err := cf.UpdateStack(ctx, &cloudformation.UpdateStackInput{
+		StackName:    changeSet.StackName,
+		Parameters:   changeSet.Parameters,
+		Tags:         changeSet.Tags,
+		TemplateBody: changeSet.TemplateBody,
+	})
+	// executing a change set deletes all change sets of the stack
+	clear(cf.changeSets)
+	return &cloudformation.ExecuteChangeSetOutput{}, err
+}
+
+func (cf *mockStacks) DeleteChangeSet(_ context.Context, input *cloudformation.DeleteChangeSetInput, _ ...func(*cloudformation.Options)) (*cloudformation.DeleteChangeSetOutput, error) {
+	delete(cf.changeSets, aws.ToString(input.StackName)+"/"+aws.ToString(input.ChangeSetName))
+	return &cloudformation.DeleteChangeSetOutput{}, nil
+}
+
+func resourceChange(action cftypes.ChangeAction, logicalID, resourceType string, replacement cftypes.Replacement) cftypes.Change {
+	return cftypes.Change{
+		Type: cftypes.ChangeTypeResource,
+		ResourceChange: &cftypes.ResourceChange{
+			Action:            action,
+			LogicalResourceId: aws.String(logicalID),
+			ResourceType:      aws.String(resourceType),
+			Replacement:       replacement,
+		},
+	}
+}
+
+func TestSummarizeChangeSet(tt *testing.T) {
+	p := &AWSProvider{changeSet: ChangeSetConfig{Enabled: true, ProtectedTypes: DefaultProtectedResourceTypes}}
+	for _, tc := range []struct {
+		msg       string
+		change    cftypes.Change
+		protected bool
+	}{
+		{
+			msg:    "added routes should not be protected",
+			change: resourceChange(cftypes.ChangeActionAdd, "RouteToNAT1z1x0x0x0y24", "AWS::EC2::Route", ""),
+		},
+		{
+			msg:    "removed routes should not be protected",
+			change: resourceChange(cftypes.ChangeActionRemove, "RouteToNAT1z1x0x0x0y24", "AWS::EC2::Route", ""),
+		},
+		{
+			msg:    "modified NAT gateways should not be protected",
+			change: resourceChange(cftypes.ChangeActionModify, "NATGateway1", "AWS::EC2::NatGateway", cftypes.ReplacementFalse),
+		},
+		{
+			msg:       "replaced NAT gateways should be protected",
+			change:    resourceChange(cftypes.ChangeActionModify, "NATGateway1", "AWS::EC2::NatGateway", cftypes.ReplacementTrue),
+			protected: true,
+		},
+		{
+			msg:       "conditionally replaced EIPs should be protected",
+			change:    resourceChange(cftypes.ChangeActionModify, "EIP1", "AWS::EC2::EIP", cftypes.ReplacementConditional),
+			protected: true,
+		},
+		{
+			msg:       "removed EIPs should be protected",
+			change:    resourceChange(cftypes.ChangeActionRemove, "EIP1", "AWS::EC2::EIP", ""),
+			protected: true,
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			changeSet := p.summarizeChangeSet("stack", &cloudformation.DescribeChangeSetOutput{
+				ChangeSetName: aws.String("egress-1"),
+				Changes:       []cftypes.Change{tc.change},
+			})
+			require.Len(t, changeSet.Changes, 1)
+			require.Equal(t, tc.protected, changeSet.Changes[0].Protected)
+		})
+	}
+}
+
+func TestEnsureChangeSets(t *testing.T) {
+	resource := provider.Resource{Name: "a", Namespace: "x"}
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.0/24")},
+	})
+
+	cf := newMockStacks()
+	p := &AWSProvider{
+		clusterID:          "cluster",
+		controllerID:       "controller",
+		clusterIDTagPrefix: clusterIDTagPrefix,
+		vpcID:              "vpc-1",
+		natCidrBlocks:      []string{"172.31.64.0/28"},
+		availabilityZones:  []string{"eu-central-1a"},
+		cloudformation:     cf,
+		operations:         newOperationStore(),
+		ec2: &mockEC2{
+			describeInternetGatewaysOutput: &ec2.DescribeInternetGatewaysOutput{
+				InternetGateways: []ec2types.InternetGateway{{InternetGatewayId: aws.String("igw-1")}},
+			},
+			describeRouteTables: &ec2.DescribeRouteTablesOutput{
+				RouteTables: []ec2types.RouteTable{
+					{
+						RouteTableId: aws.String("rtb-1"),
+						Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+					},
+				},
+			},
+		},
+		changeSet:  ChangeSetConfig{Enabled: true, ProtectedTypes: DefaultProtectedResourceTypes},
+		changeSets: newChangeSetStore(),
+		logger:     log.WithFields(log.Fields{"provider": ProviderName}),
+	}
+	mux := http.NewServeMux()
+	p.RegisterHandlers(mux)
+	approvalMux := http.NewServeMux()
+	p.RegisterApprovalHandlers(approvalMux)
+	changeSets := func() []ChangeSet {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/provider/aws/changesets", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var changeSets []ChangeSet
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&changeSets))
+		return changeSets
+	}
+	approve := func(name string) int {
+		rec := httptest.NewRecorder()
+		approvalMux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/provider/aws/changesets/"+name+"/approve", nil))
+		return rec.Code
+	}
+
+	require.NoError(t, p.Ensure(t.Context(), state))
+	egressStack, err := p.getEgressStack(t.Context())
+	require.NoError(t, err)
+	stackName := aws.ToString(egressStack.StackName)
+	require.Empty(t, changeSets())
+
+	// safe change sets are executed
+	cf.changes = []cftypes.Change{resourceChange(cftypes.ChangeActionAdd, "RouteToNAT1z2x0x0x0y24", "AWS::EC2::Route", "")}
+	changed := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.0/24"), netip.MustParsePrefix("2.0.0.0/24")},
+	})
+	require.NoError(t, p.Ensure(t.Context(), changed))
+	require.Equal(t, 1, cf.updates[stackName])
+	require.Contains(t, getCIDRsFromTemplate(cf.templates[stackName]), "2.0.0.0/24")
+	require.Empty(t, cf.changeSets)
+	executed := changeSets()
+	require.Len(t, executed, 1)
+	require.Equal(t, changeSetStatusExecuted, executed[0].Status)
+	require.Equal(t, []ChangeSetChange{{Action: "Add", LogicalID: "RouteToNAT1z2x0x0x0y24", Type: "AWS::EC2::Route"}}, executed[0].Changes)
+
+	// change sets replacing protected resources wait for approval
+	cf.changes = []cftypes.Change{
+		resourceChange(cftypes.ChangeActionModify, "NATGateway1", "AWS::EC2::NatGateway", cftypes.ReplacementTrue),
+		resourceChange(cftypes.ChangeActionRemove, "RouteToNAT1z2x0x0x0y24", "AWS::EC2::Route", ""),
+	}
+	err = p.Ensure(t.Context(), state)
+	require.ErrorContains(t, err, "replaces or deletes protected resources NATGateway1, waiting for approval")
+	require.Equal(t, provider.ErrorClassRetryable, provider.ClassOf(err))
+	require.Equal(t, 1, cf.updates[stackName])
+	pending := changeSets()
+	require.Len(t, pending, 1)
+	require.Equal(t, changeSetStatusPending, pending[0].Status)
+	require.True(t, pending[0].Changes[0].Protected)
+
+	// change sets can't be approved via the read-only endpoints
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/provider/aws/changesets/"+pending[0].Name+"/approve", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// only pending change sets can be approved
+	require.Equal(t, http.StatusNotFound, approve(executed[0].Name))
+	require.Equal(t, http.StatusOK, approve(pending[0].Name))
+	require.Equal(t, http.StatusNotFound, approve(pending[0].Name))
+
+	// approvals are lost by a restart, the change set is reused but waits
+	// for approval again
+	p.changeSets = newChangeSetStore()
+	err = p.Ensure(t.Context(), state)
+	require.ErrorContains(t, err, "waiting for approval")
+	require.Equal(t, 1, cf.updates[stackName])
+	require.Equal(t, pending[0].Name, changeSets()[0].Name)
+	require.Equal(t, http.StatusOK, approve(pending[0].Name))
+
+	// approved change sets are executed by the next sync
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.Equal(t, 2, cf.updates[stackName])
+	require.NotContains(t, getCIDRsFromTemplate(cf.templates[stackName]), "2.0.0.0/24")
+	require.Equal(t, changeSetStatusExecuted, changeSets()[0].Status)
+
+	// change sets without changes are deleted
+	current := parseStackTemplate(cf.templates[stackName])
+	spec, err := p.generateStackSpec(t.Context(), state, &current)
+	require.NoError(t, err)
+	spec.name = stackName
+	require.NoError(t, p.updateCFStack(t.Context(), spec))
+	require.Equal(t, 2, cf.updates[stackName])
+	require.Empty(t, cf.changeSets)
+}
+
+func TestEnsureChangeSetsInProgress(t *testing.T) {
+	resource := provider.Resource{Name: "a", Namespace: "x"}
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.0/24")},
+	})
+	changed := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.0/24"), netip.MustParsePrefix("2.0.0.0/24")},
+	})
+
+	cf := newMockStacks()
+	p := newTestProvider(&mockEC2{
+		describeInternetGatewaysOutput: &ec2.DescribeInternetGatewaysOutput{
+			InternetGateways: []ec2types.InternetGateway{{InternetGatewayId: aws.String("igw-1")}},
+		},
+		describeRouteTables: &ec2.DescribeRouteTablesOutput{
+			RouteTables: []ec2types.RouteTable{
+				{
+					RouteTableId: aws.String("rtb-1"),
+					Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+				},
+			},
+		},
+	}, "eu-central-1a")
+	p.cloudformation = cf
+	p.changeSet = ChangeSetConfig{Enabled: true, ProtectedTypes: DefaultProtectedResourceTypes}
+	p.changeSets = newChangeSetStore()
+
+	require.NoError(t, p.Ensure(t.Context(), state))
+	egressStack, err := p.getEgressStack(t.Context())
+	require.NoError(t, err)
+	stackName := aws.ToString(egressStack.StackName)
+
+	// creating the change set isn't waited for
+	cf.creatingChangeSets = true
+	cf.changes = []cftypes.Change{resourceChange(cftypes.ChangeActionAdd, "RouteToNAT1z2x0x0x0y24", "AWS::EC2::Route", "")}
+	err = p.Ensure(t.Context(), changed)
+	require.ErrorContains(t, err, "waiting for create change set")
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	require.Len(t, cf.changeSets, 1)
+	require.Zero(t, cf.updates[stackName])
+
+	err = p.Ensure(t.Context(), changed)
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	require.Len(t, cf.changeSets, 1)
+
+	// the created change set is executed by the next sync
+	cf.completeChangeSets()
+	require.NoError(t, p.Ensure(t.Context(), changed))
+	require.Equal(t, 1, cf.updates[stackName])
+	require.Contains(t, getCIDRsFromTemplate(cf.templates[stackName]), "2.0.0.0/24")
+	require.Empty(t, p.operations.list())
+
+	// change sets taking too long to create are deleted and created again
+	cf.changes = []cftypes.Change{resourceChange(cftypes.ChangeActionRemove, "RouteToNAT1z2x0x0x0y24", "AWS::EC2::Route", "")}
+	err = p.Ensure(t.Context(), state)
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	p.operations.list()[0].started = time.Now().Add(-maxChangeSetWaitTimeout - time.Minute)
+	err = p.Ensure(t.Context(), state)
+	require.ErrorContains(t, err, "wait for change set timeout exceeded")
+	require.Equal(t, provider.ErrorClassRetryable, provider.ClassOf(err))
+	require.Empty(t, cf.changeSets)
+	require.Empty(t, p.operations.list())
+
+	err = p.Ensure(t.Context(), state)
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	cf.completeChangeSets()
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.Equal(t, 2, cf.updates[stackName])
+	require.NotContains(t, getCIDRsFromTemplate(cf.templates[stackName]), "2.0.0.0/24")
+}
@@ -0,0 +1,322 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	cft "github.com/crewjam/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+// eipStackPolicy denies updates replacing the EIPs created by the egress
+// stack, which would release allow-listed egress IPs.
+const eipStackPolicy = `{"Statement":[{"Effect":"Allow","Action":"Update:*","Principal":"*","Resource":"*"},{"Effect":"Deny","Action":"Update:Replace","Principal":"*","Resource":"LogicalResourceId/EIP*"}]}`
+
+// EgressIPConfig configures the Elastic IPs of the NAT gateways. By default
+// the egress stack creates an EIP per availability zone, which is retained
+// when the stack is deleted and adopted by the next stack.
+type EgressIPConfig struct {
+	// AllocationIDs are the allocation IDs of pre-allocated EIPs used by
+	// the NAT gateways, one per availability zone in the same order.
+	AllocationIDs []string
+	// PublicIPv4Pools are BYOIP pools the EIPs are allocated from, either
+	// one for all availability zones or one per zone.
+	PublicIPv4Pools []string
+}
+
+// validate checks the number of allocation IDs and pools against the number
+// of availability zones.
+func (c EgressIPConfig) validate(zones int) error {
+	switch {
+	case len(c.AllocationIDs) > 0 && len(c.PublicIPv4Pools) > 0:
+		return fmt.Errorf("EIP allocation IDs and public IPv4 pools are mutually exclusive")
+	case len(c.AllocationIDs) > 0 && len(c.AllocationIDs) != zones:
+		return fmt.Errorf("expected %d EIP allocation IDs, one per availability zone, got %d", zones, len(c.AllocationIDs))
+	case len(c.PublicIPv4Pools) > 1 && len(c.PublicIPv4Pools) != zones:
+		return fmt.Errorf("expected one public IPv4 pool or %d, one per availability zone, got %d", zones, len(c.PublicIPv4Pools))
+	}
+	return nil
+}
+
+// publicIPv4Pool returns the pool EIPs of the zone are allocated from.
+func (c EgressIPConfig) publicIPv4Pool(zoneIndex int) string {
+	switch len(c.PublicIPv4Pools) {
+	case 0:
+		return ""
+	case 1:
+		return c.PublicIPv4Pools[0]
+	}
+	return c.PublicIPv4Pools[zoneIndex]
+}
+
+// eipResource is an AWS::EC2::EIP including the properties not supported by
+// cft.EC2EIP.
+type eipResource struct {
+	Domain         *cft.StringExpr `json:"Domain,omitempty"`
+	PublicIpv4Pool *cft.StringExpr `json:"PublicIpv4Pool,omitempty"`
+	Tags           *cft.TagList    `json:"Tags,omitempty"`
+}
+
+func (eipResource) CfnResourceType() string {
+	return "AWS::EC2::EIP"
+}
+
+// egressIP is the EIP of the NAT gateway of an availability zone. EIPs
+// without allocation ID are created by the egress stack.
+type egressIP struct {
+	allocationID string
+	publicIP     string
+}
+
+// eipTags returns the tags of the EIP created for the availability zone.
+// They identify the EIP as owned by the controller, so it can be adopted
+// after it was retained.
+func (p *AWSProvider) eipTags(zone string) *cft.TagList {
+	return &cft.TagList{
+		{Key: cft.String(p.clusterIDTagPrefix + p.clusterID), Value: cft.String(resourceLifecycleOwned)},
+		{Key: cft.String(kubernetesApplicationTagKey), Value: cft.String(p.controllerID)},
+		{Key: cft.String(tagDefaultAZKeyRouteTableID), Value: cft.String(zone)},
+	}
+}
+
+// ownerFilters returns the filters matching the EC2 resources owned by the
+// controller, either tagged explicitly or by the stack tags propagated by
+// CloudFormation.
+func (p *AWSProvider) ownerFilters() []ec2types.Filter {
+	return []ec2types.Filter{
+		{
+			Name:   aws.String("tag:" + p.clusterIDTagPrefix + p.clusterID),
+			Values: []string{resourceLifecycleOwned},
+		},
+		{
+			Name:   aws.String("tag:" + kubernetesApplicationTagKey),
+			Values: []string{p.controllerID},
+		},
+	}
+}
+
+// natGatewayEIPs returns the EIPs of the NAT gateways of all availability
+// zones. Configured allocations take precedence. Otherwise the allocations
+// referenced by the current template are kept and a new stack, with current
+// being nil, adopts the EIPs retained from previous stacks. Zones without
+// an allocation get an EIP created by the stack.
+func (p *AWSProvider) natGatewayEIPs(ctx context.Context, current *stackTemplate) ([]egressIP, error) {
+	eips := make([]egressIP, len(p.availabilityZones))
+	switch {
+	case len(p.egressIPs.AllocationIDs) > 0:
+		for i, id := range p.egressIPs.AllocationIDs {
+			eips[i].allocationID = id
+			if i < len(p.eipPublicIPs) {
+				eips[i].publicIP = p.eipPublicIPs[i]
+			}
+		}
+	case current != nil:
+		for i := range eips {
+			id, ok := current.Resources[fmt.Sprintf("NATGateway%d", i+1)].Properties["AllocationId"].(string)
+			if !ok {
+				continue
+			}
+			eips[i].allocationID = id
+			eips[i].publicIP, _ = current.Outputs[fmt.Sprintf("%s%d", eipOutputPrefix, i+1)].Value.(string)
+		}
+	default:
+		retained, err := p.retainedEIPs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for i, zone := range p.availabilityZones {
+			if address, ok := retained[zone]; ok {
+				p.logger.Infof("Adopting retained EIP %s (%s) in %s", aws.ToString(address.AllocationId), aws.ToString(address.PublicIp), zone)
+				eips[i] = egressIP{allocationID: aws.ToString(address.AllocationId), publicIP: aws.ToString(address.PublicIp)}
+			}
+		}
+	}
+	return eips, nil
+}
+
+// retainedEIPs returns an unassociated EIP owned by the controller for each
+// availability zone having one. If a zone has several, the one with the
+// lowest allocation ID is returned.
+func (p *AWSProvider) retainedEIPs(ctx context.Context) (map[string]ec2types.Address, error) {
+	resp, err := p.ec2.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		Filters: p.ownerFilters(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to describe retained EIPs")
+	}
+
+	addresses := resp.Addresses
+	sort.Slice(addresses, func(i, j int) bool {
+		return aws.ToString(addresses[i].AllocationId) < aws.ToString(addresses[j].AllocationId)
+	})
+
+	retained := make(map[string]ec2types.Address)
+	for _, address := range addresses {
+		zone := findTagByKey(address.Tags, tagDefaultAZKeyRouteTableID)
+		if zone == "" || address.AssociationId != nil {
+			continue
+		}
+		if _, ok := retained[zone]; !ok {
+			retained[zone] = address
+		}
+	}
+	return retained, nil
+}
+
+// ReleaseEgressIPs releases the EIPs retained from previous egress stacks.
+// EIPs still associated, e.g. with the NAT gateways of the current stack,
+// are kept. In dry-run mode the EIPs are only logged.
+func (p *AWSProvider) ReleaseEgressIPs(ctx context.Context) ([]netip.Addr, error) {
+	resp, err := p.ec2.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		Filters: p.ownerFilters(),
+	})
+	if err != nil {
+		return nil, classifyError(errors.Wrap(err, "failed to describe retained EIPs"))
+	}
+
+	var released []netip.Addr
+	for _, address := range resp.Addresses {
+		id, publicIP := aws.ToString(address.AllocationId), aws.ToString(address.PublicIp)
+		if address.AssociationId != nil {
+			p.logger.Infof("Keeping EIP %s (%s) associated with %s", id, publicIP, aws.ToString(address.NetworkInterfaceId))
+			continue
+		}
+
+		if p.dry {
+			p.logger.Infof("%s: DRY: EIP to release: %s (%s)", p, id, publicIP)
+		} else {
+			_, err := p.ec2.ReleaseAddress(ctx, &ec2.ReleaseAddressInput{AllocationId: address.AllocationId})
+			if err != nil {
+				return released, classifyError(errors.Wrapf(err, "failed to release EIP %s (%s)", id, publicIP))
+			}
+			p.logger.Infof("Released EIP %s (%s)", id, publicIP)
+		}
+
+		if ip, err := netip.ParseAddr(publicIP); err == nil {
+			released = append(released, ip)
+		}
+	}
+	return released, nil
+}
+
+// validateEgressIPs makes sure the configured EIP allocations exist and
+// aren't associated with anything but the NAT gateways of the egress stack,
+// and that the configured public IPv4 pools exist. The public IPs of the
+// allocations are stored to be exported by the stack.
+func (p *AWSProvider) validateEgressIPs(ctx context.Context) error {
+	err := p.egressIPs.validate(len(p.availabilityZones))
+	if err != nil {
+		return provider.NewError(provider.ErrorClassPermanent, err)
+	}
+
+	if len(p.egressIPs.AllocationIDs) > 0 {
+		publicIPs, err := p.validateAllocations(ctx)
+		if err != nil {
+			return classifyError(err)
+		}
+		p.eipPublicIPs = publicIPs
+	}
+
+	if len(p.egressIPs.PublicIPv4Pools) > 0 {
+		err := p.validatePublicIPv4Pools(ctx)
+		if err != nil {
+			return classifyError(err)
+		}
+	}
+	return nil
+}
+
+// validateAllocations returns the public IPs of the configured EIP
+// allocations.
+func (p *AWSProvider) validateAllocations(ctx context.Context) ([]string, error) {
+	resp, err := p.ec2.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		AllocationIds: p.egressIPs.AllocationIDs,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to describe EIP allocations")
+	}
+
+	addresses := make(map[string]ec2types.Address, len(resp.Addresses))
+	for _, address := range resp.Addresses {
+		addresses[aws.ToString(address.AllocationId)] = address
+	}
+
+	var owned map[string]struct{}
+	publicIPs := make([]string, 0, len(p.egressIPs.AllocationIDs))
+	for _, id := range p.egressIPs.AllocationIDs {
+		address, ok := addresses[id]
+		if !ok {
+			return nil, provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("EIP allocation %s not found", id))
+		}
+
+		if address.AssociationId != nil {
+			if owned == nil {
+				owned, err = p.stackNATGatewayAllocations(ctx)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if _, ok := owned[id]; !ok {
+				return nil, provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("EIP allocation %s (%s) is already associated with %s", id, aws.ToString(address.PublicIp), aws.ToString(address.NetworkInterfaceId)))
+			}
+		}
+		publicIPs = append(publicIPs, aws.ToString(address.PublicIp))
+	}
+	return publicIPs, nil
+}
+
+// stackNATGatewayAllocations returns the allocation IDs of the EIPs of the
+// NAT gateways owned by the controller. Stack tags are propagated to the NAT
+// gateways by CloudFormation.
+func (p *AWSProvider) stackNATGatewayAllocations(ctx context.Context) (map[string]struct{}, error) {
+	resp, err := p.ec2.DescribeNatGateways(ctx, &ec2.DescribeNatGatewaysInput{
+		Filter: append(p.ownerFilters(), ec2types.Filter{
+			Name:   aws.String("state"),
+			Values: []string{string(ec2types.NatGatewayStatePending), string(ec2types.NatGatewayStateAvailable)},
+		}),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to describe NAT gateways")
+	}
+
+	allocations := make(map[string]struct{})
+	for _, natGateway := range resp.NatGateways {
+		for _, address := range natGateway.NatGatewayAddresses {
+			allocations[aws.ToString(address.AllocationId)] = struct{}{}
+		}
+	}
+	return allocations, nil
+}
+
+// validatePublicIPv4Pools makes sure the configured pools exist. Pools
+// without available addresses are only logged, as the EIPs of an existing
+// stack were already allocated from them.
+func (p *AWSProvider) validatePublicIPv4Pools(ctx context.Context) error {
+	resp, err := p.ec2.DescribePublicIpv4Pools(ctx, &ec2.DescribePublicIpv4PoolsInput{
+		PoolIds: p.egressIPs.PublicIPv4Pools,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to describe public IPv4 pools")
+	}
+
+	pools := make(map[string]ec2types.PublicIpv4Pool, len(resp.PublicIpv4Pools))
+	for _, pool := range resp.PublicIpv4Pools {
+		pools[aws.ToString(pool.PoolId)] = pool
+	}
+	for _, id := range p.egressIPs.PublicIPv4Pools {
+		pool, ok := pools[id]
+		if !ok {
+			return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("public IPv4 pool %s not found", id))
+		}
+		if aws.ToInt32(pool.TotalAvailableAddressCount) == 0 {
+			p.logger.Warnf("Public IPv4 pool %s has no available addresses", id)
+		}
+	}
+	return nil
+}
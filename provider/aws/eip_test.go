@@ -0,0 +1,339 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestValidateEgressIPs(tt *testing.T) {
+	zones := []string{"eu-central-1a", "eu-central-1b"}
+	unassociated := func(id, ip string) ec2types.Address {
+		return ec2types.Address{AllocationId: aws.String(id), PublicIp: aws.String(ip)}
+	}
+	associated := func(id, ip string) ec2types.Address {
+		address := unassociated(id, ip)
+		address.AssociationId = aws.String("eipassoc-" + id)
+		address.NetworkInterfaceId = aws.String("eni-" + id)
+		return address
+	}
+
+	for _, tc := range []struct {
+		msg       string
+		egressIPs EgressIPConfig
+		ec2       *mockEC2
+		publicIPs []string
+		err       string
+	}{
+		{
+			msg: "no configuration should create EIPs",
+			ec2: &mockEC2{},
+		},
+		{
+			msg:       "unassociated allocations should be used",
+			egressIPs: EgressIPConfig{AllocationIDs: []string{"eipalloc-1", "eipalloc-2"}},
+			ec2: &mockEC2{
+				describeAddresses: &ec2.DescribeAddressesOutput{
+					Addresses: []ec2types.Address{unassociated("eipalloc-2", "52.0.0.2"), unassociated("eipalloc-1", "52.0.0.1")},
+				},
+			},
+			publicIPs: []string{"52.0.0.1", "52.0.0.2"},
+		},
+		{
+			msg:       "allocations associated with the NAT gateways of the stack should be used",
+			egressIPs: EgressIPConfig{AllocationIDs: []string{"eipalloc-1", "eipalloc-2"}},
+			ec2: &mockEC2{
+				describeAddresses: &ec2.DescribeAddressesOutput{
+					Addresses: []ec2types.Address{associated("eipalloc-1", "52.0.0.1"), unassociated("eipalloc-2", "52.0.0.2")},
+				},
+				describeNatGateways: &ec2.DescribeNatGatewaysOutput{
+					NatGateways: []ec2types.NatGateway{
+						{NatGatewayAddresses: []ec2types.NatGatewayAddress{{AllocationId: aws.String("eipalloc-1")}}},
+					},
+				},
+			},
+			publicIPs: []string{"52.0.0.1", "52.0.0.2"},
+		},
+		{
+			msg:       "allocations associated with other resources should be rejected",
+			egressIPs: EgressIPConfig{AllocationIDs: []string{"eipalloc-1", "eipalloc-2"}},
+			ec2: &mockEC2{
+				describeAddresses: &ec2.DescribeAddressesOutput{
+					Addresses: []ec2types.Address{associated("eipalloc-1", "52.0.0.1"), unassociated("eipalloc-2", "52.0.0.2")},
+				},
+				describeNatGateways: &ec2.DescribeNatGatewaysOutput{},
+			},
+			err: "permanent: EIP allocation eipalloc-1 (52.0.0.1) is already associated with eni-eipalloc-1",
+		},
+		{
+			msg:       "missing allocations should be rejected",
+			egressIPs: EgressIPConfig{AllocationIDs: []string{"eipalloc-1", "eipalloc-2"}},
+			ec2: &mockEC2{
+				describeAddresses: &ec2.DescribeAddressesOutput{
+					Addresses: []ec2types.Address{unassociated("eipalloc-1", "52.0.0.1")},
+				},
+			},
+			err: "permanent: EIP allocation eipalloc-2 not found",
+		},
+		{
+			msg:       "an allocation per zone should be required",
+			egressIPs: EgressIPConfig{AllocationIDs: []string{"eipalloc-1"}},
+			ec2:       &mockEC2{},
+			err:       "permanent: expected 2 EIP allocation IDs, one per availability zone, got 1",
+		},
+		{
+			msg:       "allocations and pools should be mutually exclusive",
+			egressIPs: EgressIPConfig{AllocationIDs: []string{"eipalloc-1", "eipalloc-2"}, PublicIPv4Pools: []string{"ipv4pool-ec2-1"}},
+			ec2:       &mockEC2{},
+			err:       "permanent: EIP allocation IDs and public IPv4 pools are mutually exclusive",
+		},
+		{
+			msg:       "existing pools should be used",
+			egressIPs: EgressIPConfig{PublicIPv4Pools: []string{"ipv4pool-ec2-1"}},
+			ec2: &mockEC2{
+				describePublicIpv4Pools: &ec2.DescribePublicIpv4PoolsOutput{
+					PublicIpv4Pools: []ec2types.PublicIpv4Pool{{PoolId: aws.String("ipv4pool-ec2-1"), TotalAvailableAddressCount: aws.Int32(10)}},
+				},
+			},
+		},
+		{
+			msg:       "missing pools should be rejected",
+			egressIPs: EgressIPConfig{PublicIPv4Pools: []string{"ipv4pool-ec2-1", "ipv4pool-ec2-2"}},
+			ec2: &mockEC2{
+				describePublicIpv4Pools: &ec2.DescribePublicIpv4PoolsOutput{
+					PublicIpv4Pools: []ec2types.PublicIpv4Pool{{PoolId: aws.String("ipv4pool-ec2-1")}},
+				},
+			},
+			err: "permanent: public IPv4 pool ipv4pool-ec2-2 not found",
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			p := &AWSProvider{
+				clusterID:          "cluster",
+				controllerID:       "controller",
+				clusterIDTagPrefix: clusterIDTagPrefix,
+				availabilityZones:  zones,
+				egressIPs:          tc.egressIPs,
+				ec2:                tc.ec2,
+				logger:             log.WithFields(log.Fields{"provider": ProviderName}),
+			}
+			err := p.validateEgressIPs(t.Context())
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				require.Equal(t, provider.ErrorClassPermanent, provider.ClassOf(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.publicIPs, p.eipPublicIPs)
+		})
+	}
+}
+
+func TestNATGatewayEIPs(tt *testing.T) {
+	retained := func(id, ip, zone string) ec2types.Address {
+		return ec2types.Address{
+			AllocationId: aws.String(id),
+			PublicIp:     aws.String(ip),
+			Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String(zone)}},
+		}
+	}
+	created := func(i int) interface{} {
+		return map[string]interface{}{"Fn::GetAtt": []interface{}{fmt.Sprintf("EIP%d", i), "AllocationId"}}
+	}
+	ref := func(i int) interface{} {
+		return map[string]interface{}{"Ref": fmt.Sprintf("EIP%d", i)}
+	}
+
+	for _, tc := range []struct {
+		msg         string
+		egressIPs   EgressIPConfig
+		publicIPs   []string
+		addresses   []ec2types.Address
+		current     string
+		allocations []interface{}
+		pools       map[string]string
+		outputs     []interface{}
+	}{
+		{
+			msg:         "EIPs should be created by default",
+			allocations: []interface{}{created(1), created(2)},
+			pools:       map[string]string{"EIP1": "", "EIP2": ""},
+			outputs:     []interface{}{ref(1), ref(2)},
+		},
+		{
+			msg:         "EIPs should be allocated from the pool",
+			egressIPs:   EgressIPConfig{PublicIPv4Pools: []string{"ipv4pool-ec2-1"}},
+			allocations: []interface{}{created(1), created(2)},
+			pools:       map[string]string{"EIP1": "ipv4pool-ec2-1", "EIP2": "ipv4pool-ec2-1"},
+			outputs:     []interface{}{ref(1), ref(2)},
+		},
+		{
+			msg:         "pre-allocated EIPs should be referenced",
+			egressIPs:   EgressIPConfig{AllocationIDs: []string{"eipalloc-1", "eipalloc-2"}},
+			publicIPs:   []string{"52.0.0.1", "52.0.0.2"},
+			addresses:   []ec2types.Address{retained("eipalloc-3", "52.0.0.3", "eu-central-1a")},
+			allocations: []interface{}{"eipalloc-1", "eipalloc-2"},
+			pools:       map[string]string{},
+			outputs:     []interface{}{"52.0.0.1", "52.0.0.2"},
+		},
+		{
+			msg: "retained EIPs should be adopted by a new stack",
+			addresses: []ec2types.Address{
+				retained("eipalloc-3", "52.0.0.3", "eu-central-1a"),
+				retained("eipalloc-1", "52.0.0.1", "eu-central-1a"),
+				{AllocationId: aws.String("eipalloc-2"), AssociationId: aws.String("eipassoc-2"), Tags: retained("", "", "eu-central-1b").Tags},
+				{AllocationId: aws.String("eipalloc-4")},
+			},
+			allocations: []interface{}{"eipalloc-1", created(2)},
+			pools:       map[string]string{"EIP2": ""},
+			outputs:     []interface{}{"52.0.0.1", ref(2)},
+		},
+		{
+			msg:         "EIPs referenced by an existing stack should be kept",
+			addresses:   []ec2types.Address{retained("eipalloc-3", "52.0.0.3", "eu-central-1b")},
+			current:     `{"Resources":{"NATGateway1":{"Type":"AWS::EC2::NatGateway","Properties":{"AllocationId":"eipalloc-1"}},"NATGateway2":{"Type":"AWS::EC2::NatGateway","Properties":{"AllocationId":{"Fn::GetAtt":["EIP2","AllocationId"]}}}},"Outputs":{"EIP1":{"Value":"52.0.0.1"},"EIP2":{"Value":{"Ref":"EIP2"}}}}`,
+			allocations: []interface{}{"eipalloc-1", created(2)},
+			pools:       map[string]string{"EIP2": ""},
+			outputs:     []interface{}{"52.0.0.1", ref(2)},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			p := &AWSProvider{
+				clusterID:          "cluster",
+				controllerID:       "controller",
+				clusterIDTagPrefix: clusterIDTagPrefix,
+				natCidrBlocks:      []string{"172.31.64.0/28", "172.31.64.16/28"},
+				availabilityZones:  []string{"eu-central-1a", "eu-central-1b"},
+				egressIPs:          tc.egressIPs,
+				eipPublicIPs:       tc.publicIPs,
+				ec2:                &mockEC2{describeAddresses: &ec2.DescribeAddressesOutput{Addresses: tc.addresses}},
+				logger:             log.WithFields(log.Fields{"provider": ProviderName}),
+			}
+
+			var current *stackTemplate
+			if tc.current != "" {
+				template := parseStackTemplate(tc.current)
+				current = &template
+			}
+			eips, err := p.natGatewayEIPs(t.Context(), current)
+			require.NoError(t, err)
+
+			var template struct {
+				Resources map[string]struct {
+					Type           string
+					DeletionPolicy string
+					Properties     map[string]interface{}
+				}
+				Outputs map[string]struct {
+					Value interface{}
+				}
+			}
+			body := p.generateTemplate(provider.NewDesiredState(nil), nil, nil, eips)
+			require.NoError(t, json.Unmarshal([]byte(body), &template))
+
+			var allocations, outputs []interface{}
+			for i := 1; i <= 2; i++ {
+				allocations = append(allocations, template.Resources[fmt.Sprintf("NATGateway%d", i)].Properties["AllocationId"])
+				outputs = append(outputs, template.Outputs[fmt.Sprintf("EIP%d", i)].Value)
+			}
+			pools := make(map[string]string)
+			for name, r := range template.Resources {
+				if r.Type != "AWS::EC2::EIP" {
+					continue
+				}
+				require.Equal(t, "Retain", r.DeletionPolicy)
+				require.Contains(t, r.Properties["Tags"], map[string]interface{}{"Key": kubernetesApplicationTagKey, "Value": "controller"})
+				pools[name], _ = r.Properties["PublicIpv4Pool"].(string)
+			}
+			require.Equal(t, tc.allocations, allocations)
+			require.Equal(t, tc.pools, pools)
+			require.Equal(t, tc.outputs, outputs)
+		})
+	}
+}
+
+func TestEnsureAdoptsRetainedEIPs(t *testing.T) {
+	cf := &mockCloudformation{}
+	p := &AWSProvider{
+		clusterID:          "cluster",
+		controllerID:       "controller",
+		clusterIDTagPrefix: clusterIDTagPrefix,
+		vpcID:              "vpc",
+		natCidrBlocks:      []string{"172.31.64.0/28"},
+		availabilityZones:  []string{"eu-central-1a"},
+		cloudformation:     cf,
+		operations:         newOperationStore(),
+		ec2: &mockEC2{
+			describeInternetGatewaysOutput: &ec2.DescribeInternetGatewaysOutput{
+				InternetGateways: []ec2types.InternetGateway{{InternetGatewayId: aws.String("igw-1")}},
+			},
+			describeRouteTables: &ec2.DescribeRouteTablesOutput{},
+			describeAddresses: &ec2.DescribeAddressesOutput{
+				Addresses: []ec2types.Address{{
+					AllocationId: aws.String("eipalloc-1"),
+					PublicIp:     aws.String("52.0.0.1"),
+					Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+				}},
+			},
+		},
+		logger: log.WithFields(log.Fields{"provider": ProviderName}),
+	}
+
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		{Name: "a", Namespace: "x"}: {netip.MustParsePrefix("1.0.0.1/32")},
+	})
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.Equal(t, eipStackPolicy, cf.stackPolicyBody)
+
+	template := parseStackTemplate(cf.templateBody)
+	require.Equal(t, "eipalloc-1", template.Resources["NATGateway1"].Properties["AllocationId"])
+	require.NotContains(t, template.Resources, "EIP1")
+}
+
+func TestReleaseEgressIPs(tt *testing.T) {
+	addresses := []ec2types.Address{
+		{AllocationId: aws.String("eipalloc-1"), PublicIp: aws.String("52.0.0.1")},
+		{AllocationId: aws.String("eipalloc-2"), PublicIp: aws.String("52.0.0.2"), AssociationId: aws.String("eipassoc-2")},
+		{AllocationId: aws.String("eipalloc-3"), PublicIp: aws.String("52.0.0.3")},
+	}
+
+	for _, tc := range []struct {
+		msg      string
+		dry      bool
+		released []string
+	}{
+		{
+			msg:      "unassociated EIPs should be released",
+			released: []string{"eipalloc-1", "eipalloc-3"},
+		},
+		{
+			msg: "EIPs should not be released in dry-run mode",
+			dry: true,
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			ec2API := &mockEC2{describeAddresses: &ec2.DescribeAddressesOutput{Addresses: addresses}}
+			p := &AWSProvider{
+				clusterID:          "cluster",
+				controllerID:       "controller",
+				clusterIDTagPrefix: clusterIDTagPrefix,
+				dry:                tc.dry,
+				ec2:                ec2API,
+				logger:             log.WithFields(log.Fields{"provider": ProviderName}),
+			}
+
+			ips, err := p.ReleaseEgressIPs(t.Context())
+			require.NoError(t, err)
+			require.Equal(t, []netip.Addr{netip.MustParseAddr("52.0.0.1"), netip.MustParseAddr("52.0.0.3")}, ips)
+			require.Equal(t, tc.released, ec2API.released)
+		})
+	}
+}
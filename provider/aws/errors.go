@@ -0,0 +1,80 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/aws/smithy-go"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+// errorCodeClasses maps the error codes of the CloudFormation and EC2 APIs
+// to error classes.
+var errorCodeClasses = map[string]provider.ErrorClass{
+	"Throttling":                        provider.ErrorClassThrottled,
+	"ThrottlingException":               provider.ErrorClassThrottled,
+	"RequestLimitExceeded":              provider.ErrorClassThrottled,
+	"TooManyRequestsException":          provider.ErrorClassThrottled,
+	"AccessDenied":                      provider.ErrorClassBlockedByPolicy,
+	"AccessDeniedException":             provider.ErrorClassBlockedByPolicy,
+	"UnauthorizedOperation":             provider.ErrorClassBlockedByPolicy,
+	"AuthFailure":                       provider.ErrorClassBlockedByPolicy,
+	"AlreadyExistsException":            provider.ErrorClassConflict,
+	"OperationInProgressException":      provider.ErrorClassConflict,
+	"IncorrectState":                    provider.ErrorClassConflict,
+	"InsufficientCapabilities":          provider.ErrorClassPermanent,
+	"InsufficientCapabilitiesException": provider.ErrorClassPermanent,
+	"LimitExceededException":            provider.ErrorClassPermanent,
+	"AddressLimitExceeded":              provider.ErrorClassPermanent,
+	"RouteLimitExceeded":                provider.ErrorClassPermanent,
+	"InvalidParameterValue":             provider.ErrorClassPermanent,
+	"InvalidParameterCombination":       provider.ErrorClassPermanent,
+	"InternalFailure":                   provider.ErrorClassRetryable,
+	"InternalError":                     provider.ErrorClassRetryable,
+	"ServiceUnavailable":                provider.ErrorClassRetryable,
+	"Unavailable":                       provider.ErrorClassRetryable,
+	"RequestTimeout":                    provider.ErrorClassRetryable,
+}
+
+// classifyError classifies errors returned by the CloudFormation and EC2
+// APIs. Errors already classified, e.g. failed stack states, keep their
+// class.
+func classifyError(err error) error {
+	if err == nil || provider.ClassOf(err) != provider.ErrorClassUnknown {
+		return err
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		if class := apiErrorClass(apiErr); class != provider.ErrorClassUnknown {
+			return provider.NewError(class, err)
+		}
+		return err
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.As(err, &netErr) {
+		return provider.NewError(provider.ErrorClassRetryable, err)
+	}
+	return err
+}
+
+func apiErrorClass(apiErr smithy.APIError) provider.ErrorClass {
+	code := apiErr.ErrorCode()
+	if class, ok := errorCodeClasses[code]; ok {
+		return class
+	}
+
+	switch {
+	case code == "ValidationError" && strings.Contains(apiErr.ErrorMessage(), "_IN_PROGRESS state"):
+		// another operation is still running on the stack.
+		return provider.ErrorClassConflict
+	case code == "ValidationError", strings.HasPrefix(code, "Invalid"), strings.HasSuffix(code, ".NotFound"):
+		return provider.ErrorClassPermanent
+	case apiErr.ErrorFault() == smithy.FaultServer:
+		return provider.ErrorClassRetryable
+	}
+	return provider.ErrorClassUnknown
+}
@@ -0,0 +1,103 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func apiError(code, message string) error {
+	return &smithy.OperationError{
+		ServiceID:     "CloudFormation",
+		OperationName: "UpdateStack",
+		Err: &http.ResponseError{
+			ResponseError: &smithyhttp.ResponseError{
+				Err: &smithy.GenericAPIError{Code: code, Message: message},
+			},
+		},
+	}
+}
+
+func TestClassifyError(tt *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		err      error
+		expected provider.ErrorClass
+	}{
+		{
+			msg:      "throttling should be throttled",
+			err:      apiError("Throttling", "Rate exceeded"),
+			expected: provider.ErrorClassThrottled,
+		},
+		{
+			msg:      "EC2 request limits should be throttled",
+			err:      pkgerrors.Wrap(apiError("RequestLimitExceeded", "Request limit exceeded."), "failed to describe route tables"),
+			expected: provider.ErrorClassThrottled,
+		},
+		{
+			msg:      "missing permissions should be blocked by policy",
+			err:      apiError("UnauthorizedOperation", "You are not authorized to perform this operation."),
+			expected: provider.ErrorClassBlockedByPolicy,
+		},
+		{
+			msg:      "stack updates in progress should be a conflict",
+			err:      apiError("ValidationError", "Stack:arn is in UPDATE_IN_PROGRESS state and can not be updated."),
+			expected: provider.ErrorClassConflict,
+		},
+		{
+			msg:      "invalid templates should be permanent",
+			err:      apiError("ValidationError", "Template format error"),
+			expected: provider.ErrorClassPermanent,
+		},
+		{
+			msg:      "invalid EC2 IDs should be permanent",
+			err:      apiError("InvalidVpcID.NotFound", "The vpc ID 'vpc-1' does not exist"),
+			expected: provider.ErrorClassPermanent,
+		},
+		{
+			msg:      "internal failures should be retryable",
+			err:      apiError("InternalFailure", ""),
+			expected: provider.ErrorClassRetryable,
+		},
+		{
+			msg:      "timeouts should be retryable",
+			err:      pkgerrors.Wrap(context.DeadlineExceeded, "failed to create CF stack"),
+			expected: provider.ErrorClassRetryable,
+		},
+		{
+			msg:      "update rollback failed should be a partial apply",
+			err:      pkgerrors.Wrap(errUpdateRollbackFailed, "failed to update CF stack"),
+			expected: provider.ErrorClassPartialApply,
+		},
+		{
+			msg:      "rollback complete should be permanent",
+			err:      pkgerrors.Wrap(errRollbackComplete, "failed to create CF stack"),
+			expected: provider.ErrorClassPermanent,
+		},
+		{
+			msg:      "unknown API errors should stay unclassified",
+			err:      apiError("SomethingNew", ""),
+			expected: provider.ErrorClassUnknown,
+		},
+		{
+			msg:      "other errors should stay unclassified",
+			err:      errors.New("failed"),
+			expected: provider.ErrorClassUnknown,
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			err := classifyError(tc.err)
+			require.ErrorIs(t, err, tc.err)
+			require.Equal(t, tc.expected, provider.ClassOf(err))
+		})
+	}
+
+	require.NoError(tt, classifyError(nil))
+}
@@ -0,0 +1,276 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	cft "github.com/crewjam/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+// ExistingNATConfig configures NAT gateways operated outside of the
+// controller. If they are configured, the egress stack doesn't create NAT
+// gateways, subnets and EIPs but only routes the egress CIDRs to them.
+type ExistingNATConfig struct {
+	// IDs are the IDs of the NAT gateways, one per availability zone in
+	// the same order.
+	IDs []string
+	// Tags discover the NAT gateways of the VPC by their tags. Every
+	// availability zone must have exactly one available NAT gateway
+	// with all tags.
+	Tags map[string]string
+}
+
+func (c ExistingNATConfig) enabled() bool {
+	return len(c.IDs) > 0 || len(c.Tags) > 0
+}
+
+// validate checks the configuration for consistency with the number of
+// availability zones and the configurations of the other modes.
+func (c ExistingNATConfig) validate(zones int, egressIPs EgressIPConfig, transitGateway TransitGatewayConfig) error {
+	if !c.enabled() {
+		return nil
+	}
+
+	switch {
+	case len(c.IDs) > 0 && len(c.Tags) > 0:
+		return fmt.Errorf("NAT gateway IDs and tags are mutually exclusive")
+	case len(c.IDs) > 0 && len(c.IDs) != zones:
+		return fmt.Errorf("expected %d NAT gateway IDs, one per availability zone, got %d", zones, len(c.IDs))
+	case transitGateway.enabled():
+		return fmt.Errorf("existing NAT gateways and a transit gateway are mutually exclusive")
+	case len(egressIPs.AllocationIDs) > 0 || len(egressIPs.PublicIPv4Pools) > 0:
+		return fmt.Errorf("EIPs can't be configured for existing NAT gateways")
+	}
+	return nil
+}
+
+// tagFilters returns the filters matching the tags in a stable order.
+func (c ExistingNATConfig) tagFilters() []ec2types.Filter {
+	keys := make([]string, 0, len(c.Tags))
+	for key := range c.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	filters := make([]ec2types.Filter, 0, len(keys))
+	for _, key := range keys {
+		filters = append(filters, ec2types.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []string{c.Tags[key]},
+		})
+	}
+	return filters
+}
+
+func (c ExistingNATConfig) String() string {
+	if len(c.IDs) > 0 {
+		return strings.Join(c.IDs, ", ")
+	}
+
+	tags := make([]string, 0, len(c.Tags))
+	for key, value := range c.Tags {
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+	return "tagged " + strings.Join(tags, ",")
+}
+
+// existingNATGateway is the NAT gateway of an availability zone operated
+// outside of the controller.
+type existingNATGateway struct {
+	id       string
+	publicIP string
+}
+
+// validateExistingNAT makes sure the configured NAT gateways exist in the
+// VPC and the availability zones, or discovers them by their tags. The
+// NAT gateways are stored to be routed to by the stack.
+func (p *AWSProvider) validateExistingNAT(ctx context.Context) error {
+	err := p.existingNAT.validate(len(p.availabilityZones), p.egressIPs, p.transitGateway)
+	if err != nil {
+		return provider.NewError(provider.ErrorClassPermanent, err)
+	}
+	if !p.existingNAT.enabled() {
+		return nil
+	}
+
+	natGateways, err := p.findExistingNATGateways(ctx)
+	if err != nil {
+		return classifyError(err)
+	}
+	for i, natGateway := range natGateways {
+		p.logger.Infof("Routing egress traffic of %s to NAT gateway %s (%s)", p.availabilityZones[i], natGateway.id, natGateway.publicIP)
+	}
+	p.existingNATGateways = natGateways
+	return nil
+}
+
+// findExistingNATGateways returns the NAT gateways of all availability zones
+// in the same order.
+func (p *AWSProvider) findExistingNATGateways(ctx context.Context) ([]existingNATGateway, error) {
+	vpcID, err := p.findVPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &ec2.DescribeNatGatewaysInput{NatGatewayIds: p.existingNAT.IDs}
+	if len(p.existingNAT.IDs) == 0 {
+		input = &ec2.DescribeNatGatewaysInput{
+			Filter: append(p.existingNAT.tagFilters(),
+				ec2types.Filter{Name: aws.String("vpc-id"), Values: []string{vpcID}},
+				ec2types.Filter{Name: aws.String("state"), Values: []string{string(ec2types.NatGatewayStateAvailable)}},
+			),
+		}
+	}
+	resp, err := p.ec2.DescribeNatGateways(ctx, input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to describe NAT gateways %s", p.existingNAT)
+	}
+
+	zones, err := p.natGatewayZones(ctx, resp.NatGateways)
+	if err != nil {
+		return nil, err
+	}
+
+	byZone := make(map[string][]ec2types.NatGateway)
+	for _, natGateway := range resp.NatGateways {
+		zone := zones[aws.ToString(natGateway.SubnetId)]
+		byZone[zone] = append(byZone[zone], natGateway)
+	}
+
+	natGateways := make([]existingNATGateway, len(p.availabilityZones))
+	for i, zone := range p.availabilityZones {
+		var natGateway ec2types.NatGateway
+		if len(p.existingNAT.IDs) > 0 {
+			natGateway, err = findNATGateway(resp.NatGateways, p.existingNAT.IDs[i], vpcID, zone, zones)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			switch candidates := byZone[zone]; len(candidates) {
+			case 0:
+				return nil, provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("no available NAT gateway %s found in %s", p.existingNAT, zone))
+			case 1:
+				natGateway = candidates[0]
+			default:
+				ids := make([]string, 0, len(candidates))
+				for _, candidate := range candidates {
+					ids = append(ids, aws.ToString(candidate.NatGatewayId))
+				}
+				sort.Strings(ids)
+				return nil, provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("found several NAT gateways %s in %s: %s", p.existingNAT, zone, strings.Join(ids, ", ")))
+			}
+		}
+
+		natGateways[i].id = aws.ToString(natGateway.NatGatewayId)
+		for _, address := range natGateway.NatGatewayAddresses {
+			if address.PublicIp != nil {
+				natGateways[i].publicIP = aws.ToString(address.PublicIp)
+				break
+			}
+		}
+	}
+	return natGateways, nil
+}
+
+// findNATGateway returns the configured NAT gateway of the zone.
+func findNATGateway(natGateways []ec2types.NatGateway, id, vpcID, zone string, zones map[string]string) (ec2types.NatGateway, error) {
+	for _, natGateway := range natGateways {
+		if aws.ToString(natGateway.NatGatewayId) != id {
+			continue
+		}
+
+		switch {
+		case natGateway.State != ec2types.NatGatewayStateAvailable:
+			return natGateway, provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("NAT gateway %s is %s", id, natGateway.State))
+		case aws.ToString(natGateway.VpcId) != vpcID:
+			return natGateway, provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("NAT gateway %s is not in VPC %s", id, vpcID))
+		case zones[aws.ToString(natGateway.SubnetId)] != zone:
+			return natGateway, provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("NAT gateway %s is in %s instead of %s", id, zones[aws.ToString(natGateway.SubnetId)], zone))
+		}
+		return natGateway, nil
+	}
+	return ec2types.NatGateway{}, provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("NAT gateway %s not found", id))
+}
+
+// natGatewayZones returns the availability zones of the subnets of the NAT
+// gateways.
+func (p *AWSProvider) natGatewayZones(ctx context.Context, natGateways []ec2types.NatGateway) (map[string]string, error) {
+	zones := make(map[string]string, len(natGateways))
+	if len(natGateways) == 0 {
+		return zones, nil
+	}
+
+	subnetIDs := make([]string, 0, len(natGateways))
+	for _, natGateway := range natGateways {
+		subnetIDs = append(subnetIDs, aws.ToString(natGateway.SubnetId))
+	}
+	slices.Sort(subnetIDs)
+	resp, err := p.ec2.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		SubnetIds: slices.Compact(subnetIDs),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to describe subnets of NAT gateways")
+	}
+
+	for _, subnet := range resp.Subnets {
+		zones[aws.ToString(subnet.SubnetId)] = aws.ToString(subnet.AvailabilityZone)
+	}
+	return zones, nil
+}
+
+// addExistingNATGatewayRoutes adds the routes of the CIDR to the existing
+// NAT gateways of the zones of the route tables. The routes keep the names
+// of the routes to NAT gateways created by the stack, so switching modes
+// updates them in place.
+func (p *AWSProvider) addExistingNATGatewayRoutes(template *cft.Template, cidrEntry, cleanCidrEntry string, routeTableParamOrder []string, routeTableZoneIndexes map[string]int) {
+	for i, routeTableParam := range routeTableParamOrder {
+		template.AddResource(fmt.Sprintf("RouteToNAT%dz%s", i+1, cleanCidrEntry), &cft.EC2Route{
+			RouteTableID:         cft.Ref(routeTableParam).String(),
+			DestinationCidrBlock: cft.String(cidrEntry),
+			NatGatewayID:         cft.String(p.existingNATGateways[routeTableZoneIndexes[routeTableParam]].id),
+		})
+	}
+}
+
+// addExistingNATGatewayOutputs exports the public IPs of the existing NAT
+// gateways like the EIPs of the NAT gateways created by the stack.
+func (p *AWSProvider) addExistingNATGatewayOutputs(template *cft.Template) {
+	for i, natGateway := range p.existingNATGateways {
+		if natGateway.publicIP == "" {
+			continue
+		}
+		template.Outputs[fmt.Sprintf("%s%d", eipOutputPrefix, i+1)] = &cft.Output{
+			Description: fmt.Sprintf("external IP of the NAT gateway %s", natGateway.id),
+			Value:       natGateway.publicIP,
+		}
+	}
+}
+
+// existingNATGatewaysChanged returns true if the stack routes to other NAT
+// gateways than the configured existing ones.
+func (p *AWSProvider) existingNATGatewaysChanged(current stackTemplate) bool {
+	ids := make(map[string]struct{}, len(p.existingNATGateways))
+	for _, natGateway := range p.existingNATGateways {
+		ids[natGateway.id] = struct{}{}
+	}
+
+	for name, r := range current.Resources {
+		if !strings.HasPrefix(name, "RouteToNAT") {
+			continue
+		}
+		id, _ := r.Properties["NatGatewayId"].(string)
+		if _, ok := ids[id]; !ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package aws
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+// existingNATGateways returns a mockEC2 with an available NAT gateway per
+// zone of the VPC vpc-1.
+func existingNATGateways() *mockEC2 {
+	return &mockEC2{
+		describeNatGateways: &ec2.DescribeNatGatewaysOutput{
+			NatGateways: []ec2types.NatGateway{
+				{
+					NatGatewayId:        aws.String("nat-1"),
+					SubnetId:            aws.String("subnet-1"),
+					VpcId:               aws.String("vpc-1"),
+					State:               ec2types.NatGatewayStateAvailable,
+					NatGatewayAddresses: []ec2types.NatGatewayAddress{{PublicIp: aws.String("52.0.0.1")}},
+				},
+				{
+					NatGatewayId:        aws.String("nat-2"),
+					SubnetId:            aws.String("subnet-2"),
+					VpcId:               aws.String("vpc-1"),
+					State:               ec2types.NatGatewayStateAvailable,
+					NatGatewayAddresses: []ec2types.NatGatewayAddress{{PublicIp: aws.String("52.0.0.2")}},
+				},
+			},
+		},
+		describeSubnets: &ec2.DescribeSubnetsOutput{
+			Subnets: []ec2types.Subnet{
+				{SubnetId: aws.String("subnet-1"), AvailabilityZone: aws.String("eu-central-1a")},
+				{SubnetId: aws.String("subnet-2"), AvailabilityZone: aws.String("eu-central-1b")},
+			},
+		},
+	}
+}
+
+func TestValidateExistingNAT(tt *testing.T) {
+	for _, tc := range []struct {
+		msg            string
+		existingNAT    ExistingNATConfig
+		egressIPs      EgressIPConfig
+		transitGateway TransitGatewayConfig
+		ec2            func() *mockEC2
+		expected       []existingNATGateway
+		err            string
+	}{
+		{
+			msg: "NAT gateways should be created by default",
+			ec2: func() *mockEC2 { return &mockEC2{} },
+		},
+		{
+			msg:         "configured NAT gateways should be used",
+			existingNAT: ExistingNATConfig{IDs: []string{"nat-1", "nat-2"}},
+			ec2:         existingNATGateways,
+			expected:    []existingNATGateway{{id: "nat-1", publicIP: "52.0.0.1"}, {id: "nat-2", publicIP: "52.0.0.2"}},
+		},
+		{
+			msg:         "NAT gateways should be discovered by their tags",
+			existingNAT: ExistingNATConfig{Tags: map[string]string{"egress": "shared"}},
+			ec2:         existingNATGateways,
+			expected:    []existingNATGateway{{id: "nat-1", publicIP: "52.0.0.1"}, {id: "nat-2", publicIP: "52.0.0.2"}},
+		},
+		{
+			msg:         "IDs and tags should be mutually exclusive",
+			existingNAT: ExistingNATConfig{IDs: []string{"nat-1", "nat-2"}, Tags: map[string]string{"egress": "shared"}},
+			ec2:         existingNATGateways,
+			err:         "permanent: NAT gateway IDs and tags are mutually exclusive",
+		},
+		{
+			msg:         "a NAT gateway should be configured per zone",
+			existingNAT: ExistingNATConfig{IDs: []string{"nat-1"}},
+			ec2:         existingNATGateways,
+			err:         "permanent: expected 2 NAT gateway IDs, one per availability zone, got 1",
+		},
+		{
+			msg:            "a transit gateway should not be configured",
+			existingNAT:    ExistingNATConfig{IDs: []string{"nat-1", "nat-2"}},
+			transitGateway: TransitGatewayConfig{ID: "tgw-1"},
+			ec2:            existingNATGateways,
+			err:            "permanent: existing NAT gateways and a transit gateway are mutually exclusive",
+		},
+		{
+			msg:         "EIPs should not be configured",
+			existingNAT: ExistingNATConfig{IDs: []string{"nat-1", "nat-2"}},
+			egressIPs:   EgressIPConfig{AllocationIDs: []string{"eipalloc-1", "eipalloc-2"}},
+			ec2:         existingNATGateways,
+			err:         "permanent: EIPs can't be configured for existing NAT gateways",
+		},
+		{
+			msg:         "missing NAT gateways should be rejected",
+			existingNAT: ExistingNATConfig{IDs: []string{"nat-1", "nat-3"}},
+			ec2:         existingNATGateways,
+			err:         "permanent: NAT gateway nat-3 not found",
+		},
+		{
+			msg:         "NAT gateways should be in the order of the zones",
+			existingNAT: ExistingNATConfig{IDs: []string{"nat-2", "nat-1"}},
+			ec2:         existingNATGateways,
+			err:         "permanent: NAT gateway nat-2 is in eu-central-1b instead of eu-central-1a",
+		},
+		{
+			msg:         "NAT gateways should be available",
+			existingNAT: ExistingNATConfig{IDs: []string{"nat-1", "nat-2"}},
+			ec2: func() *mockEC2 {
+				m := existingNATGateways()
+				m.describeNatGateways.NatGateways[1].State = ec2types.NatGatewayStateDeleted
+				return m
+			},
+			err: "permanent: NAT gateway nat-2 is deleted",
+		},
+		{
+			msg:         "NAT gateways should be in the VPC",
+			existingNAT: ExistingNATConfig{IDs: []string{"nat-1", "nat-2"}},
+			ec2: func() *mockEC2 {
+				m := existingNATGateways()
+				m.describeNatGateways.NatGateways[0].VpcId = aws.String("vpc-2")
+				return m
+			},
+			err: "permanent: NAT gateway nat-1 is not in VPC vpc-1",
+		},
+		{
+			msg:         "every zone should have a tagged NAT gateway",
+			existingNAT: ExistingNATConfig{Tags: map[string]string{"egress": "shared", "team": "network"}},
+			ec2: func() *mockEC2 {
+				m := existingNATGateways()
+				m.describeNatGateways.NatGateways = m.describeNatGateways.NatGateways[:1]
+				return m
+			},
+			err: "permanent: no available NAT gateway tagged egress=shared,team=network found in eu-central-1b",
+		},
+		{
+			msg:         "tags should match a single NAT gateway per zone",
+			existingNAT: ExistingNATConfig{Tags: map[string]string{"egress": "shared"}},
+			ec2: func() *mockEC2 {
+				m := existingNATGateways()
+				m.describeNatGateways.NatGateways = append(m.describeNatGateways.NatGateways, ec2types.NatGateway{
+					NatGatewayId: aws.String("nat-0"),
+					SubnetId:     aws.String("subnet-1"),
+				})
+				return m
+			},
+			err: "permanent: found several NAT gateways tagged egress=shared in eu-central-1a: nat-0, nat-1",
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			p := newTestProvider(tc.ec2(), "eu-central-1a", "eu-central-1b")
+			p.existingNAT = tc.existingNAT
+			p.egressIPs = tc.egressIPs
+			p.transitGateway = tc.transitGateway
+			err := p.validateExistingNAT(t.Context())
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				require.Equal(t, provider.ErrorClassPermanent, provider.ClassOf(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, p.existingNATGateways)
+		})
+	}
+}
+
+func TestEnsureExistingNAT(t *testing.T) {
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		{Name: "a", Namespace: "x"}: {netip.MustParsePrefix("1.0.0.1/32")},
+	})
+
+	m := existingNATGateways()
+	p := newTestProvider(m, "eu-central-1a", "eu-central-1b")
+	cf := newTestStack(p, state)
+	p.existingNAT = ExistingNATConfig{IDs: []string{"nat-1", "nat-2"}}
+	require.NoError(t, p.validateExistingNAT(t.Context()))
+
+	// the routes are unchanged, but the NAT gateways of the stack are
+	// replaced by the existing ones
+	plan, err := p.Plan(t.Context(), state)
+	require.NoError(t, err)
+	require.Equal(t, provider.PlanActionUpdate, plan.Action)
+	require.Empty(t, plan.RouteTables)
+	for _, change := range plan.Resources {
+		require.Equal(t, provider.ChangeActionRemove, change.Action, change.Name)
+	}
+
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.NotContains(t, cf.parameters, cfParam(parameterInternetGatewayIDParameter, "igw-1"))
+
+	template := parseStackTemplate(cf.templateBody)
+	require.ElementsMatch(t, []string{"RouteToNAT1z1x0x0x1y32", "RouteToNAT2z1x0x0x1y32"}, resourceNames(template))
+	require.Equal(t, "nat-2", template.Resources["RouteToNAT2z1x0x0x1y32"].Properties["NatGatewayId"])
+	require.Equal(t, "52.0.0.1", template.Outputs["EIP1"].Value)
+	require.NotContains(t, template.Parameters, parameterInternetGatewayIDParameter)
+
+	// further syncs don't update the stack
+	requireStackUnchanged(t, p, cf, state)
+
+	// replaced NAT gateways are routed to after a restart
+	m.describeNatGateways.NatGateways[1].NatGatewayId = aws.String("nat-3")
+	p.existingNAT = ExistingNATConfig{IDs: []string{"nat-1", "nat-3"}}
+	require.NoError(t, p.validateExistingNAT(t.Context()))
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.NotNil(t, cf.parameters)
+	template = parseStackTemplate(cf.templateBody)
+	require.Equal(t, "nat-3", template.Resources["RouteToNAT2z1x0x0x1y32"].Properties["NatGatewayId"])
+}
@@ -0,0 +1,116 @@
+package aws
+
+import (
+	"context"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+const defaultClusterIDTagPrefix = "kubernetes.io/cluster/"
+
+func init() {
+	provider.Register(ProviderName, &factory{
+		additionalStackTags: make(provider.StringMap),
+		egressNATRoutes:     make(provider.StringMap),
+		natGatewayTags:      make(provider.StringMap),
+	})
+}
+
+// factory creates the AWS provider from its command line flags.
+type factory struct {
+	vpcID                      string
+	cfTemplateBucket           string
+	clusterIDTagPrefix         string
+	natCidrBlocks              []string
+	availabilityZones          []string
+	stackTerminationProtection bool
+	additionalStackTags        provider.StringMap
+	egressIPs                  EgressIPConfig
+	transitGateway             TransitGatewayConfig
+	egressNATRoutes            provider.StringMap
+	privateNAT                 PrivateNATConfig
+	natGatewayIDs              []string
+	natGatewayTags             provider.StringMap
+	prefixList                 PrefixListConfig
+	shards                     ShardConfig
+	changeSet                  ChangeSetConfig
+	recovery                   RecoveryConfig
+}
+
+func (f *factory) Description() string {
+	return "NAT gateways with static EIPs managed by a CloudFormation stack"
+}
+
+func (f *factory) RegisterFlags(app *kingpin.Application) {
+	app.Flag("vpc-id", "VPC ID (default: auto-detect)").StringVar(&f.vpcID)
+	app.Flag("cf-template-bucket", "S3 bucket to use for CF template storage").StringVar(&f.cfTemplateBucket)
+	app.Flag("cluster-id-tag-prefix", "Prefix for the Cluster ID tag set on the Egress stack.").Default(defaultClusterIDTagPrefix).StringVar(&f.clusterIDTagPrefix)
+	app.Flag("aws-nat-cidr-block", "AWS Provider requires to specify NAT-CIDR-Blocks for each AZ to have a NAT gateway in. Each should be a small network having only the NAT GW").StringsVar(&f.natCidrBlocks)
+	app.Flag("aws-az", "AWS Provider requires to specify all AZs to have a NAT gateway in.").StringsVar(&f.availabilityZones)
+	app.Flag("stack-termination-protection", "Enables AWS clouformation stack termination protection for the stacks managed by the controller.").BoolVar(&f.stackTerminationProtection)
+	app.Flag("aws-eip-allocation-id", "Allocation ID of a pre-allocated Elastic IP used by the NAT gateway of an AZ, specified once per AZ in the order of --aws-az. The EIPs must not be associated and are kept when the stack is deleted.").StringsVar(&f.egressIPs.AllocationIDs)
+	app.Flag("aws-public-ipv4-pool", "BYOIP public IPv4 pool the Elastic IPs of the NAT gateways are allocated from, specified once for all AZs or once per AZ in the order of --aws-az.").StringsVar(&f.egressIPs.PublicIPv4Pools)
+	app.Flag("aws-transit-gateway-id", "Route egress traffic to this Transit Gateway, which the VPC must be attached to, instead of creating NAT gateways. (default: disabled)").StringVar(&f.transitGateway.ID)
+	app.Flag("aws-transit-gateway-route-table-id", "Transit Gateway route table associated with the attachment of the VPC, in which the egress CIDRs are routed to --aws-transit-gateway-attachment-id. (default: unmanaged)").StringVar(&f.transitGateway.RouteTableID)
+	app.Flag("aws-transit-gateway-attachment-id", "Transit Gateway attachment of the egress VPC.").StringVar(&f.transitGateway.AttachmentID)
+	app.Flag("aws-transit-gateway-egress-nat-route", "Route table of the egress VPC and NAT gateway the egress CIDRs are routed to in it, as <route-table-id>=<nat-gateway-id>. (default: unmanaged)").SetValue(&f.egressNATRoutes)
+	app.Flag("aws-nat-gateway-id", "Route egress traffic to this existing NAT gateway instead of creating NAT gateways, specified once per AZ in the order of --aws-az. (default: disabled)").StringsVar(&f.natGatewayIDs)
+	app.Flag("aws-nat-gateway-tag", "Route egress traffic to the existing NAT gateways with this tag, as <key>=<value>, instead of creating NAT gateways. Every AZ must have exactly one available NAT gateway with all tags. (default: disabled)").SetValue(&f.natGatewayTags)
+	app.Flag("aws-private-nat-subnet-id", "Subnet of the private NAT gateway of an AZ, specified once per AZ in the order of --aws-az. Egress traffic of resources with private connectivity is routed via private NAT gateways. (default: disabled)").StringsVar(&f.privateNAT.SubnetIDs)
+	app.Flag("aws-private-nat-ip", "Private IP of the private NAT gateway of an AZ within its subnet, specified once per AZ in the order of --aws-az.").StringsVar(&f.privateNAT.IPs)
+	app.Flag("aws-prefix-list-routing", "Route the egress CIDRs as entries of a managed prefix list owned by the egress stack, with a single route per route table, instead of a route per CIDR and route table.").BoolVar(&f.prefixList.Enabled)
+	app.Flag("aws-prefix-list-max-entries", "Fixed max entries of the managed prefix list, which count against the route quota of every route table. (default: the number of egress CIDRs rounded up to a multiple of 20)").IntVar(&f.prefixList.MaxEntries)
+	app.Flag("aws-stack-shards", "Number of shard stacks the egress routes are split across, each updated independently. The egress stack keeps the NAT gateways and EIPs. (default: disabled)").IntVar(&f.shards.Count)
+	app.Flag("aws-stack-shard-by", "Key the egress routes are assigned to shard stacks by, either a consistent hash of the route or its egress group, the namespace of the resource configuring it. Must be hash or group.").Default(shardByHash).EnumVar(&f.shards.By, shardByHash, shardByGroup)
+	app.Flag("aws-change-sets", "Update the stacks via change sets, which are only executed automatically if they don't replace or delete resources of the --aws-change-set-protected-type. Otherwise they wait for approval via POST /provider/aws/changesets/<name>/approve.").BoolVar(&f.changeSet.Enabled)
+	app.Flag("aws-change-set-protected-type", "CloudFormation resource type whose replacement or deletion by a change set requires approval. (default: AWS::EC2::NatGateway and AWS::EC2::EIP)").Default(DefaultProtectedResourceTypes...).StringsVar(&f.changeSet.ProtectedTypes)
+	app.Flag("aws-stack-recovery", "Recover stacks stuck in a state which can't be updated by this action, specified once per action: continue-update-rollback continues the rollback of stacks in UPDATE_ROLLBACK_FAILED skipping the resources failing it, recreate deletes stacks in ROLLBACK_COMPLETE to create them again, retry-delete retries deleting stacks in DELETE_FAILED. (default: disabled)").EnumsVar(&f.recovery.Actions, RecoveryActions...)
+	app.Flag("additional-stack-tags", "Set additional custom tags on the Cloudformation Stacks managed by the controller.").SetValue(&f.additionalStackTags)
+}
+
+func (f *factory) New(opts provider.Options) (provider.Provider, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewAWSProvider(cfg, AWSProviderConfig{
+		ClusterID:                  opts.ClusterID,
+		ControllerID:               opts.ControllerID,
+		DryRun:                     opts.DryRun,
+		VPCID:                      f.vpcID,
+		CFTemplateBucket:           f.cfTemplateBucket,
+		ClusterIDTagPrefix:         f.clusterIDTagPrefix,
+		NATCIDRBlocks:              f.natCidrBlocks,
+		AvailabilityZones:          f.availabilityZones,
+		StackTerminationProtection: f.stackTerminationProtection,
+		AdditionalStackTags:        f.additionalStackTags,
+		RouteOptions:               opts.RouteOptions,
+		EgressIPs:                  f.egressIPs,
+		TransitGateway:             f.transitGatewayConfig(),
+		PrivateNAT:                 f.privateNAT,
+		ExistingNAT:                f.existingNATConfig(),
+		PrefixList:                 f.prefixList,
+		Shards:                     f.shards,
+		ChangeSet:                  f.changeSet,
+		Recovery:                   f.recovery,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (f *factory) transitGatewayConfig() TransitGatewayConfig {
+	config := f.transitGateway
+	config.EgressNATRoutes = f.egressNATRoutes
+	return config
+}
+
+func (f *factory) existingNATConfig() ExistingNATConfig {
+	return ExistingNATConfig{
+		IDs:  f.natGatewayIDs,
+		Tags: f.natGatewayTags,
+	}
+}
@@ -0,0 +1,179 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+
+	cft "github.com/crewjam/go-cloudformation"
+)
+
+const (
+	prefixListResourceName = "EgressPrefixList"
+	prefixListRoutePrefix  = "RouteToPrefixList"
+	// prefixListEntriesStep is the granularity the max entries of the
+	// prefix list are sized in, so adding or removing single routes
+	// doesn't resize it.
+	prefixListEntriesStep = 20
+	// maxPrefixListEntries is the maximum number of entries of a
+	// customer-managed prefix list.
+	maxPrefixListEntries = 1000
+)
+
+// PrefixListConfig configures routing via a managed prefix list owned by
+// the egress stack. Instead of a route per CIDR and route table, the CIDRs
+// are entries of the prefix list and every route table has a single route
+// to it. Changing the CIDRs modifies the entries in place without touching
+// the routes.
+type PrefixListConfig struct {
+	Enabled bool
+	// MaxEntries is the fixed size of the prefix list. The routes of a
+	// prefix list count against the route table quota with its max
+	// entries. If 0, it's sized to the number of CIDRs in steps of
+	// prefixListEntriesStep.
+	MaxEntries int
+}
+
+// validate checks the configured size against the quota of prefix lists.
+func (c PrefixListConfig) validate() error {
+	switch {
+	case c.MaxEntries < 0 || c.MaxEntries > maxPrefixListEntries:
+		return fmt.Errorf("invalid prefix list max entries %d, must be at most %d", c.MaxEntries, maxPrefixListEntries)
+	case c.MaxEntries > 0 && !c.Enabled:
+		return fmt.Errorf("prefix list max entries require prefix list routing")
+	}
+	return nil
+}
+
+// maxEntries returns the size of the prefix list for the number of routes.
+func (c PrefixListConfig) maxEntries(routes int) int {
+	if c.MaxEntries > 0 {
+		return c.MaxEntries
+	}
+	size := max((routes+prefixListEntriesStep-1)/prefixListEntriesStep, 1) * prefixListEntriesStep
+	return min(size, maxPrefixListEntries)
+}
+
+// checkRoutes returns an error if the routes don't fit into the prefix
+// list.
+func (c PrefixListConfig) checkRoutes(routes int) error {
+	if size := c.maxEntries(routes); routes > size {
+		return fmt.Errorf("%d routes exceed the %d entries of the prefix list", routes, size)
+	}
+	return nil
+}
+
+// managedPrefixList is an AWS::EC2::PrefixList, which isn't supported by
+// cft.
+type managedPrefixList struct {
+	PrefixListName *cft.StringExpr   `json:"PrefixListName,omitempty"`
+	AddressFamily  *cft.StringExpr   `json:"AddressFamily,omitempty"`
+	MaxEntries     *cft.IntegerExpr  `json:"MaxEntries,omitempty"`
+	Entries        []prefixListEntry `json:"Entries"`
+}
+
+type prefixListEntry struct {
+	Cidr string `json:"Cidr"`
+}
+
+func (managedPrefixList) CfnResourceType() string {
+	return "AWS::EC2::PrefixList"
+}
+
+// prefixListRoute is an AWS::EC2::Route to a prefix list, which isn't
+// supported by cft.EC2Route.
+type prefixListRoute struct {
+	DestinationPrefixListID *cft.StringExpr `json:"DestinationPrefixListId,omitempty"`
+	RouteTableID            *cft.StringExpr `json:"RouteTableId,omitempty"`
+	NatGatewayID            *cft.StringExpr `json:"NatGatewayId,omitempty"`
+	TransitGatewayID        *cft.StringExpr `json:"TransitGatewayId,omitempty"`
+}
+
+func (prefixListRoute) CfnResourceType() string {
+	return "AWS::EC2::Route"
+}
+
+// addPrefixList adds the prefix list with the routes as entries. The
+// prefix list is part of the stack even without routes, so the stack
+// doesn't switch between routing modes.
+func (p *AWSProvider) addPrefixList(template *cft.Template, routes []netip.Prefix) {
+	entries := make([]prefixListEntry, 0, len(routes))
+	for _, route := range routes {
+		entries = append(entries, prefixListEntry{Cidr: route.String()})
+	}
+
+	template.AddResource(prefixListResourceName, &managedPrefixList{
+		PrefixListName: cft.Ref("AWS::StackName").String(),
+		AddressFamily:  cft.String("IPv4"),
+		MaxEntries:     cft.Integer(int64(p.prefixList.maxEntries(len(routes)))),
+		Entries:        entries,
+	})
+}
+
+// addPrefixListRoutes adds the routes of the prefix list to the egress
+// target of the zones of the route tables.
+func (p *AWSProvider) addPrefixListRoutes(template *cft.Template, routeTableParamOrder []string, routeTableZoneIndexes map[string]int) {
+	for i, routeTableParam := range routeTableParamOrder {
+		route := &prefixListRoute{
+			DestinationPrefixListID: cft.Ref(prefixListResourceName).String(),
+			RouteTableID:            cft.Ref(routeTableParam).String(),
+		}
+
+		zone := routeTableZoneIndexes[routeTableParam]
+		switch p.egressMode() {
+		case egressModeTransitGateway:
+			route.TransitGatewayID = cft.Ref(parameterTransitGatewayIDParameter).String()
+		case egressModeExistingNATGateways:
+			route.NatGatewayID = cft.String(p.existingNATGateways[zone].id)
+		default:
+			route.NatGatewayID = cft.Ref(fmt.Sprintf("NATGateway%d", zone+1)).String()
+		}
+		template.AddResource(fmt.Sprintf("%s%d", prefixListRoutePrefix, i+1), route)
+	}
+}
+
+// getPrefixListCIDRsFromTemplate parses the entries of the prefix list
+// from the CloudFormation template.
+func getPrefixListCIDRsFromTemplate(template string) map[string]struct{} {
+	var cfTemplate struct {
+		Resources map[string]struct {
+			Properties struct {
+				Entries []prefixListEntry
+			}
+		}
+	}
+	err := json.Unmarshal([]byte(template), &cfTemplate)
+	if err != nil {
+		return nil
+	}
+
+	cidrs := make(map[string]struct{})
+	for _, entry := range cfTemplate.Resources[prefixListResourceName].Properties.Entries {
+		cidrs[entry.Cidr] = struct{}{}
+	}
+	return cidrs
+}
+
+// prefixListEntries returns the entries of the prefix list of the
+// template.
+func (t stackTemplate) prefixListEntries() []netip.Prefix {
+	entries, _ := t.Resources[prefixListResourceName].Properties["Entries"].([]interface{})
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		e, _ := entry.(map[string]interface{})
+		cidr, _ := e["Cidr"].(string)
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// hasPrefixList returns true if the stack of the template routes via the
+// prefix list.
+func (t stackTemplate) hasPrefixList() bool {
+	_, ok := t.Resources[prefixListResourceName]
+	return ok
+}
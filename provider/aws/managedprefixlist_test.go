@@ -0,0 +1,133 @@
+package aws
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestPrefixListConfig(tt *testing.T) {
+	for _, tc := range []struct {
+		msg        string
+		config     PrefixListConfig
+		routes     int
+		maxEntries int
+		err        string
+	}{
+		{
+			msg:        "prefix lists should have room for a step of routes",
+			config:     PrefixListConfig{Enabled: true},
+			maxEntries: 20,
+		},
+		{
+			msg:        "prefix lists should be sized in steps",
+			config:     PrefixListConfig{Enabled: true},
+			routes:     21,
+			maxEntries: 40,
+		},
+		{
+			msg:        "prefix lists should not exceed the quota",
+			config:     PrefixListConfig{Enabled: true},
+			routes:     1001,
+			maxEntries: 1000,
+			err:        "1001 routes exceed the 1000 entries of the prefix list",
+		},
+		{
+			msg:        "configured max entries should be used",
+			config:     PrefixListConfig{Enabled: true, MaxEntries: 100},
+			routes:     21,
+			maxEntries: 100,
+		},
+		{
+			msg:        "routes should fit into the configured max entries",
+			config:     PrefixListConfig{Enabled: true, MaxEntries: 10},
+			routes:     11,
+			maxEntries: 10,
+			err:        "11 routes exceed the 10 entries of the prefix list",
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			require.NoError(t, tc.config.validate())
+			require.Equal(t, tc.maxEntries, tc.config.maxEntries(tc.routes))
+			err := tc.config.checkRoutes(tc.routes)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	require.EqualError(tt, PrefixListConfig{Enabled: true, MaxEntries: 1001}.validate(), "invalid prefix list max entries 1001, must be at most 1000")
+	require.EqualError(tt, PrefixListConfig{MaxEntries: 10}.validate(), "prefix list max entries require prefix list routing")
+}
+
+func TestEnsurePrefixList(t *testing.T) {
+	resource := provider.Resource{Name: "a", Namespace: "x"}
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.1/32"), netip.MustParsePrefix("2.0.0.0/24")},
+	})
+
+	p := newTestProvider(&mockEC2{}, "eu-central-1a", "eu-central-1b")
+	cf := newTestStack(p, state)
+	p.prefixList = PrefixListConfig{Enabled: true}
+
+	// the routes of the route tables are unchanged, but routed via the
+	// prefix list
+	plan, err := p.Plan(t.Context(), state)
+	require.NoError(t, err)
+	require.Equal(t, provider.PlanActionUpdate, plan.Action)
+	require.Empty(t, plan.RouteTables)
+	require.Equal(t, []provider.ResourceChange{
+		{Type: "AWS::EC2::PrefixList", Name: prefixListResourceName, Action: provider.ChangeActionAdd},
+	}, plan.Resources)
+
+	require.NoError(t, p.Ensure(t.Context(), state))
+	cf.stack.Parameters = cf.parameters
+	template := parseStackTemplate(cf.templateBody)
+	var routes []string
+	for name := range template.Resources {
+		if template.isEgressRoute(name) {
+			routes = append(routes, name)
+		}
+	}
+	require.ElementsMatch(t, []string{"RouteToPrefixList1", "RouteToPrefixList2"}, routes)
+	require.Equal(t, map[string]interface{}{
+		"DestinationPrefixListId": map[string]interface{}{"Ref": prefixListResourceName},
+		"NatGatewayId":            map[string]interface{}{"Ref": "NATGateway2"},
+		"RouteTableId":            map[string]interface{}{"Ref": "AZ2RouteTableIDParameter"},
+	}, template.Resources["RouteToPrefixList2"].Properties)
+	require.Equal(t, float64(20), template.Resources[prefixListResourceName].Properties["MaxEntries"])
+	require.Equal(t, map[string]struct{}{"1.0.0.1/32": {}, "2.0.0.0/24": {}}, getCIDRsFromTemplate(cf.templateBody))
+
+	// further syncs don't update the stack
+	requireStackUnchanged(t, p, cf, state)
+
+	// changed routes only modify the entries of the prefix list
+	changed := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.1/32"), netip.MustParsePrefix("3.0.0.0/24")},
+	})
+	plan, err = p.Plan(t.Context(), changed)
+	require.NoError(t, err)
+	require.Equal(t, []provider.RouteTableChange{
+		{RouteTable: "rtb-1", Added: []netip.Prefix{netip.MustParsePrefix("3.0.0.0/24")}, Removed: []netip.Prefix{netip.MustParsePrefix("2.0.0.0/24")}},
+		{RouteTable: "rtb-2", Added: []netip.Prefix{netip.MustParsePrefix("3.0.0.0/24")}, Removed: []netip.Prefix{netip.MustParsePrefix("2.0.0.0/24")}},
+	}, plan.RouteTables)
+	require.Equal(t, []provider.ResourceChange{
+		{Type: "AWS::EC2::PrefixList", Name: prefixListResourceName, Action: provider.ChangeActionModify},
+	}, plan.Resources)
+
+	require.NoError(t, p.Ensure(t.Context(), changed))
+	updated := parseStackTemplate(cf.templateBody)
+	require.Equal(t, template.Resources["RouteToPrefixList1"], updated.Resources["RouteToPrefixList1"])
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("1.0.0.1/32"), netip.MustParsePrefix("3.0.0.0/24")}, updated.prefixListEntries())
+
+	// disabling prefix list routing routes the CIDRs one by one again
+	p.prefixList = PrefixListConfig{}
+	require.NoError(t, p.Ensure(t.Context(), changed))
+	updated = parseStackTemplate(cf.templateBody)
+	require.NotContains(t, updated.Resources, prefixListResourceName)
+	require.Contains(t, updated.Resources, "RouteToNAT1z3x0x0x0y24")
+}
@@ -0,0 +1,310 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/pkg/errors"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+const (
+	operationCreate = "create"
+	operationUpdate = "update"
+	operationDelete = "delete"
+	// operationCreateChangeSet creates a change set of a stack, it's
+	// finished once CloudFormation computed the changes.
+	operationCreateChangeSet = "create change set"
+)
+
+// stackStatusErrors are the errors of the stack states ending failed
+// operations.
+var stackStatusErrors = map[cftypes.StackStatus]error{
+	cftypes.StackStatusCreateFailed:           errCreateFailed,
+	cftypes.StackStatusDeleteFailed:           errDeleteFailed,
+	cftypes.StackStatusRollbackComplete:       errRollbackComplete,
+	cftypes.StackStatusRollbackFailed:         errRollbackFailed,
+	cftypes.StackStatusUpdateRollbackComplete: errUpdateRollbackComplete,
+	cftypes.StackStatusUpdateRollbackFailed:   errUpdateRollbackFailed,
+}
+
+// stackOperation is an operation started on a stack. Operations aren't
+// waited for, their results are picked up by later syncs from the status
+// of the stack.
+type stackOperation struct {
+	stackName string
+	// stackID identifies the stack after it was deleted, e.g. because
+	// its creation failed.
+	stackID string
+	// action is create, update, delete, create change set or a recovery
+	// action.
+	action string
+	// changeSet is the name of the change set created by the operation.
+	changeSet string
+	// routes are the CIDRs routed by the stack before the operation, they
+	// may still be routed by it until the operation finished.
+	routes  map[string]struct{}
+	started time.Time
+}
+
+func newStackOperation(stackName, stackID, action string) *stackOperation {
+	if stackID == "" {
+		stackID = stackName
+	}
+	return &stackOperation{
+		stackName: stackName,
+		stackID:   stackID,
+		action:    action,
+		started:   time.Now(),
+	}
+}
+
+// completed returns the status of the stack after the operation
+// succeeded.
+func (o *stackOperation) completed() cftypes.StackStatus {
+	switch o.action {
+	case operationCreate:
+		return cftypes.StackStatusCreateComplete
+	case operationUpdate:
+		return cftypes.StackStatusUpdateComplete
+	case recoveryContinueUpdateRollback:
+		return cftypes.StackStatusUpdateRollbackComplete
+	}
+	return cftypes.StackStatusDeleteComplete
+}
+
+func (o *stackOperation) String() string {
+	if o.action == operationCreateChangeSet {
+		return fmt.Sprintf("%s %s of stack %s", o.action, o.changeSet, o.stackName)
+	}
+	return fmt.Sprintf("%s of stack %s", o.action, o.stackName)
+}
+
+// operationStore holds the operations in progress by stack name.
+type operationStore struct {
+	sync.Mutex
+	operations map[string]*stackOperation
+}
+
+func newOperationStore() *operationStore {
+	return &operationStore{operations: make(map[string]*stackOperation)}
+}
+
+func (s *operationStore) start(operation *stackOperation) {
+	s.Lock()
+	defer s.Unlock()
+	s.operations[operation.stackName] = operation
+}
+
+func (s *operationStore) finish(stackName string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.operations, stackName)
+}
+
+func (s *operationStore) inProgress(stackName string) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.operations[stackName]
+	return ok
+}
+
+// hold records the routes of the stack before its operation in progress.
+func (s *operationStore) hold(stackName string, routes map[string]struct{}) {
+	s.Lock()
+	defer s.Unlock()
+	if operation, ok := s.operations[stackName]; ok {
+		operation.routes = routes
+	}
+}
+
+// held returns the routes of the stack before its operation in progress.
+func (s *operationStore) held(stackName string) map[string]struct{} {
+	s.Lock()
+	defer s.Unlock()
+	if operation, ok := s.operations[stackName]; ok {
+		return operation.routes
+	}
+	return nil
+}
+
+// list returns the operations in progress ordered by stack name.
+func (s *operationStore) list() []*stackOperation {
+	s.Lock()
+	defer s.Unlock()
+	operations := make([]*stackOperation, 0, len(s.operations))
+	for _, operation := range s.operations {
+		operations = append(operations, operation)
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		return operations[i].stackName < operations[j].stackName
+	})
+	return operations
+}
+
+// stackInProgress returns true if an operation is running on the stack.
+func stackInProgress(stack cftypes.Stack) bool {
+	return strings.HasSuffix(string(stack.StackStatus), "_IN_PROGRESS")
+}
+
+// startOperation records the operation started on the stack.
+func (p *AWSProvider) startOperation(stackName, stackID, action string) {
+	p.operations.start(newStackOperation(stackName, stackID, action))
+	p.logger.Infof("Started %s of stack %s", action, stackName)
+}
+
+// startChangeSetOperation records the change set being created for the
+// stack.
+func (p *AWSProvider) startChangeSetOperation(stackName, changeSet string) {
+	operation := newStackOperation(stackName, "", operationCreateChangeSet)
+	operation.changeSet = changeSet
+	p.operations.start(operation)
+	p.logger.Infof("Started creating change set %s of stack %s", changeSet, stackName)
+}
+
+// adoptOperations records the operations running on the stacks which
+// weren't started by the controller, e.g. before it was restarted, so
+// they are waited for like the operations it started.
+func (p *AWSProvider) adoptOperations(stacks []cftypes.Stack) {
+	for _, stack := range stacks {
+		stackName := aws.ToString(stack.StackName)
+		if !stackInProgress(stack) || p.operations.inProgress(stackName) {
+			continue
+		}
+
+		action := operationUpdate
+		switch status := string(stack.StackStatus); {
+		case strings.HasPrefix(status, "CREATE_"), strings.HasPrefix(status, "ROLLBACK_"):
+			action = operationCreate
+		case strings.HasPrefix(status, "DELETE_"):
+			action = operationDelete
+		}
+		p.logger.Infof("Found stack %s in %s, waiting for its %s", stackName, stack.StackStatus, action)
+		p.operations.start(newStackOperation(stackName, aws.ToString(stack.StackId), action))
+	}
+}
+
+// deletedStacks returns the names of the stacks with operations which
+// aren't listed anymore, e.g. because they were deleted after failing to be
+// created.
+func (p *AWSProvider) deletedStacks(stacks []cftypes.Stack) []string {
+	var stackNames []string
+	for _, operation := range p.operations.list() {
+		if !slices.ContainsFunc(stacks, func(stack cftypes.Stack) bool {
+			return aws.ToString(stack.StackName) == operation.stackName
+		}) {
+			stackNames = append(stackNames, operation.stackName)
+		}
+	}
+	return stackNames
+}
+
+// awaitStackOperations picks up the results of the operations of the
+// stacks which finished since the last check. Operations aren't waited
+// for, if any is still running an error of ErrorClassInProgress is
+// returned, so no conflicting operation is started on the stacks before
+// the sync is retried. Failed operations are returned before operations in
+// progress and operations running longer than maxStackWaitTimeout return
+// errTimeoutExceeded. Change sets being created are awaited the same way,
+// their result is picked up by the update executing them.
+func (p *AWSProvider) awaitStackOperations(ctx context.Context, stackNames ...string) error {
+	var running []string
+	var errs []error
+	timedOut := false
+	for _, operation := range p.operations.list() {
+		if !slices.Contains(stackNames, operation.stackName) {
+			continue
+		}
+		if operation.action == operationCreateChangeSet {
+			output, err := p.describeChangeSet(ctx, operation.stackName, operation.changeSet)
+			if err != nil {
+				return err
+			}
+			if output != nil && changeSetInProgress(output.Status) && time.Since(operation.started) <= maxChangeSetWaitTimeout {
+				p.logger.Debugf("Change set '%s' of stack '%s' - [%s]", operation.changeSet, operation.stackName, output.Status)
+				running = append(running, fmt.Sprintf("%s (%s for %s)", operation, output.Status, time.Since(operation.started).Round(time.Second)))
+				continue
+			}
+
+			p.operations.finish(operation.stackName)
+			if output != nil && changeSetInProgress(output.Status) {
+				// stuck change sets are deleted to be created again
+				// by the next sync
+				err = p.deleteChangeSet(ctx, operation.stackName, operation.changeSet)
+				if err != nil {
+					return err
+				}
+				errs = append(errs, errors.Wrapf(errChangeSetTimeoutExceeded, "waiting for %s", operation))
+			}
+			continue
+		}
+
+		stack, err := p.getStackByName(ctx, operation.stackID)
+		switch {
+		case isDoesNotExistsErr(err):
+			stack = cftypes.Stack{StackName: aws.String(operation.stackName), StackStatus: cftypes.StackStatusDeleteComplete}
+		case err != nil:
+			return err
+		}
+
+		if stackInProgress(stack) {
+			p.logger.Debugf("Stack '%s' - [%s]", operation.stackName, stack.StackStatus)
+			running = append(running, fmt.Sprintf("%s (%s for %s)", operation, stack.StackStatus, time.Since(operation.started).Round(time.Second)))
+			timedOut = timedOut || time.Since(operation.started) > maxStackWaitTimeout
+			continue
+		}
+
+		p.operations.finish(operation.stackName)
+		err = p.operationResult(ctx, operation, &stack)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		for _, err := range errs[1:] {
+			p.logger.Error(err)
+		}
+		return errs[0]
+	}
+	switch {
+	case timedOut:
+		return errors.Wrapf(errTimeoutExceeded, "waiting for %s", strings.Join(running, ", "))
+	case len(running) > 0:
+		return provider.NewError(provider.ErrorClassInProgress, fmt.Errorf("waiting for %s", strings.Join(running, ", ")))
+	}
+	return nil
+}
+
+// operationResult logs the result of the finished operation and returns
+// the error of the status of the stack if it failed.
+func (p *AWSProvider) operationResult(ctx context.Context, operation *stackOperation, stack *cftypes.Stack) error {
+	failed, ok := stackStatusErrors[stack.StackStatus]
+	if operation.action == operationCreate && stack.StackStatus == cftypes.StackStatusDeleteComplete {
+		// stacks failing to create are deleted
+		failed, ok = errCreateFailed, true
+	}
+	recovery := slices.Contains(RecoveryActions, operation.action)
+
+	if !ok || stack.StackStatus == operation.completed() {
+		if recovery {
+			stackRecoveries.WithLabelValues(operation.action, "success").Inc()
+		}
+		p.logger.Infof("Finished %s in %s with %s", operation, time.Since(operation.started).Round(time.Second), stack.StackStatus)
+		return nil
+	}
+
+	err := p.stackFailed(ctx, operation.stackID, stack, failed)
+	if recovery {
+		stackRecoveries.WithLabelValues(operation.action, "failure").Inc()
+		return errors.Wrapf(err, "failed to recover stack %s by %s", operation.stackName, operation.action)
+	}
+	return errors.Wrapf(err, "failed to %s stack %s", operation.action, operation.stackName)
+}
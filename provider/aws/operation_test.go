@@ -0,0 +1,112 @@
+package aws
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestEnsureOperationsInProgress(t *testing.T) {
+	resource := provider.Resource{Name: "a", Namespace: "x"}
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.0/24")},
+	})
+	changed := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.0/24"), netip.MustParsePrefix("2.0.0.0/24")},
+	})
+
+	cf := newMockStacks()
+	cf.running = true
+	newProvider := func() *AWSProvider {
+		return &AWSProvider{
+			clusterID:          "cluster",
+			controllerID:       "controller",
+			clusterIDTagPrefix: clusterIDTagPrefix,
+			vpcID:              "vpc-1",
+			natCidrBlocks:      []string{"172.31.64.0/28"},
+			availabilityZones:  []string{"eu-central-1a"},
+			cloudformation:     cf,
+			operations:         newOperationStore(),
+			ec2: &mockEC2{
+				describeInternetGatewaysOutput: &ec2.DescribeInternetGatewaysOutput{
+					InternetGateways: []ec2types.InternetGateway{{InternetGatewayId: aws.String("igw-1")}},
+				},
+				describeRouteTables: &ec2.DescribeRouteTablesOutput{
+					RouteTables: []ec2types.RouteTable{
+						{
+							RouteTableId: aws.String("rtb-1"),
+							Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+						},
+					},
+				},
+			},
+			logger: log.WithFields(log.Fields{"provider": ProviderName}),
+		}
+	}
+	p := newProvider()
+
+	// creating the stack isn't waited for
+	err := p.Ensure(t.Context(), state)
+	require.ErrorContains(t, err, "waiting for create of stack")
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	stack, err := p.getEgressStack(t.Context())
+	require.NoError(t, err)
+	stackName := aws.ToString(stack.StackName)
+	require.Equal(t, cftypes.StackStatusCreateInProgress, cf.stacks[stackName].StackStatus)
+
+	// changes aren't applied while the stack is in progress
+	err = p.Ensure(t.Context(), changed)
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	require.Empty(t, cf.updates)
+
+	// the next sync after the stack was created updates it
+	cf.stacks[stackName].StackStatus = cftypes.StackStatusCreateComplete
+	err = p.Ensure(t.Context(), changed)
+	require.ErrorContains(t, err, "waiting for update of stack "+stackName)
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	require.Equal(t, 1, cf.updates[stackName])
+
+	// operations found after a restart are waited for
+	p = newProvider()
+	err = p.Ensure(t.Context(), state)
+	require.ErrorContains(t, err, "waiting for update of stack "+stackName)
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	require.Equal(t, 1, cf.updates[stackName])
+
+	// operations running too long time out, but are still waited for
+	p.operations.list()[0].started = time.Now().Add(-maxStackWaitTimeout - time.Minute)
+	err = p.Ensure(t.Context(), state)
+	require.ErrorIs(t, err, errTimeoutExceeded)
+	require.True(t, p.operations.inProgress(stackName))
+
+	// failed operations are returned once
+	cf.stacks[stackName].StackStatus = cftypes.StackStatusUpdateRollbackComplete
+	err = p.Ensure(t.Context(), changed)
+	require.ErrorIs(t, err, errUpdateRollbackComplete)
+	require.EqualError(t, err, "failed to update stack "+stackName+": "+errUpdateRollbackComplete.Error())
+	require.False(t, p.operations.inProgress(stackName))
+
+	// deleting the stack isn't waited for
+	err = p.Ensure(t.Context(), provider.NewDesiredState(nil))
+	require.ErrorContains(t, err, "waiting for delete of stack "+stackName)
+	require.Equal(t, cftypes.StackStatusDeleteInProgress, cf.stacks[stackName].StackStatus)
+	cf.stacks[stackName].StackStatus = cftypes.StackStatusDeleteComplete
+	require.NoError(t, p.Ensure(t.Context(), provider.NewDesiredState(nil)))
+
+	// stacks deleted after failing to create report the failure
+	err = p.Ensure(t.Context(), state)
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	stack, err = p.getEgressStack(t.Context())
+	require.NoError(t, err)
+	cf.stacks[aws.ToString(stack.StackName)].StackStatus = cftypes.StackStatusDeleteComplete
+	err = p.Ensure(t.Context(), state)
+	require.ErrorIs(t, err, errCreateFailed)
+}
@@ -0,0 +1,287 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+// resources which are replaced on any property change except for tags.
+var replacedOnChange = map[string]bool{
+	"AWS::EC2::EIP":        true,
+	"AWS::EC2::NatGateway": true,
+	"AWS::EC2::Subnet":     true,
+}
+
+// stackTemplate is the part of a CloudFormation template needed to diff
+// two templates.
+type stackTemplate struct {
+	Parameters map[string]struct {
+		Default string
+	}
+	Resources map[string]struct {
+		Type           string
+		DeletionPolicy string
+		Properties     map[string]interface{}
+	}
+	Outputs map[string]struct {
+		Value interface{}
+	}
+}
+
+// Plan previews the changes Ensure would make to the egress stack.
+func (p *AWSProvider) Plan(ctx context.Context, state *provider.DesiredState) (*provider.Plan, error) {
+	stack, err := p.getEgressStack(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Len() == 0 && stack.StackName == nil {
+		return &provider.Plan{Action: provider.PlanActionNone}, nil
+	}
+
+	var current stackTemplate
+	currentParams := make(map[string]string)
+	if stack.StackName != nil {
+		templateBody, err := p.getStackTemplateBody(ctx, stack)
+		if err != nil {
+			return nil, err
+		}
+
+		current = parseStackTemplate(templateBody)
+		if state.Len() > 0 && !p.egressRoutes(state).changed(templateBody) && !p.modeChanged(current) && !p.shards.enabled() {
+			return &provider.Plan{Action: provider.PlanActionNone}, nil
+		}
+
+		for _, param := range stack.Parameters {
+			currentParams[aws.ToString(param.ParameterKey)] = aws.ToString(param.ParameterValue)
+		}
+	}
+
+	plan := &provider.Plan{Action: provider.PlanActionDelete}
+	egressStackName := aws.ToString(stack.StackName)
+	var desired stackTemplate
+	desiredParams := make(map[string]string)
+	if state.Len() > 0 {
+		var existing *stackTemplate
+		if stack.StackName != nil {
+			existing = &current
+		}
+		spec, err := p.generateStackSpec(ctx, state, existing)
+		if err != nil {
+			return nil, err
+		}
+		desired = parseStackTemplate(spec.template)
+		desiredParams = spec.tableID
+		if stack.StackName == nil {
+			egressStackName = spec.name
+		}
+
+		plan.Action = provider.PlanActionUpdate
+		if stack.StackName == nil {
+			plan.Action = provider.PlanActionCreate
+		}
+	}
+
+	currentRoutes := current.routesByTable(currentParams)
+	desiredRoutes := desired.routesByTable(desiredParams)
+	shardChanges, err := p.planShards(ctx, state, egressStackName, currentRoutes, desiredRoutes)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]struct{})
+	for table := range currentRoutes {
+		tables[table] = struct{}{}
+	}
+	for table := range desiredRoutes {
+		tables[table] = struct{}{}
+	}
+	for table := range tables {
+		added, removed := provider.DiffRoutes(currentRoutes[table], desiredRoutes[table])
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		plan.RouteTables = append(plan.RouteTables, provider.RouteTableChange{
+			RouteTable: table,
+			Added:      added,
+			Removed:    removed,
+		})
+	}
+	sort.Slice(plan.RouteTables, func(i, j int) bool {
+		return plan.RouteTables[i].RouteTable < plan.RouteTables[j].RouteTable
+	})
+
+	plan.Resources = append(diffResources(current, desired), shardChanges...)
+	for _, change := range plan.Resources {
+		if change.Type != "AWS::EC2::EIP" {
+			continue
+		}
+		// retained EIPs are adopted by the next stack
+		released := change.Action == provider.ChangeActionRemove && current.Resources[change.Name].DeletionPolicy != "Retain"
+		if released || change.Replacement {
+			plan.ReplacesEgressIPs = true
+		}
+	}
+	return plan, nil
+}
+
+// parseStackTemplate parses the template. Templates which can't be parsed
+// are treated as empty.
+func parseStackTemplate(body string) stackTemplate {
+	var template stackTemplate
+	err := json.Unmarshal([]byte(body), &template)
+	if err != nil {
+		return stackTemplate{}
+	}
+	return template
+}
+
+// egressMode is how the egress stack routes egress traffic.
+type egressMode string
+
+const (
+	egressModeNATGateways         egressMode = "NAT gateways"
+	egressModeTransitGateway      egressMode = "transit gateway"
+	egressModeExistingNATGateways egressMode = "existing NAT gateways"
+)
+
+// egressMode returns how the stack of the template routes egress traffic.
+func (t stackTemplate) egressMode() egressMode {
+	if _, ok := t.Resources["NATGateway1"]; ok {
+		return egressModeNATGateways
+	}
+	if _, ok := t.Parameters[parameterTransitGatewayIDParameter]; ok {
+		return egressModeTransitGateway
+	}
+	return egressModeExistingNATGateways
+}
+
+// isEgressRoute returns true if the resource is a route of egress traffic,
+// either to a NAT gateway or a transit gateway, or in a transit gateway
+// route table.
+func (t stackTemplate) isEgressRoute(name string) bool {
+	r := t.Resources[name]
+	switch r.Type {
+	case "AWS::EC2::Route":
+		_, nat := r.Properties["NatGatewayId"]
+		_, tgw := r.Properties["TransitGatewayId"]
+		return nat || tgw
+	case "AWS::EC2::TransitGatewayRoute":
+		return true
+	}
+	return false
+}
+
+// routesByTable returns the destinations of the egress routes by route
+// table. Route table parameters are resolved with params.
+func (t stackTemplate) routesByTable(params map[string]string) map[string][]netip.Prefix {
+	routes := make(map[string][]netip.Prefix)
+	for name, r := range t.Resources {
+		if !t.isEgressRoute(name) {
+			continue
+		}
+
+		table, ok := r.Properties["RouteTableId"]
+		if !ok {
+			table = r.Properties["TransitGatewayRouteTableId"]
+		}
+		tableID := t.resolve(table, params)
+
+		// routes to the prefix list route all of its entries
+		if t.resolve(r.Properties["DestinationPrefixListId"], nil) == prefixListResourceName {
+			routes[tableID] = append(routes[tableID], t.prefixListEntries()...)
+			continue
+		}
+
+		destination, err := netip.ParsePrefix(t.resolve(r.Properties["DestinationCidrBlock"], nil))
+		if err != nil {
+			continue
+		}
+		routes[tableID] = append(routes[tableID], destination)
+	}
+	return routes
+}
+
+// resolve returns the value of a string property or a reference to a
+// parameter. Parameters are resolved with params or their default value.
+func (t stackTemplate) resolve(value interface{}, params map[string]string) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		ref, _ := v["Ref"].(string)
+		if resolved, ok := params[ref]; ok {
+			return resolved
+		}
+		if param, ok := t.Parameters[ref]; ok && param.Default != "" {
+			return param.Default
+		}
+		return ref
+	}
+	return ""
+}
+
+// onlyTagsChanged returns true if the properties only differ in their tags,
+// which are updated without replacing the resource.
+func onlyTagsChanged(a, b map[string]interface{}) bool {
+	for key := range a {
+		if key != "Tags" && !reflect.DeepEqual(a[key], b[key]) {
+			return false
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok && key != "Tags" {
+			return false
+		}
+	}
+	return true
+}
+
+// diffResources returns the changes of all resources except the egress
+// routes, which are diffed by route table.
+func diffResources(current, desired stackTemplate) []provider.ResourceChange {
+	var changes []provider.ResourceChange
+	for name, r := range desired.Resources {
+		if desired.isEgressRoute(name) {
+			continue
+		}
+
+		old, ok := current.Resources[name]
+		switch {
+		case !ok:
+			changes = append(changes, provider.ResourceChange{
+				Type:   r.Type,
+				Name:   name,
+				Action: provider.ChangeActionAdd,
+			})
+		case old.Type != r.Type || !reflect.DeepEqual(old.Properties, r.Properties):
+			changes = append(changes, provider.ResourceChange{
+				Type:        r.Type,
+				Name:        name,
+				Action:      provider.ChangeActionModify,
+				Replacement: old.Type != r.Type || replacedOnChange[r.Type] && !onlyTagsChanged(old.Properties, r.Properties),
+			})
+		}
+	}
+
+	for name, r := range current.Resources {
+		if _, ok := desired.Resources[name]; ok || current.isEgressRoute(name) {
+			continue
+		}
+		changes = append(changes, provider.ResourceChange{
+			Type:   r.Type,
+			Name:   name,
+			Action: provider.ChangeActionRemove,
+		})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
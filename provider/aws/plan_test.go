@@ -0,0 +1,195 @@
+package aws
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestPlan(tt *testing.T) {
+	resource := provider.Resource{Name: "a", Namespace: "x", Cluster: "m"}
+	stateA := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.1/32"), netip.MustParsePrefix("2.0.0.0/24")},
+	})
+	stateB := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.1/32"), netip.MustParsePrefix("3.0.0.0/24")},
+	})
+
+	newProvider := func(cf *mockCloudformation) *AWSProvider {
+		return &AWSProvider{
+			clusterID:          "cluster",
+			controllerID:       "controller",
+			clusterIDTagPrefix: clusterIDTagPrefix,
+			vpcID:              "vpc",
+			natCidrBlocks:      []string{"172.31.64.0/28"},
+			availabilityZones:  []string{"eu-central-1a"},
+			cloudformation:     cf,
+			ec2: &mockEC2{
+				describeInternetGatewaysOutput: &ec2.DescribeInternetGatewaysOutput{
+					InternetGateways: []ec2types.InternetGateway{
+						{InternetGatewayId: aws.String("igw-1")},
+					},
+				},
+				describeRouteTables: &ec2.DescribeRouteTablesOutput{
+					RouteTables: []ec2types.RouteTable{
+						{
+							RouteTableId: aws.String("rtb-1"),
+							Tags: []ec2types.Tag{
+								{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")},
+							},
+						},
+					},
+				},
+			},
+			logger: log.WithFields(log.Fields{"provider": ProviderName}),
+		}
+	}
+
+	existingStack := func(state *provider.DesiredState) *mockCloudformation {
+		return &mockCloudformation{
+			stack: cftypes.Stack{
+				StackName:   aws.String("stack"),
+				StackStatus: cftypes.StackStatusCreateComplete,
+				Tags: []cftypes.Tag{
+					{Key: aws.String(clusterIDTagPrefix + "cluster"), Value: aws.String(resourceLifecycleOwned)},
+					{Key: aws.String(kubernetesApplicationTagKey), Value: aws.String("controller")},
+				},
+				Parameters: []cftypes.Parameter{
+					cfParam("AZ1RouteTableIDParameter", "rtb-1"),
+				},
+			},
+			templateBody: newProvider(nil).generateTemplate(state, []string{"AZ1RouteTableIDParameter"}, map[string]int{"AZ1RouteTableIDParameter": 0}, nil),
+		}
+	}
+
+	// legacyStack is a stack created before EIPs were tagged and retained.
+	legacyStack := func() *mockCloudformation {
+		cf := existingStack(nil)
+		cf.templateBody = `{"Resources":{"EIP1":{"Type":"AWS::EC2::EIP","Properties":{"Domain":"vpc"}},"NATGateway1":{"Type":"AWS::EC2::NatGateway","Properties":{"AllocationId":{"Fn::GetAtt":["EIP1","AllocationId"]},"SubnetId":{"Ref":"NATSubnet1"}}},"RouteToNAT1z1x0x0x1y32":{"Type":"AWS::EC2::Route","Properties":{"DestinationCidrBlock":"1.0.0.1/32","NatGatewayId":{"Ref":"NATGateway1"},"RouteTableId":{"Ref":"AZ1RouteTableIDParameter"}}}}}`
+		return cf
+	}
+
+	natResources := func(action provider.ChangeAction) []provider.ResourceChange {
+		return []provider.ResourceChange{
+			{Type: "AWS::EC2::EIP", Name: "EIP1", Action: action},
+			{Type: "AWS::EC2::NatGateway", Name: "NATGateway1", Action: action},
+			{Type: "AWS::EC2::Subnet", Name: "NATSubnet1", Action: action},
+			{Type: "AWS::EC2::Route", Name: "NATSubnetRoute1", Action: action},
+			{Type: "AWS::EC2::RouteTable", Name: "NATSubnetRouteTable1", Action: action},
+			{Type: "AWS::EC2::SubnetRouteTableAssociation", Name: "NATSubnetRouteTableAssociation1", Action: action},
+		}
+	}
+
+	for _, tc := range []struct {
+		msg      string
+		cf       *mockCloudformation
+		state    *provider.DesiredState
+		expected *provider.Plan
+	}{
+		{
+			msg:      "no stack and no config should not change anything",
+			cf:       &mockCloudformation{},
+			state:    provider.NewDesiredState(nil),
+			expected: &provider.Plan{Action: provider.PlanActionNone},
+		},
+		{
+			msg:   "missing stack should be created",
+			cf:    &mockCloudformation{},
+			state: stateA,
+			expected: &provider.Plan{
+				Action: provider.PlanActionCreate,
+				RouteTables: []provider.RouteTableChange{
+					{
+						RouteTable: "rtb-1",
+						Added:      []netip.Prefix{netip.MustParsePrefix("1.0.0.1/32"), netip.MustParsePrefix("2.0.0.0/24")},
+					},
+				},
+				Resources: natResources(provider.ChangeActionAdd),
+			},
+		},
+		{
+			msg:      "unchanged routes should not change anything",
+			cf:       existingStack(stateA),
+			state:    stateA,
+			expected: &provider.Plan{Action: provider.PlanActionNone},
+		},
+		{
+			msg:   "changed routes should be updated",
+			cf:    existingStack(stateA),
+			state: stateB,
+			expected: &provider.Plan{
+				Action: provider.PlanActionUpdate,
+				RouteTables: []provider.RouteTableChange{
+					{
+						RouteTable: "rtb-1",
+						Added:      []netip.Prefix{netip.MustParsePrefix("3.0.0.0/24")},
+						Removed:    []netip.Prefix{netip.MustParsePrefix("2.0.0.0/24")},
+					},
+				},
+			},
+		},
+		{
+			msg:   "empty config should delete the stack and retain the EIPs",
+			cf:    existingStack(stateA),
+			state: provider.NewDesiredState(nil),
+			expected: &provider.Plan{
+				Action: provider.PlanActionDelete,
+				RouteTables: []provider.RouteTableChange{
+					{
+						RouteTable: "rtb-1",
+						Removed:    []netip.Prefix{netip.MustParsePrefix("1.0.0.1/32"), netip.MustParsePrefix("2.0.0.0/24")},
+					},
+				},
+				Resources: natResources(provider.ChangeActionRemove),
+			},
+		},
+		{
+			msg:   "EIPs not retained should be released",
+			cf:    legacyStack(),
+			state: provider.NewDesiredState(nil),
+			expected: &provider.Plan{
+				Action: provider.PlanActionDelete,
+				RouteTables: []provider.RouteTableChange{
+					{
+						RouteTable: "rtb-1",
+						Removed:    []netip.Prefix{netip.MustParsePrefix("1.0.0.1/32")},
+					},
+				},
+				Resources:         natResources(provider.ChangeActionRemove)[:2],
+				ReplacesEgressIPs: true,
+			},
+		},
+		{
+			msg:   "tagging EIPs should not replace them",
+			cf:    legacyStack(),
+			state: stateA,
+			expected: &provider.Plan{
+				Action: provider.PlanActionUpdate,
+				RouteTables: []provider.RouteTableChange{
+					{
+						RouteTable: "rtb-1",
+						Added:      []netip.Prefix{netip.MustParsePrefix("2.0.0.0/24")},
+					},
+				},
+				Resources: append(
+					[]provider.ResourceChange{{Type: "AWS::EC2::EIP", Name: "EIP1", Action: provider.ChangeActionModify}},
+					natResources(provider.ChangeActionAdd)[2:]...,
+				),
+			},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			plan, err := newProvider(tc.cf).Plan(context.Background(), tc.state)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, plan)
+		})
+	}
+}
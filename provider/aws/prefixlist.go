@@ -0,0 +1,80 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+// prefixListCache caches the resolved entries of managed prefix lists and
+// refreshes them once they are older than the refresh interval.
+type prefixListCache struct {
+	sync.Mutex
+	refreshInterval time.Duration
+	entries         map[string]prefixListEntries
+}
+
+type prefixListEntries struct {
+	nets      []netip.Prefix
+	fetchedAt time.Time
+}
+
+func newPrefixListCache(refreshInterval time.Duration) *prefixListCache {
+	return &prefixListCache{
+		refreshInterval: refreshInterval,
+		entries:         make(map[string]prefixListEntries),
+	}
+}
+
+// ResolvePrefixList resolves a managed prefix list ID into the CIDRs it
+// contains. Results are cached and refreshed periodically.
+func (p *AWSProvider) ResolvePrefixList(ctx context.Context, id string) ([]netip.Prefix, error) {
+	p.prefixLists.Lock()
+	defer p.prefixLists.Unlock()
+
+	cached, ok := p.prefixLists.entries[id]
+	if ok && time.Since(cached.fetchedAt) < p.prefixLists.refreshInterval {
+		return cached.nets, nil
+	}
+
+	nets, err := p.getPrefixListEntries(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	p.logger.Debugf("Resolved prefix list %s: %v", id, nets)
+	p.prefixLists.entries[id] = prefixListEntries{
+		nets:      nets,
+		fetchedAt: time.Now(),
+	}
+	return nets, nil
+}
+
+func (p *AWSProvider) getPrefixListEntries(ctx context.Context, id string) ([]netip.Prefix, error) {
+	params := &ec2.GetManagedPrefixListEntriesInput{
+		PrefixListId: aws.String(id),
+	}
+	paginator := ec2.NewGetManagedPrefixListEntriesPaginator(p.ec2, params)
+
+	var nets []netip.Prefix
+	for paginator.HasMorePages() {
+		resp, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range resp.Entries {
+			prefix, err := netip.ParsePrefix(aws.ToString(entry.Cidr))
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s' in prefix list %s: %w", aws.ToString(entry.Cidr), id, err)
+			}
+			nets = append(nets, prefix.Masked())
+		}
+	}
+	return nets, nil
+}
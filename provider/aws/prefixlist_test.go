@@ -0,0 +1,112 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type mockPrefixListEC2 struct {
+	ec2API
+	err     error
+	entries map[string][]string
+	calls   int
+}
+
+func (m *mockPrefixListEC2) GetManagedPrefixListEntries(_ context.Context, in *ec2.GetManagedPrefixListEntriesInput, _ ...func(*ec2.Options)) (*ec2.GetManagedPrefixListEntriesOutput, error) {
+	m.calls++
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	out := &ec2.GetManagedPrefixListEntriesOutput{}
+	for _, cidr := range m.entries[aws.ToString(in.PrefixListId)] {
+		out.Entries = append(out.Entries, ec2types.PrefixListEntry{Cidr: aws.String(cidr)})
+	}
+	return out, nil
+}
+
+func TestResolvePrefixList(tt *testing.T) {
+	for _, tc := range []struct {
+		msg             string
+		ec2             *mockPrefixListEC2
+		refreshInterval time.Duration
+		expected        []string
+		expectedCalls   int
+		success         bool
+	}{
+		{
+			msg: "entries should be resolved and cached",
+			ec2: &mockPrefixListEC2{
+				entries: map[string][]string{
+					"pl-1111": {"1.2.3.0/24", "5.6.7.8/32"},
+				},
+			},
+			refreshInterval: time.Hour,
+			expected:        []string{"1.2.3.0/24", "5.6.7.8/32"},
+			expectedCalls:   1,
+			success:         true,
+		},
+		{
+			msg: "entries should be refreshed after the refresh interval",
+			ec2: &mockPrefixListEC2{
+				entries: map[string][]string{
+					"pl-1111": {"1.2.3.0/24"},
+				},
+			},
+			refreshInterval: 0,
+			expected:        []string{"1.2.3.0/24"},
+			expectedCalls:   2,
+			success:         true,
+		},
+		{
+			msg: "invalid entries should result in error",
+			ec2: &mockPrefixListEC2{
+				entries: map[string][]string{
+					"pl-1111": {"foo"},
+				},
+			},
+			refreshInterval: time.Hour,
+			success:         false,
+		},
+		{
+			msg: "failing API calls should result in error",
+			ec2: &mockPrefixListEC2{
+				err: errors.New("failed"),
+			},
+			refreshInterval: time.Hour,
+			success:         false,
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			p := &AWSProvider{
+				ec2:         tc.ec2,
+				prefixLists: newPrefixListCache(tc.refreshInterval),
+				logger:      log.WithFields(log.Fields{"provider": ProviderName}),
+			}
+
+			for i := 0; i < 2; i++ {
+				nets, err := p.ResolvePrefixList(context.Background(), "pl-1111")
+				if !tc.success {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+
+				cidrs := make([]string, 0, len(nets))
+				for _, n := range nets {
+					cidrs = append(cidrs, n.String())
+				}
+				require.Equal(t, tc.expected, cidrs)
+			}
+			require.Equal(t, tc.expectedCalls, tc.ec2.calls)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	cft "github.com/crewjam/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+const (
+	privateNATRoutePrefix = "RouteToPrivateNAT"
+	privateIPOutputPrefix = "PrivateIP"
+)
+
+// PrivateNATConfig configures private NAT gateways for the egress traffic
+// of resources with private connectivity. Private NAT gateways have no EIP
+// but translate to fixed private IPs, e.g. allow-listed by on-premise
+// networks reached via Direct Connect.
+type PrivateNATConfig struct {
+	// SubnetIDs are the subnets of the private NAT gateways, one per
+	// availability zone in the same order. Their route tables must route
+	// the private egress CIDRs, e.g. to a virtual private gateway.
+	SubnetIDs []string
+	// IPs are the private IPs of the NAT gateways, one per availability
+	// zone within the subnet of the zone.
+	IPs []string
+}
+
+func (c PrivateNATConfig) enabled() bool {
+	return len(c.SubnetIDs) > 0
+}
+
+// validate checks the number of subnets and IPs against the number of
+// availability zones.
+func (c PrivateNATConfig) validate(zones int) error {
+	if !c.enabled() {
+		if len(c.IPs) > 0 {
+			return fmt.Errorf("private NAT gateway IPs require the subnets of the private NAT gateways")
+		}
+		return nil
+	}
+
+	switch {
+	case len(c.SubnetIDs) != zones:
+		return fmt.Errorf("expected %d private NAT gateway subnets, one per availability zone, got %d", zones, len(c.SubnetIDs))
+	case len(c.IPs) != zones:
+		return fmt.Errorf("expected %d private NAT gateway IPs, one per availability zone, got %d", zones, len(c.IPs))
+	}
+
+	for _, ip := range c.IPs {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || !addr.Is4() {
+			return fmt.Errorf("invalid private NAT gateway IP '%s'", ip)
+		}
+	}
+	return nil
+}
+
+// privateNATGateway is an AWS::EC2::NatGateway with private connectivity,
+// which isn't supported by cft.EC2NatGateway.
+type privateNATGateway struct {
+	ConnectivityType *cft.StringExpr `json:"ConnectivityType,omitempty"`
+	PrivateIPAddress *cft.StringExpr `json:"PrivateIpAddress,omitempty"`
+	SubnetID         *cft.StringExpr `json:"SubnetId,omitempty"`
+}
+
+func (privateNATGateway) CfnResourceType() string {
+	return "AWS::EC2::NatGateway"
+}
+
+// egressRoutes are the routes of the egress stack by connectivity.
+type egressRoutes struct {
+	public  []netip.Prefix
+	private []netip.Prefix
+	// conflicting are private routes also configured with public
+	// connectivity, which are routed via the public egress target.
+	conflicting []netip.Prefix
+	// unsupported are private routes skipped as no private NAT gateways
+	// are configured.
+	unsupported []netip.Prefix
+	// shards are the public routes of the shard stacks, which aren't
+	// part of the egress stack.
+	shards [][]netip.Prefix
+}
+
+// egressRoutes splits the routes of the state by the connectivity of the
+// resources configuring them.
+func (p *AWSProvider) egressRoutes(state *provider.DesiredState) egressRoutes {
+	public := state.FilterConnectivity(provider.ConnectivityPublic).RoutesWithOptions(p.routeOptions)
+	routes := egressRoutes{public: public}
+	if p.shards.enabled() {
+		routes.shards = p.shards.split(public, state)
+		routes.public = nil
+	}
+
+	private := state.FilterConnectivity(provider.ConnectivityPrivate).RoutesWithOptions(p.routeOptions)
+	if !p.privateNAT.enabled() {
+		routes.unsupported = private
+		return routes
+	}
+
+	publicSet := provider.PrefixSet(public)
+	for _, route := range private {
+		if _, ok := publicSet[route.String()]; ok {
+			routes.conflicting = append(routes.conflicting, route)
+			continue
+		}
+		routes.private = append(routes.private, route)
+	}
+	return routes
+}
+
+// changed returns true if the routes differ from the ones of the template.
+func (r egressRoutes) changed(templateBody string) bool {
+	return !stringSetEqual(getCIDRsFromTemplate(templateBody), provider.PrefixSet(r.public)) ||
+		!stringSetEqual(getPrivateCIDRsFromTemplate(templateBody), provider.PrefixSet(r.private))
+}
+
+// addPrivateNATGateways adds the private NAT gateways of all availability
+// zones exporting their private IPs.
+func (p *AWSProvider) addPrivateNATGateways(template *cft.Template) {
+	for i := range p.availabilityZones {
+		template.AddResource(fmt.Sprintf("PrivateNATGateway%d", i+1), &privateNATGateway{
+			ConnectivityType: cft.String("private"),
+			PrivateIPAddress: cft.String(p.privateNAT.IPs[i]),
+			SubnetID:         cft.String(p.privateNAT.SubnetIDs[i]),
+		})
+		template.Outputs[fmt.Sprintf("%s%d", privateIPOutputPrefix, i+1)] = &cft.Output{
+			Description: fmt.Sprintf("private IP of the PrivateNATGateway%d", i+1),
+			Value:       p.privateNAT.IPs[i],
+		}
+	}
+}
+
+// addPrivateNATRoutes adds the routes of the CIDR to the private NAT
+// gateways of the zones of the route tables.
+func addPrivateNATRoutes(template *cft.Template, cidrEntry, cleanCidrEntry string, routeTableParamOrder []string, routeTableZoneIndexes map[string]int) {
+	for i, routeTableParam := range routeTableParamOrder {
+		template.AddResource(fmt.Sprintf("%s%dz%s", privateNATRoutePrefix, i+1, cleanCidrEntry), &cft.EC2Route{
+			RouteTableID:         cft.Ref(routeTableParam).String(),
+			DestinationCidrBlock: cft.String(cidrEntry),
+			NatGatewayID: cft.Ref(fmt.Sprintf(
+				"PrivateNATGateway%d",
+				routeTableZoneIndexes[routeTableParam]+1,
+			)).String(),
+		})
+	}
+}
+
+// getPrivateCIDRsFromTemplate parses the CIDRs routed to the private NAT
+// gateways from the CloudFormation template.
+func getPrivateCIDRsFromTemplate(template string) map[string]struct{} {
+	return getRouteCIDRsFromTemplate(template, privateNATRoutePrefix)
+}
+
+// validatePrivateNAT makes sure the subnets of the private NAT gateways
+// exist in the VPC and their availability zones, and that the private IPs
+// are part of them.
+func (p *AWSProvider) validatePrivateNAT(ctx context.Context) error {
+	err := p.privateNAT.validate(len(p.availabilityZones))
+	if err != nil {
+		return provider.NewError(provider.ErrorClassPermanent, err)
+	}
+	if !p.privateNAT.enabled() {
+		return nil
+	}
+	return classifyError(p.validatePrivateNATSubnets(ctx))
+}
+
+func (p *AWSProvider) validatePrivateNATSubnets(ctx context.Context) error {
+	vpcID, err := p.findVPC(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.ec2.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		SubnetIds: p.privateNAT.SubnetIDs,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to describe private NAT gateway subnets %s", strings.Join(p.privateNAT.SubnetIDs, ", "))
+	}
+
+	subnets := make(map[string]ec2types.Subnet, len(resp.Subnets))
+	for _, subnet := range resp.Subnets {
+		subnets[aws.ToString(subnet.SubnetId)] = subnet
+	}
+
+	for i, id := range p.privateNAT.SubnetIDs {
+		subnet, ok := subnets[id]
+		if !ok {
+			return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("private NAT gateway subnet %s not found", id))
+		}
+
+		zone := p.availabilityZones[i]
+		switch {
+		case aws.ToString(subnet.VpcId) != vpcID:
+			return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("private NAT gateway subnet %s is not in VPC %s", id, vpcID))
+		case aws.ToString(subnet.AvailabilityZone) != zone:
+			return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("private NAT gateway subnet %s is in %s instead of %s", id, aws.ToString(subnet.AvailabilityZone), zone))
+		}
+
+		cidr, err := netip.ParsePrefix(aws.ToString(subnet.CidrBlock))
+		if err != nil || !cidr.Contains(netip.MustParseAddr(p.privateNAT.IPs[i])) {
+			return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("private NAT gateway IP %s is not in subnet %s (%s)", p.privateNAT.IPs[i], id, aws.ToString(subnet.CidrBlock)))
+		}
+	}
+	return nil
+}
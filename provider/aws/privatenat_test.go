@@ -0,0 +1,160 @@
+package aws
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestValidatePrivateNAT(tt *testing.T) {
+	subnets := func() *mockEC2 {
+		return &mockEC2{
+			describeSubnets: &ec2.DescribeSubnetsOutput{
+				Subnets: []ec2types.Subnet{
+					{SubnetId: aws.String("subnet-1"), VpcId: aws.String("vpc-1"), AvailabilityZone: aws.String("eu-central-1a"), CidrBlock: aws.String("10.10.0.0/24")},
+					{SubnetId: aws.String("subnet-2"), VpcId: aws.String("vpc-1"), AvailabilityZone: aws.String("eu-central-1b"), CidrBlock: aws.String("10.10.1.0/24")},
+				},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		msg        string
+		privateNAT PrivateNATConfig
+		ec2        func() *mockEC2
+		err        string
+	}{
+		{
+			msg: "private NAT gateways should be disabled by default",
+			ec2: func() *mockEC2 { return &mockEC2{} },
+		},
+		{
+			msg:        "private NAT gateways should be created in the subnets of their zones",
+			privateNAT: PrivateNATConfig{SubnetIDs: []string{"subnet-1", "subnet-2"}, IPs: []string{"10.10.0.10", "10.10.1.10"}},
+			ec2:        subnets,
+		},
+		{
+			msg:        "private IPs should require the subnets",
+			privateNAT: PrivateNATConfig{IPs: []string{"10.10.0.10", "10.10.1.10"}},
+			ec2:        subnets,
+			err:        "permanent: private NAT gateway IPs require the subnets of the private NAT gateways",
+		},
+		{
+			msg:        "a subnet should be configured per zone",
+			privateNAT: PrivateNATConfig{SubnetIDs: []string{"subnet-1"}, IPs: []string{"10.10.0.10"}},
+			ec2:        subnets,
+			err:        "permanent: expected 2 private NAT gateway subnets, one per availability zone, got 1",
+		},
+		{
+			msg:        "a private IP should be configured per zone",
+			privateNAT: PrivateNATConfig{SubnetIDs: []string{"subnet-1", "subnet-2"}, IPs: []string{"10.10.0.10"}},
+			ec2:        subnets,
+			err:        "permanent: expected 2 private NAT gateway IPs, one per availability zone, got 1",
+		},
+		{
+			msg:        "invalid private IPs should be rejected",
+			privateNAT: PrivateNATConfig{SubnetIDs: []string{"subnet-1", "subnet-2"}, IPs: []string{"10.10.0.10", "10.10.1.0/24"}},
+			ec2:        subnets,
+			err:        "permanent: invalid private NAT gateway IP '10.10.1.0/24'",
+		},
+		{
+			msg:        "missing subnets should be rejected",
+			privateNAT: PrivateNATConfig{SubnetIDs: []string{"subnet-1", "subnet-3"}, IPs: []string{"10.10.0.10", "10.10.1.10"}},
+			ec2:        subnets,
+			err:        "permanent: private NAT gateway subnet subnet-3 not found",
+		},
+		{
+			msg:        "subnets should be in the VPC",
+			privateNAT: PrivateNATConfig{SubnetIDs: []string{"subnet-1", "subnet-2"}, IPs: []string{"10.10.0.10", "10.10.1.10"}},
+			ec2: func() *mockEC2 {
+				m := subnets()
+				m.describeSubnets.Subnets[1].VpcId = aws.String("vpc-2")
+				return m
+			},
+			err: "permanent: private NAT gateway subnet subnet-2 is not in VPC vpc-1",
+		},
+		{
+			msg:        "subnets should be in the order of the zones",
+			privateNAT: PrivateNATConfig{SubnetIDs: []string{"subnet-2", "subnet-1"}, IPs: []string{"10.10.1.10", "10.10.0.10"}},
+			ec2:        subnets,
+			err:        "permanent: private NAT gateway subnet subnet-2 is in eu-central-1b instead of eu-central-1a",
+		},
+		{
+			msg:        "private IPs should be in the subnets",
+			privateNAT: PrivateNATConfig{SubnetIDs: []string{"subnet-1", "subnet-2"}, IPs: []string{"10.10.0.10", "10.10.0.11"}},
+			ec2:        subnets,
+			err:        "permanent: private NAT gateway IP 10.10.0.11 is not in subnet subnet-2 (10.10.1.0/24)",
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			p := newTestProvider(tc.ec2(), "eu-central-1a", "eu-central-1b")
+			p.privateNAT = tc.privateNAT
+			err := p.validatePrivateNAT(t.Context())
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				require.Equal(t, provider.ErrorClassPermanent, provider.ClassOf(err))
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestEnsurePrivateNAT(t *testing.T) {
+	public := provider.Resource{Name: "public", Namespace: "x"}
+	private := provider.Resource{Name: "private", Namespace: "x"}
+	publicState := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		public: {netip.MustParsePrefix("1.0.0.1/32")},
+	})
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		public:  {netip.MustParsePrefix("1.0.0.1/32")},
+		private: {netip.MustParsePrefix("1.0.0.1/32"), netip.MustParsePrefix("192.168.0.0/16")},
+	}).WithConnectivity(map[provider.Resource]provider.Connectivity{private: provider.ConnectivityPrivate})
+
+	p := newTestProvider(&mockEC2{}, "eu-central-1a", "eu-central-1b")
+	cf := newTestStack(p, publicState)
+
+	// private routes are skipped without private NAT gateways
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.Nil(t, cf.parameters)
+
+	p.privateNAT = PrivateNATConfig{
+		SubnetIDs: []string{"subnet-1", "subnet-2"},
+		IPs:       []string{"10.10.0.10", "10.10.1.10"},
+	}
+	plan, err := p.Plan(t.Context(), state)
+	require.NoError(t, err)
+	require.Equal(t, provider.PlanActionUpdate, plan.Action)
+	require.Equal(t, []provider.RouteTableChange{
+		{RouteTable: "rtb-1", Added: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}},
+		{RouteTable: "rtb-2", Added: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}},
+	}, plan.RouteTables)
+	require.Equal(t, []provider.ResourceChange{
+		{Type: "AWS::EC2::NatGateway", Name: "PrivateNATGateway1", Action: provider.ChangeActionAdd},
+		{Type: "AWS::EC2::NatGateway", Name: "PrivateNATGateway2", Action: provider.ChangeActionAdd},
+	}, plan.Resources)
+	require.False(t, plan.ReplacesEgressIPs)
+
+	// routes configured as public and private are routed via the public
+	// NAT gateways
+	require.NoError(t, p.Ensure(t.Context(), state))
+	template := parseStackTemplate(cf.templateBody)
+	require.Equal(t, map[string]struct{}{"1.0.0.1/32": {}}, getCIDRsFromTemplate(cf.templateBody))
+	require.Equal(t, map[string]struct{}{"192.168.0.0/16": {}}, getPrivateCIDRsFromTemplate(cf.templateBody))
+	require.Equal(t, map[string]interface{}{
+		"ConnectivityType": "private",
+		"PrivateIpAddress": "10.10.1.10",
+		"SubnetId":         "subnet-2",
+	}, template.Resources["PrivateNATGateway2"].Properties)
+	require.Equal(t, map[string]interface{}{"Ref": "PrivateNATGateway2"}, template.Resources["RouteToPrivateNAT2z192x168x0x0y16"].Properties["NatGatewayId"])
+	require.Equal(t, "10.10.0.10", template.Outputs["PrivateIP1"].Value)
+	require.Contains(t, template.Resources, "NATGateway1")
+
+	// further syncs don't update the stack
+	requireStackUnchanged(t, p, cf, state)
+}
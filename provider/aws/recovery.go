@@ -0,0 +1,148 @@
+package aws
+
+import (
+	"context"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// recoveryContinueUpdateRollback continues the rollback of stacks in
+	// UPDATE_ROLLBACK_FAILED, skipping the resources failing it.
+	recoveryContinueUpdateRollback = "continue-update-rollback"
+	// recoveryRecreate deletes stacks in ROLLBACK_COMPLETE, which never
+	// finished creating, so they are created again.
+	recoveryRecreate = "recreate"
+	// recoveryRetryDelete retries deleting stacks in DELETE_FAILED.
+	recoveryRetryDelete = "retry-delete"
+)
+
+// RecoveryActions are the supported recovery actions.
+var RecoveryActions = []string{recoveryContinueUpdateRollback, recoveryRecreate, recoveryRetryDelete}
+
+// stuckStatusRecoveries are the recovery actions of the stack states which
+// can't be updated anymore.
+var stuckStatusRecoveries = map[cftypes.StackStatus]string{
+	cftypes.StackStatusUpdateRollbackFailed: recoveryContinueUpdateRollback,
+	cftypes.StackStatusRollbackComplete:     recoveryRecreate,
+	cftypes.StackStatusDeleteFailed:         recoveryRetryDelete,
+}
+
+var stackRecoveries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "kube_static_egress",
+		Subsystem: "aws",
+		Name:      "stack_recoveries_total",
+		Help:      "Number of recoveries of stuck stacks by action and result",
+	},
+	[]string{"action", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(stackRecoveries)
+}
+
+// RecoveryConfig configures the recovery of stacks stuck in a state which
+// can't be updated. Every recovery action is opt-in.
+type RecoveryConfig struct {
+	Actions []string
+}
+
+func (c RecoveryConfig) enabled(action string) bool {
+	return slices.Contains(c.Actions, action)
+}
+
+// recoverStack starts the recovery of the stack if it's stuck and the
+// recovery action of its state is enabled. Recoveries deleting the stack
+// are followed by creating it again once the stack is deleted.
+func (p *AWSProvider) recoverStack(ctx context.Context, stack cftypes.Stack) error {
+	action, ok := stuckStatusRecoveries[stack.StackStatus]
+	if !ok {
+		return nil
+	}
+
+	stackName := aws.ToString(stack.StackName)
+	if !p.recovery.enabled(action) {
+		p.logger.Warnf("Stack %s is stuck in %s, recover it with --aws-stack-recovery=%s", stackName, stack.StackStatus, action)
+		return nil
+	}
+
+	p.logger.Infof("Recovering stack %s from %s by %s", stackName, stack.StackStatus, action)
+	var err error
+	switch action {
+	case recoveryContinueUpdateRollback:
+		err = p.continueUpdateRollback(ctx, stackName)
+	case recoveryRecreate, recoveryRetryDelete:
+		err = p.deleteCFStack(ctx, stackName, action)
+	}
+	if err != nil {
+		stackRecoveries.WithLabelValues(action, "failure").Inc()
+		return errors.Wrapf(err, "failed to recover stack %s from %s by %s", stackName, stack.StackStatus, action)
+	}
+	return nil
+}
+
+// continueUpdateRollback starts continuing the rollback of the stack,
+// skipping the resources which failed to roll back.
+func (p *AWSProvider) continueUpdateRollback(ctx context.Context, stackName string) error {
+	skip, err := p.getRollbackFailedResources(ctx, stackName)
+	if err != nil {
+		return err
+	}
+
+	if p.dry {
+		p.logger.Debugf("%s: DRY: Stack to continue rolling back: %s, skipping %v", p, stackName, skip)
+		return nil
+	}
+
+	p.logger.Infof("Continuing rollback of stack %s, skipping %v", stackName, skip)
+	_, err = p.cloudformation.ContinueUpdateRollback(ctx, &cloudformation.ContinueUpdateRollbackInput{
+		StackName:       aws.String(stackName),
+		ResourcesToSkip: skip,
+	})
+	if err != nil {
+		return err
+	}
+	p.startOperation(stackName, "", recoveryContinueUpdateRollback)
+	return nil
+}
+
+// getRollbackFailedResources returns the resources which failed to roll
+// back in the last rollback of the stack.
+func (p *AWSProvider) getRollbackFailedResources(ctx context.Context, stackName string) ([]string, error) {
+	params := &cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(stackName),
+	}
+
+	var failed []string
+	for page := 0; page < maxStackEventPages; page++ {
+		resp, err := p.cloudformation.DescribeStackEvents(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, event := range resp.StackEvents {
+			logicalID := aws.ToString(event.LogicalResourceId)
+			if logicalID == stackName {
+				if event.ResourceStatus == cftypes.ResourceStatusUpdateRollbackInProgress {
+					return failed, nil
+				}
+				continue
+			}
+			if event.ResourceStatus == cftypes.ResourceStatusUpdateFailed && !slices.Contains(failed, logicalID) {
+				failed = append(failed, logicalID)
+			}
+		}
+
+		if resp.NextToken == nil {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+	return failed, nil
+}
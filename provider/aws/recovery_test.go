@@ -0,0 +1,163 @@
+package aws
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestRecoverStack(tt *testing.T) {
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		{Name: "a", Namespace: "x"}: {netip.MustParsePrefix("1.0.0.0/24")},
+	})
+	retained := &ec2.DescribeAddressesOutput{
+		Addresses: []ec2types.Address{{
+			AllocationId: aws.String("eipalloc-1"),
+			PublicIp:     aws.String("52.0.0.1"),
+			Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+		}},
+	}
+
+	for _, tc := range []struct {
+		msg       string
+		status    cftypes.StackStatus
+		actions   []string
+		state     *provider.DesiredState
+		skipped   []string
+		recreated bool
+		deleted   bool
+		action    string
+	}{
+		{
+			msg:    "stuck stacks should not be recovered by default",
+			status: cftypes.StackStatusUpdateRollbackFailed,
+			state:  state,
+		},
+		{
+			msg:     "update rollbacks should be continued skipping the failed resources",
+			status:  cftypes.StackStatusUpdateRollbackFailed,
+			actions: []string{recoveryContinueUpdateRollback},
+			state:   state,
+			skipped: []string{"NATGateway1"},
+			action:  recoveryContinueUpdateRollback,
+		},
+		{
+			msg:     "stacks should only be recovered by the action of their status",
+			status:  cftypes.StackStatusRollbackComplete,
+			actions: []string{recoveryContinueUpdateRollback, recoveryRetryDelete},
+			state:   state,
+		},
+		{
+			msg:       "stacks which never finished creating should be recreated adopting retained EIPs",
+			status:    cftypes.StackStatusRollbackComplete,
+			actions:   []string{recoveryRecreate},
+			state:     state,
+			recreated: true,
+			deleted:   true,
+			action:    recoveryRecreate,
+		},
+		{
+			msg:     "failed deletes should be retried",
+			status:  cftypes.StackStatusDeleteFailed,
+			actions: []string{recoveryRetryDelete},
+			state:   provider.NewDesiredState(nil),
+			deleted: true,
+			action:  recoveryRetryDelete,
+		},
+		{
+			msg:       "failed deletes of stacks still in use should be recreated",
+			status:    cftypes.StackStatusDeleteFailed,
+			actions:   []string{recoveryRetryDelete},
+			state:     state,
+			recreated: true,
+			deleted:   true,
+			action:    recoveryRetryDelete,
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			cf := newMockStacks()
+			ec2API := &mockEC2{
+				describeInternetGatewaysOutput: &ec2.DescribeInternetGatewaysOutput{
+					InternetGateways: []ec2types.InternetGateway{{InternetGatewayId: aws.String("igw-1")}},
+				},
+				describeRouteTables: &ec2.DescribeRouteTablesOutput{
+					RouteTables: []ec2types.RouteTable{
+						{
+							RouteTableId: aws.String("rtb-1"),
+							Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+						},
+					},
+				},
+			}
+			p := &AWSProvider{
+				clusterID:          "cluster",
+				controllerID:       "controller",
+				clusterIDTagPrefix: clusterIDTagPrefix,
+				vpcID:              "vpc-1",
+				natCidrBlocks:      []string{"172.31.64.0/28"},
+				availabilityZones:  []string{"eu-central-1a"},
+				cloudformation:     cf,
+				operations:         newOperationStore(),
+				ec2:                ec2API,
+				recovery:           RecoveryConfig{Actions: tc.actions},
+				logger:             log.WithFields(log.Fields{"provider": ProviderName}),
+			}
+
+			require.NoError(t, p.Ensure(t.Context(), state))
+			stuck, err := p.getEgressStack(t.Context())
+			require.NoError(t, err)
+			stuckName := aws.ToString(stuck.StackName)
+			cf.stacks[stuckName].StackStatus = tc.status
+			cf.events[stuckName] = []cftypes.StackEvent{
+				stackEvent(stuckName, "AWS::CloudFormation::Stack", cftypes.ResourceStatusUpdateRollbackFailed, ""),
+				stackEvent("NATGateway1", "AWS::EC2::NatGateway", cftypes.ResourceStatusUpdateFailed, "NAT gateway nat-1 was not found"),
+				stackEvent(stuckName, "AWS::CloudFormation::Stack", cftypes.ResourceStatusUpdateRollbackInProgress, ""),
+				stackEvent("RouteToNAT1z1x0x0x0y24", "AWS::EC2::Route", cftypes.ResourceStatusUpdateFailed, "Route not found"),
+			}
+			ec2API.describeAddresses = retained
+
+			var recoveries float64
+			if tc.action != "" {
+				recoveries = testutil.ToFloat64(stackRecoveries.WithLabelValues(tc.action, "success"))
+			}
+
+			require.NoError(t, p.Ensure(t.Context(), tc.state))
+			if tc.skipped != nil {
+				require.Len(t, cf.continued, 1)
+				require.Equal(t, tc.skipped, cf.continued[0].ResourcesToSkip)
+				require.Equal(t, cftypes.StackStatusUpdateRollbackComplete, cf.stacks[stuckName].StackStatus)
+			} else {
+				require.Empty(t, cf.continued)
+			}
+			if tc.action != "" {
+				require.Equal(t, recoveries+1, testutil.ToFloat64(stackRecoveries.WithLabelValues(tc.action, "success")))
+			}
+
+			if !tc.deleted {
+				if tc.skipped == nil {
+					require.Equal(t, tc.status, cf.stacks[stuckName].StackStatus)
+				}
+				return
+			}
+			require.Equal(t, cftypes.StackStatusDeleteComplete, cf.stacks[stuckName].StackStatus)
+
+			stack, err := p.getEgressStack(t.Context())
+			require.NoError(t, err)
+			if !tc.recreated {
+				require.Nil(t, stack.StackName)
+				return
+			}
+			require.NotEqual(t, stuckName, aws.ToString(stack.StackName))
+			template := parseStackTemplate(cf.templates[aws.ToString(stack.StackName)])
+			require.Equal(t, "eipalloc-1", template.Resources["NATGateway1"].Properties["AllocationId"])
+		})
+	}
+}
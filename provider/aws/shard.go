@@ -0,0 +1,581 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	cft "github.com/crewjam/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+const (
+	shardTagKey            = "kube-static-egress-controller/shard"
+	shardByHash            = "hash"
+	shardByGroup           = "group"
+	natGatewayOutputPrefix = "NATGateway"
+)
+
+// ShardConfig configures splitting the routes of the egress stack across
+// several shard stacks. The egress stack keeps the NAT gateways, EIPs and
+// subnets and exports the IDs of the NAT gateways, the shard stacks only
+// contain the routes to them. Every shard is reconciled independently, so
+// a failing update only blocks the routes of its shard.
+type ShardConfig struct {
+	// Count is the number of shard stacks. If 0 all routes are part of
+	// the egress stack.
+	Count int
+	// By defines how routes are assigned to shards, either by a hash of
+	// the route or by its egress group, the namespace of the resource
+	// configuring it. Both are hashed consistently, so changing the
+	// number of shards only moves the routes of a fraction of them.
+	By string
+}
+
+func (c ShardConfig) enabled() bool {
+	return c.Count > 0
+}
+
+// validate checks the configuration for consistency with the other modes.
+// Shard stacks route to the NAT gateways of the egress stack one by one.
+func (c ShardConfig) validate(transitGateway TransitGatewayConfig, existingNAT ExistingNATConfig, prefixList PrefixListConfig) error {
+	switch {
+	case c.Count < 0:
+		return fmt.Errorf("invalid number of stack shards %d", c.Count)
+	case c.By != shardByHash && c.By != shardByGroup:
+		return fmt.Errorf("invalid stack shard key '%s', must be %s or %s", c.By, shardByHash, shardByGroup)
+	case !c.enabled():
+		return nil
+	case transitGateway.enabled(), existingNAT.enabled():
+		return fmt.Errorf("stack shards require NAT gateways created by the controller")
+	case prefixList.Enabled:
+		return fmt.Errorf("stack shards and prefix list routing are mutually exclusive")
+	}
+	return nil
+}
+
+// split assigns the routes to the shards.
+func (c ShardConfig) split(routes []netip.Prefix, state *provider.DesiredState) [][]netip.Prefix {
+	shards := make([][]netip.Prefix, c.Count)
+	for _, route := range routes {
+		key := route.String()
+		if c.By == shardByGroup {
+			if sources := state.Provenance(route); len(sources) > 0 {
+				key = sources[0].Resource.Namespace
+			}
+		}
+		shard := shardOf(key, c.Count)
+		shards[shard] = append(shards[shard], route)
+	}
+	return shards
+}
+
+// shardOf returns the shard of the key by rendezvous hashing.
+func shardOf(key string, shards int) int {
+	var shard int
+	var best uint64
+	for i := range shards {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s/%d", key, i+1)
+		if score := mix64(h.Sum64()); i == 0 || score > best {
+			shard, best = i, score
+		}
+	}
+	return shard
+}
+
+// mix64 is the finalizer of MurmurHash3. FNV barely mixes the trailing
+// shard number of the key into the high bits compared by shardOf.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// natGatewayExportName returns the name of the export of the ID of the
+// i-th NAT gateway of the egress stack.
+func natGatewayExportName(stackName string, i int) string {
+	return fmt.Sprintf("%s-%s%d", stackName, natGatewayOutputPrefix, i)
+}
+
+// addNATGatewayExports exports the IDs of the NAT gateways of the egress
+// stack for the shard stacks.
+func (p *AWSProvider) addNATGatewayExports(template *cft.Template) {
+	for i := 1; i <= len(p.availabilityZones); i++ {
+		name := fmt.Sprintf("%s%d", natGatewayOutputPrefix, i)
+		template.Outputs[name] = &cft.Output{
+			Description: fmt.Sprintf("ID of the %s", name),
+			Value:       cft.Ref(name),
+			Export: &cft.OutputExport{
+				Name: cft.Join("-", cft.Ref("AWS::StackName"), cft.String(name)),
+			},
+		}
+	}
+}
+
+// exportsNATGateways returns true if the stack of the template exports the
+// IDs of its NAT gateways.
+func (t stackTemplate) exportsNATGateways() bool {
+	_, ok := t.Outputs[natGatewayOutputPrefix+"1"]
+	return ok
+}
+
+// generateShardStackSpec generates the spec of the shard stack routing the
+// routes to the NAT gateways of the egress stack.
+func (p *AWSProvider) generateShardStackSpec(shard int, routes []netip.Prefix, tables routeTables, egressStackName string) *stackSpec {
+	tags := map[string]string{
+		p.clusterIDTagPrefix + p.clusterID: resourceLifecycleOwned,
+		kubernetesApplicationTagKey:        p.controllerID,
+		shardTagKey:                        strconv.Itoa(shard),
+	}
+
+	return &stackSpec{
+		name:                       normalizeStackName(fmt.Sprintf("%s-shard%d", p.clusterID, shard)),
+		tableID:                    tables.ids,
+		timeoutInMinutes:           10,
+		template:                   p.generateShardTemplate(shard, routes, tables, egressStackName),
+		stackTerminationProtection: p.stackTerminationProtection,
+		tags:                       tagMapToCloudformationTags(mergeTags(p.additionalStackTags, tags)),
+	}
+}
+
+func (p *AWSProvider) generateShardTemplate(shard int, routes []netip.Prefix, tables routeTables, egressStackName string) string {
+	template := cft.NewTemplate()
+	template.Description = fmt.Sprintf("Static Egress Stack Shard %d", shard)
+	for i, routeTableParam := range tables.paramOrder {
+		template.Parameters[routeTableParam] = &cft.Parameter{
+			Description: fmt.Sprintf("Route Table ID No %d", i+1),
+			Type:        "String",
+		}
+	}
+
+	for _, route := range routes {
+		cidrEntry, cleanCidrEntry := routeNames(route)
+		for i, routeTableParam := range tables.paramOrder {
+			template.AddResource(fmt.Sprintf("RouteToNAT%dz%s", i+1, cleanCidrEntry), &cft.EC2Route{
+				RouteTableID:         cft.Ref(routeTableParam).String(),
+				DestinationCidrBlock: cft.String(cidrEntry),
+				NatGatewayID: cft.ImportValue(cft.String(natGatewayExportName(
+					egressStackName,
+					tables.zoneIndexes[routeTableParam]+1,
+				))).String(),
+			})
+		}
+	}
+
+	stack, _ := json.Marshal(template)
+	return string(stack)
+}
+
+// importsFrom returns true if all routes of the shard stack of the template
+// route to the NAT gateways of the egress stack.
+func (t stackTemplate) importsFrom(egressStackName string) bool {
+	for name, r := range t.Resources {
+		if !t.isEgressRoute(name) {
+			continue
+		}
+		natGatewayID, _ := r.Properties["NatGatewayId"].(map[string]interface{})
+		export, _ := natGatewayID["Fn::ImportValue"].(string)
+		if !strings.HasPrefix(export, egressStackName+"-") {
+			return false
+		}
+	}
+	return true
+}
+
+// getShardStacks returns the shard stacks of the egress stack by shard.
+func (p *AWSProvider) getShardStacks(ctx context.Context) (map[int]cftypes.Stack, error) {
+	stacks, err := p.getOwnedStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make(map[int]cftypes.Stack)
+	for _, stack := range stacks {
+		shard, err := strconv.Atoi(stackTag(stack, shardTagKey))
+		if err != nil || shard < 1 {
+			continue
+		}
+		shards[shard] = stack
+	}
+	return shards, nil
+}
+
+// stackTag returns the value of the tag of the stack.
+func stackTag(stack cftypes.Stack, key string) string {
+	for _, tag := range stack.Tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// sortedShards returns the shards of the stacks in ascending order.
+func sortedShards(stacks map[int]cftypes.Stack) []int {
+	shards := make([]int, 0, len(stacks))
+	for shard := range stacks {
+		shards = append(shards, shard)
+	}
+	sort.Ints(shards)
+	return shards
+}
+
+// ensureShards creates, updates or deletes the shard stacks routing the
+// routes of the desired state to the NAT gateways of the egress stack.
+// Shards are reconciled independently, errors of a shard don't stop the
+// others and shards with an operation in progress are skipped until it
+// finished. Without sharding configured all shard stacks are deleted.
+func (p *AWSProvider) ensureShards(ctx context.Context, state *provider.DesiredState, egressStackName string) error {
+	stacks, err := p.getShardStacks(ctx)
+	if err != nil {
+		return err
+	}
+
+	routes := p.egressRoutes(state).shards
+	busy := make(map[int]bool)
+	errs := p.awaitShards(ctx, stacks, sortedShards(stacks), busy)
+
+	// shards without routes are deleted first, so their routes can be
+	// moved to other shards
+	var started []int
+	for _, shard := range sortedShards(stacks) {
+		if busy[shard] || shard <= len(routes) && len(routes[shard-1]) > 0 {
+			continue
+		}
+		p.logger.Infof("Deleting CF stack shard %d", shard)
+		err := p.deleteShard(ctx, stacks[shard])
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to delete CF stack shard %d", shard))
+			continue
+		}
+		started = append(started, shard)
+	}
+
+	if !p.shards.enabled() {
+		return p.shardErrors(append(errs, p.awaitShards(ctx, stacks, started, busy)...))
+	}
+
+	vpcID, err := p.findVPC(ctx)
+	if err != nil {
+		return err
+	}
+	tables, err := p.routeTables(ctx, vpcID)
+	if err != nil {
+		return err
+	}
+
+	// routes moving to another shard are removed from their current shard
+	// first, adding them before fails as the route already exists. They
+	// are only added to the other shard once the removal finished, so a
+	// shard failing to remove its moved routes only blocks these routes.
+	moved, moveErrs := p.removeMovedRoutes(ctx, stacks, routes, tables, egressStackName, state, busy)
+	errs = append(errs, moveErrs...)
+	started = append(started, moved...)
+	errs = append(errs, p.awaitShards(ctx, stacks, started, busy)...)
+
+	held, err := p.heldRoutes(ctx, stacks)
+	if err != nil {
+		return p.shardErrors(append(errs, err))
+	}
+
+	started = nil
+	for i, shardRoutes := range routes {
+		shard := i + 1
+		if busy[shard] {
+			continue
+		}
+		var added []netip.Prefix
+		for _, route := range shardRoutes {
+			if s, ok := held[route.String()]; !ok || s == shard {
+				added = append(added, route)
+			}
+		}
+		if len(added) == 0 {
+			continue
+		}
+		err := p.ensureShard(ctx, shard, stacks[shard], added, tables, egressStackName, state)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to ensure CF stack shard %d", shard))
+			continue
+		}
+		started = append(started, shard)
+	}
+	return p.shardErrors(append(errs, p.awaitShards(ctx, stacks, started, busy)...))
+}
+
+// awaitShards picks up the results of the operations of the shards. Shards
+// with an operation in progress or failed are marked busy and aren't changed
+// by this sync, shards deleted are removed from the stacks.
+func (p *AWSProvider) awaitShards(ctx context.Context, stacks map[int]cftypes.Stack, shards []int, busy map[int]bool) []error {
+	var errs []error
+	for _, shard := range shards {
+		stackName := aws.ToString(stacks[shard].StackName)
+		if !p.operations.inProgress(stackName) {
+			continue
+		}
+		err := p.awaitStackOperations(ctx, stackName)
+		if err != nil {
+			errs = append(errs, err)
+			busy[shard] = true
+			continue
+		}
+		stack, err := p.getStackByName(ctx, stackName)
+		switch {
+		case isDoesNotExistsErr(err), err == nil && stack.StackStatus == cftypes.StackStatusDeleteComplete:
+			delete(stacks, shard)
+		case err != nil:
+			errs = append(errs, errors.Wrapf(err, "failed to get CF stack shard %d", shard))
+			busy[shard] = true
+		}
+	}
+	return errs
+}
+
+// deleteShard deletes the shard stack, its routes are held until the
+// deletion finished.
+func (p *AWSProvider) deleteShard(ctx context.Context, stack cftypes.Stack) error {
+	templateBody, err := p.getStackTemplateBody(ctx, stack)
+	if err != nil {
+		return err
+	}
+	stackName := aws.ToString(stack.StackName)
+	err = p.deleteCFStack(ctx, stackName, operationDelete)
+	if err != nil {
+		return err
+	}
+	p.operations.hold(stackName, getCIDRsFromTemplate(templateBody))
+	return nil
+}
+
+// heldRoutes returns the shards of the routes of the shard stacks,
+// including the routes they held before their operations in progress.
+func (p *AWSProvider) heldRoutes(ctx context.Context, stacks map[int]cftypes.Stack) (map[string]int, error) {
+	held := make(map[string]int)
+	for _, shard := range sortedShards(stacks) {
+		templateBody, err := p.getStackTemplateBody(ctx, stacks[shard])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get CF stack shard %d", shard)
+		}
+		for cidr := range getCIDRsFromTemplate(templateBody) {
+			held[cidr] = shard
+		}
+		for cidr := range p.operations.held(aws.ToString(stacks[shard].StackName)) {
+			held[cidr] = shard
+		}
+	}
+	return held, nil
+}
+
+// removeMovedRoutes removes the routes assigned to other shards from the
+// shard stacks which aren't busy, shard stacks left without routes are
+// deleted. Routes of the shard which aren't stored yet are not added. The
+// shards updated or deleted are returned.
+func (p *AWSProvider) removeMovedRoutes(ctx context.Context, stacks map[int]cftypes.Stack, routes [][]netip.Prefix, tables routeTables, egressStackName string, state *provider.DesiredState, busy map[int]bool) ([]int, []error) {
+	shards := make(map[string]int)
+	for i, shardRoutes := range routes {
+		for _, route := range shardRoutes {
+			shards[route.String()] = i + 1
+		}
+	}
+
+	var started []int
+	var errs []error
+	for _, shard := range sortedShards(stacks) {
+		if busy[shard] || shard > len(routes) || len(routes[shard-1]) == 0 {
+			// in progress or deleted
+			continue
+		}
+
+		templateBody, err := p.getStackTemplateBody(ctx, stacks[shard])
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to get CF stack shard %d", shard))
+			continue
+		}
+
+		var kept []netip.Prefix
+		moved := 0
+		for cidr := range getCIDRsFromTemplate(templateBody) {
+			if s, ok := shards[cidr]; ok && s != shard {
+				moved++
+				continue
+			}
+			route, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				continue
+			}
+			kept = append(kept, route)
+		}
+		if moved == 0 {
+			continue
+		}
+		sort.Slice(kept, func(i, j int) bool {
+			return kept[i].Addr().Less(kept[j].Addr())
+		})
+
+		p.logger.Infof("Removing %d routes moved to other shards from CF stack shard %d", moved, shard)
+		if len(kept) == 0 {
+			err = p.deleteShard(ctx, stacks[shard])
+		} else {
+			err = p.ensureShard(ctx, shard, stacks[shard], kept, tables, egressStackName, state)
+		}
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to remove moved routes from CF stack shard %d", shard))
+			continue
+		}
+		started = append(started, shard)
+	}
+	return started, errs
+}
+
+// shardErrors logs the errors of all shards and returns the first one,
+// failures are returned before shards in progress.
+func (p *AWSProvider) shardErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		return provider.ClassOf(errs[i]) != provider.ErrorClassInProgress && provider.ClassOf(errs[j]) == provider.ErrorClassInProgress
+	})
+	for _, err := range errs[1:] {
+		p.logger.Error(err)
+	}
+	return errs[0]
+}
+
+func (p *AWSProvider) ensureShard(ctx context.Context, shard int, stack cftypes.Stack, routes []netip.Prefix, tables routeTables, egressStackName string, state *provider.DesiredState) error {
+	if stack.StackName != nil {
+		err := p.recoverStack(ctx, stack)
+		if err != nil {
+			return err
+		}
+		if p.operations.inProgress(aws.ToString(stack.StackName)) {
+			return nil
+		}
+	}
+
+	spec := p.generateShardStackSpec(shard, routes, tables, egressStackName)
+	if stack.StackName == nil {
+		p.logger.Infof("Creating CF stack shard %d with routes %v", shard, routes)
+		return p.createCFStack(ctx, spec)
+	}
+
+	templateBody, err := p.getStackTemplateBody(ctx, stack)
+	if err != nil {
+		return err
+	}
+	stored := getCIDRsFromTemplate(templateBody)
+	if stringSetEqual(stored, provider.PrefixSet(routes)) && parseStackTemplate(templateBody).importsFrom(egressStackName) {
+		return nil
+	}
+
+	spec.name = aws.ToString(stack.StackName)
+	p.logRouteChanges("", stored, routes, state)
+	p.logger.Infof("Updating CF stack shard %d", shard)
+	err = p.updateCFStack(ctx, spec)
+	if err != nil {
+		return err
+	}
+	// the removed routes may be routed until the update finished
+	p.operations.hold(spec.name, stored)
+	return nil
+}
+
+// shardStatuses returns the health of the shard stacks with the routes of
+// their templates.
+func (p *AWSProvider) shardStatuses(ctx context.Context) ([]provider.ResourceHealth, error) {
+	stacks, err := p.getShardStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]provider.ResourceHealth, 0, len(stacks))
+	for _, shard := range sortedShards(stacks) {
+		templateBody, err := p.getStackTemplateBody(ctx, stacks[shard])
+		if err != nil {
+			return nil, err
+		}
+
+		health := stackHealth(stacks[shard])
+		health.Routes = p.templateRoutes(getCIDRsFromTemplate(templateBody))
+		statuses = append(statuses, health)
+	}
+	return statuses, nil
+}
+
+// planShards adds the routes of the current and the desired shard stacks
+// to the routes by route table and returns the shard stacks created or
+// deleted.
+func (p *AWSProvider) planShards(ctx context.Context, state *provider.DesiredState, egressStackName string, currentRoutes, desiredRoutes map[string][]netip.Prefix) ([]provider.ResourceChange, error) {
+	stacks, err := p.getShardStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := p.egressRoutes(state).shards
+	var changes []provider.ResourceChange
+	for _, shard := range sortedShards(stacks) {
+		templateBody, err := p.getStackTemplateBody(ctx, stacks[shard])
+		if err != nil {
+			return nil, err
+		}
+		params := make(map[string]string)
+		for _, param := range stacks[shard].Parameters {
+			params[aws.ToString(param.ParameterKey)] = aws.ToString(param.ParameterValue)
+		}
+		for table, prefixes := range parseStackTemplate(templateBody).routesByTable(params) {
+			currentRoutes[table] = append(currentRoutes[table], prefixes...)
+		}
+
+		if shard > len(routes) || len(routes[shard-1]) == 0 {
+			changes = append(changes, provider.ResourceChange{
+				Type:   "AWS::CloudFormation::Stack",
+				Name:   fmt.Sprintf("Shard%d", shard),
+				Action: provider.ChangeActionRemove,
+			})
+		}
+	}
+
+	if len(routes) == 0 {
+		return changes, nil
+	}
+
+	vpcID, err := p.findVPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := p.routeTables(ctx, vpcID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, shardRoutes := range routes {
+		if len(shardRoutes) == 0 {
+			continue
+		}
+		spec := p.generateShardStackSpec(i+1, shardRoutes, tables, egressStackName)
+		for table, prefixes := range parseStackTemplate(spec.template).routesByTable(spec.tableID) {
+			desiredRoutes[table] = append(desiredRoutes[table], prefixes...)
+		}
+
+		if _, ok := stacks[i+1]; !ok {
+			changes = append(changes, provider.ResourceChange{
+				Type:   "AWS::CloudFormation::Stack",
+				Name:   fmt.Sprintf("Shard%d", i+1),
+				Action: provider.ChangeActionAdd,
+			})
+		}
+	}
+	return changes, nil
+}
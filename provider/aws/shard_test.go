@@ -0,0 +1,538 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+// mockStacks is a cloudformationAPI managing several stacks by name.
+type mockStacks struct {
+	stacks    map[string]*cftypes.Stack
+	templates map[string]string
+	// updates counts the updates by stack.
+	updates map[string]int
+	// failUpdates fails the updates of the stacks.
+	failUpdates map[string]bool
+	// changeSets are the change sets by stack and name.
+	changeSets map[string]*mockChangeSet
+	// changes are the changes of the next change sets.
+	changes []cftypes.Change
+	// events are the events by stack.
+	events map[string][]cftypes.StackEvent
+	// continued are the stacks whose rollback was continued.
+	continued []*cloudformation.ContinueUpdateRollbackInput
+	// running leaves the stacks in progress after starting operations.
+	running bool
+	// creatingChangeSets leaves change sets in progress until
+	// completeChangeSets is called.
+	creatingChangeSets bool
+}
+
+// status returns the status of the stack after starting an operation.
+func (cf *mockStacks) status(running, completed cftypes.StackStatus) cftypes.StackStatus {
+	if cf.running {
+		return running
+	}
+	return completed
+}
+
+func newMockStacks() *mockStacks {
+	return &mockStacks{
+		stacks:      make(map[string]*cftypes.Stack),
+		templates:   make(map[string]string),
+		updates:     make(map[string]int),
+		failUpdates: make(map[string]bool),
+		changeSets:  make(map[string]*mockChangeSet),
+		events:      make(map[string][]cftypes.StackEvent),
+	}
+}
+
+// shard returns the name of the stack of the shard.
+func (cf *mockStacks) shard(shard int) string {
+	for name, stack := range cf.stacks {
+		if stack.StackStatus != cftypes.StackStatusDeleteComplete && stackTag(*stack, shardTagKey) == fmt.Sprint(shard) {
+			return name
+		}
+	}
+	return ""
+}
+
+func (cf *mockStacks) DescribeStacks(_ context.Context, input *cloudformation.DescribeStacksInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeStacksOutput, error) {
+	if input.StackName != nil {
+		stack, ok := cf.stacks[aws.ToString(input.StackName)]
+		if !ok {
+			return nil, fmt.Errorf("stack %s does not exist", aws.ToString(input.StackName))
+		}
+		return &cloudformation.DescribeStacksOutput{Stacks: []cftypes.Stack{*stack}}, nil
+	}
+
+	var stacks []cftypes.Stack
+	for _, stack := range cf.stacks {
+		if stack.StackStatus != cftypes.StackStatusDeleteComplete {
+			stacks = append(stacks, *stack)
+		}
+	}
+	return &cloudformation.DescribeStacksOutput{Stacks: stacks}, nil
+}
+
+func (cf *mockStacks) DescribeStackEvents(_ context.Context, input *cloudformation.DescribeStackEventsInput, _ ...func(*cloudformation.Options)) (*cloudformation.DescribeStackEventsOutput, error) {
+	return &cloudformation.DescribeStackEventsOutput{StackEvents: cf.events[aws.ToString(input.StackName)]}, nil
+}
+
+func (cf *mockStacks) GetTemplate(_ context.Context, input *cloudformation.GetTemplateInput, _ ...func(*cloudformation.Options)) (*cloudformation.GetTemplateOutput, error) {
+	return &cloudformation.GetTemplateOutput{TemplateBody: aws.String(cf.templates[aws.ToString(input.StackName)])}, nil
+}
+
+// routeExists fails like adding a route to a route table which already
+// has a route to the same CIDR, e.g. of another stack.
+func (cf *mockStacks) routeExists(name, template string) error {
+	for other, stack := range cf.stacks {
+		if other == name || stack.StackStatus == cftypes.StackStatusDeleteComplete {
+			continue
+		}
+		existing := getCIDRsFromTemplate(cf.templates[other])
+		for cidr := range getCIDRsFromTemplate(template) {
+			if _, ok := existing[cidr]; ok {
+				return fmt.Errorf("route %s already exists in stack %s", cidr, other)
+			}
+		}
+	}
+	return nil
+}
+
+func (cf *mockStacks) CreateStack(_ context.Context, input *cloudformation.CreateStackInput, _ ...func(*cloudformation.Options)) (*cloudformation.CreateStackOutput, error) {
+	if err := cf.routeExists(aws.ToString(input.StackName), aws.ToString(input.TemplateBody)); err != nil {
+		return nil, err
+	}
+	cf.stacks[aws.ToString(input.StackName)] = &cftypes.Stack{
+		StackName:   input.StackName,
+		StackStatus: cf.status(cftypes.StackStatusCreateInProgress, cftypes.StackStatusCreateComplete),
+		Tags:        input.Tags,
+		Parameters:  input.Parameters,
+	}
+	cf.templates[aws.ToString(input.StackName)] = aws.ToString(input.TemplateBody)
+	return &cloudformation.CreateStackOutput{}, nil
+}
+
+func (cf *mockStacks) UpdateStack(_ context.Context, input *cloudformation.UpdateStackInput, _ ...func(*cloudformation.Options)) (*cloudformation.UpdateStackOutput, error) {
+	name := aws.ToString(input.StackName)
+	if cf.failUpdates[name] {
+		cf.stacks[name].StackStatus = cftypes.StackStatusUpdateRollbackComplete
+		return &cloudformation.UpdateStackOutput{}, nil
+	}
+
+	if err := cf.routeExists(name, aws.ToString(input.TemplateBody)); err != nil {
+		return nil, err
+	}
+
+	cf.stacks[name].StackStatus = cf.status(cftypes.StackStatusUpdateInProgress, cftypes.StackStatusUpdateComplete)
+	cf.stacks[name].Parameters = input.Parameters
+	cf.templates[name] = aws.ToString(input.TemplateBody)
+	cf.updates[name]++
+	return &cloudformation.UpdateStackOutput{}, nil
+}
+
+func (cf *mockStacks) DeleteStack(_ context.Context, input *cloudformation.DeleteStackInput, _ ...func(*cloudformation.Options)) (*cloudformation.DeleteStackOutput, error) {
+	cf.stacks[aws.ToString(input.StackName)].StackStatus = cf.status(cftypes.StackStatusDeleteInProgress, cftypes.StackStatusDeleteComplete)
+	return &cloudformation.DeleteStackOutput{}, nil
+}
+
+func (cf *mockStacks) ContinueUpdateRollback(_ context.Context, input *cloudformation.ContinueUpdateRollbackInput, _ ...func(*cloudformation.Options)) (*cloudformation.ContinueUpdateRollbackOutput, error) {
+	cf.stacks[aws.ToString(input.StackName)].StackStatus = cftypes.StackStatusUpdateRollbackComplete
+	cf.continued = append(cf.continued, input)
+	return &cloudformation.ContinueUpdateRollbackOutput{}, nil
+}
+
+func (cf *mockStacks) UpdateTerminationProtection(context.Context, *cloudformation.UpdateTerminationProtectionInput, ...func(*cloudformation.Options)) (*cloudformation.UpdateTerminationProtectionOutput, error) {
+	return &cloudformation.UpdateTerminationProtectionOutput{}, nil
+}
+
+func TestShardConfig(tt *testing.T) {
+	for _, tc := range []struct {
+		msg            string
+		shards         ShardConfig
+		transitGateway TransitGatewayConfig
+		existingNAT    ExistingNATConfig
+		prefixList     PrefixListConfig
+		err            string
+	}{
+		{
+			msg:    "sharding should be disabled by default",
+			shards: ShardConfig{By: shardByHash},
+		},
+		{
+			msg:    "routes should be sharded by group",
+			shards: ShardConfig{Count: 3, By: shardByGroup},
+		},
+		{
+			msg:    "the number of shards should not be negative",
+			shards: ShardConfig{Count: -1, By: shardByHash},
+			err:    "invalid number of stack shards -1",
+		},
+		{
+			msg:    "unknown shard keys should be rejected",
+			shards: ShardConfig{Count: 3, By: "cidr"},
+			err:    "invalid stack shard key 'cidr', must be hash or group",
+		},
+		{
+			msg:            "shards should require NAT gateways of the controller",
+			shards:         ShardConfig{Count: 3, By: shardByHash},
+			transitGateway: TransitGatewayConfig{ID: "tgw-1"},
+			err:            "stack shards require NAT gateways created by the controller",
+		},
+		{
+			msg:         "shards should not route to existing NAT gateways",
+			shards:      ShardConfig{Count: 3, By: shardByHash},
+			existingNAT: ExistingNATConfig{IDs: []string{"nat-1"}},
+			err:         "stack shards require NAT gateways created by the controller",
+		},
+		{
+			msg:        "shards should not be combined with prefix list routing",
+			shards:     ShardConfig{Count: 3, By: shardByHash},
+			prefixList: PrefixListConfig{Enabled: true},
+			err:        "stack shards and prefix list routing are mutually exclusive",
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			err := tc.shards.validate(tc.transitGateway, tc.existingNAT, tc.prefixList)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestShardSplit(t *testing.T) {
+	var routes []netip.Prefix
+	for i := range 100 {
+		routes = append(routes, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i), 0, 0}), 16))
+	}
+	a := provider.Resource{Name: "a", Namespace: "team-a"}
+	b := provider.Resource{Name: "b", Namespace: "team-b"}
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		a: routes[:50],
+		b: routes[50:],
+	})
+
+	shardsOf := func(config ShardConfig) map[netip.Prefix]int {
+		shards := make(map[netip.Prefix]int)
+		for i, shard := range config.split(routes, state) {
+			for _, route := range shard {
+				shards[route] = i
+			}
+		}
+		return shards
+	}
+
+	// every route is assigned to exactly one shard
+	three := shardsOf(ShardConfig{Count: 3, By: shardByHash})
+	require.Len(t, three, len(routes))
+
+	// adding a shard only moves routes to the new shard
+	four := shardsOf(ShardConfig{Count: 4, By: shardByHash})
+	moved := 0
+	for route, shard := range four {
+		if shard != three[route] {
+			require.Equal(t, 3, shard)
+			moved++
+		}
+	}
+	require.Greater(t, moved, 0)
+	require.Less(t, moved, len(routes)/2)
+
+	// the routes of a group are assigned to the same shard
+	groups := shardsOf(ShardConfig{Count: 3, By: shardByGroup})
+	for _, route := range routes[1:50] {
+		require.Equal(t, groups[routes[0]], groups[route])
+	}
+	for _, route := range routes[51:] {
+		require.Equal(t, groups[routes[50]], groups[route])
+	}
+}
+
+func TestEnsureShards(t *testing.T) {
+	resource := provider.Resource{Name: "a", Namespace: "x"}
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("1.0.0.0/24"),
+		netip.MustParsePrefix("2.0.0.0/24"),
+		netip.MustParsePrefix("3.0.0.0/24"),
+		netip.MustParsePrefix("4.0.0.0/24"),
+		netip.MustParsePrefix("5.0.0.0/24"),
+		netip.MustParsePrefix("6.0.0.0/24"),
+	}
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{resource: prefixes})
+
+	cf := newMockStacks()
+	p := &AWSProvider{
+		clusterID:          "cluster",
+		controllerID:       "controller",
+		clusterIDTagPrefix: clusterIDTagPrefix,
+		vpcID:              "vpc-1",
+		natCidrBlocks:      []string{"172.31.64.0/28", "172.31.64.16/28"},
+		availabilityZones:  []string{"eu-central-1a", "eu-central-1b"},
+		cloudformation:     cf,
+		operations:         newOperationStore(),
+		ec2: &mockEC2{
+			describeInternetGatewaysOutput: &ec2.DescribeInternetGatewaysOutput{
+				InternetGateways: []ec2types.InternetGateway{{InternetGatewayId: aws.String("igw-1")}},
+			},
+			describeRouteTables: &ec2.DescribeRouteTablesOutput{
+				RouteTables: []ec2types.RouteTable{
+					{
+						RouteTableId: aws.String("rtb-1"),
+						Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+					},
+					{
+						RouteTableId: aws.String("rtb-2"),
+						Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1b")}},
+					},
+				},
+			},
+		},
+		shards: ShardConfig{Count: 2, By: shardByHash},
+		logger: log.WithFields(log.Fields{"provider": ProviderName}),
+	}
+	shards := p.shards.split(prefixes, state)
+	require.NotEmpty(t, shards[0])
+	require.NotEmpty(t, shards[1])
+
+	// the plan of a new stack adds the routes of all shards
+	plan, err := p.Plan(t.Context(), state)
+	require.NoError(t, err)
+	require.Equal(t, provider.PlanActionCreate, plan.Action)
+	require.Len(t, plan.RouteTables, 2)
+	require.ElementsMatch(t, prefixes, plan.RouteTables[0].Added)
+	require.Contains(t, plan.Resources, provider.ResourceChange{Type: "AWS::CloudFormation::Stack", Name: "Shard2", Action: provider.ChangeActionAdd})
+
+	// the egress stack exports the NAT gateways routed to by the shards
+	require.NoError(t, p.Ensure(t.Context(), state))
+	egressStack, err := p.getEgressStack(t.Context())
+	require.NoError(t, err)
+	egressStackName := aws.ToString(egressStack.StackName)
+	egress := parseStackTemplate(cf.templates[egressStackName])
+	require.Contains(t, egress.Outputs, "NATGateway2")
+	require.Empty(t, getCIDRsFromTemplate(cf.templates[egressStackName]))
+	for i, shardRoutes := range shards {
+		body := cf.templates[cf.shard(i+1)]
+		require.Equal(t, provider.PrefixSet(shardRoutes), getCIDRsFromTemplate(body))
+
+		_, cleanCidrEntry := routeNames(shardRoutes[0])
+		route := parseStackTemplate(body).Resources["RouteToNAT2z"+cleanCidrEntry]
+		require.Equal(t, map[string]interface{}{"Fn::ImportValue": egressStackName + "-NATGateway2"}, route.Properties["NatGatewayId"])
+	}
+
+	// further syncs don't update any stack
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.Empty(t, cf.updates)
+
+	// changed routes only update their shard
+	added := netip.MustParsePrefix("7.0.0.0/24")
+	addedShard := shardOf(added.String(), 2) + 1
+	otherShard := 3 - addedShard
+	changed := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{resource: append(prefixes, added)})
+	require.NoError(t, p.Ensure(t.Context(), changed))
+	require.Equal(t, map[string]int{cf.shard(addedShard): 1}, cf.updates)
+
+	// a failing shard doesn't block the other shards
+	cf.failUpdates[cf.shard(addedShard)] = true
+	removed := append([]netip.Prefix{}, shards[addedShard-1][1:]...)
+	removed = append(removed, shards[otherShard-1][1:]...)
+	changed = provider.NewDesiredState(map[provider.Resource][]netip.Prefix{resource: removed})
+	err = p.Ensure(t.Context(), changed)
+	require.EqualError(t, err, fmt.Sprintf("failed to update stack %s: %s", cf.shard(addedShard), errUpdateRollbackComplete))
+	require.Equal(t, provider.ErrorClassRetryable, provider.ClassOf(err))
+	require.Equal(t, 1, cf.updates[cf.shard(otherShard)])
+
+	// the status reports the health and the routes of every shard
+	status, err := p.Status(t.Context())
+	require.NoError(t, err)
+	require.Len(t, status.Resources, 3)
+	require.False(t, status.Resources[addedShard].Healthy)
+	require.Equal(t, shards[otherShard-1][1:], status.Resources[otherShard].Routes)
+	statuses := provider.ResourceStatuses(changed, status)
+	require.False(t, statuses[resource].Healthy)
+	other := provider.Resource{Name: "b", Namespace: "x"}
+	statuses = provider.ResourceStatuses(provider.NewDesiredState(map[provider.Resource][]netip.Prefix{other: shards[otherShard-1][1:]}), status)
+	require.True(t, statuses[other].Healthy)
+
+	// disabling sharding moves the routes back to the egress stack
+	cf.failUpdates = map[string]bool{}
+	p.shards = ShardConfig{By: shardByHash}
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.Empty(t, cf.shard(1))
+	require.Empty(t, cf.shard(2))
+	egress = parseStackTemplate(cf.templates[egressStackName])
+	require.NotContains(t, egress.Outputs, "NATGateway1")
+	require.Equal(t, provider.PrefixSet(prefixes), getCIDRsFromTemplate(cf.templates[egressStackName]))
+}
+
+func TestEnsureShardsMovedRoutes(t *testing.T) {
+	moved := netip.MustParsePrefix("2.0.0.0/24")
+	a := provider.Resource{Name: "a", Namespace: "team-a"}
+	b := provider.Resource{Name: "b", Namespace: "team-b"}
+	for i := 0; shardOf(b.Namespace, 2) == shardOf(a.Namespace, 2); i++ {
+		b.Namespace = fmt.Sprintf("team-b%d", i)
+	}
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		a: {netip.MustParsePrefix("1.0.0.0/24"), moved},
+		b: {netip.MustParsePrefix("3.0.0.0/24")},
+	})
+	changed := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		a: {netip.MustParsePrefix("1.0.0.0/24")},
+		b: {netip.MustParsePrefix("3.0.0.0/24"), moved},
+	})
+
+	cf := newMockStacks()
+	p := &AWSProvider{
+		clusterID:          "cluster",
+		controllerID:       "controller",
+		clusterIDTagPrefix: clusterIDTagPrefix,
+		vpcID:              "vpc-1",
+		natCidrBlocks:      []string{"172.31.64.0/28"},
+		availabilityZones:  []string{"eu-central-1a"},
+		cloudformation:     cf,
+		operations:         newOperationStore(),
+		ec2: &mockEC2{
+			describeInternetGatewaysOutput: &ec2.DescribeInternetGatewaysOutput{
+				InternetGateways: []ec2types.InternetGateway{{InternetGatewayId: aws.String("igw-1")}},
+			},
+			describeRouteTables: &ec2.DescribeRouteTablesOutput{
+				RouteTables: []ec2types.RouteTable{
+					{
+						RouteTableId: aws.String("rtb-1"),
+						Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+					},
+				},
+			},
+		},
+		shards: ShardConfig{Count: 2, By: shardByGroup},
+		logger: log.WithFields(log.Fields{"provider": ProviderName}),
+	}
+	require.NoError(t, p.Ensure(t.Context(), state))
+	from := cf.shard(shardOf(a.Namespace, 2) + 1)
+	to := cf.shard(shardOf(b.Namespace, 2) + 1)
+	require.Contains(t, getCIDRsFromTemplate(cf.templates[from]), moved.String())
+
+	// the moved route is only removed while the removal is in progress
+	cf.running = true
+	err := p.Ensure(t.Context(), changed)
+	require.ErrorContains(t, err, "waiting for update of stack "+from)
+	require.Equal(t, provider.ErrorClassInProgress, provider.ClassOf(err))
+	require.NotContains(t, getCIDRsFromTemplate(cf.templates[from]), moved.String())
+	require.Zero(t, cf.updates[to])
+
+	// the next sync after the removal adds it to the other shard
+	cf.stacks[from].StackStatus = cftypes.StackStatusUpdateComplete
+	err = p.Ensure(t.Context(), changed)
+	require.ErrorContains(t, err, "waiting for update of stack "+to)
+	require.Contains(t, getCIDRsFromTemplate(cf.templates[to]), moved.String())
+	require.Equal(t, 1, cf.updates[from])
+
+	// shards left without routes are deleted before the routes are added
+	// to the other shards
+	cf.stacks[to].StackStatus = cftypes.StackStatusUpdateComplete
+	cf.running = false
+	state = provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		a: {netip.MustParsePrefix("4.0.0.0/24")},
+		b: {netip.MustParsePrefix("3.0.0.0/24"), moved, netip.MustParsePrefix("1.0.0.0/24")},
+	})
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.Equal(t, provider.PrefixSet([]netip.Prefix{netip.MustParsePrefix("4.0.0.0/24")}), getCIDRsFromTemplate(cf.templates[cf.shard(shardOf(a.Namespace, 2)+1)]))
+	require.Len(t, getCIDRsFromTemplate(cf.templates[to]), 3)
+}
+
+func TestEnsureShardsInProgress(t *testing.T) {
+	resource := provider.Resource{Name: "a", Namespace: "x"}
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("1.0.0.0/24"),
+		netip.MustParsePrefix("2.0.0.0/24"),
+		netip.MustParsePrefix("3.0.0.0/24"),
+		netip.MustParsePrefix("4.0.0.0/24"),
+	}
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{resource: prefixes})
+
+	cf := newMockStacks()
+	p := &AWSProvider{
+		clusterID:          "cluster",
+		controllerID:       "controller",
+		clusterIDTagPrefix: clusterIDTagPrefix,
+		vpcID:              "vpc-1",
+		natCidrBlocks:      []string{"172.31.64.0/28"},
+		availabilityZones:  []string{"eu-central-1a"},
+		cloudformation:     cf,
+		operations:         newOperationStore(),
+		ec2: &mockEC2{
+			describeInternetGatewaysOutput: &ec2.DescribeInternetGatewaysOutput{
+				InternetGateways: []ec2types.InternetGateway{{InternetGatewayId: aws.String("igw-1")}},
+			},
+			describeRouteTables: &ec2.DescribeRouteTablesOutput{
+				RouteTables: []ec2types.RouteTable{
+					{
+						RouteTableId: aws.String("rtb-1"),
+						Tags:         []ec2types.Tag{{Key: aws.String(tagDefaultAZKeyRouteTableID), Value: aws.String("eu-central-1a")}},
+					},
+				},
+			},
+		},
+		shards: ShardConfig{Count: 2, By: shardByHash},
+		logger: log.WithFields(log.Fields{"provider": ProviderName}),
+	}
+	require.NoError(t, p.Ensure(t.Context(), state))
+	egressStack, err := p.getEgressStack(t.Context())
+	require.NoError(t, err)
+	egressStackName := aws.ToString(egressStack.StackName)
+
+	// the update of the first shard is stuck
+	stuck := cf.shard(1)
+	cf.stacks[stuck].StackStatus = cftypes.StackStatusUpdateInProgress
+	p.startOperation(stuck, "", operationUpdate)
+	p.operations.list()[0].started = time.Now().Add(-maxStackWaitTimeout - time.Minute)
+
+	// the egress stack and the other shard are still updated
+	added := make(map[int]netip.Prefix)
+	for i := 5; len(added) < 2; i++ {
+		route := netip.MustParsePrefix(fmt.Sprintf("%d.0.0.0/24", i))
+		if _, ok := added[shardOf(route.String(), 2)+1]; !ok {
+			added[shardOf(route.String(), 2)+1] = route
+		}
+	}
+	var template map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(cf.templates[egressStackName]), &template))
+	template["Resources"].(map[string]interface{})["RouteToNAT1z9x0x0x0y24"] = map[string]interface{}{
+		"Type":       "AWS::EC2::Route",
+		"Properties": map[string]interface{}{"DestinationCidrBlock": "9.0.0.0/24", "NatGatewayId": map[string]interface{}{"Ref": "NATGateway1"}},
+	}
+	body, err := json.Marshal(template)
+	require.NoError(t, err)
+	cf.templates[egressStackName] = string(body)
+	changed := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{resource: append(prefixes, added[1], added[2])})
+	err = p.Ensure(t.Context(), changed)
+	require.ErrorIs(t, err, errTimeoutExceeded)
+	require.ErrorContains(t, err, "waiting for update of stack "+stuck)
+	require.Equal(t, 1, cf.updates[egressStackName])
+	require.Empty(t, getCIDRsFromTemplate(cf.templates[egressStackName]))
+	require.Equal(t, 1, cf.updates[cf.shard(2)])
+	require.Contains(t, getCIDRsFromTemplate(cf.templates[cf.shard(2)]), added[2].String())
+	require.Zero(t, cf.updates[stuck])
+
+	// the shard is updated once its update finished
+	cf.stacks[stuck].StackStatus = cftypes.StackStatusUpdateComplete
+	require.NoError(t, p.Ensure(t.Context(), changed))
+	require.Equal(t, 1, cf.updates[stuck])
+	require.Contains(t, getCIDRsFromTemplate(cf.templates[stuck]), added[1].String())
+}
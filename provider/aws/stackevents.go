@@ -0,0 +1,161 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudformation"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxStackEventPages limits the stack events read back to the start of
+// the failed operation.
+const maxStackEventPages = 5
+
+var stackFailures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "kube_static_egress",
+		Subsystem: "aws",
+		Name:      "stack_failures_total",
+		Help:      "Number of failed stack operations by stack status and type of the first failed resource",
+	},
+	[]string{"stack_status", "resource_type"},
+)
+
+func init() {
+	prometheus.MustRegister(stackFailures)
+}
+
+// stackFailure is the first resource failing a stack operation.
+type stackFailure struct {
+	LogicalID    string
+	ResourceType string
+	Status       string
+	Reason       string
+}
+
+func (f *stackFailure) String() string {
+	return fmt.Sprintf("%s (%s) %s: %s", f.LogicalID, f.ResourceType, f.Status, f.Reason)
+}
+
+// stackFailedError is the error of a failed stack operation with the first
+// failed resource. It unwraps to the error of the stack status, keeping its
+// class.
+type stackFailedError struct {
+	err     error
+	failure *stackFailure
+}
+
+func (e *stackFailedError) Error() string {
+	return fmt.Sprintf("%v: %s", e.err, e.failure)
+}
+
+func (e *stackFailedError) Unwrap() error {
+	return e.err
+}
+
+// stackFailed adds the first failed resource of the last operation of the
+// stack to the error of its failed status, logs and counts it. The events
+// are looked up by the stack ID, as the events of deleted stacks, e.g.
+// failing to create, aren't returned by name.
+func (p *AWSProvider) stackFailed(ctx context.Context, stackID string, stack *cftypes.Stack, err error) error {
+	stackName := aws.ToString(stack.StackName)
+	failure, eventsErr := p.getStackFailure(ctx, stackName, stackID)
+	if eventsErr != nil {
+		p.logger.Warnf("Failed to get events of stack %s: %v", stackName, eventsErr)
+	}
+
+	resourceType := ""
+	if failure != nil {
+		resourceType = failure.ResourceType
+	}
+	stackFailures.WithLabelValues(string(stack.StackStatus), resourceType).Inc()
+
+	if failure == nil {
+		return err
+	}
+	p.logger.WithFields(log.Fields{
+		"stack":         stackName,
+		"stack_status":  stack.StackStatus,
+		"logical_id":    failure.LogicalID,
+		"resource_type": failure.ResourceType,
+	}).Errorf("Stack %s failed with %s: %s", stackName, stack.StackStatus, failure)
+	return &stackFailedError{err: err, failure: failure}
+}
+
+// getStackFailure returns the first failed resource of the last operation
+// of the stack with the name and ID, or nil if none failed. Events are
+// returned newest first, so they are read back to the start of the
+// operation.
+func (p *AWSProvider) getStackFailure(ctx context.Context, stackName, stackID string) (*stackFailure, error) {
+	params := &cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(stackID),
+	}
+
+	var failure, stackEventFailure *stackFailure
+	for page := 0; page < maxStackEventPages; page++ {
+		resp, err := p.cloudformation.DescribeStackEvents(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, event := range resp.StackEvents {
+			status := string(event.ResourceStatus)
+			reason := aws.ToString(event.ResourceStatusReason)
+			isStack := aws.ToString(event.LogicalResourceId) == stackName
+			if isStack && operationStarted(event.ResourceStatus) {
+				return firstFailure(failure, stackEventFailure), nil
+			}
+
+			// resources failing after the first one are cancelled
+			failed := strings.HasSuffix(status, "_FAILED") && !strings.Contains(reason, "cancelled")
+			if isStack {
+				failed = failed || strings.HasSuffix(status, "ROLLBACK_IN_PROGRESS")
+			}
+			if !failed {
+				continue
+			}
+
+			eventFailure := &stackFailure{
+				LogicalID:    aws.ToString(event.LogicalResourceId),
+				ResourceType: aws.ToString(event.ResourceType),
+				Status:       status,
+				Reason:       reason,
+			}
+			if isStack {
+				stackEventFailure = eventFailure
+			} else {
+				failure = eventFailure
+			}
+		}
+
+		if resp.NextToken == nil {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+	return firstFailure(failure, stackEventFailure), nil
+}
+
+// firstFailure prefers the failure of a resource over the reason of the
+// stack, which only lists the failed resources.
+func firstFailure(resource, stack *stackFailure) *stackFailure {
+	if resource != nil {
+		return resource
+	}
+	return stack
+}
+
+// operationStarted returns true if the status of the stack starts an
+// operation.
+func operationStarted(status cftypes.ResourceStatus) bool {
+	switch status {
+	case cftypes.ResourceStatusCreateInProgress, cftypes.ResourceStatusUpdateInProgress, cftypes.ResourceStatusDeleteInProgress:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func stackEvent(logicalID, resourceType string, status cftypes.ResourceStatus, reason string) cftypes.StackEvent {
+	event := cftypes.StackEvent{
+		LogicalResourceId: aws.String(logicalID),
+		ResourceType:      aws.String(resourceType),
+		ResourceStatus:    status,
+	}
+	if reason != "" {
+		event.ResourceStatusReason = aws.String(reason)
+	}
+	return event
+}
+
+func TestGetStackFailure(tt *testing.T) {
+	for _, tc := range []struct {
+		msg     string
+		events  []cftypes.StackEvent
+		failure *stackFailure
+	}{
+		{
+			msg: "the first failed resource should be returned",
+			events: []cftypes.StackEvent{
+				stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusUpdateRollbackComplete, ""),
+				stackEvent("RouteToNAT1z2x0x0x0y24", "AWS::EC2::Route", cftypes.ResourceStatusUpdateFailed, "Resource update cancelled"),
+				stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusUpdateRollbackInProgress, "The following resource(s) failed to create: [RouteToNAT1z1x0x0x0y24]."),
+				stackEvent("RouteToNAT1z1x0x0x0y24", "AWS::EC2::Route", cftypes.ResourceStatusCreateFailed, "The route identified by 1.0.0.0/24 already exists."),
+				stackEvent("RouteToNAT1z1x0x0x0y24", "AWS::EC2::Route", cftypes.ResourceStatusCreateInProgress, ""),
+				stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusUpdateInProgress, "User Initiated"),
+				stackEvent("NATGateway1", "AWS::EC2::NatGateway", cftypes.ResourceStatusCreateFailed, "failure of a previous operation"),
+			},
+			failure: &stackFailure{
+				LogicalID:    "RouteToNAT1z1x0x0x0y24",
+				ResourceType: "AWS::EC2::Route",
+				Status:       "CREATE_FAILED",
+				Reason:       "The route identified by 1.0.0.0/24 already exists.",
+			},
+		},
+		{
+			msg: "the reason of the stack should be returned without failed resources",
+			events: []cftypes.StackEvent{
+				stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusRollbackComplete, ""),
+				stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusRollbackInProgress, "Template error: instance of Fn::ImportValue references undefined export"),
+				stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusCreateInProgress, "User Initiated"),
+			},
+			failure: &stackFailure{
+				LogicalID:    "stack",
+				ResourceType: "AWS::CloudFormation::Stack",
+				Status:       "ROLLBACK_IN_PROGRESS",
+				Reason:       "Template error: instance of Fn::ImportValue references undefined export",
+			},
+		},
+		{
+			msg: "no failure should be returned for successful operations",
+			events: []cftypes.StackEvent{
+				stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusUpdateComplete, ""),
+				stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusUpdateInProgress, "User Initiated"),
+				stackEvent("NATGateway1", "AWS::EC2::NatGateway", cftypes.ResourceStatusCreateFailed, "failure of a previous operation"),
+			},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			p := &AWSProvider{
+				cloudformation: &mockCloudformation{events: tc.events},
+			}
+			failure, err := p.getStackFailure(t.Context(), "stack", "stack")
+			require.NoError(t, err)
+			require.Equal(t, tc.failure, failure)
+		})
+	}
+}
+
+func TestAwaitOperationsFailure(t *testing.T) {
+	cf := &mockCloudformation{
+		stack: cftypes.Stack{
+			StackName:   aws.String("stack"),
+			StackStatus: cftypes.StackStatusUpdateRollbackComplete,
+		},
+		events: []cftypes.StackEvent{
+			stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusUpdateRollbackComplete, ""),
+			stackEvent("RouteToNAT1z1x0x0x0y24", "AWS::EC2::Route", cftypes.ResourceStatusCreateFailed, "The route identified by 1.0.0.0/24 already exists."),
+			stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusUpdateInProgress, "User Initiated"),
+		},
+	}
+	p := &AWSProvider{
+		cloudformation: cf,
+		operations:     newOperationStore(),
+		logger:         log.WithFields(log.Fields{"provider": ProviderName}),
+	}
+	failures := stackFailures.WithLabelValues("UPDATE_ROLLBACK_COMPLETE", "AWS::EC2::Route")
+	before := testutil.ToFloat64(failures)
+
+	p.startOperation("stack", "", operationUpdate)
+	err := p.awaitStackOperations(t.Context(), "stack")
+	require.EqualError(t, err, "failed to update stack stack: retryable: wait for stack failed with UPDATE_ROLLBACK_COMPLETE: RouteToNAT1z1x0x0x0y24 (AWS::EC2::Route) CREATE_FAILED: The route identified by 1.0.0.0/24 already exists.")
+	require.ErrorIs(t, err, errUpdateRollbackComplete)
+	require.Equal(t, provider.ErrorClassRetryable, provider.ClassOf(err))
+	require.Equal(t, before+1, testutil.ToFloat64(failures))
+	require.False(t, p.operations.inProgress("stack"))
+
+	// the status error is returned without events
+	cf.events = nil
+	p.startOperation("stack", "", operationUpdate)
+	err = p.awaitStackOperations(t.Context(), "stack")
+	require.Equal(t, errUpdateRollbackComplete, errors.Cause(err))
+}
+
+func TestAwaitOperationsCreateFailure(t *testing.T) {
+	stackID := "arn:aws:cloudformation:eu-central-1:123456789012:stack/stack/1"
+	cf := &mockCloudformation{
+		stack: cftypes.Stack{
+			StackName:   aws.String("stack"),
+			StackId:     aws.String(stackID),
+			StackStatus: cftypes.StackStatusDeleteComplete,
+		},
+		events: []cftypes.StackEvent{
+			stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusDeleteComplete, ""),
+			stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusCreateFailed, "The following resource(s) failed to create: [NATGateway1]."),
+			stackEvent("NATGateway1", "AWS::EC2::NatGateway", cftypes.ResourceStatusCreateFailed, "Resource handler returned message: \"Elastic IP address is already associated\""),
+			stackEvent("stack", "AWS::CloudFormation::Stack", cftypes.ResourceStatusCreateInProgress, "User Initiated"),
+		},
+		deletedStackID: stackID,
+	}
+	p := newTestProvider(&mockEC2{})
+	p.cloudformation = cf
+
+	// stacks failing to create are deleted, their events are only
+	// returned by stack ID
+	p.startOperation("stack", stackID, operationCreate)
+	err := p.awaitStackOperations(t.Context(), "stack")
+	require.EqualError(t, err, "failed to create stack stack: partial_apply: wait for stack failed with CREATE_FAILED: NATGateway1 (AWS::EC2::NatGateway) CREATE_FAILED: Resource handler returned message: \"Elastic IP address is already associated\"")
+	require.ErrorIs(t, err, errCreateFailed)
+}
@@ -0,0 +1,145 @@
+package aws
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+const eipOutputPrefix = "EIP"
+
+// Status reports the EIPs of the NAT gateways and the IPs of the private NAT
+// gateways from the outputs of the egress stack, the routes of its template
+// and the health of the stack.
+func (p *AWSProvider) Status(ctx context.Context) (*provider.Status, error) {
+	status := &provider.Status{
+		EgressIPs: map[string][]netip.Addr{},
+	}
+
+	stack, err := p.getEgressStack(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if stack.StackName == nil {
+		return status, nil
+	}
+
+	status.Resources = []provider.ResourceHealth{stackHealth(stack)}
+	for _, output := range stack.Outputs {
+		egressIPs := status.EgressIPs
+		zone, ok := p.outputZone(eipOutputPrefix, aws.ToString(output.OutputKey))
+		if !ok {
+			zone, ok = p.outputZone(privateIPOutputPrefix, aws.ToString(output.OutputKey))
+			if !ok {
+				continue
+			}
+			if status.PrivateEgressIPs == nil {
+				status.PrivateEgressIPs = map[string][]netip.Addr{}
+			}
+			egressIPs = status.PrivateEgressIPs
+		}
+
+		ip, err := netip.ParseAddr(aws.ToString(output.OutputValue))
+		if err != nil {
+			p.logger.Warnf("Invalid IP '%s' in stack output %s", aws.ToString(output.OutputValue), aws.ToString(output.OutputKey))
+			continue
+		}
+		egressIPs[zone] = append(egressIPs[zone], ip)
+	}
+
+	templateBody, err := p.getStackTemplateBody(ctx, stack)
+	if err != nil {
+		return nil, err
+	}
+
+	cidrs := getCIDRsFromTemplate(templateBody)
+	for cidr := range getPrivateCIDRsFromTemplate(templateBody) {
+		cidrs[cidr] = struct{}{}
+	}
+
+	// the routes of the shard stacks are reported with their health
+	var shards []provider.ResourceHealth
+	if p.shards.enabled() {
+		shards, err = p.shardStatuses(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, shard := range shards {
+		status.Resources = append(status.Resources, shard)
+		for _, route := range shard.Routes {
+			cidrs[route.String()] = struct{}{}
+		}
+	}
+
+	status.Routes = p.templateRoutes(cidrs)
+	return status, nil
+}
+
+// templateRoutes returns the CIDRs parsed from a stack template as sorted
+// routes.
+func (p *AWSProvider) templateRoutes(cidrs map[string]struct{}) []netip.Prefix {
+	var routes []netip.Prefix
+	for cidr := range cidrs {
+		route, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			p.logger.Warnf("Invalid route '%s' in stack template", cidr)
+			continue
+		}
+		routes = append(routes, route)
+	}
+	slices.SortFunc(routes, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+	return routes
+}
+
+// outputZone returns the availability zone of the NAT gateway whose IP is
+// exported by the stack output with the prefix. Outputs of zones no longer
+// configured are reported by their output key.
+func (p *AWSProvider) outputZone(prefix, outputKey string) (string, bool) {
+	suffix, ok := strings.CutPrefix(outputKey, prefix)
+	if !ok {
+		return "", false
+	}
+
+	i, err := strconv.Atoi(suffix)
+	if err != nil || i < 1 {
+		return "", false
+	}
+
+	if i > len(p.availabilityZones) {
+		return outputKey, true
+	}
+	return p.availabilityZones[i-1], true
+}
+
+// stackHealth returns the health of the stack. Stacks are healthy if the
+// last operation succeeded or an update is in progress.
+func stackHealth(stack cftypes.Stack) provider.ResourceHealth {
+	health := provider.ResourceHealth{
+		Name:   aws.ToString(stack.StackName),
+		Status: string(stack.StackStatus),
+		Reason: aws.ToString(stack.StackStatusReason),
+	}
+
+	switch stack.StackStatus {
+	case cftypes.StackStatusCreateComplete,
+		cftypes.StackStatusUpdateComplete,
+		cftypes.StackStatusUpdateInProgress,
+		cftypes.StackStatusUpdateCompleteCleanupInProgress,
+		cftypes.StackStatusImportComplete:
+		health.Healthy = true
+	}
+	return health
+}
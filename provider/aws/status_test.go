@@ -0,0 +1,130 @@
+package aws
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	cftypes "github.com/aws/aws-sdk-go-v2/service/cloudformation/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestStatus(tt *testing.T) {
+	stackTags := []cftypes.Tag{
+		{Key: aws.String(clusterIDTagPrefix + "cluster"), Value: aws.String(resourceLifecycleOwned)},
+		{Key: aws.String(kubernetesApplicationTagKey), Value: aws.String("controller")},
+	}
+
+	for _, tc := range []struct {
+		msg      string
+		cf       *mockCloudformation
+		expected *provider.Status
+	}{
+		{
+			msg: "no stack should result in an empty status",
+			cf:  &mockCloudformation{},
+			expected: &provider.Status{
+				EgressIPs: map[string][]netip.Addr{},
+			},
+		},
+		{
+			msg: "EIPs and routes should be read from the stack",
+			cf: &mockCloudformation{
+				stack: cftypes.Stack{
+					StackName:   aws.String("stack"),
+					StackStatus: cftypes.StackStatusUpdateComplete,
+					Tags:        stackTags,
+					Outputs: []cftypes.Output{
+						{OutputKey: aws.String("EIP1"), OutputValue: aws.String("1.2.3.4")},
+						{OutputKey: aws.String("EIP2"), OutputValue: aws.String("1.2.3.5")},
+						{OutputKey: aws.String("EIP3"), OutputValue: aws.String("1.2.3.6")},
+						{OutputKey: aws.String("Other"), OutputValue: aws.String("x")},
+					},
+				},
+				templateBody: `{"Resources":{"RouteToNAT1z10x0x0x0y24":{"Type":"AWS::EC2::Route","Properties":{"DestinationCidrBlock":"10.0.0.0/24"}},"RouteToNAT1z1x0x0x1y32":{"Type":"AWS::EC2::Route","Properties":{"DestinationCidrBlock":"1.0.0.1/32"}}}}`,
+			},
+			expected: &provider.Status{
+				EgressIPs: map[string][]netip.Addr{
+					"eu-central-1a": {netip.MustParseAddr("1.2.3.4")},
+					"eu-central-1b": {netip.MustParseAddr("1.2.3.5")},
+					"EIP3":          {netip.MustParseAddr("1.2.3.6")},
+				},
+				Routes: []netip.Prefix{
+					netip.MustParsePrefix("1.0.0.1/32"),
+					netip.MustParsePrefix("10.0.0.0/24"),
+				},
+				Resources: []provider.ResourceHealth{
+					{Name: "stack", Healthy: true, Status: "UPDATE_COMPLETE"},
+				},
+			},
+		},
+		{
+			msg: "private IPs and routes should be read from the stack",
+			cf: &mockCloudformation{
+				stack: cftypes.Stack{
+					StackName:   aws.String("stack"),
+					StackStatus: cftypes.StackStatusUpdateComplete,
+					Tags:        stackTags,
+					Outputs: []cftypes.Output{
+						{OutputKey: aws.String("EIP1"), OutputValue: aws.String("1.2.3.4")},
+						{OutputKey: aws.String("PrivateIP1"), OutputValue: aws.String("10.10.0.10")},
+						{OutputKey: aws.String("PrivateIP2"), OutputValue: aws.String("10.10.1.10")},
+					},
+				},
+				templateBody: `{"Resources":{"RouteToNAT1z1x0x0x1y32":{"Type":"AWS::EC2::Route","Properties":{"DestinationCidrBlock":"1.0.0.1/32"}},"RouteToPrivateNAT1z192x168x0x0y16":{"Type":"AWS::EC2::Route","Properties":{"DestinationCidrBlock":"192.168.0.0/16"}}}}`,
+			},
+			expected: &provider.Status{
+				EgressIPs: map[string][]netip.Addr{
+					"eu-central-1a": {netip.MustParseAddr("1.2.3.4")},
+				},
+				PrivateEgressIPs: map[string][]netip.Addr{
+					"eu-central-1a": {netip.MustParseAddr("10.10.0.10")},
+					"eu-central-1b": {netip.MustParseAddr("10.10.1.10")},
+				},
+				Routes: []netip.Prefix{
+					netip.MustParsePrefix("1.0.0.1/32"),
+					netip.MustParsePrefix("192.168.0.0/16"),
+				},
+				Resources: []provider.ResourceHealth{
+					{Name: "stack", Healthy: true, Status: "UPDATE_COMPLETE"},
+				},
+			},
+		},
+		{
+			msg: "rolled back stacks should be unhealthy",
+			cf: &mockCloudformation{
+				stack: cftypes.Stack{
+					StackName:         aws.String("stack"),
+					StackStatus:       cftypes.StackStatusUpdateRollbackComplete,
+					StackStatusReason: aws.String("resource failed"),
+					Tags:              stackTags,
+				},
+				templateBody: `{}`,
+			},
+			expected: &provider.Status{
+				EgressIPs: map[string][]netip.Addr{},
+				Resources: []provider.ResourceHealth{
+					{Name: "stack", Healthy: false, Status: "UPDATE_ROLLBACK_COMPLETE", Reason: "resource failed"},
+				},
+			},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			p := &AWSProvider{
+				clusterID:          "cluster",
+				controllerID:       "controller",
+				clusterIDTagPrefix: clusterIDTagPrefix,
+				availabilityZones:  []string{"eu-central-1a", "eu-central-1b"},
+				cloudformation:     tc.cf,
+				logger:             log.WithFields(log.Fields{"provider": ProviderName}),
+			}
+
+			status, err := p.Status(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, status)
+		})
+	}
+}
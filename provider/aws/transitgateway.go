@@ -0,0 +1,195 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	cft "github.com/crewjam/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+const parameterTransitGatewayIDParameter = "TransitGatewayIDParameter"
+
+// TransitGatewayConfig configures centralized egress through a Transit
+// Gateway. If a Transit Gateway is configured, the egress stack doesn't
+// create NAT gateways but routes the egress CIDRs of the route tables to the
+// Transit Gateway, which forwards them to a shared egress VPC.
+type TransitGatewayConfig struct {
+	// ID is the ID of the Transit Gateway the VPC is attached to.
+	ID string
+	// RouteTableID is the Transit Gateway route table associated with the
+	// attachment of the VPC. If set, the egress CIDRs are routed to
+	// AttachmentID in it.
+	RouteTableID string
+	// AttachmentID is the attachment of the egress VPC.
+	AttachmentID string
+	// EgressNATRoutes maps route tables of the egress VPC to the NAT
+	// gateways the egress CIDRs are routed to.
+	EgressNATRoutes map[string]string
+}
+
+func (c TransitGatewayConfig) enabled() bool {
+	return c.ID != ""
+}
+
+// validate checks the configuration for consistency with the EIP
+// configuration, which requires NAT gateways in the VPC.
+func (c TransitGatewayConfig) validate(egressIPs EgressIPConfig) error {
+	if !c.enabled() {
+		if c.RouteTableID != "" || c.AttachmentID != "" || len(c.EgressNATRoutes) > 0 {
+			return fmt.Errorf("transit gateway routes require a transit gateway ID")
+		}
+		return nil
+	}
+
+	switch {
+	case len(egressIPs.AllocationIDs) > 0 || len(egressIPs.PublicIPv4Pools) > 0:
+		return fmt.Errorf("EIPs can't be configured for egress through a transit gateway")
+	case c.RouteTableID != "" && c.AttachmentID == "":
+		return fmt.Errorf("transit gateway route table %s requires the attachment of the egress VPC", c.RouteTableID)
+	case c.RouteTableID == "" && c.AttachmentID != "":
+		return fmt.Errorf("transit gateway attachment %s requires the transit gateway route table", c.AttachmentID)
+	}
+	return nil
+}
+
+// egressNATRouteTables returns the route tables of the egress VPC in a
+// stable order.
+func (c TransitGatewayConfig) egressNATRouteTables() []string {
+	tables := make([]string, 0, len(c.EgressNATRoutes))
+	for table := range c.EgressNATRoutes {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// transitGatewayVPCRoute is an AWS::EC2::Route to a Transit Gateway, which
+// isn't supported by cft.EC2Route.
+type transitGatewayVPCRoute struct {
+	DestinationCidrBlock *cft.StringExpr `json:"DestinationCidrBlock,omitempty"`
+	RouteTableID         *cft.StringExpr `json:"RouteTableId,omitempty"`
+	TransitGatewayID     *cft.StringExpr `json:"TransitGatewayId,omitempty"`
+}
+
+func (transitGatewayVPCRoute) CfnResourceType() string {
+	return "AWS::EC2::Route"
+}
+
+// transitGatewayRoute is an AWS::EC2::TransitGatewayRoute.
+type transitGatewayRoute struct {
+	DestinationCidrBlock       *cft.StringExpr `json:"DestinationCidrBlock,omitempty"`
+	TransitGatewayAttachmentID *cft.StringExpr `json:"TransitGatewayAttachmentId,omitempty"`
+	TransitGatewayRouteTableID *cft.StringExpr `json:"TransitGatewayRouteTableId,omitempty"`
+}
+
+func (transitGatewayRoute) CfnResourceType() string {
+	return "AWS::EC2::TransitGatewayRoute"
+}
+
+// addTransitGatewayRoutes adds the routes of the CIDR to the Transit
+// Gateway and, if configured, the routes of the Transit Gateway route table
+// and the egress VPC.
+func (p *AWSProvider) addTransitGatewayRoutes(template *cft.Template, cidrEntry, cleanCidrEntry string, routeTableParamOrder []string) {
+	for i, routeTableParam := range routeTableParamOrder {
+		// the routes keep the names of the routes to NAT gateways, so
+		// switching modes updates them in place instead of creating
+		// conflicting routes
+		template.AddResource(fmt.Sprintf("RouteToNAT%dz%s", i+1, cleanCidrEntry), &transitGatewayVPCRoute{
+			RouteTableID:         cft.Ref(routeTableParam).String(),
+			DestinationCidrBlock: cft.String(cidrEntry),
+			TransitGatewayID:     cft.Ref(parameterTransitGatewayIDParameter).String(),
+		})
+	}
+
+	if p.transitGateway.RouteTableID != "" {
+		template.AddResource(fmt.Sprintf("TGWRoute%s", cleanCidrEntry), &transitGatewayRoute{
+			TransitGatewayRouteTableID: cft.String(p.transitGateway.RouteTableID),
+			DestinationCidrBlock:       cft.String(cidrEntry),
+			TransitGatewayAttachmentID: cft.String(p.transitGateway.AttachmentID),
+		})
+	}
+
+	for i, table := range p.transitGateway.egressNATRouteTables() {
+		template.AddResource(fmt.Sprintf("EgressNATRoute%dz%s", i+1, cleanCidrEntry), &cft.EC2Route{
+			RouteTableID:         cft.String(table),
+			DestinationCidrBlock: cft.String(cidrEntry),
+			NatGatewayID:         cft.String(p.transitGateway.EgressNATRoutes[table]),
+		})
+	}
+}
+
+// validateTransitGateway makes sure the configured Transit Gateway exists
+// and the VPC is attached to it, and that the route table and the
+// attachment of the egress VPC belong to it.
+func (p *AWSProvider) validateTransitGateway(ctx context.Context) error {
+	err := p.transitGateway.validate(p.egressIPs)
+	if err != nil {
+		return provider.NewError(provider.ErrorClassPermanent, err)
+	}
+	if !p.transitGateway.enabled() {
+		return nil
+	}
+	return classifyError(p.validateTransitGatewayAttachments(ctx))
+}
+
+func (p *AWSProvider) validateTransitGatewayAttachments(ctx context.Context) error {
+	id := p.transitGateway.ID
+	gateways, err := p.ec2.DescribeTransitGateways(ctx, &ec2.DescribeTransitGatewaysInput{
+		TransitGatewayIds: []string{id},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to describe transit gateway %s", id)
+	}
+	if len(gateways.TransitGateways) == 0 {
+		return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("transit gateway %s not found", id))
+	}
+
+	vpcID, err := p.findVPC(ctx)
+	if err != nil {
+		return err
+	}
+	attachments, err := p.ec2.DescribeTransitGatewayVpcAttachments(ctx, &ec2.DescribeTransitGatewayVpcAttachmentsInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("transit-gateway-id"), Values: []string{id}},
+			{Name: aws.String("vpc-id"), Values: []string{vpcID}},
+			{Name: aws.String("state"), Values: []string{string(ec2types.TransitGatewayAttachmentStateAvailable)}},
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to describe attachments of transit gateway %s", id)
+	}
+	if len(attachments.TransitGatewayVpcAttachments) == 0 {
+		return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("VPC %s is not attached to transit gateway %s", vpcID, id))
+	}
+
+	if p.transitGateway.RouteTableID == "" {
+		return nil
+	}
+
+	routeTables, err := p.ec2.DescribeTransitGatewayRouteTables(ctx, &ec2.DescribeTransitGatewayRouteTablesInput{
+		TransitGatewayRouteTableIds: []string{p.transitGateway.RouteTableID},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to describe transit gateway route table %s", p.transitGateway.RouteTableID)
+	}
+	if len(routeTables.TransitGatewayRouteTables) == 0 || aws.ToString(routeTables.TransitGatewayRouteTables[0].TransitGatewayId) != id {
+		return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("route table %s not found in transit gateway %s", p.transitGateway.RouteTableID, id))
+	}
+
+	egressAttachments, err := p.ec2.DescribeTransitGatewayAttachments(ctx, &ec2.DescribeTransitGatewayAttachmentsInput{
+		TransitGatewayAttachmentIds: []string{p.transitGateway.AttachmentID},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to describe transit gateway attachment %s", p.transitGateway.AttachmentID)
+	}
+	if len(egressAttachments.TransitGatewayAttachments) == 0 || aws.ToString(egressAttachments.TransitGatewayAttachments[0].TransitGatewayId) != id {
+		return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("attachment %s not found in transit gateway %s", p.transitGateway.AttachmentID, id))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package aws
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestValidateTransitGateway(tt *testing.T) {
+	attached := func() *mockEC2 {
+		return &mockEC2{
+			describeTransitGateways: &ec2.DescribeTransitGatewaysOutput{
+				TransitGateways: []ec2types.TransitGateway{{TransitGatewayId: aws.String("tgw-1")}},
+			},
+			describeTGWVpcAttachments: &ec2.DescribeTransitGatewayVpcAttachmentsOutput{
+				TransitGatewayVpcAttachments: []ec2types.TransitGatewayVpcAttachment{{TransitGatewayAttachmentId: aws.String("tgw-attach-1")}},
+			},
+			describeTGWRouteTables: &ec2.DescribeTransitGatewayRouteTablesOutput{
+				TransitGatewayRouteTables: []ec2types.TransitGatewayRouteTable{{TransitGatewayId: aws.String("tgw-1")}},
+			},
+			describeTGWAttachments: &ec2.DescribeTransitGatewayAttachmentsOutput{
+				TransitGatewayAttachments: []ec2types.TransitGatewayAttachment{{TransitGatewayId: aws.String("tgw-1")}},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		msg            string
+		transitGateway TransitGatewayConfig
+		egressIPs      EgressIPConfig
+		ec2            func() *mockEC2
+		err            string
+	}{
+		{
+			msg: "NAT gateways should be used by default",
+			ec2: func() *mockEC2 { return &mockEC2{} },
+		},
+		{
+			msg:            "an attached transit gateway should be used",
+			transitGateway: TransitGatewayConfig{ID: "tgw-1"},
+			ec2:            attached,
+		},
+		{
+			msg:            "transit gateway routes should be managed in a route table of the transit gateway",
+			transitGateway: TransitGatewayConfig{ID: "tgw-1", RouteTableID: "tgw-rtb-1", AttachmentID: "tgw-attach-2"},
+			ec2:            attached,
+		},
+		{
+			msg:            "transit gateway routes should require the transit gateway",
+			transitGateway: TransitGatewayConfig{EgressNATRoutes: map[string]string{"rtb-1": "nat-1"}},
+			ec2:            attached,
+			err:            "permanent: transit gateway routes require a transit gateway ID",
+		},
+		{
+			msg:            "a transit gateway route table should require the egress attachment",
+			transitGateway: TransitGatewayConfig{ID: "tgw-1", RouteTableID: "tgw-rtb-1"},
+			ec2:            attached,
+			err:            "permanent: transit gateway route table tgw-rtb-1 requires the attachment of the egress VPC",
+		},
+		{
+			msg:            "EIPs should not be configured",
+			transitGateway: TransitGatewayConfig{ID: "tgw-1"},
+			egressIPs:      EgressIPConfig{PublicIPv4Pools: []string{"ipv4pool-ec2-1"}},
+			ec2:            attached,
+			err:            "permanent: EIPs can't be configured for egress through a transit gateway",
+		},
+		{
+			msg:            "a missing transit gateway should be rejected",
+			transitGateway: TransitGatewayConfig{ID: "tgw-1"},
+			ec2: func() *mockEC2 {
+				m := attached()
+				m.describeTransitGateways = &ec2.DescribeTransitGatewaysOutput{}
+				return m
+			},
+			err: "permanent: transit gateway tgw-1 not found",
+		},
+		{
+			msg:            "the VPC should be attached to the transit gateway",
+			transitGateway: TransitGatewayConfig{ID: "tgw-1"},
+			ec2: func() *mockEC2 {
+				m := attached()
+				m.describeTGWVpcAttachments = &ec2.DescribeTransitGatewayVpcAttachmentsOutput{}
+				return m
+			},
+			err: "permanent: VPC vpc-1 is not attached to transit gateway tgw-1",
+		},
+		{
+			msg:            "the route table should belong to the transit gateway",
+			transitGateway: TransitGatewayConfig{ID: "tgw-1", RouteTableID: "tgw-rtb-1", AttachmentID: "tgw-attach-2"},
+			ec2: func() *mockEC2 {
+				m := attached()
+				m.describeTGWRouteTables.TransitGatewayRouteTables[0].TransitGatewayId = aws.String("tgw-2")
+				return m
+			},
+			err: "permanent: route table tgw-rtb-1 not found in transit gateway tgw-1",
+		},
+		{
+			msg:            "the egress attachment should belong to the transit gateway",
+			transitGateway: TransitGatewayConfig{ID: "tgw-1", RouteTableID: "tgw-rtb-1", AttachmentID: "tgw-attach-2"},
+			ec2: func() *mockEC2 {
+				m := attached()
+				m.describeTGWAttachments = &ec2.DescribeTransitGatewayAttachmentsOutput{}
+				return m
+			},
+			err: "permanent: attachment tgw-attach-2 not found in transit gateway tgw-1",
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			p := newTestProvider(tc.ec2())
+			p.egressIPs = tc.egressIPs
+			p.transitGateway = tc.transitGateway
+			err := p.validateTransitGateway(t.Context())
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				require.Equal(t, provider.ErrorClassPermanent, provider.ClassOf(err))
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestEnsureTransitGateway(t *testing.T) {
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		{Name: "a", Namespace: "x"}: {netip.MustParsePrefix("1.0.0.1/32")},
+	})
+
+	p := newTestProvider(&mockEC2{}, "eu-central-1a")
+	cf := newTestStack(p, state)
+	p.transitGateway = TransitGatewayConfig{
+		ID:              "tgw-1",
+		RouteTableID:    "tgw-rtb-1",
+		AttachmentID:    "tgw-attach-2",
+		EgressNATRoutes: map[string]string{"rtb-egress-2": "nat-2", "rtb-egress-1": "nat-1"},
+	}
+
+	plan, err := p.Plan(t.Context(), state)
+	require.NoError(t, err)
+	require.Equal(t, provider.PlanActionUpdate, plan.Action)
+	require.Equal(t, []provider.RouteTableChange{
+		{RouteTable: "rtb-2", Added: []netip.Prefix{netip.MustParsePrefix("1.0.0.1/32")}},
+		{RouteTable: "rtb-egress-1", Added: []netip.Prefix{netip.MustParsePrefix("1.0.0.1/32")}},
+		{RouteTable: "rtb-egress-2", Added: []netip.Prefix{netip.MustParsePrefix("1.0.0.1/32")}},
+		{RouteTable: "tgw-rtb-1", Added: []netip.Prefix{netip.MustParsePrefix("1.0.0.1/32")}},
+	}, plan.RouteTables)
+	for _, change := range plan.Resources {
+		require.Equal(t, provider.ChangeActionRemove, change.Action, change.Name)
+	}
+
+	// the routes are unchanged, but the NAT gateways have to be replaced
+	// by the transit gateway
+	require.NoError(t, p.Ensure(t.Context(), state))
+	require.Contains(t, cf.parameters, cfParam(parameterTransitGatewayIDParameter, "tgw-1"))
+	require.NotContains(t, cf.parameters, cfParam(parameterInternetGatewayIDParameter, "igw-1"))
+
+	template := parseStackTemplate(cf.templateBody)
+	require.ElementsMatch(t, []string{
+		"RouteToNAT1z1x0x0x1y32",
+		"RouteToNAT2z1x0x0x1y32",
+		"TGWRoute1x0x0x1y32",
+		"EgressNATRoute1z1x0x0x1y32",
+		"EgressNATRoute2z1x0x0x1y32",
+	}, resourceNames(template))
+	require.Equal(t, map[string]interface{}{"Ref": parameterTransitGatewayIDParameter}, template.Resources["RouteToNAT2z1x0x0x1y32"].Properties["TransitGatewayId"])
+	require.Equal(t, "tgw-attach-2", template.Resources["TGWRoute1x0x0x1y32"].Properties["TransitGatewayAttachmentId"])
+	require.Equal(t, "nat-1", template.Resources["EgressNATRoute1z1x0x0x1y32"].Properties["NatGatewayId"])
+	require.Contains(t, template.Parameters, parameterTransitGatewayIDParameter)
+	require.NotContains(t, template.Parameters, parameterInternetGatewayIDParameter)
+
+	// further syncs don't update the stack
+	requireStackUnchanged(t, p, cf, state)
+}
@@ -0,0 +1,185 @@
+package provider
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// RouteBudget limits the number of routes passed to a provider.
+type RouteBudget struct {
+	// MaxRoutes is the maximum number of routes. 0 disables the budget.
+	MaxRoutes int
+	// MinPrefixLength is the shortest prefix length an IPv4 route may be
+	// widened to.
+	MinPrefixLength int
+	// MinPrefixLengthIPv6 is the shortest prefix length an IPv6 route may
+	// be widened to.
+	MinPrefixLengthIPv6 int
+	// Denied are networks a widened route must never overlap.
+	Denied []netip.Prefix
+}
+
+// WidenedRoute describes a route replacing several configured routes.
+type WidenedRoute struct {
+	Route          netip.Prefix
+	Replaced       []netip.Prefix
+	ExtraAddresses uint64
+}
+
+func (w WidenedRoute) String() string {
+	return fmt.Sprintf("%s replacing %v (%d extra addresses)", w.Route, w.Replaced, w.ExtraAddresses)
+}
+
+// RouteBudgetReport describes how routes were compressed to fit into the
+// route budget.
+type RouteBudgetReport struct {
+	MaxRoutes int
+	// Routes is the number of routes before compression.
+	Routes  int
+	Widened []WidenedRoute
+	// Dropped are the lowest priority routes which would have to be
+	// dropped to fit into the budget.
+	Dropped []netip.Prefix
+}
+
+// RouteBudgetError is returned if the routes can't be compressed to fit into
+// the route budget.
+type RouteBudgetError struct {
+	Report *RouteBudgetReport
+}
+
+func (e *RouteBudgetError) Error() string {
+	widened := make([]string, 0, len(e.Report.Widened))
+	for _, w := range e.Report.Widened {
+		widened = append(widened, w.String())
+	}
+	return fmt.Sprintf("%d routes exceed the route budget of %d, widened: [%s], would drop: %v",
+		e.Report.Routes, e.Report.MaxRoutes, strings.Join(widened, ", "), e.Report.Dropped)
+}
+
+// EnforceRouteBudget compresses the routes of the state to fit into the
+// budget. Neighbouring routes are merged into their common supernet, merging
+// routes of the lowest priority and with the fewest extra addresses first.
+// The priority of a route is the highest priority of the resources
+// configuring it. The possible merges are the branches of the prefix trie of
+// the routes, their cost doesn't change by other merges, so they are ordered
+// only once. In the returned state every prefix is replaced by the route
+// covering it, which keeps the sources of the prefix. If the routes can't be
+// compressed enough a *RouteBudgetError is returned.
+func (s *DesiredState) EnforceRouteBudget(priorities map[Resource]int, budget RouteBudget) (*DesiredState, *RouteBudgetReport, error) {
+	original := s.Routes()
+	if budget.MaxRoutes <= 0 || len(original) <= budget.MaxRoutes {
+		return s, nil, nil
+	}
+
+	routePriorities := make(map[netip.Prefix]int, len(original))
+	for resource, prefixes := range s.prefixes {
+		for _, p := range prefixes {
+			route := coveringPrefix(original, p)
+			if priority, ok := routePriorities[route]; !ok || priorities[resource] > priority {
+				routePriorities[route] = priorities[resource]
+			}
+		}
+	}
+
+	trie := newPrefixTrie()
+	for _, route := range original {
+		trie.insert(route)
+	}
+	candidates := slices.DeleteFunc(trie.mergeCandidates(func(route netip.Prefix) int {
+		return routePriorities[route]
+	}), func(c *mergeCandidate) bool {
+		return c.prefix.Bits() < minPrefixLength(c.prefix, budget.MinPrefixLength, budget.MinPrefixLengthIPv6) || overlapsAny(c.prefix, budget.Denied)
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		if a.extra != b.extra {
+			return a.extra < b.extra
+		}
+		return a.order < b.order
+	})
+
+	count := len(original)
+	extra := make(map[netip.Prefix]uint64)
+	for _, c := range candidates {
+		if count <= budget.MaxRoutes {
+			break
+		}
+		if c.node.merged {
+			continue
+		}
+		count -= c.merge() - 1
+		routePriorities[c.prefix] = c.priority
+		extra[c.prefix] = c.extra
+	}
+	routes := trie.prefixes()
+
+	report := &RouteBudgetReport{
+		MaxRoutes: budget.MaxRoutes,
+		Routes:    len(original),
+	}
+	for _, route := range routes {
+		if _, ok := extra[route]; !ok {
+			continue
+		}
+		var replaced []netip.Prefix
+		i := sort.Search(len(original), func(i int) bool {
+			return original[i].Addr().Compare(route.Addr()) >= 0
+		})
+		for ; i < len(original) && prefixContains(route, original[i]); i++ {
+			replaced = append(replaced, original[i])
+		}
+		report.Widened = append(report.Widened, WidenedRoute{
+			Route:          route,
+			Replaced:       replaced,
+			ExtraAddresses: extra[route],
+		})
+	}
+
+	if len(routes) > budget.MaxRoutes {
+		dropped := slices.Clone(routes)
+		sort.SliceStable(dropped, func(i, j int) bool {
+			return routePriorities[dropped[i]] < routePriorities[dropped[j]]
+		})
+		report.Dropped = dropped[:len(routes)-budget.MaxRoutes]
+		return nil, report, &RouteBudgetError{Report: report}
+	}
+
+	result := make(map[Resource]map[netip.Prefix][]Source, len(s.prefixes))
+	for resource, prefixes := range s.prefixes {
+		result[resource] = make(map[netip.Prefix][]Source, len(prefixes))
+		for _, p := range prefixes {
+			route := coveringPrefix(routes, p)
+			result[resource][route] = append(result[resource][route], s.sources[resource][p]...)
+		}
+	}
+	return newDesiredState(result).withConnectivityOf(s), report, nil
+}
+
+// coveringPrefix returns the prefix of the sorted non-overlapping prefixes
+// covering p. p must be covered by one of the prefixes.
+func coveringPrefix(prefixes []netip.Prefix, p netip.Prefix) netip.Prefix {
+	i := sort.Search(len(prefixes), func(i int) bool {
+		return prefixes[i].Addr().Compare(p.Addr()) > 0
+	})
+	if i > 0 && prefixContains(prefixes[i-1], p) {
+		return prefixes[i-1]
+	}
+	return p
+}
+
+// overlapsAny returns true if p overlaps any of the prefixes.
+func overlapsAny(p netip.Prefix, prefixes []netip.Prefix) bool {
+	for _, prefix := range prefixes {
+		if p.Overlaps(prefix) {
+			return true
+		}
+	}
+	return false
+}
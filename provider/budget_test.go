@@ -0,0 +1,151 @@
+package provider
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnforceRouteBudget(tt *testing.T) {
+	resourceA := Resource{Name: "a", Namespace: "x", Cluster: "m"}
+	resourceB := Resource{Name: "b", Namespace: "x", Cluster: "m"}
+
+	for _, tc := range []struct {
+		msg             string
+		configs         map[Resource][]string
+		priorities      map[Resource]int
+		budget          RouteBudget
+		expected        map[Resource][]string
+		expectedWidened []string
+		expectedDropped []string
+	}{
+		{
+			msg: "routes within budget should not be changed",
+			configs: map[Resource][]string{
+				resourceA: {"1.0.0.1/32", "1.0.0.3/32"},
+			},
+			budget: RouteBudget{MaxRoutes: 2},
+			expected: map[Resource][]string{
+				resourceA: {"1.0.0.1/32", "1.0.0.3/32"},
+			},
+		},
+		{
+			msg: "closest routes should be merged first",
+			configs: map[Resource][]string{
+				resourceA: {"1.0.0.1/32", "1.0.0.3/32", "1.0.1.0/32"},
+			},
+			budget: RouteBudget{MaxRoutes: 2},
+			expected: map[Resource][]string{
+				resourceA: {"1.0.0.0/30", "1.0.1.0/32"},
+			},
+			expectedWidened: []string{"1.0.0.0/30"},
+		},
+		{
+			msg: "routes of lower priority should be merged first",
+			configs: map[Resource][]string{
+				resourceA: {"1.0.0.1/32", "1.0.0.3/32"},
+				resourceB: {"2.0.0.1/32", "2.0.0.64/32"},
+			},
+			priorities: map[Resource]int{
+				resourceA: 10,
+			},
+			budget: RouteBudget{MaxRoutes: 3},
+			expected: map[Resource][]string{
+				resourceA: {"1.0.0.1/32", "1.0.0.3/32"},
+				resourceB: {"2.0.0.0/25"},
+			},
+			expectedWidened: []string{"2.0.0.0/25"},
+		},
+		{
+			msg: "routes should not be widened beyond the minimum prefix length",
+			configs: map[Resource][]string{
+				resourceA: {"1.0.0.1/32", "2.0.0.1/32"},
+			},
+			priorities: map[Resource]int{
+				resourceA: 1,
+			},
+			budget:          RouteBudget{MaxRoutes: 1, MinPrefixLength: 16},
+			expectedDropped: []string{"1.0.0.1/32"},
+		},
+		{
+			msg: "IPv6 routes should not be widened beyond the IPv6 minimum prefix length",
+			configs: map[Resource][]string{
+				resourceA: {"2001:db8::/48", "2001:db8:2::/48"},
+			},
+			priorities: map[Resource]int{
+				resourceA: 1,
+			},
+			budget:          RouteBudget{MaxRoutes: 1, MinPrefixLength: 16, MinPrefixLengthIPv6: 48},
+			expectedDropped: []string{"2001:db8::/48"},
+		},
+		{
+			msg: "routes should not be widened over denied networks",
+			configs: map[Resource][]string{
+				resourceA: {"1.0.0.1/32", "1.0.0.3/32"},
+			},
+			budget:          RouteBudget{MaxRoutes: 1, Denied: []netip.Prefix{netip.MustParsePrefix("1.0.0.2/32")}},
+			expectedDropped: []string{"1.0.0.1/32"},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			result, report, err := desiredStateFromStrings(tc.configs).EnforceRouteBudget(tc.priorities, tc.budget)
+			if len(tc.expectedDropped) > 0 {
+				var budgetErr *RouteBudgetError
+				require.ErrorAs(t, err, &budgetErr)
+				dropped := make([]string, 0, len(report.Dropped))
+				for _, d := range report.Dropped {
+					dropped = append(dropped, d.String())
+				}
+				require.Equal(t, tc.expectedDropped, dropped)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Equal(t, desiredStateFromStrings(tc.expected).String(), result.String())
+
+			if len(tc.expectedWidened) == 0 {
+				require.Nil(t, report)
+				return
+			}
+			widened := make([]string, 0, len(report.Widened))
+			for _, w := range report.Widened {
+				widened = append(widened, w.Route.String())
+			}
+			require.Equal(t, tc.expectedWidened, widened)
+		})
+	}
+}
+
+func desiredStateFromStrings(configs map[Resource][]string) *DesiredState {
+	prefixes := make(map[Resource][]netip.Prefix, len(configs))
+	for resource, cidrs := range configs {
+		for _, c := range cidrs {
+			prefixes[resource] = append(prefixes[resource], netip.MustParsePrefix(c))
+		}
+	}
+	return NewDesiredState(prefixes)
+}
+
+// benchmarkSpreadHosts returns n /32 prefixes with gaps of different sizes
+// between them, so no prefixes can be aggregated.
+func benchmarkSpreadHosts(n int) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, n)
+	for i := range n {
+		a := uint32(10<<24 + i*(2+i%7))
+		prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom4([4]byte{byte(a >> 24), byte(a >> 16), byte(a >> 8), byte(a)}), 32))
+	}
+	return prefixes
+}
+
+func BenchmarkEnforceRouteBudget(b *testing.B) {
+	state := NewDesiredState(map[Resource][]netip.Prefix{
+		{Name: "a", Namespace: "x", Cluster: "m"}: benchmarkSpreadHosts(1500),
+	})
+
+	b.ReportAllocs()
+	for b.Loop() {
+		_, _, err := state.EnforceRouteBudget(nil, RouteBudget{MaxRoutes: 50})
+		require.NoError(b, err)
+	}
+}
@@ -1,56 +1,117 @@
 package provider
 
 import (
+	"fmt"
 	"net"
-	"sort"
-
-	"github.com/apparentlymart/go-cidr/cidr"
+	"net/netip"
 )
 
 // GenerateRoutes generates the minimal number of needed routes based on a set
-// of routing configurations.
+// of routing configurations. Routes contained in other routes are dropped and
+// adjacent routes are merged into their common supernet, without changing the
+// covered addresses. It's an adapter for the legacy representation of
+// DesiredState.Routes.
 func GenerateRoutes(configs map[Resource]map[string]*net.IPNet) map[string]struct{} {
-	cidrs := make([]*net.IPNet, 0, len(configs))
-	for _, rs := range configs {
-		for _, ipnet := range rs {
-			cidrs = append(cidrs, ipnet)
-		}
+	return GenerateRoutesWithOptions(configs, RouteOptions{})
+}
+
+// GenerateRoutesWithOptions generates the minimal number of needed routes
+// like GenerateRoutes, additionally merging routes into supernets covering
+// unconfigured addresses as allowed by the options.
+func GenerateRoutesWithOptions(configs map[Resource]map[string]*net.IPNet, opts RouteOptions) map[string]struct{} {
+	return PrefixSet(DesiredStateFromLegacy(configs).RoutesWithOptions(opts))
+}
+
+// PrefixSet returns the set of the string representations of the prefixes.
+func PrefixSet(prefixes []netip.Prefix) map[string]struct{} {
+	set := make(map[string]struct{}, len(prefixes))
+	for _, p := range prefixes {
+		set[p.String()] = struct{}{}
 	}
+	return set
+}
+
+// SubtractCIDRs returns the minimal list of networks covering block without
+// any of the excluded networks. Excluded networks not overlapping block are
+// ignored.
+func SubtractCIDRs(block *net.IPNet, excluded ...*net.IPNet) []*net.IPNet {
+	exclusions := make([]netip.Prefix, 0, len(excluded))
+	for _, e := range excluded {
+		exclusions = append(exclusions, PrefixFromIPNet(e))
+	}
+
+	remaining := subtractPrefix(PrefixFromIPNet(block), exclusions)
+	nets := make([]*net.IPNet, 0, len(remaining))
+	for _, p := range remaining {
+		nets = append(nets, ipNetFromPrefix(p))
+	}
+	return nets
+}
 
-	sort.Slice(cidrs, func(i, j int) bool {
-		countI := cidr.AddressCount(cidrs[i])
-		countJ := cidr.AddressCount(cidrs[j])
-		if countI == countJ {
-			return cidrs[i].String() < cidrs[j].String()
+// subtractPrefix recursively splits p into halves until none of the
+// resulting prefixes overlap with any of the exclusions.
+func subtractPrefix(p netip.Prefix, exclusions []netip.Prefix) []netip.Prefix {
+	overlaps := false
+	for _, e := range exclusions {
+		if !p.Overlaps(e) {
+			continue
 		}
-		return countI < countJ
-	})
-
-	newCIDRs := make(map[string]struct{}, len(cidrs))
-	i := 0
-	for _, c := range cidrs {
-		contained := false
-		if i < len(cidrs)-1 {
-			for _, block := range cidrs[i+1:] {
-				if networkContained(c, block) {
-					contained = true
-					break
-				}
-			}
+		if e.Bits() <= p.Bits() {
+			// p is fully covered by the exclusion
+			return nil
 		}
+		overlaps = true
+	}
+
+	if !overlaps {
+		return []netip.Prefix{p}
+	}
+
+	lower, upper := splitPrefix(p)
+	return append(subtractPrefix(lower, exclusions), subtractPrefix(upper, exclusions)...)
+}
+
+// splitPrefix splits p into its two halves. p must not be a single address.
+func splitPrefix(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := p.Bits() + 1
+	lower := netip.PrefixFrom(p.Addr(), bits)
 
-		if !contained {
-			newCIDRs[c.String()] = struct{}{}
+	addr := p.Addr().AsSlice()
+	addr[p.Bits()/8] |= 0x80 >> (p.Bits() % 8)
+	upperAddr, _ := netip.AddrFromSlice(addr)
+	return lower, netip.PrefixFrom(upperAddr, bits)
+}
+
+// PrefixFromIPNet converts a *net.IPNet into a netip.Prefix. IPv4 networks
+// are always represented as 4 byte addresses.
+func PrefixFromIPNet(ipnet *net.IPNet) netip.Prefix {
+	addr, _ := netip.AddrFromSlice(ipnet.IP)
+	ones, bits := ipnet.Mask.Size()
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+		if bits == 128 {
+			ones -= 96
 		}
-		i++
 	}
+	return netip.PrefixFrom(addr, ones).Masked()
+}
+
+// ipNetFromPrefix converts a netip.Prefix into a *net.IPNet.
+func ipNetFromPrefix(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   net.IP(p.Masked().Addr().AsSlice()),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
 
-	return newCIDRs
+// Exclusion describes a configured prefix overlapping with denied prefixes.
+type Exclusion struct {
+	Resource  Resource
+	Prefix    netip.Prefix
+	Denied    []netip.Prefix
+	Remaining []netip.Prefix
 }
 
-// networkContained returns true if the subBlock is completely contained inside
-// the superBlock.
-func networkContained(subBlock, superBlock *net.IPNet) bool {
-	first, last := cidr.AddressRange(subBlock)
-	return superBlock.Contains(first) && superBlock.Contains(last)
+func (e Exclusion) String() string {
+	return fmt.Sprintf("%s of %v overlaps denied %v, remaining %v", e.Prefix, e.Resource, e.Denied, e.Remaining)
 }
@@ -2,6 +2,7 @@ package provider
 
 import (
 	"net"
+	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -58,3 +59,108 @@ func TestGenerateRoutes(tt *testing.T) {
 		})
 	}
 }
+
+func TestSubtractCIDRs(tt *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		block    string
+		excluded []string
+		expected []string
+	}{
+		{
+			msg:      "no exclusions should return the block",
+			block:    "10.0.0.0/24",
+			expected: []string{"10.0.0.0/24"},
+		},
+		{
+			msg:      "non-overlapping exclusions should be ignored",
+			block:    "10.0.0.0/24",
+			excluded: []string{"10.0.1.0/24"},
+			expected: []string{"10.0.0.0/24"},
+		},
+		{
+			msg:      "covering exclusion should remove the block",
+			block:    "10.0.0.0/24",
+			excluded: []string{"10.0.0.0/16"},
+			expected: []string{},
+		},
+		{
+			msg:      "excluded half should leave the other half",
+			block:    "10.0.0.0/24",
+			excluded: []string{"10.0.0.128/25"},
+			expected: []string{"10.0.0.0/25"},
+		},
+		{
+			msg:      "excluded single address should be cut out",
+			block:    "10.0.0.0/30",
+			excluded: []string{"10.0.0.1/32"},
+			expected: []string{"10.0.0.0/32", "10.0.0.2/31"},
+		},
+		{
+			msg:      "multiple exclusions should all be cut out",
+			block:    "192.168.0.0/22",
+			excluded: []string{"192.168.1.0/24", "192.168.3.0/24"},
+			expected: []string{"192.168.0.0/24", "192.168.2.0/24"},
+		},
+		{
+			msg:      "IPv6 exclusions should be cut out",
+			block:    "2001:db8::/32",
+			excluded: []string{"2001:db8:8000::/33"},
+			expected: []string{"2001:db8::/33"},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			_, block, err := net.ParseCIDR(tc.block)
+			require.NoError(t, err)
+
+			excluded := make([]*net.IPNet, 0, len(tc.excluded))
+			for _, e := range tc.excluded {
+				_, ipnet, err := net.ParseCIDR(e)
+				require.NoError(t, err)
+				excluded = append(excluded, ipnet)
+			}
+
+			nets := SubtractCIDRs(block, excluded...)
+			result := make([]string, 0, len(nets))
+			for _, n := range nets {
+				result = append(result, n.String())
+			}
+			require.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+func TestDesiredStateExclude(t *testing.T) {
+	resourceA := Resource{Name: "a", Namespace: "x", Cluster: "m"}
+	resourceB := Resource{Name: "b", Namespace: "x", Cluster: "m"}
+	state := desiredStateFromStrings(map[Resource][]string{
+		resourceA: {"10.0.0.0/24", "8.8.8.8/32"},
+		resourceB: {"1.2.3.4/32"},
+	})
+
+	result, exclusions := state.Exclude([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.128/25"),
+		netip.MustParsePrefix("1.2.3.0/24"),
+	})
+	require.Equal(t, desiredStateFromStrings(map[Resource][]string{
+		resourceA: {"10.0.0.0/25", "8.8.8.8/32"},
+	}).String(), result.String())
+	require.Equal(t, []Exclusion{
+		{
+			Resource:  resourceB,
+			Prefix:    netip.MustParsePrefix("1.2.3.4/32"),
+			Denied:    []netip.Prefix{netip.MustParsePrefix("1.2.3.0/24")},
+			Remaining: []netip.Prefix{},
+		},
+		{
+			Resource:  resourceA,
+			Prefix:    netip.MustParsePrefix("10.0.0.0/24"),
+			Denied:    []netip.Prefix{netip.MustParsePrefix("10.0.0.128/25")},
+			Remaining: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/25")},
+		},
+	}, exclusions)
+
+	// the state is immutable
+	require.Len(t, state.Prefixes(resourceA), 2)
+	require.Len(t, state.Prefixes(resourceB), 1)
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+)
+
+// Connectivity defines whether the egress traffic of a resource leaves via
+// public or private egress IPs.
+type Connectivity string
+
+const (
+	// ConnectivityPublic routes egress traffic via public egress IPs to
+	// the internet. It's the default.
+	ConnectivityPublic Connectivity = "public"
+	// ConnectivityPrivate routes egress traffic via private egress IPs,
+	// e.g. to on-premise networks allow-listing them.
+	ConnectivityPrivate Connectivity = "private"
+)
+
+// ParseConnectivity parses the connectivity, an empty value defaults to
+// ConnectivityPublic.
+func ParseConnectivity(value string) (Connectivity, error) {
+	switch Connectivity(value) {
+	case "", ConnectivityPublic:
+		return ConnectivityPublic, nil
+	case ConnectivityPrivate:
+		return ConnectivityPrivate, nil
+	}
+	return "", fmt.Errorf("invalid connectivity '%s', must be %s or %s", value, ConnectivityPublic, ConnectivityPrivate)
+}
+
+// WithConnectivity returns the DesiredState with the connectivity of the
+// resources. Resources without a connectivity use ConnectivityPublic. The
+// given map is not referenced by the DesiredState.
+func (s *DesiredState) WithConnectivity(connectivity map[Resource]Connectivity) *DesiredState {
+	result := &DesiredState{
+		prefixes: s.prefixes,
+		sources:  s.sources,
+	}
+	for resource, c := range connectivity {
+		if c == ConnectivityPublic || c == "" {
+			continue
+		}
+		if result.connectivity == nil {
+			result.connectivity = make(map[Resource]Connectivity)
+		}
+		result.connectivity[resource] = c
+	}
+	return result
+}
+
+// withConnectivityOf sets the connectivity of the resources to the one of
+// the resources of other. It must only be called on newly created states.
+func (s *DesiredState) withConnectivityOf(other *DesiredState) *DesiredState {
+	s.connectivity = maps.Clone(other.connectivity)
+	return s
+}
+
+// Connectivity returns the connectivity of the resource.
+func (s *DesiredState) Connectivity(resource Resource) Connectivity {
+	if s == nil {
+		return ConnectivityPublic
+	}
+	if c, ok := s.connectivity[resource]; ok {
+		return c
+	}
+	return ConnectivityPublic
+}
+
+// FilterConnectivity returns the DesiredState of the resources with the
+// connectivity.
+func (s *DesiredState) FilterConnectivity(connectivity Connectivity) *DesiredState {
+	result := &DesiredState{
+		prefixes: make(map[Resource][]netip.Prefix),
+		sources:  make(map[Resource]map[netip.Prefix][]Source),
+	}
+	for _, resource := range s.Resources() {
+		if s.Connectivity(resource) != connectivity {
+			continue
+		}
+		result.prefixes[resource] = s.prefixes[resource]
+		result.sources[resource] = s.sources[resource]
+	}
+	if connectivity != ConnectivityPublic && result.Len() > 0 {
+		result.connectivity = make(map[Resource]Connectivity, result.Len())
+		for resource := range result.prefixes {
+			result.connectivity[resource] = connectivity
+		}
+	}
+	return result
+}
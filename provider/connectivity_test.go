@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConnectivity(tt *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		value    string
+		expected Connectivity
+		err      string
+	}{
+		{
+			msg:      "empty connectivity should default to public",
+			expected: ConnectivityPublic,
+		},
+		{
+			msg:      "public connectivity should be parsed",
+			value:    "public",
+			expected: ConnectivityPublic,
+		},
+		{
+			msg:      "private connectivity should be parsed",
+			value:    "private",
+			expected: ConnectivityPrivate,
+		},
+		{
+			msg:   "unknown connectivity should be rejected",
+			value: "Private",
+			err:   "invalid connectivity 'Private', must be public or private",
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			connectivity, err := ParseConnectivity(tc.value)
+			if tc.err != "" {
+				require.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, connectivity)
+		})
+	}
+}
+
+func TestDesiredStateConnectivity(t *testing.T) {
+	public := Resource{Kind: "ConfigMap", Name: "public", Namespace: "x"}
+	private := Resource{Kind: "ConfigMap", Name: "private", Namespace: "x"}
+	state := NewDesiredState(map[Resource][]netip.Prefix{
+		public:  {netip.MustParsePrefix("1.0.0.0/24")},
+		private: {netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.1.0/24")},
+	}).WithConnectivity(map[Resource]Connectivity{
+		public:  ConnectivityPublic,
+		private: ConnectivityPrivate,
+	})
+
+	require.Equal(t, ConnectivityPublic, state.Connectivity(public))
+	require.Equal(t, ConnectivityPrivate, state.Connectivity(private))
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("1.0.0.0/24")}, state.FilterConnectivity(ConnectivityPublic).Routes())
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/23")}, state.FilterConnectivity(ConnectivityPrivate).Routes())
+	require.Equal(t, ConnectivityPrivate, state.FilterConnectivity(ConnectivityPrivate).Connectivity(private))
+
+	// the connectivity is kept by derived states
+	excluded, _ := state.Exclude([]netip.Prefix{netip.MustParsePrefix("10.0.1.0/25")})
+	require.Equal(t, ConnectivityPrivate, excluded.Connectivity(private))
+	widened, _, err := state.EnforceRouteBudget(nil, RouteBudget{MaxRoutes: 1})
+	require.NoError(t, err)
+	require.Equal(t, ConnectivityPrivate, widened.Connectivity(private))
+
+	// entries restore the connectivity
+	entries := state.Entries()
+	require.Equal(t, ConnectivityPrivate, entries[0].Connectivity)
+	require.Empty(t, entries[2].Connectivity)
+	restored := NewDesiredStateFromEntries(entries)
+	require.Equal(t, ConnectivityPrivate, restored.Connectivity(private))
+	require.Equal(t, ConnectivityPublic, restored.Connectivity(public))
+
+	// private resources report the private egress IPs
+	statuses := ResourceStatuses(state, &Status{
+		EgressIPs:        map[string][]netip.Addr{"a": {netip.MustParseAddr("52.0.0.1")}},
+		PrivateEgressIPs: map[string][]netip.Addr{"a": {netip.MustParseAddr("10.10.0.1")}},
+		Routes:           []netip.Prefix{netip.MustParsePrefix("1.0.0.0/24")},
+	})
+	require.Equal(t, ResourceStatus{EgressIPs: []netip.Addr{netip.MustParseAddr("52.0.0.1")}, Applied: true, Healthy: true}, statuses[public])
+	require.Equal(t, ResourceStatus{EgressIPs: []netip.Addr{netip.MustParseAddr("10.10.0.1")}, Healthy: true}, statuses[private])
+}
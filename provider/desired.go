@@ -0,0 +1,390 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Source describes where a prefix was configured.
+type Source struct {
+	Resource Resource `json:"resource"`
+	// Key is the key of the resource configuring the prefix, e.g. the
+	// data key of a ConfigMap.
+	Key string `json:"key,omitempty"`
+	// PrefixList is the ID of the managed prefix list the prefix was
+	// resolved from.
+	PrefixList string `json:"prefixList,omitempty"`
+	// Prefix is the prefix as configured, before denied networks were
+	// excluded or routes were widened.
+	Prefix netip.Prefix `json:"prefix"`
+}
+
+func (s Source) String() string {
+	var from string
+	if s.PrefixList != "" {
+		from = " from " + s.PrefixList
+	}
+	return fmt.Sprintf("%s%s (key '%s' of %v)", s.Prefix, from, s.Key, s.Resource)
+}
+
+func (s Source) compare(o Source) int {
+	if s.Resource != o.Resource {
+		if s.Resource.less(o.Resource) {
+			return -1
+		}
+		return 1
+	}
+	if c := strings.Compare(s.Key, o.Key); c != 0 {
+		return c
+	}
+	if c := strings.Compare(s.PrefixList, o.PrefixList); c != 0 {
+		return c
+	}
+	if c := s.Prefix.Addr().Compare(o.Prefix.Addr()); c != 0 {
+		return c
+	}
+	return s.Prefix.Bits() - o.Prefix.Bits()
+}
+
+// RouteSources is a route with the sources of all prefixes covered by it.
+type RouteSources struct {
+	Route   netip.Prefix `json:"route"`
+	Sources []Source     `json:"sources"`
+}
+
+// Entry is a prefix of a resource with the sources it was derived from.
+type Entry struct {
+	Resource Resource     `json:"resource"`
+	Prefix   netip.Prefix `json:"prefix"`
+	Sources  []Source     `json:"sources"`
+	// Connectivity is the connectivity of the resource, it's omitted for
+	// ConnectivityPublic.
+	Connectivity Connectivity `json:"connectivity,omitempty"`
+}
+
+// DesiredState is the immutable desired egress state, the prefixes each
+// resource wants to be routed via static egress IPs. Every prefix keeps
+// track of the sources it was derived from and every resource of its
+// connectivity.
+type DesiredState struct {
+	prefixes     map[Resource][]netip.Prefix
+	sources      map[Resource]map[netip.Prefix][]Source
+	connectivity map[Resource]Connectivity
+
+	routesOnce sync.Once
+	routes     []netip.Prefix
+}
+
+// NewDesiredState creates a DesiredState from the prefixes of each resource.
+// Prefixes are masked, sorted and deduplicated and resources without
+// prefixes are dropped. The given map is not referenced by the DesiredState.
+func NewDesiredState(prefixes map[Resource][]netip.Prefix) *DesiredState {
+	sources := make([]Source, 0, len(prefixes))
+	for resource, ps := range prefixes {
+		for _, p := range ps {
+			sources = append(sources, Source{Resource: resource, Prefix: p})
+		}
+	}
+	return NewDesiredStateFromSources(sources)
+}
+
+// NewDesiredStateFromSources creates a DesiredState from the configured
+// prefixes of all resources.
+func NewDesiredStateFromSources(sources []Source) *DesiredState {
+	entries := make(map[Resource]map[netip.Prefix][]Source)
+	for _, source := range sources {
+		source.Prefix = source.Prefix.Masked()
+		if entries[source.Resource] == nil {
+			entries[source.Resource] = make(map[netip.Prefix][]Source)
+		}
+		entries[source.Resource][source.Prefix] = append(entries[source.Resource][source.Prefix], source)
+	}
+	return newDesiredState(entries)
+}
+
+// NewDesiredStateFromEntries initializes a desired state from the entries
+// returned by Entries. Entries without sources get a source of their own
+// prefix.
+func NewDesiredStateFromEntries(entries []Entry) *DesiredState {
+	bySource := make(map[Resource]map[netip.Prefix][]Source)
+	connectivity := make(map[Resource]Connectivity)
+	for _, entry := range entries {
+		if entry.Connectivity != "" {
+			connectivity[entry.Resource] = entry.Connectivity
+		}
+		if bySource[entry.Resource] == nil {
+			bySource[entry.Resource] = make(map[netip.Prefix][]Source)
+		}
+		prefix := entry.Prefix.Masked()
+		sources := entry.Sources
+		if len(sources) == 0 {
+			sources = []Source{{Resource: entry.Resource, Prefix: prefix}}
+		}
+		bySource[entry.Resource][prefix] = append(bySource[entry.Resource][prefix], sources...)
+	}
+	return newDesiredState(bySource).WithConnectivity(connectivity)
+}
+
+// newDesiredState creates a DesiredState from the sources of the prefixes of
+// each resource. The prefixes must be masked.
+func newDesiredState(entries map[Resource]map[netip.Prefix][]Source) *DesiredState {
+	s := &DesiredState{
+		prefixes: make(map[Resource][]netip.Prefix, len(entries)),
+		sources:  make(map[Resource]map[netip.Prefix][]Source, len(entries)),
+	}
+
+	for resource, bySource := range entries {
+		if len(bySource) == 0 {
+			continue
+		}
+
+		prefixes := make([]netip.Prefix, 0, len(bySource))
+		sources := make(map[netip.Prefix][]Source, len(bySource))
+		for p, ss := range bySource {
+			prefixes = append(prefixes, p)
+			sources[p] = sortSources(ss)
+		}
+		sortPrefixes(prefixes)
+		s.prefixes[resource] = prefixes
+		s.sources[resource] = sources
+	}
+	return s
+}
+
+// sortSources returns the sorted and deduplicated sources. The result has no
+// spare capacity, so appending to it never modifies a DesiredState.
+func sortSources(sources []Source) []Source {
+	sorted := slices.Clone(sources)
+	slices.SortFunc(sorted, Source.compare)
+	return slices.Clip(slices.Compact(sorted))
+}
+
+// DesiredStateFromLegacy creates a DesiredState from the legacy
+// representation of CIDRs by resource.
+func DesiredStateFromLegacy(configs map[Resource]map[string]*net.IPNet) *DesiredState {
+	prefixes := make(map[Resource][]netip.Prefix, len(configs))
+	for resource, ipAddresses := range configs {
+		for _, ipnet := range ipAddresses {
+			prefixes[resource] = append(prefixes[resource], PrefixFromIPNet(ipnet))
+		}
+	}
+	return NewDesiredState(prefixes)
+}
+
+// Len returns the number of resources.
+func (s *DesiredState) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.prefixes)
+}
+
+// Resources returns the resources in a stable order.
+func (s *DesiredState) Resources() []Resource {
+	if s == nil {
+		return nil
+	}
+
+	resources := make([]Resource, 0, len(s.prefixes))
+	for resource := range s.prefixes {
+		resources = append(resources, resource)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i].less(resources[j])
+	})
+	return resources
+}
+
+// Prefixes returns the sorted prefixes of the resource.
+func (s *DesiredState) Prefixes(resource Resource) []netip.Prefix {
+	if s == nil {
+		return nil
+	}
+	return slices.Clone(s.prefixes[resource])
+}
+
+// Sources returns the sources the prefix of the resource was derived from.
+func (s *DesiredState) Sources(resource Resource, prefix netip.Prefix) []Source {
+	if s == nil {
+		return nil
+	}
+	return slices.Clone(s.sources[resource][prefix])
+}
+
+// Entries returns the prefixes of all resources together with their
+// sources and connectivity. The desired state can be restored from them with
+// NewDesiredStateFromEntries.
+func (s *DesiredState) Entries() []Entry {
+	var entries []Entry
+	for _, resource := range s.Resources() {
+		var connectivity Connectivity
+		if c := s.Connectivity(resource); c != ConnectivityPublic {
+			connectivity = c
+		}
+		for _, prefix := range s.prefixes[resource] {
+			entries = append(entries, Entry{
+				Resource:     resource,
+				Prefix:       prefix,
+				Sources:      slices.Clone(s.sources[resource][prefix]),
+				Connectivity: connectivity,
+			})
+		}
+	}
+	return entries
+}
+
+// Routes returns the minimal sorted list of routes covering exactly the
+// prefixes of all resources.
+func (s *DesiredState) Routes() []netip.Prefix {
+	if s == nil {
+		return nil
+	}
+
+	s.routesOnce.Do(func() {
+		trie := newPrefixTrie()
+		for _, prefixes := range s.prefixes {
+			for _, p := range prefixes {
+				trie.insert(p)
+			}
+		}
+		trie.aggregate()
+		s.routes = trie.prefixes()
+	})
+	return slices.Clone(s.routes)
+}
+
+// RoutesWithOptions returns the routes like Routes, additionally merging
+// routes into supernets covering unconfigured addresses as allowed by the
+// options.
+func (s *DesiredState) RoutesWithOptions(opts RouteOptions) []netip.Prefix {
+	routes := s.Routes()
+	if opts.MaxOverApproximation > 0 {
+		routes = overApproximatePrefixes(routes, opts)
+	}
+	return routes
+}
+
+// RoutesWithSources returns the routes like RoutesWithOptions together with
+// the sources of all prefixes covered by each route, including prefixes
+// subsumed by other prefixes.
+func (s *DesiredState) RoutesWithSources(opts RouteOptions) []RouteSources {
+	routes := s.RoutesWithOptions(opts)
+	result := make([]RouteSources, len(routes))
+	for i, route := range routes {
+		result[i].Route = route
+	}
+
+	for _, bySource := range s.sources {
+		for p, sources := range bySource {
+			// routes are sorted and don't overlap, so the covering
+			// route is the last one starting at or before p
+			i := sort.Search(len(routes), func(i int) bool {
+				return routes[i].Addr().Compare(p.Addr()) > 0
+			}) - 1
+			if i >= 0 && prefixContains(routes[i], p) {
+				result[i].Sources = append(result[i].Sources, sources...)
+			}
+		}
+	}
+
+	for i := range result {
+		result[i].Sources = sortSources(result[i].Sources)
+	}
+	return result
+}
+
+// Provenance returns the sources of all prefixes covered by the route.
+func (s *DesiredState) Provenance(route netip.Prefix) []Source {
+	if s == nil {
+		return nil
+	}
+
+	var sources []Source
+	for _, bySource := range s.sources {
+		for p, ss := range bySource {
+			if prefixContains(route, p) {
+				sources = append(sources, ss...)
+			}
+		}
+	}
+	return sortSources(sources)
+}
+
+func (s *DesiredState) String() string {
+	resources := s.Resources()
+	entries := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		entries = append(entries, fmt.Sprintf("%s:%v", resource, s.prefixes[resource]))
+	}
+	return "[" + strings.Join(entries, " ") + "]"
+}
+
+// Exclude returns a DesiredState without the denied prefixes. Prefixes
+// partially overlapping a denied prefix are split into the remaining parts,
+// which keep the sources of the prefix.
+func (s *DesiredState) Exclude(denied []netip.Prefix) (*DesiredState, []Exclusion) {
+	if len(denied) == 0 {
+		return s, nil
+	}
+
+	deniedTrie := newPrefixTrie()
+	for _, d := range denied {
+		deniedTrie.insert(d.Masked())
+	}
+
+	var exclusions []Exclusion
+	result := make(map[Resource]map[netip.Prefix][]Source, s.Len())
+	for _, resource := range s.Resources() {
+		result[resource] = make(map[netip.Prefix][]Source, len(s.prefixes[resource]))
+		for _, p := range s.prefixes[resource] {
+			var overlapping []netip.Prefix
+			for _, d := range denied {
+				if p.Overlaps(d) {
+					overlapping = append(overlapping, d.Masked())
+				}
+			}
+
+			if len(overlapping) == 0 {
+				result[resource][p] = s.sources[resource][p]
+				continue
+			}
+
+			remaining := []netip.Prefix{}
+			if !deniedTrie.contains(p) {
+				remaining = subtractPrefix(p, overlapping)
+			}
+			for _, r := range remaining {
+				result[resource][r] = append(result[resource][r], s.sources[resource][p]...)
+			}
+			exclusions = append(exclusions, Exclusion{
+				Resource:  resource,
+				Prefix:    p,
+				Denied:    overlapping,
+				Remaining: remaining,
+			})
+		}
+	}
+
+	sort.Slice(exclusions, func(i, j int) bool {
+		return exclusions[i].String() < exclusions[j].String()
+	})
+	return newDesiredState(result).withConnectivityOf(s), exclusions
+}
+
+func (r Resource) less(o Resource) bool {
+	if r.Cluster != o.Cluster {
+		return r.Cluster < o.Cluster
+	}
+	if r.Namespace != o.Namespace {
+		return r.Namespace < o.Namespace
+	}
+	if r.Name != o.Name {
+		return r.Name < o.Name
+	}
+	return r.Kind < o.Kind
+}
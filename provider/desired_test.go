@@ -0,0 +1,50 @@
+package provider
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDesiredStateProvenance(t *testing.T) {
+	resourceA := Resource{Kind: "ConfigMap", Name: "a", Namespace: "x", Cluster: "m"}
+	resourceB := Resource{Kind: "ConfigMap", Name: "b", Namespace: "x", Cluster: "m"}
+	sourceA1 := Source{Resource: resourceA, Key: "a1", Prefix: netip.MustParsePrefix("10.0.0.0/25")}
+	sourceA2 := Source{Resource: resourceA, Key: "a2", Prefix: netip.MustParsePrefix("10.0.0.128/25")}
+	sourceB1 := Source{Resource: resourceB, Key: "b1", Prefix: netip.MustParsePrefix("10.0.0.1/32")}
+	sourceB2 := Source{Resource: resourceB, Key: "b2", PrefixList: "pl-1111", Prefix: netip.MustParsePrefix("1.0.0.0/24")}
+	state := NewDesiredStateFromSources([]Source{sourceA1, sourceA2, sourceB1, sourceB2})
+
+	// subsumed prefixes contribute to the aggregated route
+	require.Equal(t, []RouteSources{
+		{
+			Route:   netip.MustParsePrefix("1.0.0.0/24"),
+			Sources: []Source{sourceB2},
+		},
+		{
+			Route:   netip.MustParsePrefix("10.0.0.0/24"),
+			Sources: []Source{sourceA1, sourceA2, sourceB1},
+		},
+	}, state.RoutesWithSources(RouteOptions{}))
+	require.Equal(t, []Source{sourceA1, sourceB1}, state.Provenance(netip.MustParsePrefix("10.0.0.0/25")))
+
+	// remaining parts of excluded prefixes keep their sources
+	excluded, _ := state.Exclude([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/26")})
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.64/26"),
+		netip.MustParsePrefix("10.0.0.128/25"),
+	}, excluded.Prefixes(resourceA))
+	require.Equal(t, []Source{sourceA1}, excluded.Sources(resourceA, netip.MustParsePrefix("10.0.0.64/26")))
+
+	// entries restore the desired state with its sources
+	restored := NewDesiredStateFromEntries(excluded.Entries())
+	require.Equal(t, excluded.Entries(), restored.Entries())
+	require.Equal(t, excluded.RoutesWithSources(RouteOptions{}), restored.RoutesWithSources(RouteOptions{}))
+
+	// widened routes keep the sources of all replaced prefixes
+	widened, _, err := state.EnforceRouteBudget(nil, RouteBudget{MaxRoutes: 1})
+	require.NoError(t, err)
+	require.Equal(t, []Source{sourceB1, sourceB2}, widened.Sources(resourceB, netip.MustParsePrefix("0.0.0.0/4")))
+	require.Equal(t, []Source{sourceA1, sourceA2}, widened.Sources(resourceA, netip.MustParsePrefix("0.0.0.0/4")))
+}
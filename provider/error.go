@@ -1,5 +1,10 @@
 package provider
 
+import (
+	"errors"
+	"fmt"
+)
+
 type AlreadyExistsError struct {
 	msg string
 }
@@ -23,3 +28,87 @@ func NewAlreadyExistsError(msg string) error {
 func NewDoesNotExistError(msg string) error {
 	return &DoesNotExistError{msg}
 }
+
+// ErrorClass classifies provider errors by how they should be handled.
+type ErrorClass string
+
+const (
+	// ErrorClassUnknown is the class of unclassified errors.
+	ErrorClassUnknown ErrorClass = "unknown"
+	// ErrorClassRetryable are transient errors which may succeed when
+	// retried.
+	ErrorClassRetryable ErrorClass = "retryable"
+	// ErrorClassThrottled are errors caused by rate limits. Requests
+	// should be backed off.
+	ErrorClassThrottled ErrorClass = "throttled"
+	// ErrorClassPermanent are errors which won't go away by retrying,
+	// e.g. caused by a misconfiguration or exceeded quotas.
+	ErrorClassPermanent ErrorClass = "permanent"
+	// ErrorClassConflict are errors caused by a concurrent operation on
+	// the same resources.
+	ErrorClassConflict ErrorClass = "conflict"
+	// ErrorClassPartialApply are errors after which only some of the
+	// changes were applied and the resources are left in an
+	// inconsistent state.
+	ErrorClassPartialApply ErrorClass = "partial_apply"
+	// ErrorClassBlockedByPolicy are errors caused by missing
+	// permissions or organization policies.
+	ErrorClassBlockedByPolicy ErrorClass = "blocked_by_policy"
+	// ErrorClassInProgress are syncs waiting for operations started by
+	// the provider, whose results are picked up by the next syncs.
+	ErrorClassInProgress ErrorClass = "in_progress"
+)
+
+// ErrorClasses are all error classes.
+var ErrorClasses = []ErrorClass{
+	ErrorClassUnknown,
+	ErrorClassRetryable,
+	ErrorClassThrottled,
+	ErrorClassPermanent,
+	ErrorClassConflict,
+	ErrorClassPartialApply,
+	ErrorClassBlockedByPolicy,
+	ErrorClassInProgress,
+}
+
+// Error is a classified provider error.
+type Error struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Class, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NewError classifies the error. nil errors stay nil.
+func NewError(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Class: class, Err: err}
+}
+
+// ClassOf returns the class of the error. Errors not classified by a
+// provider are ErrorClassUnknown.
+func ClassOf(err error) ErrorClass {
+	var classified *Error
+	if errors.As(err, &classified) {
+		return classified.Class
+	}
+
+	var alreadyExists *AlreadyExistsError
+	if errors.As(err, &alreadyExists) {
+		return ErrorClassConflict
+	}
+
+	var doesNotExist *DoesNotExistError
+	if errors.As(err, &doesNotExist) {
+		return ErrorClassRetryable
+	}
+	return ErrorClassUnknown
+}
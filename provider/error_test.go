@@ -0,0 +1,56 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassOf(tt *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		err      error
+		expected ErrorClass
+	}{
+		{
+			msg:      "unclassified errors should be unknown",
+			err:      errors.New("failed"),
+			expected: ErrorClassUnknown,
+		},
+		{
+			msg:      "classified errors should keep their class",
+			err:      NewError(ErrorClassThrottled, errors.New("rate exceeded")),
+			expected: ErrorClassThrottled,
+		},
+		{
+			msg:      "wrapped classified errors should keep their class",
+			err:      fmt.Errorf("failed to update: %w", NewError(ErrorClassPartialApply, errors.New("rollback failed"))),
+			expected: ErrorClassPartialApply,
+		},
+		{
+			msg:      "already existing resources should be a conflict",
+			err:      NewAlreadyExistsError("stack exists"),
+			expected: ErrorClassConflict,
+		},
+		{
+			msg:      "missing resources should be retryable",
+			err:      NewDoesNotExistError("stack is gone"),
+			expected: ErrorClassRetryable,
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			require.Equal(t, tc.expected, ClassOf(tc.err))
+		})
+	}
+}
+
+func TestNewError(t *testing.T) {
+	require.NoError(t, NewError(ErrorClassPermanent, nil))
+
+	cause := errors.New("invalid template")
+	err := NewError(ErrorClassPermanent, cause)
+	require.ErrorIs(t, err, cause)
+	require.Equal(t, "permanent: invalid template", err.Error())
+}
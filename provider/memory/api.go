@@ -0,0 +1,104 @@
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+// failureRequest injects failures of the next Ensure calls.
+type failureRequest struct {
+	Class   provider.ErrorClass `json:"class"`
+	Message string              `json:"message"`
+	// Count is the number of Ensure calls failing (default: 1).
+	Count int `json:"count"`
+}
+
+// latencyRequest sets the delay of Ensure calls, e.g. "2s".
+type latencyRequest struct {
+	Latency string `json:"latency"`
+}
+
+// RegisterHandlers registers the read-only endpoints of the memory provider:
+//
+//	GET    /provider/memory           applied routes, egress IPs and history
+func (p *MemoryProvider) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /provider/memory", p.handleState)
+}
+
+// RegisterApprovalHandlers registers the endpoints changing the behaviour of
+// the memory provider, which are only served by the authenticated approval
+// listener:
+//
+//	POST   /provider/memory/failures  fail the next Ensure calls
+//	DELETE /provider/memory/failures  remove all injected failures
+//	PUT    /provider/memory/latency   set the delay of Ensure calls
+func (p *MemoryProvider) RegisterApprovalHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("POST /provider/memory/failures", p.handleAddFailures)
+	mux.HandleFunc("DELETE /provider/memory/failures", p.handleClearFailures)
+	mux.HandleFunc("PUT /provider/memory/latency", p.handleLatency)
+}
+
+func (p *MemoryProvider) handleState(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, p.State())
+}
+
+func (p *MemoryProvider) handleAddFailures(w http.ResponseWriter, r *http.Request) {
+	var req failureRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Class == "" {
+		req.Class = provider.ErrorClassRetryable
+	}
+	if req.Message == "" {
+		req.Message = "injected failure"
+	}
+	if req.Count <= 0 {
+		req.Count = 1
+	}
+
+	errs := make([]error, 0, req.Count)
+	for i := 0; i < req.Count; i++ {
+		errs = append(errs, provider.NewError(req.Class, errors.New(req.Message)))
+	}
+	p.FailNext(errs...)
+	writeJSON(w, http.StatusOK, p.State())
+}
+
+func (p *MemoryProvider) handleClearFailures(w http.ResponseWriter, _ *http.Request) {
+	p.ClearFailures()
+	writeJSON(w, http.StatusOK, p.State())
+}
+
+func (p *MemoryProvider) handleLatency(w http.ResponseWriter, r *http.Request) {
+	var req latencyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	latency, err := time.ParseDuration(req.Latency)
+	if err != nil || latency < 0 {
+		http.Error(w, fmt.Sprintf("invalid latency %q", req.Latency), http.StatusBadRequest)
+		return
+	}
+	p.SetLatency(latency)
+	writeJSON(w, http.StatusOK, p.State())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Errorf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package memory
+
+import (
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func init() {
+	provider.Register(ProviderName, &factory{})
+}
+
+// factory creates the memory provider from its command line flags.
+type factory struct {
+	zones   []string
+	latency time.Duration
+}
+
+func (f *factory) Description() string {
+	return "keeps routes and synthetic egress IPs in memory, for tests and demos"
+}
+
+func (f *factory) RegisterFlags(app *kingpin.Application) {
+	app.Flag("memory-zone", "Zones the memory provider allocates a synthetic egress IP in. (default: zone-a, zone-b, zone-c)").Default("zone-a", "zone-b", "zone-c").StringsVar(&f.zones)
+	app.Flag("memory-latency", "Delay of every sync of the memory provider. (default: 0s)").Default("0s").DurationVar(&f.latency)
+}
+
+func (f *factory) New(_ provider.Options) (provider.Provider, error) {
+	return NewMemoryProvider(f.zones, f.latency), nil
+}
@@ -0,0 +1,232 @@
+// Package memory implements a provider keeping the applied state in memory.
+// It allocates synthetic egress IPs, records every Ensure call and supports
+// injecting failures and latency, which makes it possible to run the
+// controller end to end without a cloud provider.
+package memory
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+const (
+	ProviderName = "memory"
+	// maxHistory is the number of Ensure calls kept in the history.
+	maxHistory = 100
+)
+
+// egressIPRange is the range synthetic egress IPs are allocated from
+// (TEST-NET-2, RFC 5737).
+var egressIPRange = netip.MustParsePrefix("198.51.100.0/24")
+
+// EnsureCall records a call of Ensure.
+type EnsureCall struct {
+	Time     time.Time      `json:"time"`
+	Duration time.Duration  `json:"duration"`
+	Routes   []netip.Prefix `json:"routes"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// State is the state of the memory provider.
+type State struct {
+	Routes    []netip.Prefix          `json:"routes"`
+	EgressIPs map[string][]netip.Addr `json:"egressIPs"`
+	Latency   time.Duration           `json:"latency"`
+	// Failures are the errors returned by the next Ensure calls.
+	Failures []string     `json:"failures"`
+	History  []EnsureCall `json:"history"`
+}
+
+// MemoryProvider applies the desired state by storing its routes. Egress IPs
+// are allocated per zone when the first routes are applied and released when
+// all routes are removed, like NAT gateways with EIPs would be.
+type MemoryProvider struct {
+	mu        sync.Mutex
+	zones     []string
+	latency   time.Duration
+	failures  []error
+	routes    []netip.Prefix
+	egressIPs map[string][]netip.Addr
+	nextIP    netip.Addr
+	history   []EnsureCall
+}
+
+// NewMemoryProvider initializes a new MemoryProvider allocating an egress IP
+// in each zone. Every Ensure call is delayed by latency.
+func NewMemoryProvider(zones []string, latency time.Duration) *MemoryProvider {
+	return &MemoryProvider{
+		zones:     zones,
+		latency:   latency,
+		egressIPs: make(map[string][]netip.Addr),
+		nextIP:    egressIPRange.Addr().Next(),
+	}
+}
+
+func (p *MemoryProvider) String() string {
+	return ProviderName
+}
+
+// Ensure applies the routes of the desired state after the configured
+// latency. Injected failures are returned in order and leave the applied
+// state unchanged.
+func (p *MemoryProvider) Ensure(ctx context.Context, state *provider.DesiredState) error {
+	p.mu.Lock()
+	latency := p.latency
+	p.mu.Unlock()
+
+	start := time.Now()
+	routes := state.Routes()
+	err := p.wait(ctx, latency)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil && len(p.failures) > 0 {
+		err = p.failures[0]
+		p.failures = p.failures[1:]
+	}
+	if err == nil {
+		p.apply(routes)
+	}
+
+	call := EnsureCall{Time: start, Duration: time.Since(start), Routes: routes}
+	if err != nil {
+		call.Error = err.Error()
+		log.Warnf("%s Ensure failed: %v", ProviderName, err)
+	}
+	p.history = append(p.history, call)
+	if len(p.history) > maxHistory {
+		p.history = p.history[len(p.history)-maxHistory:]
+	}
+	return err
+}
+
+func (p *MemoryProvider) wait(ctx context.Context, latency time.Duration) error {
+	if latency <= 0 {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return provider.NewError(provider.ErrorClassRetryable, ctx.Err())
+	case <-time.After(latency):
+		return nil
+	}
+}
+
+// apply stores the routes and allocates or releases the egress IPs.
+func (p *MemoryProvider) apply(routes []netip.Prefix) {
+	p.routes = routes
+	if len(routes) == 0 {
+		p.egressIPs = make(map[string][]netip.Addr)
+		return
+	}
+
+	for _, zone := range p.zones {
+		if len(p.egressIPs[zone]) > 0 {
+			continue
+		}
+		p.egressIPs[zone] = []netip.Addr{p.nextIP}
+		p.nextIP = p.nextIP.Next()
+		if !egressIPRange.Contains(p.nextIP) {
+			p.nextIP = egressIPRange.Addr().Next()
+		}
+	}
+}
+
+// FailNext makes the next Ensure calls return the errors, one per call.
+func (p *MemoryProvider) FailNext(errs ...error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures = append(p.failures, errs...)
+}
+
+// ClearFailures removes all injected failures.
+func (p *MemoryProvider) ClearFailures() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures = nil
+}
+
+// SetLatency sets the delay of Ensure calls.
+func (p *MemoryProvider) SetLatency(latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.latency = latency
+}
+
+// State returns a copy of the current state.
+func (p *MemoryProvider) State() *State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := &State{
+		Routes:    append([]netip.Prefix(nil), p.routes...),
+		EgressIPs: p.copyEgressIPs(),
+		Latency:   p.latency,
+		Failures:  make([]string, 0, len(p.failures)),
+		History:   append([]EnsureCall(nil), p.history...),
+	}
+	for _, err := range p.failures {
+		state.Failures = append(state.Failures, err.Error())
+	}
+	return state
+}
+
+func (p *MemoryProvider) copyEgressIPs() map[string][]netip.Addr {
+	egressIPs := make(map[string][]netip.Addr, len(p.egressIPs))
+	for zone, ips := range p.egressIPs {
+		egressIPs[zone] = append([]netip.Addr(nil), ips...)
+	}
+	return egressIPs
+}
+
+// Status reports the applied routes and the allocated egress IPs. The
+// provider is unhealthy if the last Ensure call failed.
+func (p *MemoryProvider) Status(_ context.Context) (*provider.Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	health := provider.ResourceHealth{Name: ProviderName, Healthy: true, Status: "ok"}
+	if len(p.history) > 0 {
+		if last := p.history[len(p.history)-1]; last.Error != "" {
+			health = provider.ResourceHealth{Name: ProviderName, Status: "failed", Reason: last.Error}
+		}
+	}
+	return &provider.Status{
+		EgressIPs: p.copyEgressIPs(),
+		Routes:    append([]netip.Prefix(nil), p.routes...),
+		Resources: []provider.ResourceHealth{health},
+	}, nil
+}
+
+// Plan returns the routes added and removed compared to the applied routes.
+func (p *MemoryProvider) Plan(_ context.Context, state *provider.DesiredState) (*provider.Plan, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	routes := state.Routes()
+	added, removed := provider.DiffRoutes(p.routes, routes)
+	if len(added) == 0 && len(removed) == 0 {
+		return &provider.Plan{Action: provider.PlanActionNone}, nil
+	}
+
+	plan := &provider.Plan{
+		Action: provider.PlanActionUpdate,
+		RouteTables: []provider.RouteTableChange{
+			{RouteTable: ProviderName, Added: added, Removed: removed},
+		},
+	}
+	switch {
+	case len(p.routes) == 0:
+		plan.Action = provider.PlanActionCreate
+	case len(routes) == 0:
+		plan.Action = provider.PlanActionDelete
+		plan.ReplacesEgressIPs = true
+	}
+	return plan, nil
+}
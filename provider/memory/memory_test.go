@@ -0,0 +1,161 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func TestMemoryProviderEnsure(t *testing.T) {
+	resource := provider.Resource{Name: "a", Namespace: "x", Cluster: "m"}
+	state := provider.NewDesiredState(map[provider.Resource][]netip.Prefix{
+		resource: {netip.MustParsePrefix("1.0.0.1/32"), netip.MustParsePrefix("2.0.0.0/24")},
+	})
+	p := NewMemoryProvider([]string{"zone-a", "zone-b"}, 0)
+	ctx := context.Background()
+
+	require.NoError(t, p.Ensure(ctx, state))
+	status, err := p.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, state.Routes(), status.Routes)
+	require.Equal(t, map[string][]netip.Addr{
+		"zone-a": {netip.MustParseAddr("198.51.100.1")},
+		"zone-b": {netip.MustParseAddr("198.51.100.2")},
+	}, status.EgressIPs)
+	require.True(t, status.Healthy())
+
+	// egress IPs should be kept while routes are applied.
+	require.NoError(t, p.Ensure(ctx, state))
+	require.Equal(t, status.EgressIPs, p.State().EgressIPs)
+
+	// injected failures should be returned in order and keep the state.
+	throttled := provider.NewError(provider.ErrorClassThrottled, errors.New("rate exceeded"))
+	p.FailNext(throttled)
+	require.Equal(t, throttled, p.Ensure(ctx, provider.NewDesiredState(nil)))
+	status, err = p.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, state.Routes(), status.Routes)
+	require.False(t, status.Healthy())
+
+	// removing all routes should release the egress IPs.
+	require.NoError(t, p.Ensure(ctx, provider.NewDesiredState(nil)))
+	require.Empty(t, p.State().Routes)
+	require.Empty(t, p.State().EgressIPs)
+
+	// new egress IPs should be allocated.
+	require.NoError(t, p.Ensure(ctx, state))
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("198.51.100.3")}, p.State().EgressIPs["zone-a"])
+
+	history := p.State().History
+	require.Len(t, history, 5)
+	require.Equal(t, throttled.Error(), history[2].Error)
+	require.Equal(t, state.Routes(), history[4].Routes)
+}
+
+func TestMemoryProviderLatency(t *testing.T) {
+	p := NewMemoryProvider(nil, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := p.Ensure(ctx, provider.NewDesiredState(nil))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, provider.ErrorClassRetryable, provider.ClassOf(err))
+}
+
+func TestMemoryProviderAPI(tt *testing.T) {
+	p := NewMemoryProvider([]string{"zone-a"}, 0)
+	mux := http.NewServeMux()
+	p.RegisterHandlers(mux)
+	approvalMux := http.NewServeMux()
+	p.RegisterApprovalHandlers(approvalMux)
+
+	// injecting failures and latency isn't served next to the metrics
+	for _, path := range []string{"/provider/memory/failures", "/provider/memory/latency"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`)))
+		require.NotEqual(tt, http.StatusOK, rec.Code)
+	}
+
+	for _, tc := range []struct {
+		msg      string
+		method   string
+		path     string
+		body     string
+		status   int
+		failures []string
+		latency  time.Duration
+	}{
+		{
+			msg:      "state should be served",
+			method:   http.MethodGet,
+			path:     "/provider/memory",
+			status:   http.StatusOK,
+			failures: []string{},
+		},
+		{
+			msg:      "failures should be injected",
+			method:   http.MethodPost,
+			path:     "/provider/memory/failures",
+			body:     `{"class": "conflict", "message": "stack busy", "count": 2}`,
+			status:   http.StatusOK,
+			failures: []string{"conflict: stack busy", "conflict: stack busy"},
+		},
+		{
+			msg:    "invalid failures should be rejected",
+			method: http.MethodPost,
+			path:   "/provider/memory/failures",
+			body:   `{`,
+			status: http.StatusBadRequest,
+		},
+		{
+			msg:      "failures should be cleared",
+			method:   http.MethodDelete,
+			path:     "/provider/memory/failures",
+			status:   http.StatusOK,
+			failures: []string{},
+		},
+		{
+			msg:      "latency should be set",
+			method:   http.MethodPut,
+			path:     "/provider/memory/latency",
+			body:     `{"latency": "2s"}`,
+			status:   http.StatusOK,
+			failures: []string{},
+			latency:  2 * time.Second,
+		},
+		{
+			msg:    "invalid latency should be rejected",
+			method: http.MethodPut,
+			path:   "/provider/memory/latency",
+			body:   `{"latency": "soon"}`,
+			status: http.StatusBadRequest,
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler := approvalMux
+			if tc.method == http.MethodGet {
+				handler = mux
+			}
+			handler.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+			require.Equal(t, tc.status, rec.Code)
+			if tc.status != http.StatusOK {
+				return
+			}
+
+			var state State
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&state))
+			require.Equal(t, tc.failures, state.Failures)
+			require.Equal(t, tc.latency, state.Latency)
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package noop
+
+import (
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func init() {
+	provider.Register(ProviderName, factory{})
+}
+
+// factory creates the noop provider. It has no flags.
+type factory struct{}
+
+func (factory) Description() string {
+	return "logs the desired state without creating any resources"
+}
+
+func (factory) RegisterFlags(_ *kingpin.Application) {}
+
+func (factory) New(_ provider.Options) (provider.Provider, error) {
+	return NewNoopProvider(), nil
+}
@@ -2,7 +2,8 @@ package noop
 
 import (
 	"context"
-	"net"
+	"net/netip"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/szuecs/kube-static-egress-controller/provider"
@@ -10,17 +11,55 @@ import (
 
 const ProviderName = "noop"
 
-type NoopProvider struct{}
+type NoopProvider struct {
+	mu     sync.Mutex
+	routes []netip.Prefix
+}
 
 func NewNoopProvider() *NoopProvider {
 	return &NoopProvider{}
 }
 
-func (p NoopProvider) String() string {
+func (p *NoopProvider) String() string {
 	return ProviderName
 }
 
-func (p *NoopProvider) Ensure(_ context.Context, configs map[provider.Resource]map[string]*net.IPNet) error {
-	log.Infof("%s Ensure(%v)", ProviderName, configs)
+func (p *NoopProvider) Ensure(_ context.Context, state *provider.DesiredState) error {
+	log.Infof("%s Ensure(%v)", ProviderName, state)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.routes = state.Routes()
 	return nil
 }
+
+// Status reports the routes of the last Ensure call as applied. The noop
+// provider has no egress IPs.
+func (p *NoopProvider) Status(_ context.Context) (*provider.Status, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &provider.Status{
+		EgressIPs: map[string][]netip.Addr{},
+		Routes:    p.routes,
+		Resources: []provider.ResourceHealth{
+			{Name: ProviderName, Healthy: true, Status: "ok"},
+		},
+	}, nil
+}
+
+// Plan returns the routes added and removed compared to the last Ensure
+// call.
+func (p *NoopProvider) Plan(_ context.Context, state *provider.DesiredState) (*provider.Plan, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	added, removed := provider.DiffRoutes(p.routes, state.Routes())
+	if len(added) == 0 && len(removed) == 0 {
+		return &provider.Plan{Action: provider.PlanActionNone}, nil
+	}
+	return &provider.Plan{
+		Action: provider.PlanActionUpdate,
+		RouteTables: []provider.RouteTableChange{
+			{RouteTable: ProviderName, Added: added, Removed: removed},
+		},
+	}, nil
+}
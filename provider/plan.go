@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Planner is implemented by providers which can preview the changes Ensure
+// would make for a desired state without applying them.
+type Planner interface {
+	Plan(ctx context.Context, state *DesiredState) (*Plan, error)
+}
+
+// PlanAction is the operation a provider would perform.
+type PlanAction string
+
+const (
+	PlanActionNone   PlanAction = "none"
+	PlanActionCreate PlanAction = "create"
+	PlanActionUpdate PlanAction = "update"
+	PlanActionDelete PlanAction = "delete"
+)
+
+// ChangeAction is the change of a single resource.
+type ChangeAction string
+
+const (
+	ChangeActionAdd    ChangeAction = "add"
+	ChangeActionRemove ChangeAction = "remove"
+	ChangeActionModify ChangeAction = "modify"
+)
+
+// Plan describes the changes a provider would make to reach a desired state.
+type Plan struct {
+	Action PlanAction `json:"action"`
+	// RouteTables are the routes added and removed per route table.
+	RouteTables []RouteTableChange `json:"routeTables,omitempty"`
+	// Resources are the changes of other resources, e.g. NAT gateways,
+	// EIPs and subnets.
+	Resources []ResourceChange `json:"resources,omitempty"`
+	// ReplacesEgressIPs is true if egress IPs would be released or
+	// replaced by new ones.
+	ReplacesEgressIPs bool `json:"replacesEgressIPs"`
+}
+
+// RouteTableChange describes the routes added to and removed from a route
+// table.
+type RouteTableChange struct {
+	RouteTable string         `json:"routeTable"`
+	Added      []netip.Prefix `json:"added,omitempty"`
+	Removed    []netip.Prefix `json:"removed,omitempty"`
+}
+
+// ResourceChange describes the change of a resource managed by a provider.
+type ResourceChange struct {
+	Type   string       `json:"type"`
+	Name   string       `json:"name"`
+	Action ChangeAction `json:"action"`
+	// Replacement is true if the resource is replaced by a new one.
+	Replacement bool `json:"replacement,omitempty"`
+}
+
+// Empty returns true if the plan doesn't change anything.
+func (p *Plan) Empty() bool {
+	if p.Action == PlanActionNone {
+		return true
+	}
+
+	for _, rt := range p.RouteTables {
+		if len(rt.Added) > 0 || len(rt.Removed) > 0 {
+			return false
+		}
+	}
+	return len(p.Resources) == 0
+}
+
+// String returns a human readable preview of the changes.
+func (p *Plan) String() string {
+	if p.Empty() {
+		return "no changes"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s", p.Action)
+	if p.ReplacesEgressIPs {
+		b.WriteString(" (replaces egress IPs)")
+	}
+	for _, rt := range p.RouteTables {
+		if len(rt.Added) == 0 && len(rt.Removed) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n  route table %s:", rt.RouteTable)
+		for _, route := range rt.Added {
+			fmt.Fprintf(&b, "\n    + %s", route)
+		}
+		for _, route := range rt.Removed {
+			fmt.Fprintf(&b, "\n    - %s", route)
+		}
+	}
+	for _, r := range p.Resources {
+		symbol := map[ChangeAction]string{
+			ChangeActionAdd:    "+",
+			ChangeActionRemove: "-",
+			ChangeActionModify: "~",
+		}[r.Action]
+		fmt.Fprintf(&b, "\n  %s %s %s", symbol, r.Type, r.Name)
+		if r.Replacement {
+			b.WriteString(" (replacement)")
+		}
+	}
+	return b.String()
+}
+
+// DiffRoutes returns the routes of desired missing in current and the routes
+// of current missing in desired, both sorted.
+func DiffRoutes(current, desired []netip.Prefix) (added, removed []netip.Prefix) {
+	currentSet := make(map[netip.Prefix]struct{}, len(current))
+	for _, route := range current {
+		currentSet[route] = struct{}{}
+	}
+	desiredSet := make(map[netip.Prefix]struct{}, len(desired))
+	for _, route := range desired {
+		desiredSet[route] = struct{}{}
+		if _, ok := currentSet[route]; !ok {
+			added = append(added, route)
+		}
+	}
+	for _, route := range current {
+		if _, ok := desiredSet[route]; !ok {
+			removed = append(removed, route)
+		}
+	}
+	sortPrefixes(added)
+	sortPrefixes(removed)
+	return added, removed
+}
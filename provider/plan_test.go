@@ -0,0 +1,32 @@
+package provider
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanString(t *testing.T) {
+	added, removed := DiffRoutes(
+		[]netip.Prefix{netip.MustParsePrefix("2.0.0.0/24"), netip.MustParsePrefix("1.0.0.1/32")},
+		[]netip.Prefix{netip.MustParsePrefix("3.0.0.0/24"), netip.MustParsePrefix("1.0.0.1/32")},
+	)
+	plan := &Plan{
+		Action: PlanActionUpdate,
+		RouteTables: []RouteTableChange{
+			{RouteTable: "rtb-1", Added: added, Removed: removed},
+		},
+		Resources: []ResourceChange{
+			{Type: "AWS::EC2::EIP", Name: "EIP2", Action: ChangeActionModify, Replacement: true},
+		},
+		ReplacesEgressIPs: true,
+	}
+	require.Equal(t, `update (replaces egress IPs)
+  route table rtb-1:
+    + 3.0.0.0/24
+    - 2.0.0.0/24
+  ~ AWS::EC2::EIP EIP2 (replacement)`, plan.String())
+
+	require.Equal(t, "no changes", (&Plan{Action: PlanActionUpdate}).String())
+}
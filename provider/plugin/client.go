@@ -0,0 +1,211 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const ProviderName = "plugin"
+
+// PluginProvider forwards Ensure, Status and Plan calls to a plugin.
+type PluginProvider struct {
+	address       string
+	dry           bool
+	timeout       time.Duration
+	ensureTimeout time.Duration
+	conn          *grpc.ClientConn
+	health        healthpb.HealthClient
+	info          *InfoResponse
+}
+
+// statusPluginProvider is a PluginProvider of a plugin reporting its status.
+type statusPluginProvider struct {
+	*PluginProvider
+}
+
+func (p *statusPluginProvider) Status(ctx context.Context) (*provider.Status, error) {
+	return p.status(ctx)
+}
+
+// planPluginProvider is a PluginProvider of a plugin supporting planning.
+type planPluginProvider struct {
+	*PluginProvider
+}
+
+func (p *planPluginProvider) Plan(ctx context.Context, state *provider.DesiredState) (*provider.Plan, error) {
+	return p.plan(ctx, state)
+}
+
+// statusPlanPluginProvider is a PluginProvider of a plugin reporting its
+// status and supporting planning.
+type statusPlanPluginProvider struct {
+	*PluginProvider
+}
+
+func (p *statusPlanPluginProvider) Status(ctx context.Context) (*provider.Status, error) {
+	return p.status(ctx)
+}
+
+func (p *statusPlanPluginProvider) Plan(ctx context.Context, state *provider.DesiredState) (*provider.Plan, error) {
+	return p.plan(ctx, state)
+}
+
+// NewPluginProvider connects to the plugin listening on address, either
+// "unix://<path>" for a Unix socket or "<host>:<port>" for TCP. TCP addresses
+// other than loopback addresses require a TLS config, see LoadTLSConfig. It
+// waits up to timeout for the plugin to become healthy and checks its
+// protocol version. The returned provider implements provider.StatusReporter
+// and provider.Planner if the plugin supports them. Ensure calls time out
+// after ensureTimeout, all other calls after timeout.
+func NewPluginProvider(ctx context.Context, address string, dry bool, timeout, ensureTimeout time.Duration, tlsConfig *tls.Config) (provider.Provider, error) {
+	creds, err := transportCredentials(address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to plugin %s: %w", address, err)
+	}
+
+	p := &PluginProvider{
+		address:       address,
+		dry:           dry,
+		timeout:       timeout,
+		ensureTimeout: ensureTimeout,
+		conn:          conn,
+		health:        healthpb.NewHealthClient(conn),
+	}
+
+	err = p.handshake(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	log.Infof("Connected to plugin %s on %s with capabilities %v", p.info.Name, address, p.info.Capabilities)
+
+	status, plan := p.has(CapabilityStatus), p.has(CapabilityPlan)
+	switch {
+	case status && plan:
+		return &statusPlanPluginProvider{p}, nil
+	case status:
+		return &statusPluginProvider{p}, nil
+	case plan:
+		return &planPluginProvider{p}, nil
+	}
+	return p, nil
+}
+
+// handshake waits for the plugin to become healthy and negotiates the
+// protocol version.
+func (p *PluginProvider) handshake(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	resp, err := p.health.Check(ctx, &healthpb.HealthCheckRequest{Service: ServiceName}, grpc.WaitForReady(true))
+	if err != nil {
+		return fmt.Errorf("plugin %s didn't become healthy: %w", p.address, err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("plugin %s is %s", p.address, resp.GetStatus())
+	}
+
+	info := &InfoResponse{}
+	err = p.invoke(ctx, "Info", &InfoRequest{ProtocolVersion: ProtocolVersion}, info)
+	if err != nil {
+		return fmt.Errorf("failed to get info of plugin %s: %w", p.address, err)
+	}
+	if info.ProtocolVersion != ProtocolVersion {
+		return provider.NewError(provider.ErrorClassPermanent, fmt.Errorf("plugin %s uses protocol version %d, expected %d", info.Name, info.ProtocolVersion, ProtocolVersion))
+	}
+	p.info = info
+	return nil
+}
+
+func (p *PluginProvider) has(capability string) bool {
+	return slices.Contains(p.info.Capabilities, capability)
+}
+
+// invoke calls the method of the plugin with JSON encoded messages. Errors
+// are converted into classified provider errors.
+func (p *PluginProvider) invoke(ctx context.Context, method string, req, resp any) error {
+	err := p.conn.Invoke(ctx, fullMethod(method), req, resp, grpc.CallContentSubtype(codecName))
+	return fromStatus(err)
+}
+
+func (p *PluginProvider) String() string {
+	return fmt.Sprintf("%s(%s)", ProviderName, p.info.Name)
+}
+
+// Ensure forwards the desired state to the plugin. In dry-run mode the
+// desired state is only logged.
+func (p *PluginProvider) Ensure(ctx context.Context, state *provider.DesiredState) error {
+	if p.dry {
+		log.Infof("%s: not forwarding desired state in dry-run mode: %v", p, state)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.ensureTimeout)
+	defer cancel()
+	err := p.invoke(ctx, "Ensure", &EnsureRequest{Entries: state.Entries()}, &EnsureResponse{})
+	if err != nil {
+		return fmt.Errorf("%s failed to ensure desired state: %w", p, err)
+	}
+	return nil
+}
+
+// status returns the status reported by the plugin together with the
+// result of its health check. Unhealthy plugins are reported as such without
+// asking them for their status.
+func (p *PluginProvider) status(ctx context.Context) (*provider.Status, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	health := provider.ResourceHealth{Name: p.String(), Healthy: true, Status: healthpb.HealthCheckResponse_SERVING.String()}
+	resp, err := p.health.Check(ctx, &healthpb.HealthCheckRequest{Service: ServiceName})
+	switch {
+	case err != nil:
+		health = provider.ResourceHealth{Name: p.String(), Status: "UNREACHABLE", Reason: err.Error()}
+	case resp.GetStatus() != healthpb.HealthCheckResponse_SERVING:
+		health = provider.ResourceHealth{Name: p.String(), Status: resp.GetStatus().String()}
+	}
+	if !health.Healthy {
+		return &provider.Status{
+			EgressIPs: map[string][]netip.Addr{},
+			Resources: []provider.ResourceHealth{health},
+		}, nil
+	}
+
+	status := &provider.Status{}
+	err = p.invoke(ctx, "Status", &StatusRequest{}, status)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to report status: %w", p, err)
+	}
+	status.Resources = append(status.Resources, health)
+	return status, nil
+}
+
+func (p *PluginProvider) plan(ctx context.Context, state *provider.DesiredState) (*provider.Plan, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	plan := &provider.Plan{}
+	err := p.invoke(ctx, "Plan", &PlanRequest{Entries: state.Entries()}, plan)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed to plan changes: %w", p, err)
+	}
+	return plan, nil
+}
+
+// Close closes the connection to the plugin.
+func (p *PluginProvider) Close() error {
+	return p.conn.Close()
+}
@@ -0,0 +1,55 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+)
+
+func init() {
+	provider.Register(ProviderName, &factory{})
+}
+
+// factory creates the plugin provider from its command line flags.
+type factory struct {
+	address       string
+	timeout       time.Duration
+	ensureTimeout time.Duration
+	tlsCAFile     string
+	tlsCertFile   string
+	tlsKeyFile    string
+}
+
+func (f *factory) Description() string {
+	return "forwards all calls over gRPC to an external provider plugin"
+}
+
+func (f *factory) RegisterFlags(app *kingpin.Application) {
+	app.Flag("plugin-address", "Address of the provider plugin, either unix://<path> or <host>:<port>.").StringVar(&f.address)
+	app.Flag("plugin-timeout", "Timeout for connecting to the plugin and for all calls except Ensure. (default: 30s)").Default("30s").DurationVar(&f.timeout)
+	app.Flag("plugin-ensure-timeout", "Timeout of Ensure calls of the plugin. (default: 15m)").Default("15m").DurationVar(&f.ensureTimeout)
+	app.Flag("plugin-tls-ca-file", "CA verifying the certificate of the plugin. Enables TLS, which is required for TCP addresses other than loopback addresses.").StringVar(&f.tlsCAFile)
+	app.Flag("plugin-tls-cert-file", "Client certificate authenticating the controller to the plugin (mTLS).").StringVar(&f.tlsCertFile)
+	app.Flag("plugin-tls-key-file", "Key of the client certificate of --plugin-tls-cert-file.").StringVar(&f.tlsKeyFile)
+}
+
+func (f *factory) New(opts provider.Options) (provider.Provider, error) {
+	if f.address == "" {
+		return nil, errors.New("--plugin-address is required for the plugin provider")
+	}
+
+	var tlsConfig *tls.Config
+	if f.tlsCAFile != "" || f.tlsCertFile != "" || f.tlsKeyFile != "" {
+		var err error
+		tlsConfig, err = LoadTLSConfig(f.tlsCAFile, f.tlsCertFile, f.tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS config of the plugin: %w", err)
+		}
+	}
+	return NewPluginProvider(context.Background(), f.address, opts.DryRun, f.timeout, f.ensureTimeout, tlsConfig)
+}
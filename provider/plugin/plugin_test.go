@@ -0,0 +1,203 @@
+package plugin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+	"github.com/szuecs/kube-static-egress-controller/provider/memory"
+	"github.com/szuecs/kube-static-egress-controller/provider/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// servePlugin serves the provider on a Unix socket and returns the address.
+func servePlugin(t *testing.T, p provider.Provider) string {
+	address := "unix://" + filepath.Join(t.TempDir(), "plugin.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ListenAndServe(ctx, address, p)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+	return address
+}
+
+func TestPluginProvider(t *testing.T) {
+	resource := provider.Resource{Kind: "ConfigMap", Name: "a", Namespace: "x", Cluster: "m"}
+	state := provider.NewDesiredStateFromSources([]provider.Source{
+		{Resource: resource, Key: "a1", Prefix: netip.MustParsePrefix("10.0.0.0/25")},
+		{Resource: resource, Key: "a2", PrefixList: "pl-1111", Prefix: netip.MustParsePrefix("10.0.0.128/25")},
+	})
+	plugin := memory.NewMemoryProvider([]string{"zone-a"}, 0)
+	ctx := context.Background()
+
+	p, err := NewPluginProvider(ctx, servePlugin(t, plugin), false, 5*time.Second, 5*time.Second, nil)
+	require.NoError(t, err)
+	defer p.(*statusPlanPluginProvider).Close()
+	require.Equal(t, "plugin(memory)", p.String())
+
+	planner, ok := p.(provider.Planner)
+	require.True(t, ok)
+	plan, err := planner.Plan(ctx, state)
+	require.NoError(t, err)
+	require.Equal(t, provider.PlanActionCreate, plan.Action)
+
+	require.NoError(t, p.Ensure(ctx, state))
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, plugin.State().Routes)
+
+	reporter, ok := p.(provider.StatusReporter)
+	require.True(t, ok)
+	status, err := reporter.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, state.Routes(), status.Routes)
+	require.Equal(t, map[string][]netip.Addr{"zone-a": {netip.MustParseAddr("198.51.100.1")}}, status.EgressIPs)
+	require.Len(t, status.Resources, 2)
+	require.True(t, status.Healthy())
+
+	// errors should keep their class.
+	plugin.FailNext(provider.NewError(provider.ErrorClassThrottled, errors.New("rate exceeded")))
+	err = p.Ensure(ctx, state)
+	require.Equal(t, provider.ErrorClassThrottled, provider.ClassOf(err))
+	require.ErrorContains(t, err, "rate exceeded")
+}
+
+func TestPluginProviderCapabilities(t *testing.T) {
+	p, err := NewPluginProvider(context.Background(), servePlugin(t, noopProvider{}), false, 5*time.Second, 5*time.Second, nil)
+	require.NoError(t, err)
+	defer p.(*PluginProvider).Close()
+
+	_, ok := p.(provider.StatusReporter)
+	require.False(t, ok)
+	_, ok = p.(provider.Planner)
+	require.False(t, ok)
+}
+
+func TestPluginProviderUnreachable(t *testing.T) {
+	address := "unix://" + filepath.Join(t.TempDir(), "missing.sock")
+	_, err := NewPluginProvider(context.Background(), address, false, 100*time.Millisecond, time.Second, nil)
+	require.ErrorContains(t, err, "didn't become healthy")
+}
+
+// writeCertificate writes a certificate for 127.0.0.1 and its key signed by
+// the parent, or a self-signed CA without parent, to the directory and
+// returns the paths of the certificate and the key.
+func writeCertificate(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return cert, key, certFile, keyFile
+}
+
+func TestPluginProviderTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCertificate(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeCertificate(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeCertificate(t, dir, "client", ca, caKey)
+
+	serverConfig, err := LoadTLSConfig(caFile, serverCert, serverKey)
+	require.NoError(t, err)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Serve(ctx, lis, noopProvider{}, grpc.Creds(credentials.NewTLS(serverConfig)))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	// clients need a certificate signed by the CA
+	clientConfig, err := LoadTLSConfig(caFile, clientCert, clientKey)
+	require.NoError(t, err)
+	p, err := NewPluginProvider(context.Background(), lis.Addr().String(), false, 5*time.Second, 5*time.Second, clientConfig)
+	require.NoError(t, err)
+	defer p.(*PluginProvider).Close()
+	require.Equal(t, "plugin(noop)", p.String())
+
+	clientConfig, err = LoadTLSConfig(caFile, "", "")
+	require.NoError(t, err)
+	_, err = NewPluginProvider(context.Background(), lis.Addr().String(), false, 100*time.Millisecond, time.Second, clientConfig)
+	require.ErrorContains(t, err, "didn't become healthy")
+}
+
+func TestPluginAddressRequiresTLS(t *testing.T) {
+	// TCP addresses other than loopback addresses require TLS on both
+	// sides
+	_, err := NewPluginProvider(context.Background(), "198.51.100.1:9000", false, time.Second, time.Second, nil)
+	require.EqualError(t, err, "plugin address 198.51.100.1:9000 is neither a Unix socket nor a loopback address and requires TLS")
+	err = ListenAndServe(context.Background(), "0.0.0.0:0", noopProvider{})
+	require.EqualError(t, err, "plugin address 0.0.0.0:0 is neither a Unix socket nor a loopback address and requires TLS")
+
+	for _, address := range []string{"unix:///run/plugin.sock", "localhost:9000", "127.0.0.1:9000", "[::1]:9000"} {
+		require.True(t, localAddress(address), address)
+	}
+}
+
+func TestErrorCodes(tt *testing.T) {
+	for _, class := range provider.ErrorClasses {
+		tt.Run(string(class), func(t *testing.T) {
+			err := fromStatus(toStatus(provider.NewError(class, errors.New("failed"))))
+			require.Equal(t, class, provider.ClassOf(err))
+			require.EqualError(t, errors.Unwrap(err), "failed")
+		})
+	}
+
+	// classes without a code are never sent as success
+	err := toStatus(provider.NewError(provider.ErrorClass("new"), errors.New("failed")))
+	require.Error(tt, err)
+	require.Equal(tt, provider.ErrorClassUnknown, provider.ClassOf(fromStatus(err)))
+}
+
+// noopProvider is a provider implementing neither provider.StatusReporter
+// nor provider.Planner.
+type noopProvider struct{}
+
+func (noopProvider) Ensure(ctx context.Context, state *provider.DesiredState) error {
+	return noop.NewNoopProvider().Ensure(ctx, state)
+}
+
+func (noopProvider) String() string {
+	return noop.ProviderName
+}
@@ -0,0 +1,220 @@
+// Package plugin implements a provider forwarding all calls over gRPC to a
+// provider running in an external plugin process, and the helpers to serve a
+// provider as plugin.
+//
+// The protocol is versioned by ProtocolVersion and the service name. There is
+// no .proto file, the service is described by serviceDesc and the messages
+// are encoded as JSON with the content type "application/grpc+json", so
+// plugins can be written without generated code. The wire format is
+// documented in the README. Plugins must serve the standard gRPC health
+// service for the service name.
+//
+// The protocol has no authentication of its own, TCP connections to other
+// than loopback addresses require TLS, see LoadTLSConfig.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/szuecs/kube-static-egress-controller/provider"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ProtocolVersion is the version of the plugin protocol. It's
+	// incremented on incompatible changes.
+	ProtocolVersion = 1
+	// ServiceName is the name of the gRPC service implemented by plugins.
+	ServiceName = "kubestaticegress.plugin.v1.Provider"
+	// codecName is the content subtype of the JSON encoded messages.
+	codecName = "json"
+)
+
+// Capabilities of plugins, which are derived from the optional provider
+// interfaces the plugin implements.
+const (
+	CapabilityStatus = "status"
+	CapabilityPlan   = "plan"
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// InfoRequest negotiates the protocol version.
+type InfoRequest struct {
+	ProtocolVersion int `json:"protocolVersion"`
+}
+
+// InfoResponse describes the plugin.
+type InfoResponse struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	Name            string   `json:"name"`
+	Capabilities    []string `json:"capabilities"`
+}
+
+// EnsureRequest passes the desired state to the plugin.
+type EnsureRequest struct {
+	Entries []provider.Entry `json:"entries"`
+}
+
+type EnsureResponse struct{}
+
+type StatusRequest struct{}
+
+// PlanRequest asks for the changes Ensure would make for the desired state.
+type PlanRequest struct {
+	Entries []provider.Entry `json:"entries"`
+}
+
+// service is implemented by the plugin server.
+type service interface {
+	info(ctx context.Context, req *InfoRequest) (*InfoResponse, error)
+	ensure(ctx context.Context, req *EnsureRequest) (*EnsureResponse, error)
+	status(ctx context.Context, req *StatusRequest) (*provider.Status, error)
+	plan(ctx context.Context, req *PlanRequest) (*provider.Plan, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*service)(nil),
+	Methods: []grpc.MethodDesc{
+		method("Info", service.info),
+		method("Ensure", service.ensure),
+		method("Status", service.status),
+		method("Plan", service.plan),
+	},
+	Metadata: "kube-static-egress-controller/plugin",
+}
+
+// method returns the description of a unary method of the service.
+func method[Req, Resp any](name string, call func(service, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(Req)
+			err := dec(req)
+			if err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(service), ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod(name)}
+			return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+				return call(srv.(service), ctx, req.(*Req))
+			})
+		},
+	}
+}
+
+func fullMethod(name string) string {
+	return "/" + ServiceName + "/" + name
+}
+
+// jsonCodec encodes the messages of the plugin protocol as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return codecName
+}
+
+// errorCodes maps error classes to gRPC status codes and back.
+var errorCodes = map[provider.ErrorClass]codes.Code{
+	provider.ErrorClassUnknown:         codes.Unknown,
+	provider.ErrorClassRetryable:       codes.Unavailable,
+	provider.ErrorClassThrottled:       codes.ResourceExhausted,
+	provider.ErrorClassPermanent:       codes.InvalidArgument,
+	provider.ErrorClassConflict:        codes.Aborted,
+	provider.ErrorClassPartialApply:    codes.FailedPrecondition,
+	provider.ErrorClassBlockedByPolicy: codes.PermissionDenied,
+	// gRPC has no code for pending results, the operation the sync
+	// would start already exists
+	provider.ErrorClassInProgress: codes.AlreadyExists,
+}
+
+// toStatus converts a provider error into a gRPC status error keeping its
+// class. Classes without a code are sent as codes.Unknown, never as
+// codes.OK.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	var classified *provider.Error
+	if errors.As(err, &classified) {
+		msg = classified.Err.Error()
+	}
+	code, ok := errorCodes[provider.ClassOf(err)]
+	if !ok {
+		code = codes.Unknown
+	}
+	return status.Error(code, msg)
+}
+
+// fromStatus converts a gRPC status error into a classified provider error.
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	st := status.Convert(err)
+	class := provider.ErrorClassUnknown
+	switch st.Code() {
+	case codes.DeadlineExceeded, codes.Canceled:
+		class = provider.ErrorClassRetryable
+	case codes.Unimplemented:
+		class = provider.ErrorClassPermanent
+	default:
+		for c, code := range errorCodes {
+			if code == st.Code() {
+				class = c
+				break
+			}
+		}
+	}
+	return provider.NewError(class, errors.New(st.Message()))
+}
+
+// listen listens on the address, either "unix://<path>" for a Unix socket or
+// "<host>:<port>" for TCP. Stale Unix sockets are removed.
+func listen(address string) (net.Listener, error) {
+	path, ok := unixSocketPath(address)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		err := os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// unixSocketPath returns the path of "unix://<path>" and "unix:<path>"
+// addresses.
+func unixSocketPath(address string) (string, bool) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		return path, true
+	}
+	return strings.CutPrefix(address, "unix:")
+}
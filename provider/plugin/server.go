@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/szuecs/kube-static-egress-controller/provider"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// server serves a provider as plugin.
+type server struct {
+	provider provider.Provider
+}
+
+// ListenAndServe serves the provider as plugin on the address, either
+// "unix://<path>" for a Unix socket or "<host>:<port>" for TCP, until the
+// context is done. Without TLS TCP is only served on loopback addresses, see
+// ListenAndServeTLS.
+func ListenAndServe(ctx context.Context, address string, p provider.Provider) error {
+	return ListenAndServeTLS(ctx, address, p, nil)
+}
+
+// ListenAndServeTLS serves the provider as plugin on the address like
+// ListenAndServe, with TLS if config isn't nil, see LoadTLSConfig.
+func ListenAndServeTLS(ctx context.Context, address string, p provider.Provider, config *tls.Config) error {
+	creds, err := transportCredentials(address, config)
+	if err != nil {
+		return err
+	}
+	lis, err := listen(address)
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, lis, p, grpc.Creds(creds))
+}
+
+// Serve serves the provider as plugin on the listener until the context is
+// done. The provider is called with the same semantics as by the
+// controller. Status and Plan are served if the provider implements
+// provider.StatusReporter and provider.Planner. The options configure the
+// gRPC server, e.g. its transport credentials.
+func Serve(ctx context.Context, lis net.Listener, p provider.Provider, opts ...grpc.ServerOption) error {
+	s := grpc.NewServer(opts...)
+	s.RegisterService(&serviceDesc, &server{provider: p})
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, healthServer)
+
+	go func() {
+		<-ctx.Done()
+		healthServer.Shutdown()
+		s.GracefulStop()
+	}()
+
+	log.Infof("Serving provider %s as plugin on %s", p, lis.Addr())
+	return s.Serve(lis)
+}
+
+func (s *server) info(_ context.Context, req *InfoRequest) (*InfoResponse, error) {
+	if req.ProtocolVersion != ProtocolVersion {
+		log.Warnf("Controller uses plugin protocol version %d, plugin %d", req.ProtocolVersion, ProtocolVersion)
+	}
+
+	info := &InfoResponse{
+		ProtocolVersion: ProtocolVersion,
+		Name:            s.provider.String(),
+		Capabilities:    []string{},
+	}
+	if _, ok := s.provider.(provider.StatusReporter); ok {
+		info.Capabilities = append(info.Capabilities, CapabilityStatus)
+	}
+	if _, ok := s.provider.(provider.Planner); ok {
+		info.Capabilities = append(info.Capabilities, CapabilityPlan)
+	}
+	return info, nil
+}
+
+func (s *server) ensure(ctx context.Context, req *EnsureRequest) (*EnsureResponse, error) {
+	err := s.provider.Ensure(ctx, provider.NewDesiredStateFromEntries(req.Entries))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &EnsureResponse{}, nil
+}
+
+func (s *server) status(ctx context.Context, _ *StatusRequest) (*provider.Status, error) {
+	reporter, ok := s.provider.(provider.StatusReporter)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "provider %s doesn't report its status", s.provider)
+	}
+
+	st, err := reporter.Status(ctx)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return st, nil
+}
+
+func (s *server) plan(ctx context.Context, req *PlanRequest) (*provider.Plan, error) {
+	planner, ok := s.provider.(provider.Planner)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "provider %s doesn't support planning", s.provider)
+	}
+
+	plan, err := planner.Plan(ctx, provider.NewDesiredStateFromEntries(req.Entries))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return plan, nil
+}
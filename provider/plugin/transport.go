@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// LoadTLSConfig loads the TLS configuration of the connection between the
+// controller and the plugin. The certificate and key authenticate the own
+// side, the CA verifies the other side. Servers with a CA require clients to
+// present a certificate signed by it (mTLS).
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// transportCredentials returns the credentials of connections on the
+// address. The protocol has no authentication of its own, so without TLS
+// only Unix sockets and loopback addresses are allowed.
+func transportCredentials(address string, config *tls.Config) (credentials.TransportCredentials, error) {
+	if config != nil {
+		return credentials.NewTLS(config), nil
+	}
+	if !localAddress(address) {
+		return nil, fmt.Errorf("plugin address %s is neither a Unix socket nor a loopback address and requires TLS", address)
+	}
+	return insecure.NewCredentials(), nil
+}
+
+// localAddress returns true for Unix sockets and TCP addresses on the
+// loopback interface.
+func localAddress(address string) bool {
+	if _, ok := unixSocketPath(address); ok {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
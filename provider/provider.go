@@ -3,20 +3,73 @@ package provider
 import (
 	"context"
 	"net"
+	"net/http"
+	"net/netip"
 )
 
 type Resource struct {
-	Name      string
-	Namespace string
-	Cluster   string
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Cluster   string `json:"cluster"`
 }
 
 type EgressConfig struct {
 	Resource
 	IPAddresses map[string]*net.IPNet
+	// Keys maps the entries of IPAddresses and PrefixLists to the keys
+	// of the resource configuring them, e.g. the data keys of a
+	// ConfigMap.
+	Keys map[string][]string
+	// PrefixLists are IDs of managed prefix lists, which are resolved
+	// into CIDRs by providers implementing PrefixListResolver.
+	PrefixLists []string
+	// Priority defines which routes are compressed first when enforcing
+	// a route budget. Lower priorities are compressed first.
+	Priority int
+	// Connectivity defines whether the egress traffic leaves via public
+	// or private egress IPs. An empty value means ConnectivityPublic.
+	Connectivity Connectivity
 }
 
 type Provider interface {
-	Ensure(ctx context.Context, configs map[Resource]map[string]*net.IPNet) error
+	Ensure(ctx context.Context, state *DesiredState) error
 	String() string
 }
+
+// PrefixListResolver is implemented by providers which can resolve managed
+// prefix list IDs into the CIDRs they contain.
+type PrefixListResolver interface {
+	ResolvePrefixList(ctx context.Context, id string) ([]netip.Prefix, error)
+}
+
+// HandlerRegistrar is implemented by providers exposing provider specific
+// endpoints on the HTTP API of the controller. Endpoints should be
+// registered below /provider/<name>.
+type HandlerRegistrar interface {
+	RegisterHandlers(mux *http.ServeMux)
+}
+
+// ApprovalHandlerRegistrar is implemented by providers whose changes can be
+// approved via HTTP, or with other endpoints changing the infrastructure or
+// the behaviour of the provider. The endpoints are only served by the
+// authenticated approval listener of the controller, never by the HTTP API
+// next to the metrics. Endpoints should be registered below
+// /provider/<name>.
+type ApprovalHandlerRegistrar interface {
+	RegisterApprovalHandlers(mux *http.ServeMux)
+}
+
+// ReservedNetworkProvider is implemented by providers knowing networks which
+// must not be routed via static egress IPs, e.g. the networks of the VPC.
+// They are reserved in addition to the networks reserved by flag.
+type ReservedNetworkProvider interface {
+	ReservedNetworks(ctx context.Context) ([]*net.IPNet, error)
+}
+
+// EgressIPReleaser is implemented by providers retaining egress IPs no
+// longer in use, so they stay allow-listed and are reused later. Retained
+// egress IPs are only released explicitly.
+type EgressIPReleaser interface {
+	ReleaseEgressIPs(ctx context.Context) ([]netip.Addr, error)
+}
@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+)
+
+// Options are the options common to all providers.
+type Options struct {
+	// ClusterID identifies the cluster owning the egress resources.
+	ClusterID string
+	// ControllerID identifies the controller managing the egress
+	// resources.
+	ControllerID string
+	// DryRun prints changes rather than performing them.
+	DryRun       bool
+	RouteOptions RouteOptions
+}
+
+// Factory creates a provider. Factories register their own command line
+// flags, which are parsed before New is called.
+type Factory interface {
+	// Description is a short description of the provider listed in the
+	// help.
+	Description() string
+	// RegisterFlags registers the provider specific flags.
+	RegisterFlags(app *kingpin.Application)
+	// New creates the provider from the parsed flags and the common
+	// options.
+	New(opts Options) (Provider, error)
+}
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a provider available by name. It's meant to be called from
+// the init function of the provider package and panics if the name is
+// already registered.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("provider: Register factory is nil")
+	}
+	if _, ok := factories[name]; ok {
+		panic("provider: Register called twice for provider " + name)
+	}
+	factories[name] = factory
+}
+
+// Providers returns the sorted names of the registered providers.
+func Providers() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the factory of the provider registered by name.
+func Lookup(name string) (Factory, error) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %s", name)
+	}
+	return factory, nil
+}
+
+// New creates the provider registered by name.
+func New(name string, opts Options) (Provider, error) {
+	factory, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return factory.New(opts)
+}
+
+// RegisterFlags registers the flags of all registered providers.
+func RegisterFlags(app *kingpin.Application) {
+	for _, name := range Providers() {
+		factory, _ := Lookup(name)
+		factory.RegisterFlags(app)
+	}
+}
+
+// Usage lists the registered providers with their description.
+func Usage() string {
+	var b strings.Builder
+	for _, name := range Providers() {
+		factory, _ := Lookup(name)
+		fmt.Fprintf(&b, "  %-10s %s\n", name, factory.Description())
+	}
+	return b.String()
+}
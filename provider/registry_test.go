@@ -0,0 +1,58 @@
+package provider
+
+import (
+	"context"
+	"testing"
+
+	kingpin "github.com/alecthomas/kingpin/v2"
+	"github.com/stretchr/testify/require"
+)
+
+type testProvider struct {
+	opts   Options
+	region string
+}
+
+func (p *testProvider) Ensure(_ context.Context, _ *DesiredState) error {
+	return nil
+}
+
+func (p *testProvider) String() string {
+	return "test"
+}
+
+type testFactory struct {
+	region string
+}
+
+func (f *testFactory) Description() string {
+	return "test provider"
+}
+
+func (f *testFactory) RegisterFlags(app *kingpin.Application) {
+	app.Flag("test-region", "Region of the test provider.").Default("local").StringVar(&f.region)
+}
+
+func (f *testFactory) New(opts Options) (Provider, error) {
+	return &testProvider{opts: opts, region: f.region}, nil
+}
+
+func TestRegistry(t *testing.T) {
+	Register("test", &testFactory{})
+	require.Contains(t, Providers(), "test")
+	require.Contains(t, Usage(), "test provider")
+	require.Panics(t, func() { Register("test", &testFactory{}) })
+
+	app := kingpin.New("test", "")
+	RegisterFlags(app)
+	_, err := app.Parse([]string{"--test-region=eu"})
+	require.NoError(t, err)
+
+	opts := Options{ClusterID: "cluster", DryRun: true}
+	p, err := New("test", opts)
+	require.NoError(t, err)
+	require.Equal(t, &testProvider{opts: opts, region: "eu"}, p)
+
+	_, err = New("unknown", opts)
+	require.EqualError(t, err, "unknown provider unknown")
+}
@@ -0,0 +1,137 @@
+package provider
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+)
+
+// StatusReporter is implemented by providers which can report the status of
+// the egress resources they manage.
+type StatusReporter interface {
+	Status(ctx context.Context) (*Status, error)
+}
+
+// Status describes the egress resources managed by a provider.
+type Status struct {
+	// EgressIPs are the public IPs used for egress traffic by zone.
+	EgressIPs map[string][]netip.Addr `json:"egressIPs"`
+	// PrivateEgressIPs are the private IPs used for egress traffic of
+	// resources with ConnectivityPrivate by zone.
+	PrivateEgressIPs map[string][]netip.Addr `json:"privateEgressIPs,omitempty"`
+	// Routes are the routes currently applied by the provider.
+	Routes []netip.Prefix `json:"routes"`
+	// Resources describe the health of the resources managed by the
+	// provider, e.g. a CloudFormation stack.
+	Resources []ResourceHealth `json:"resources"`
+}
+
+// ResourceHealth describes the health of a resource managed by a provider.
+type ResourceHealth struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	// Routes are the routes managed by the resource if it only manages
+	// part of them, e.g. a shard of the routes. The health of other
+	// resources affects all routes.
+	Routes []netip.Prefix `json:"routes,omitempty"`
+}
+
+// Healthy returns true if all resources are healthy.
+func (s *Status) Healthy() bool {
+	for _, r := range s.Resources {
+		if !r.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// healthyFor returns true if the resources affecting the prefixes are
+// healthy.
+func (s *Status) healthyFor(prefixes []netip.Prefix) bool {
+	for _, r := range s.Resources {
+		if r.Healthy {
+			continue
+		}
+		if len(r.Routes) == 0 {
+			return false
+		}
+
+		routes := newPrefixTrie()
+		for _, route := range r.Routes {
+			routes.insert(route.Masked())
+		}
+		for _, p := range prefixes {
+			if routes.contains(p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// AllEgressIPs returns the egress IPs of all zones sorted.
+func (s *Status) AllEgressIPs() []netip.Addr {
+	return sortedIPs(s.EgressIPs)
+}
+
+// AllPrivateEgressIPs returns the private egress IPs of all zones sorted.
+func (s *Status) AllPrivateEgressIPs() []netip.Addr {
+	return sortedIPs(s.PrivateEgressIPs)
+}
+
+func sortedIPs(byZone map[string][]netip.Addr) []netip.Addr {
+	var ips []netip.Addr
+	for _, zoneIPs := range byZone {
+		ips = append(ips, zoneIPs...)
+	}
+	slices.SortFunc(ips, netip.Addr.Compare)
+	return slices.Compact(ips)
+}
+
+// ResourceStatus is the egress status of a resource configuring egress
+// routes.
+type ResourceStatus struct {
+	// EgressIPs are the IPs egress traffic of the resource uses, the
+	// private ones for resources with ConnectivityPrivate.
+	EgressIPs []netip.Addr
+	// Applied is true if all prefixes of the resource are covered by
+	// the applied routes.
+	Applied bool
+	// Healthy is true if all resources of the provider affecting the
+	// prefixes of the resource are healthy.
+	Healthy bool
+}
+
+// ResourceStatuses returns the status of every resource of the desired state
+// according to the status of the provider.
+func ResourceStatuses(state *DesiredState, status *Status) map[Resource]ResourceStatus {
+	applied := newPrefixTrie()
+	for _, route := range status.Routes {
+		applied.insert(route.Masked())
+	}
+
+	egressIPs := status.AllEgressIPs()
+	privateEgressIPs := status.AllPrivateEgressIPs()
+	statuses := make(map[Resource]ResourceStatus, state.Len())
+	for _, resource := range state.Resources() {
+		resourceStatus := ResourceStatus{
+			EgressIPs: egressIPs,
+			Applied:   true,
+			Healthy:   status.healthyFor(state.prefixes[resource]),
+		}
+		if state.Connectivity(resource) == ConnectivityPrivate {
+			resourceStatus.EgressIPs = privateEgressIPs
+		}
+		for _, p := range state.prefixes[resource] {
+			if !applied.contains(p) {
+				resourceStatus.Applied = false
+				break
+			}
+		}
+		statuses[resource] = resourceStatus
+	}
+	return statuses
+}
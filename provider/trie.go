@@ -0,0 +1,253 @@
+package provider
+
+import (
+	"math"
+	"net/netip"
+)
+
+// prefixTrie is a binary trie of prefixes. A prefix is stored as the node at
+// the depth of its prefix length on the path of its address bits. Prefixes
+// contained in a stored prefix are never stored.
+type prefixTrie struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+	// merged is set for the nodes dropped by merging an ancestor.
+	merged bool
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{
+		v4: &trieNode{},
+		v6: &trieNode{},
+	}
+}
+
+func (t *prefixTrie) root(addr netip.Addr) *trieNode {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+// insert adds the prefix to the trie, dropping all stored prefixes contained
+// in it.
+func (t *prefixTrie) insert(p netip.Prefix) {
+	addr := p.Addr().As16()
+	offset := 128 - p.Addr().BitLen()
+	n := t.root(p.Addr())
+	for i := 0; i < p.Bits(); i++ {
+		if n.terminal {
+			// already covered by a shorter prefix
+			return
+		}
+		b := addrBit(&addr, offset+i)
+		if n.children[b] == nil {
+			n.children[b] = &trieNode{}
+		}
+		n = n.children[b]
+	}
+	n.terminal = true
+	n.children = [2]*trieNode{}
+}
+
+// contains returns true if p is completely covered by a stored prefix.
+func (t *prefixTrie) contains(p netip.Prefix) bool {
+	addr := p.Addr().As16()
+	offset := 128 - p.Addr().BitLen()
+	n := t.root(p.Addr())
+	for i := 0; i < p.Bits(); i++ {
+		if n.terminal {
+			return true
+		}
+		n = n.children[addrBit(&addr, offset+i)]
+		if n == nil {
+			return false
+		}
+	}
+	return n.terminal
+}
+
+// aggregate merges all pairs of sibling prefixes into their parent prefix,
+// which doesn't change the covered addresses.
+func (t *prefixTrie) aggregate() {
+	aggregateNode(t.v4)
+	aggregateNode(t.v6)
+}
+
+// aggregateNode aggregates the subtree of n and returns true if n is
+// completely covered afterwards.
+func aggregateNode(n *trieNode) bool {
+	if n == nil {
+		return false
+	}
+	if n.terminal {
+		return true
+	}
+
+	// both children must be aggregated, don't short-circuit
+	zero := aggregateNode(n.children[0])
+	one := aggregateNode(n.children[1])
+	if zero && one {
+		n.terminal = true
+		n.children = [2]*trieNode{}
+	}
+	return n.terminal
+}
+
+// prefixes returns the stored prefixes sorted by address family and address.
+func (t *prefixTrie) prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	var addr [16]byte
+	prefixes = collectPrefixes(t.v4, &addr, 96, 0, true, prefixes)
+	addr = [16]byte{}
+	return collectPrefixes(t.v6, &addr, 0, 0, false, prefixes)
+}
+
+func collectPrefixes(n *trieNode, addr *[16]byte, offset, depth int, is4 bool, prefixes []netip.Prefix) []netip.Prefix {
+	if n == nil {
+		return prefixes
+	}
+
+	if n.terminal {
+		return append(prefixes, nodePrefix(addr, depth, is4))
+	}
+
+	prefixes = collectPrefixes(n.children[0], addr, offset, depth+1, is4, prefixes)
+	setAddrBit(addr, offset+depth)
+	prefixes = collectPrefixes(n.children[1], addr, offset, depth+1, is4, prefixes)
+	clearAddrBit(addr, offset+depth)
+	return prefixes
+}
+
+// nodePrefix returns the prefix of the node at depth on the path of addr.
+func nodePrefix(addr *[16]byte, depth int, is4 bool) netip.Prefix {
+	a := netip.AddrFrom16(*addr)
+	if is4 {
+		a = netip.AddrFrom4([4]byte(addr[12:]))
+	}
+	return netip.PrefixFrom(a, depth)
+}
+
+// mergeCandidate is a node with stored prefixes below both of its children.
+// Its prefix is the common supernet of the neighbouring stored prefixes
+// on either side of it, merging them replaces all prefixes stored below it.
+type mergeCandidate struct {
+	node   *trieNode
+	prefix netip.Prefix
+	// extra is the number of addresses of the prefix not covered by the
+	// stored prefixes, saturating at math.MaxUint64.
+	extra uint64
+	// priority is the highest priority of the stored prefixes below it.
+	priority int
+	// order is the position of the node in address order.
+	order int
+}
+
+// mergeCandidates returns the merge candidates of the trie. The extra
+// addresses and priority of a candidate only depend on the prefixes stored
+// when it's returned, so they stay the same while other candidates are
+// merged.
+func (t *prefixTrie) mergeCandidates(priority func(netip.Prefix) int) []*mergeCandidate {
+	c := &candidateCollector{priority: priority}
+	var addr [16]byte
+	c.collect(t.v4, &addr, 96, 0, true)
+	addr = [16]byte{}
+	c.collect(t.v6, &addr, 0, 0, false)
+	return c.candidates
+}
+
+type candidateCollector struct {
+	priority   func(netip.Prefix) int
+	candidates []*mergeCandidate
+	nodes      int
+}
+
+// collect adds the candidates of the subtree of n and returns the number of
+// addresses covered by its stored prefixes, their highest priority and
+// whether any prefix is stored below n.
+func (c *candidateCollector) collect(n *trieNode, addr *[16]byte, offset, depth int, is4 bool) (uint64, int, bool) {
+	if n == nil {
+		return 0, 0, false
+	}
+
+	prefix := nodePrefix(addr, depth, is4)
+	if n.terminal {
+		return addressCount(prefix), c.priority(prefix), true
+	}
+
+	zeroCovered, zeroPriority, zero := c.collect(n.children[0], addr, offset, depth+1, is4)
+	// nodes are numbered between their subtrees to get their address order
+	order := c.nodes
+	c.nodes++
+	setAddrBit(addr, offset+depth)
+	oneCovered, onePriority, one := c.collect(n.children[1], addr, offset, depth+1, is4)
+	clearAddrBit(addr, offset+depth)
+
+	switch {
+	case !zero:
+		return oneCovered, onePriority, one
+	case !one:
+		return zeroCovered, zeroPriority, true
+	}
+
+	covered := zeroCovered + oneCovered
+	if covered < zeroCovered {
+		covered = math.MaxUint64
+	}
+	extra := addressCount(prefix)
+	if extra != math.MaxUint64 {
+		extra -= covered
+	}
+	priority := max(zeroPriority, onePriority)
+	c.candidates = append(c.candidates, &mergeCandidate{
+		node:     n,
+		prefix:   prefix,
+		extra:    extra,
+		priority: priority,
+		order:    order,
+	})
+	return covered, priority, true
+}
+
+// merge stores the prefix of the candidate, dropping all prefixes stored
+// below it, and returns the number of dropped prefixes. Candidates below an
+// already merged candidate can't be merged anymore.
+func (c *mergeCandidate) merge() int {
+	dropped := 0
+	var drop func(n *trieNode)
+	drop = func(n *trieNode) {
+		if n == nil {
+			return
+		}
+		n.merged = true
+		if n.terminal {
+			dropped++
+			return
+		}
+		drop(n.children[0])
+		drop(n.children[1])
+	}
+	drop(c.node.children[0])
+	drop(c.node.children[1])
+
+	c.node.terminal = true
+	c.node.children = [2]*trieNode{}
+	return dropped
+}
+
+func addrBit(addr *[16]byte, i int) int {
+	return int(addr[i/8]>>(7-i%8)) & 1
+}
+
+func setAddrBit(addr *[16]byte, i int) {
+	addr[i/8] |= 0x80 >> (i % 8)
+}
+
+func clearAddrBit(addr *[16]byte, i int) {
+	addr[i/8] &^= 0x80 >> (i % 8)
+}
@@ -0,0 +1,144 @@
+package provider
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixTrie(tt *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		prefixes []string
+		contains map[string]bool
+		expected []string
+	}{
+		{
+			msg:      "contained prefixes should be dropped",
+			prefixes: []string{"10.0.0.0/25", "10.0.0.0/16", "10.0.1.1/32"},
+			contains: map[string]bool{
+				"10.0.0.0/16": true,
+				"10.0.3.0/24": true,
+				"10.0.0.0/15": false,
+				"10.1.0.0/32": false,
+			},
+			expected: []string{"10.0.0.0/16"},
+		},
+		{
+			msg:      "siblings should be merged up to the root",
+			prefixes: []string{"0.0.0.0/1", "128.0.0.0/2", "192.0.0.0/2"},
+			contains: map[string]bool{
+				"0.0.0.0/0":      true,
+				"255.255.0.0/16": true,
+			},
+			expected: []string{"0.0.0.0/0"},
+		},
+		{
+			msg:      "address families should be kept apart",
+			prefixes: []string{"2001:db8::/33", "10.0.0.0/8", "2001:db8:8000::/33", "::/128"},
+			contains: map[string]bool{
+				"2001:db8::1/128": true,
+				"::a00:1/128":     false,
+				"10.0.0.1/32":     true,
+			},
+			expected: []string{"10.0.0.0/8", "::/128", "2001:db8::/32"},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			trie := newPrefixTrie()
+			for _, p := range tc.prefixes {
+				trie.insert(netip.MustParsePrefix(p))
+			}
+			trie.aggregate()
+
+			for p, expected := range tc.contains {
+				require.Equal(t, expected, trie.contains(netip.MustParsePrefix(p)), p)
+			}
+
+			result := make([]string, 0, len(tc.expected))
+			for _, p := range trie.prefixes() {
+				result = append(result, p.String())
+			}
+			require.Equal(t, tc.expected, result)
+		})
+	}
+}
+
+func TestPrefixTrieProperties(t *testing.T) {
+	// every inserted prefix is contained in the trie before and after
+	// aggregation
+	containsInserted := func(prefixes prefixSet) bool {
+		trie := newPrefixTrie()
+		for _, p := range prefixes {
+			trie.insert(p)
+		}
+		for _, p := range prefixes {
+			if !trie.contains(p) {
+				return false
+			}
+		}
+		trie.aggregate()
+		for _, p := range prefixes {
+			if !trie.contains(p) {
+				return false
+			}
+		}
+		return true
+	}
+	require.NoError(t, quick.Check(containsInserted, nil))
+}
+
+// benchmarkHosts returns n consecutive /32 prefixes with every fourth address
+// missing, so only pairs of siblings can be aggregated.
+func benchmarkHosts(n int) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, n)
+	for i := 0; len(prefixes) < n; i++ {
+		if i%4 == 3 {
+			continue
+		}
+		addr := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		prefixes = append(prefixes, netip.PrefixFrom(addr, 32))
+	}
+	return prefixes
+}
+
+func BenchmarkDesiredStateRoutes(b *testing.B) {
+	prefixes := benchmarkHosts(10000)
+	resource := Resource{Name: "a", Namespace: "x", Cluster: "m"}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		NewDesiredState(map[Resource][]netip.Prefix{resource: prefixes}).Routes()
+	}
+}
+
+func BenchmarkGenerateRoutes(b *testing.B) {
+	ipAddresses := make(map[string]*net.IPNet, 10000)
+	for _, p := range benchmarkHosts(10000) {
+		ipAddresses[p.String()] = ipNetFromPrefix(p)
+	}
+	configs := map[Resource]map[string]*net.IPNet{
+		{Name: "a", Namespace: "x", Cluster: "m"}: ipAddresses,
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		GenerateRoutes(configs)
+	}
+}
+
+func BenchmarkPrefixTrieContains(b *testing.B) {
+	trie := newPrefixTrie()
+	prefixes := benchmarkHosts(10000)
+	for _, p := range prefixes {
+		trie.insert(p)
+	}
+	trie.aggregate()
+
+	for i := 0; b.Loop(); i++ {
+		trie.contains(prefixes[i%len(prefixes)])
+	}
+}
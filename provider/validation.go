@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// reservedNetworks are networks which must not be routed via static egress
+// IPs.
+var reservedNetworks = []struct {
+	prefix netip.Prefix
+	reason string
+}{
+	{netip.MustParsePrefix("0.0.0.0/8"), "overlaps \"this\" network 0.0.0.0/8"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "overlaps private network 10.0.0.0/8"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "overlaps shared address space 100.64.0.0/10"},
+	{netip.MustParsePrefix("127.0.0.0/8"), "overlaps loopback network 127.0.0.0/8"},
+	{netip.MustParsePrefix("169.254.0.0/16"), "overlaps link-local network 169.254.0.0/16"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "overlaps private network 172.16.0.0/12"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "overlaps private network 192.168.0.0/16"},
+	{netip.MustParsePrefix("224.0.0.0/4"), "overlaps multicast network 224.0.0.0/4"},
+	{netip.MustParsePrefix("240.0.0.0/4"), "overlaps reserved network 240.0.0.0/4"},
+	{netip.MustParsePrefix("::1/128"), "overlaps loopback address ::1/128"},
+	{netip.MustParsePrefix("fc00::/7"), "overlaps unique local network fc00::/7"},
+	{netip.MustParsePrefix("fe80::/10"), "overlaps link-local network fe80::/10"},
+	{netip.MustParsePrefix("ff00::/8"), "overlaps multicast network ff00::/8"},
+}
+
+// InvalidCIDRError is returned for CIDRs failing validation.
+type InvalidCIDRError struct {
+	Value   string
+	Reasons []string
+}
+
+func (e *InvalidCIDRError) Error() string {
+	return fmt.Sprintf("invalid CIDR '%s': %s", e.Value, strings.Join(e.Reasons, ", "))
+}
+
+// CIDRValidator validates CIDRs of egress configurations. Next to syntax it
+// checks for host bits being set and for overlaps with reserved networks.
+type CIDRValidator struct {
+	// Strict defines if egress configurations with any invalid entry
+	// should be rejected as a whole.
+	Strict bool
+	// Reserved are additional networks which must not be routed, e.g.
+	// the CIDR of the VPC.
+	Reserved []*net.IPNet
+}
+
+// ParseCIDR parses and validates value. The parsed network is returned even
+// if validation fails, unless value isn't a CIDR at all. Validation failures
+// are returned as *InvalidCIDRError.
+func (v *CIDRValidator) ParseCIDR(value string) (*net.IPNet, error) {
+	ip, ipnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, &InvalidCIDRError{Value: value, Reasons: []string{"not a CIDR"}}
+	}
+
+	var reasons []string
+	if !ip.Equal(ipnet.IP) {
+		reasons = append(reasons, fmt.Sprintf("host bits set, network is %s", ipnet))
+	}
+
+	prefix := PrefixFromIPNet(ipnet)
+	if prefix.Bits() == 0 {
+		reasons = append(reasons, "default route")
+	} else {
+		for _, reserved := range reservedNetworks {
+			if prefix.Overlaps(reserved.prefix) {
+				reasons = append(reasons, reserved.reason)
+			}
+		}
+		for _, reserved := range v.Reserved {
+			if prefix.Overlaps(PrefixFromIPNet(reserved)) {
+				reasons = append(reasons, fmt.Sprintf("overlaps reserved network %s", reserved))
+			}
+		}
+	}
+
+	if len(reasons) > 0 {
+		return ipnet, &InvalidCIDRError{Value: value, Reasons: reasons}
+	}
+	return ipnet, nil
+}
@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCIDRValidatorParseCIDR(tt *testing.T) {
+	_, vpcCIDR, _ := net.ParseCIDR("198.51.100.0/24")
+
+	for _, tc := range []struct {
+		msg             string
+		value           string
+		expectedNetwork string
+		expectedReasons []string
+	}{
+		{
+			msg:             "public network should be valid",
+			value:           "8.8.8.8/32",
+			expectedNetwork: "8.8.8.8/32",
+		},
+		{
+			msg:             "invalid CIDR should not be parsed",
+			value:           "foo",
+			expectedReasons: []string{"not a CIDR"},
+		},
+		{
+			msg:             "host bits should be reported",
+			value:           "192.112.1.0/21",
+			expectedNetwork: "192.112.0.0/21",
+			expectedReasons: []string{"host bits set, network is 192.112.0.0/21"},
+		},
+		{
+			msg:             "default route should be reported",
+			value:           "0.0.0.0/0",
+			expectedNetwork: "0.0.0.0/0",
+			expectedReasons: []string{"default route"},
+		},
+		{
+			msg:             "private network should be reported",
+			value:           "10.2.0.0/16",
+			expectedNetwork: "10.2.0.0/16",
+			expectedReasons: []string{"overlaps private network 10.0.0.0/8"},
+		},
+		{
+			msg:             "link-local address should be reported",
+			value:           "169.254.169.254/32",
+			expectedNetwork: "169.254.169.254/32",
+			expectedReasons: []string{"overlaps link-local network 169.254.0.0/16"},
+		},
+		{
+			msg:             "supernet of a reserved network should be reported",
+			value:           "172.0.0.0/8",
+			expectedNetwork: "172.0.0.0/8",
+			expectedReasons: []string{"overlaps private network 172.16.0.0/12"},
+		},
+		{
+			msg:             "additionally reserved network should be reported",
+			value:           "198.51.100.128/25",
+			expectedNetwork: "198.51.100.128/25",
+			expectedReasons: []string{"overlaps reserved network 198.51.100.0/24"},
+		},
+		{
+			msg:             "IPv6 link-local network should be reported",
+			value:           "fe80::/64",
+			expectedNetwork: "fe80::/64",
+			expectedReasons: []string{"overlaps link-local network fe80::/10"},
+		},
+	} {
+		tt.Run(tc.msg, func(t *testing.T) {
+			validator := &CIDRValidator{Reserved: []*net.IPNet{vpcCIDR}}
+			ipnet, err := validator.ParseCIDR(tc.value)
+			if tc.expectedNetwork == "" {
+				require.Nil(t, ipnet)
+			} else {
+				require.Equal(t, tc.expectedNetwork, ipnet.String())
+			}
+
+			if len(tc.expectedReasons) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			var invalidErr *InvalidCIDRError
+			require.ErrorAs(t, err, &invalidErr)
+			require.Equal(t, tc.expectedReasons, invalidErr.Reasons)
+		})
+	}
+}